@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/msaufi2325/06_bookings/internal/channelsync"
+	"github.com/msaufi2325/06_bookings/internal/repository"
+)
+
+// calendarSyncInterval is how often other channels' calendars are imported
+const calendarSyncInterval = 15 * time.Minute
+
+// startCalendarSyncJob imports every room's channel calendar, once at start up and then every
+// calendarSyncInterval, so stays booked elsewhere close the room here
+func startCalendarSyncJob(db repository.DatabaseRepo) {
+	client := &http.Client{Timeout: channelsync.FetchTimeout}
+
+	go func() {
+		ticker := time.NewTicker(calendarSyncInterval)
+		defer ticker.Stop()
+
+		for {
+			if err := channelsync.SyncAll(context.Background(), db, client); err != nil {
+				errorLog.Println(err)
+			}
+			<-ticker.C
+		}
+	}()
+}
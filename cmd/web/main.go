@@ -1,20 +1,27 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
 	"encoding/gob"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/alexedwards/scs/v2"
+	"github.com/msaufi2325/06_bookings/internal/apikeys"
 	"github.com/msaufi2325/06_bookings/internal/config"
 	"github.com/msaufi2325/06_bookings/internal/driver"
+	"github.com/msaufi2325/06_bookings/internal/emails"
 	"github.com/msaufi2325/06_bookings/internal/handlers"
 	"github.com/msaufi2325/06_bookings/internal/helpers"
+	"github.com/msaufi2325/06_bookings/internal/mailer"
 	"github.com/msaufi2325/06_bookings/internal/models"
+	"github.com/msaufi2325/06_bookings/internal/payments"
 	"github.com/msaufi2325/06_bookings/internal/render"
 )
 
@@ -33,11 +40,16 @@ func main() {
 
 	}
 	defer db.SQL.Close()
+	defer app.Mailer.Close()
 
-	defer close(app.MailChan)
+	fmt.Println("Starting mail workers...")
+	startMailWorkers(handlers.Repo.DB)
 
-	fmt.Println("Starting mail listener...")
-	listenForMail()
+	fmt.Println("Starting deleted reservations purge job...")
+	startPurgeJob(handlers.Repo.DB)
+	startWaitlistJob(handlers.Repo.DB)
+	startCalendarSyncJob(handlers.Repo.DB)
+	startWebhookJob(handlers.Repo.DB)
 
 	// from := "me@here.com"
 	// auth := smtp.PlainAuth("", from, "", "localhost")
@@ -78,6 +90,24 @@ func run() (*driver.DB, error) {
 	dbPass := flag.String("dbpass", "", "Database password")
 	dbPort := flag.String("dbport", "5433", "Database port")
 	dbSSL := flag.String("dbssl", "disable", "Database ssl settings (disable, prefer, require)")
+	dbTimeout := flag.Duration("dbtimeout", 3*time.Second, "Default timeout for database queries")
+	retention := flag.Duration("retention", 30*24*time.Hour, "How long deleted reservations are kept before they are purged")
+	baseURL := flag.String("baseurl", "http://localhost:8080", "Public address of the site, used for links in emails")
+	linkSecret := flag.String("linksecret", "", "Secret used to sign guest booking links")
+	depositPercent := flag.Int("deposit", 0, "Percentage of the total taken as a deposit when booking; 0 for none")
+	taxPercent := flag.Int("taxrate", 0, "Tax rate, as a percentage, included in room prices and shown on invoices")
+	paymentSecret := flag.String("paymentsecret", "", "Secret the payment provider signs webhooks with")
+	waitlistHold := flag.Duration("waitlisthold", 24*time.Hour, "How long a freed room is held for a guest on the waitlist")
+	mailWorkers := flag.Int("mailworkers", 4, "Number of workers sending email from the outbox")
+	mailDriver := flag.String("mailer", mailer.DriverSMTP, "How email is sent (smtp, file, log, memory)")
+	mailDir := flag.String("maildir", "./mail", "Directory the file mailer writes .eml files to")
+	smtpHost := flag.String("smtphost", "localhost", "Mail server host")
+	smtpPort := flag.Int("smtpport", 1025, "Mail server port")
+	smtpUser := flag.String("smtpuser", "", "Mail server username; leave empty to send without logging in")
+	smtpPass := flag.String("smtppass", "", "Mail server password")
+	smtpEncryption := flag.String("smtpencryption", mailer.EncryptionNone, "Mail server encryption (none, starttls, tls)")
+	smtpTimeout := flag.Duration("smtptimeout", 10*time.Second, "Timeout for connecting to and sending through the mail server")
+	smtpKeepAlive := flag.Bool("smtpkeepalive", true, "Keep the mail server connection open between emails")
 
 	flag.Parse()
 
@@ -86,12 +116,17 @@ func run() (*driver.DB, error) {
 		os.Exit(1)
 	}
 
-	mailChan := make(chan models.MailData)
-	app.MailChan = mailChan
-
 	// change this to true when in production
 	app.InProduction = *inProduction
 	app.UseCache = *useCache
+	app.DBQueryTimeout = *dbTimeout
+	app.ReservationRetention = *retention
+	app.BaseURL = strings.TrimSuffix(*baseURL, "/")
+	app.LinkSecret = []byte(*linkSecret)
+	app.WaitlistHold = *waitlistHold
+	app.DepositPercent = *depositPercent
+	app.TaxPercent = *taxPercent
+	app.MailWorkers = *mailWorkers
 
 	// create info and error loggers
 	infoLog = log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
@@ -100,6 +135,58 @@ func run() (*driver.DB, error) {
 	errorLog = log.New(os.Stdout, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
 	app.ErrorLog = errorLog
 
+	// without a fixed secret, guest links stop working whenever the application restarts
+	if len(app.LinkSecret) == 0 {
+		app.LinkSecret = make([]byte, 32)
+		if _, err := rand.Read(app.LinkSecret); err != nil {
+			return nil, err
+		}
+		errorLog.Println("No -linksecret given; guest booking links will not survive a restart")
+	}
+
+	// an empty secret would let anyone sign a payment webhook
+	paymentKey := []byte(*paymentSecret)
+	if len(paymentKey) == 0 {
+		paymentKey = make([]byte, 32)
+		if _, err := rand.Read(paymentKey); err != nil {
+			return nil, err
+		}
+		errorLog.Println("No -paymentsecret given; payment webhooks will be refused")
+	}
+
+	// only the in-process fake provider exists so far, which takes no real money
+	app.Payments = payments.NewFake(paymentKey)
+	if app.DepositPercent > 0 {
+		infoLog.Printf("Taking a %d%% deposit through the %s payment provider", app.DepositPercent, app.Payments.Name())
+	}
+
+	app.APILimiter = apikeys.NewLimiter()
+
+	mailDriverName := strings.ToLower(*mailDriver)
+	mail, err := mailer.New(mailer.Config{
+		Driver: mailDriverName,
+		SMTP: mailer.SMTPConfig{
+			Host:           *smtpHost,
+			Port:           *smtpPort,
+			Username:       *smtpUser,
+			Password:       *smtpPass,
+			Encryption:     strings.ToLower(*smtpEncryption),
+			ConnectTimeout: *smtpTimeout,
+			SendTimeout:    *smtpTimeout,
+			KeepAlive:      *smtpKeepAlive,
+		},
+		Dir: *mailDir,
+		Log: infoLog,
+	})
+	if err != nil {
+		errorLog.Println("Invalid mail settings:", err)
+		return nil, err
+	}
+	app.Mailer = mail
+	if mailDriverName != mailer.DriverSMTP {
+		infoLog.Printf("Email is not being sent; the %s mailer is in use", mailDriverName)
+	}
+
 	// set up the session
 	session = scs.New()
 	session.Lifetime = 24 * time.Hour
@@ -126,7 +213,17 @@ func run() (*driver.DB, error) {
 
 	app.TemplateCache = tc
 
+	app.EmailTemplateDir = "./email-templates"
+
 	repo := handlers.NewRepo(&app, db)
+
+	// staff edit email templates in the database, starting from the ones that ship
+	err = emails.Seed(context.Background(), repo.DB, app.EmailTemplateDir)
+	if err != nil {
+		errorLog.Println("Cannot seed email templates:", err)
+		return nil, err
+	}
+
 	handlers.NewHandlers(repo)
 	render.NewRenderer(&app)
 	helpers.NewHelpers(&app)
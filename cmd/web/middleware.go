@@ -17,6 +17,13 @@ func NoSurf(next http.Handler) http.Handler {
 		Secure:   app.InProduction,
 		SameSite: http.SameSiteLaxMode,
 	})
+
+	// the payment provider signs its webhooks instead
+	csrfHandler.ExemptPath("/payments/webhook")
+
+	// API clients don't hold a session cookie to tie a token to
+	csrfHandler.ExemptRegexp("^/api/")
+
 	return csrfHandler
 }
 
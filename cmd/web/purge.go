@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/msaufi2325/06_bookings/internal/repository"
+)
+
+// purgeInterval is how often the trash is checked for reservations past the retention period
+const purgeInterval = time.Hour
+
+// startPurgeJob permanently deletes reservations that have been in the trash for longer than
+// app.ReservationRetention, once at start up and then every purgeInterval
+func startPurgeJob(db repository.DatabaseRepo) {
+	go func() {
+		ticker := time.NewTicker(purgeInterval)
+		defer ticker.Stop()
+
+		for {
+			purgeDeletedReservations(db)
+			<-ticker.C
+		}
+	}()
+}
+
+func purgeDeletedReservations(db repository.DatabaseRepo) {
+	n, err := db.PurgeDeletedReservations(context.Background(), time.Now().Add(-app.ReservationRetention))
+	if err != nil {
+		errorLog.Println(err)
+		return
+	}
+	if n > 0 {
+		infoLog.Printf("Purged %d deleted reservations", n)
+	}
+}
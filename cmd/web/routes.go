@@ -5,6 +5,7 @@ import (
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
+	"github.com/msaufi2325/06_bookings/internal/apikeys"
 	"github.com/msaufi2325/06_bookings/internal/config"
 	"github.com/msaufi2325/06_bookings/internal/handlers"
 )
@@ -18,8 +19,12 @@ func routes(_ *config.AppConfig) http.Handler {
 
 	mux.Get("/", handlers.Repo.Home)
 	mux.Get("/about", handlers.Repo.About)
-	mux.Get("/generals-quarters", handlers.Repo.Generals)
-	mux.Get("/majors-suite", handlers.Repo.Majors)
+	mux.Get("/rooms", handlers.Repo.Rooms)
+	mux.Get("/rooms/{slug}", handlers.Repo.Room)
+
+	// the old room pages moved under /rooms
+	mux.Handle("/generals-quarters", http.RedirectHandler("/rooms/generals-quarters", http.StatusMovedPermanently))
+	mux.Handle("/majors-suite", http.RedirectHandler("/rooms/majors-suite", http.StatusMovedPermanently))
 
 	mux.Get("/search-availability", handlers.Repo.Availability)
 	mux.Post("/search-availability", handlers.Repo.PostAvailability)
@@ -33,6 +38,36 @@ func routes(_ *config.AppConfig) http.Handler {
 	mux.Post("/make-reservation", handlers.Repo.PostReservation)
 	mux.Get("/reservation-summary", handlers.Repo.ReservationSummary)
 
+	mux.Get("/my-reservation", handlers.Repo.MyReservation)
+	mux.Post("/my-reservation/contact", handlers.Repo.PostMyReservationContact)
+	mux.Post("/my-reservation/dates", handlers.Repo.PostMyReservationDates)
+	mux.Post("/my-reservation/cancel", handlers.Repo.PostMyReservationCancel)
+
+	mux.Get("/waitlist", handlers.Repo.Waitlist)
+	mux.Post("/waitlist", handlers.Repo.PostWaitlist)
+	mux.Get("/waitlist/hold", handlers.Repo.WaitlistHold)
+
+	mux.Post("/payments/webhook", handlers.Repo.PaymentWebhook)
+
+	mux.Get("/ical/rooms/{id}.ics", handlers.Repo.RoomCalendar)
+	mux.Get("/ical/staff.ics", handlers.Repo.StaffCalendar)
+
+	mux.Route("/api/v1", func(mux chi.Router) {
+		mux.Use(handlers.Repo.APIAuth)
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(handlers.Repo.RequireAPIScope(apikeys.ScopeAvailability))
+			mux.Get("/rooms", handlers.Repo.APIRooms)
+			mux.Get("/rooms/{id}/availability", handlers.Repo.APIRoomAvailability)
+		})
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(handlers.Repo.RequireAPIScope(apikeys.ScopeBooking))
+			mux.Post("/reservations", handlers.Repo.APIPostReservation)
+			mux.Get("/reservations/{id}", handlers.Repo.APIReservation)
+		})
+	})
+
 	mux.Get("/user/login", handlers.Repo.ShowLogin)
 	mux.Post("/user/login", handlers.Repo.PostShowLogin)
 	mux.Get("/user/logout", handlers.Repo.Logout)
@@ -47,14 +82,66 @@ func routes(_ *config.AppConfig) http.Handler {
 
 		mux.Get("/reservations-new", handlers.Repo.AdminNewReservations)
 		mux.Get("/reservations-all", handlers.Repo.AdminAllReservations)
+		mux.Get("/reservations-deleted", handlers.Repo.AdminDeletedReservations)
 		mux.Get("/reservations-calendar", handlers.Repo.AdminReservationsCalendar)
-		mux.Post("/reservations-calendar", handlers.Repo.AdminPostReservationsCalendar)
+		mux.Get("/blocks/{id}/show", handlers.Repo.AdminShowBlock)
+		mux.Post("/blocks/{id}", handlers.Repo.AdminPostShowBlock)
+		mux.Get("/delete-block/{id}/do", handlers.Repo.AdminDeleteBlock)
+
+		mux.Get("/restrictions", handlers.Repo.AdminRestrictions)
+		mux.Get("/restrictions/{id}/show", handlers.Repo.AdminShowRestriction)
+		mux.Post("/restrictions/{id}", handlers.Repo.AdminPostShowRestriction)
+		mux.Get("/delete-restriction/{id}/do", handlers.Repo.AdminDeleteRestriction)
+
+		mux.Get("/cancellation-policies", handlers.Repo.AdminCancellationPolicies)
+		mux.Get("/cancellation-policies/{id}/show", handlers.Repo.AdminShowCancellationPolicy)
+		mux.Post("/cancellation-policies/{id}", handlers.Repo.AdminPostShowCancellationPolicy)
+		mux.Get("/delete-cancellation-policy/{id}/do", handlers.Repo.AdminDeleteCancellationPolicy)
+		mux.Get("/waitlist", handlers.Repo.AdminWaitlist)
+		mux.Get("/delete-waitlist-entry/{id}/do", handlers.Repo.AdminDeleteWaitlistEntry)
 
 		mux.Get("/process-reservation/{src}/{id}/do", handlers.Repo.AdminProcessReservation)
 		mux.Get("/delete-reservation/{src}/{id}/do", handlers.Repo.AdminDeleteReservation)
+		mux.Get("/restore-reservation/{id}/do", handlers.Repo.AdminRestoreReservation)
 
 		mux.Get("/reservations/{src}/{id}/show", handlers.Repo.AdminShowReservation)
+		mux.Get("/reservations/{src}/{id}/invoice", handlers.Repo.AdminReservationInvoice)
 		mux.Post("/reservations/{src}/{id}", handlers.Repo.AdminPostShowReservation)
+
+		mux.Get("/rooms", handlers.Repo.AdminRooms)
+		mux.Get("/rooms/{id}/show", handlers.Repo.AdminShowRoom)
+		mux.Post("/rooms/{id}", handlers.Repo.AdminPostShowRoom)
+		mux.Get("/rooms/{id}/rates", handlers.Repo.AdminRoomRates)
+		mux.Post("/rooms/{id}/rates", handlers.Repo.AdminPostRoomRates)
+		mux.Post("/rooms/{id}/calendar", handlers.Repo.AdminPostRoomCalendar)
+		mux.Get("/delete-rate-season/{roomID}/{id}/do", handlers.Repo.AdminDeleteRateSeason)
+		mux.Get("/archive-room/{id}/do", handlers.Repo.AdminArchiveRoom)
+		mux.Get("/restore-room/{id}/do", handlers.Repo.AdminRestoreRoom)
+
+		mux.Get("/api-keys", handlers.Repo.AdminAPIKeys)
+		mux.Get("/api-keys/{id}/show", handlers.Repo.AdminShowAPIKey)
+		mux.Post("/api-keys/{id}", handlers.Repo.AdminPostShowAPIKey)
+		mux.Get("/rotate-api-key/{id}/do", handlers.Repo.AdminRotateAPIKey)
+		mux.Get("/revoke-api-key/{id}/do", handlers.Repo.AdminRevokeAPIKey)
+
+		mux.Get("/webhooks", handlers.Repo.AdminWebhooks)
+		mux.Get("/webhooks/{id}/show", handlers.Repo.AdminShowWebhook)
+		mux.Post("/webhooks/{id}", handlers.Repo.AdminPostShowWebhook)
+		mux.Get("/webhooks/{id}/deliveries", handlers.Repo.AdminWebhookDeliveries)
+		mux.Get("/delete-webhook/{id}/do", handlers.Repo.AdminDeleteWebhook)
+		mux.Get("/redeliver-webhook/{id}/do", handlers.Repo.AdminRedeliverWebhook)
+
+		mux.Get("/outbox", handlers.Repo.AdminOutbox)
+		mux.Get("/outbox/{id}/show", handlers.Repo.AdminShowOutboxMessage)
+		mux.Get("/resend-outbox-message/{id}/do", handlers.Repo.AdminResendOutboxMessage)
+
+		mux.Get("/email-templates", handlers.Repo.AdminEmailTemplates)
+		mux.Get("/email-templates/{event}/show", handlers.Repo.AdminShowEmailTemplate)
+		mux.Post("/email-templates/{event}", handlers.Repo.AdminPostShowEmailTemplate)
+		mux.Post("/email-templates/{event}/preview", handlers.Repo.AdminPreviewEmailTemplate)
+		mux.Get("/rollback-email-template/{id}/do", handlers.Repo.AdminRollbackEmailTemplate)
+
+		mux.Get("/audit", handlers.Repo.AdminAudit)
 	})
 
 	return mux
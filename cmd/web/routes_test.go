@@ -1,8 +1,11 @@
 package main
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
+	"github.com/alexedwards/scs/v2"
 	"github.com/go-chi/chi"
 	"github.com/msaufi2325/06_bookings/internal/config"
 )
@@ -20,3 +23,21 @@ func TestRoutes(t *testing.T) {
 		t.Errorf("type is not *chi.Mux, but is %T", v)
 	}
 }
+
+func TestOldRoomPagesRedirect(t *testing.T) {
+	var app config.AppConfig
+	session = scs.New()
+	mux := routes(&app)
+
+	for old, room := range map[string]string{
+		"/generals-quarters": "/rooms/generals-quarters",
+		"/majors-suite":      "/rooms/majors-suite",
+	} {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("GET", old, nil))
+
+		if rr.Code != http.StatusMovedPermanently || rr.Header().Get("Location") != room {
+			t.Errorf("%s: expected a permanent redirect to %s, got %d to %q", old, room, rr.Code, rr.Header().Get("Location"))
+		}
+	}
+}
@@ -1,57 +1,32 @@
 package main
 
 import (
-	"fmt"
-	"log"
-	"os"
-	"strings"
+	"context"
 	"time"
 
-	"github.com/msaufi2325/06_bookings/internal/models"
-	mail "github.com/xhit/go-simple-mail/v2"
+	"github.com/msaufi2325/06_bookings/internal/outbox"
+	"github.com/msaufi2325/06_bookings/internal/repository"
 )
 
-func listenForMail() {
+// mailInterval is how often the outbox is checked for messages that have fallen due
+const mailInterval = 5 * time.Second
+
+// startMailWorkers sends the messages in the outbox as they fall due, with app.MailWorkers workers,
+// once at start up and then every mailInterval. A full batch is followed straight away by the next
+func startMailWorkers(db repository.DatabaseRepo) {
 	go func() {
+		ticker := time.NewTicker(mailInterval)
+		defer ticker.Stop()
+
 		for {
-			msg := <-app.MailChan
-			sendMsg(msg)
+			n, err := outbox.SendDue(context.Background(), db, app.Mailer.Send, app.MailWorkers)
+			if err != nil {
+				errorLog.Println(err)
+			}
+			if err == nil && n == outbox.BatchSize {
+				continue
+			}
+			<-ticker.C
 		}
 	}()
 }
-
-func sendMsg(m models.MailData) {
-	server := mail.NewSMTPClient()
-	server.Host = "localhost"
-	server.Port = 1025
-	server.KeepAlive = false
-	server.ConnectTimeout = 10 * time.Second
-	server.SendTimeout = 10 * time.Second
-
-	client, err := server.Connect()
-	if err != nil {
-		errorLog.Println(err)
-	}
-
-	email := mail.NewMSG()
-	email.SetFrom(m.From).AddTo(m.To).SetSubject(m.Subject)
-	if m.Template == "" {
-		email.SetBody(mail.TextHTML, m.Content)
-	} else {
-		data, err := os.ReadFile(fmt.Sprintf("./email-templates/%s", m.Template))
-		if err != nil {
-			errorLog.Println(err)
-		}
-
-		mailTemplate := string(data)
-		msgToSend := strings.Replace(mailTemplate, "[%BODY%]", m.Content, 1)
-		email.SetBody(mail.TextHTML, msgToSend)
-	}
-
-	err = email.Send(client)
-	if err != nil {
-		log.Println(err)
-	} else {
-		log.Println("Email sent")
-	}
-}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/msaufi2325/06_bookings/internal/repository"
+	"github.com/msaufi2325/06_bookings/internal/waitlist"
+)
+
+// waitlistInterval is how often waitlist holds are checked for expiry
+const waitlistInterval = 5 * time.Minute
+
+// startWaitlistJob releases waitlist holds that have run out and offers the freed rooms to the
+// next guests in line, once at start up and then every waitlistInterval
+func startWaitlistJob(db repository.DatabaseRepo) {
+	go func() {
+		ticker := time.NewTicker(waitlistInterval)
+		defer ticker.Stop()
+
+		for {
+			if err := waitlist.ExpireHolds(context.Background(), db, &app); err != nil {
+				errorLog.Println(err)
+			}
+			<-ticker.C
+		}
+	}()
+}
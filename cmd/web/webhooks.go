@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/msaufi2325/06_bookings/internal/repository"
+	"github.com/msaufi2325/06_bookings/internal/webhooks"
+)
+
+// webhookInterval is how often due webhook deliveries are sent
+const webhookInterval = 30 * time.Second
+
+// startWebhookJob sends webhook deliveries as they fall due, once at start up and then every
+// webhookInterval, including the retries of ones that failed
+func startWebhookJob(db repository.DatabaseRepo) {
+	client := &http.Client{Timeout: webhooks.Timeout}
+
+	go func() {
+		ticker := time.NewTicker(webhookInterval)
+		defer ticker.Stop()
+
+		for {
+			if err := webhooks.DeliverDue(context.Background(), db, client); err != nil {
+				errorLog.Println(err)
+			}
+			<-ticker.C
+		}
+	}()
+}
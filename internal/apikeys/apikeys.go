@@ -0,0 +1,136 @@
+package apikeys
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Prefix starts every key, so a leaked key is easy to recognise
+const Prefix = "bk_"
+
+// prefixLength is how much of a key, after Prefix, is kept in the clear to tell keys apart
+const prefixLength = 8
+
+// Scopes a key can be given. A booking key may also read availability
+const (
+	ScopeAvailability = "availability"
+	ScopeBooking      = "booking"
+)
+
+// Scopes are the scopes a key can be given, in the order they are offered
+var Scopes = []string{ScopeAvailability, ScopeBooking}
+
+// DefaultRateLimit is the number of requests a minute a new key is allowed
+const DefaultRateLimit = 60
+
+// Generate returns a new random key, the part of it shown to staff to tell it apart, and the hash
+// it is stored under. The key itself is never stored
+func Generate() (key, displayPrefix, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err = rand.Read(b); err != nil {
+		return "", "", "", err
+	}
+
+	key = Prefix + base64.RawURLEncoding.EncodeToString(b)
+	return key, key[:len(Prefix)+prefixLength], Hash(key), nil
+}
+
+// Hash returns the hash a key is stored and looked up under. Keys are long and random, so a fast
+// hash is enough; there is nothing to brute force
+func Hash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// FromHeader returns the key in an "Authorization: Bearer <key>" header value, or "" if there isn't one
+func FromHeader(header string) string {
+	scheme, key, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(key)
+}
+
+// Allows reports whether a key with scopes may use an endpoint that needs scope
+func Allows(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope || (s == ScopeBooking && scope == ScopeAvailability) {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidScope reports whether s is one of Scopes
+func ValidScope(s string) bool {
+	for _, scope := range Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Limiter counts each key's requests in a token bucket that holds a minute's worth of requests and
+// refills continuously, so a key can burst up to its limit and then runs at its limit a minute
+type Limiter struct {
+	mu      sync.Mutex
+	buckets map[int]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter returns a limiter with every bucket full
+func NewLimiter() *Limiter {
+	return &Limiter{buckets: make(map[int]*bucket)}
+}
+
+// Allow takes a request from keyID's bucket at now, if there is one left for a key allowed perMinute
+// requests a minute. When there isn't, it returns false and how long until there will be
+func (l *Limiter) Allow(keyID, perMinute int, now time.Time) (bool, time.Duration) {
+	if perMinute <= 0 {
+		return false, time.Minute
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	limit := float64(perMinute)
+	b, ok := l.buckets[keyID]
+	if !ok {
+		b = &bucket{tokens: limit, last: now}
+		l.buckets[keyID] = b
+	}
+
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Minutes() * limit
+		if b.tokens > limit {
+			b.tokens = limit
+		}
+		b.last = now
+	}
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / limit * float64(time.Minute))
+		return false, wait
+	}
+
+	b.tokens--
+	return true, 0
+}
+
+// Reset forgets keyID's bucket, as when the key is rotated or its limit changed
+func (l *Limiter) Reset(keyID int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.buckets, keyID)
+}
@@ -0,0 +1,118 @@
+package apikeys
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGenerate(t *testing.T) {
+	key, prefix, hash, err := Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(key, Prefix) || !strings.HasPrefix(key, prefix) {
+		t.Errorf("key %q should start with %q and %q", key, Prefix, prefix)
+	}
+	if len(prefix) != len(Prefix)+prefixLength {
+		t.Errorf("expected a display prefix of %d characters, got %q", len(Prefix)+prefixLength, prefix)
+	}
+	if hash != Hash(key) || strings.Contains(hash, key) {
+		t.Errorf("hash %q doesn't match key", hash)
+	}
+
+	other, _, _, _ := Generate()
+	if other == key {
+		t.Error("generated the same key twice")
+	}
+}
+
+var headerTests = []struct {
+	header   string
+	expected string
+}{
+	{"Bearer bk_abc", "bk_abc"},
+	{"bearer bk_abc", "bk_abc"},
+	{"Basic dXNlcjpwYXNz", ""},
+	{"bk_abc", ""},
+	{"", ""},
+}
+
+func TestFromHeader(t *testing.T) {
+	for _, e := range headerTests {
+		if got := FromHeader(e.header); got != e.expected {
+			t.Errorf("%q: expected %q, got %q", e.header, e.expected, got)
+		}
+	}
+}
+
+var allowsTests = []struct {
+	name     string
+	scopes   []string
+	scope    string
+	expected bool
+}{
+	{"availability-reads", []string{ScopeAvailability}, ScopeAvailability, true},
+	{"availability-can't-book", []string{ScopeAvailability}, ScopeBooking, false},
+	{"booking-books", []string{ScopeBooking}, ScopeBooking, true},
+	{"booking-reads", []string{ScopeBooking}, ScopeAvailability, true},
+	{"no-scopes", nil, ScopeAvailability, false},
+}
+
+func TestAllows(t *testing.T) {
+	for _, e := range allowsTests {
+		if got := Allows(e.scopes, e.scope); got != e.expected {
+			t.Errorf("%s: expected %v, got %v", e.name, e.expected, got)
+		}
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	l := NewLimiter()
+	now := time.Date(2050, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow(1, 3, now); !ok {
+			t.Fatalf("request %d should have been allowed", i+1)
+		}
+	}
+
+	ok, wait := l.Allow(1, 3, now)
+	if ok {
+		t.Fatal("a fourth request in the same instant should have been refused")
+	}
+	if wait != 20*time.Second {
+		t.Errorf("expected to wait 20s for the next request, got %s", wait)
+	}
+
+	// other keys have their own buckets
+	if ok, _ := l.Allow(2, 3, now); !ok {
+		t.Error("another key should have been allowed")
+	}
+
+	if ok, _ := l.Allow(1, 3, now.Add(20*time.Second)); !ok {
+		t.Error("a request should have been allowed once a token refilled")
+	}
+	if ok, _ := l.Allow(1, 3, now.Add(20*time.Second)); ok {
+		t.Error("only one token should have refilled")
+	}
+
+	// a long pause doesn't bank more than a minute's requests
+	later := now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		l.Allow(1, 3, later)
+	}
+	if ok, _ := l.Allow(1, 3, later); ok {
+		t.Error("the bucket should hold no more than the limit")
+	}
+
+	l.Reset(1)
+	if ok, _ := l.Allow(1, 3, later); !ok {
+		t.Error("a reset bucket should be full")
+	}
+
+	if ok, _ := l.Allow(3, 0, now); ok {
+		t.Error("a key with no allowance should be refused")
+	}
+}
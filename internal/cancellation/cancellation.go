@@ -0,0 +1,84 @@
+package cancellation
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/msaufi2325/06_bookings/internal/models"
+)
+
+// ErrInvalidTier is returned for a tier with a negative notice period or a percentage outside 0-100
+var ErrInvalidTier = errors.New("invalid cancellation tier")
+
+// Refund returns how much of total, in cents, is refunded when a reservation arriving on arrival is
+// cancelled at the time at. Notice is measured up to the start of the arrival date, and the most
+// generous tier whose notice period has been given applies. Without a matching tier nothing is refunded
+func Refund(policy models.CancellationPolicy, total int, arrival, at time.Time) int {
+	notice := arrival.Sub(at)
+
+	best := 0
+	for _, t := range policy.Tiers {
+		if notice >= time.Duration(t.HoursBefore)*time.Hour && t.RefundPercent > best {
+			best = t.RefundPercent
+		}
+	}
+
+	return total * best / 100
+}
+
+// Validate returns ErrInvalidTier if any of the policy's tiers can't be applied
+func Validate(policy models.CancellationPolicy) error {
+	for _, t := range policy.Tiers {
+		if t.HoursBefore < 0 || t.RefundPercent < 0 || t.RefundPercent > 100 {
+			return fmt.Errorf("%w: %d hours, %d%%", ErrInvalidTier, t.HoursBefore, t.RefundPercent)
+		}
+	}
+	return nil
+}
+
+// Describe returns the policy's terms as sentences for guests, longest notice first
+func Describe(policy models.CancellationPolicy) []string {
+	tiers := make([]models.CancellationTier, len(policy.Tiers))
+	copy(tiers, policy.Tiers)
+	sort.Slice(tiers, func(i, j int) bool {
+		return tiers[i].HoursBefore > tiers[j].HoursBefore
+	})
+
+	var terms []string
+	for _, t := range tiers {
+		if t.RefundPercent == 0 {
+			continue
+		}
+		refund := fmt.Sprintf("%d%% refund", t.RefundPercent)
+		if t.RefundPercent == 100 {
+			refund = "Full refund"
+		}
+		if t.HoursBefore == 0 {
+			terms = append(terms, refund+" if cancelled before arrival")
+		} else {
+			terms = append(terms, fmt.Sprintf("%s if cancelled at least %s before arrival", refund, notice(t.HoursBefore)))
+		}
+	}
+
+	if len(terms) == 0 {
+		return []string{"Non-refundable"}
+	}
+
+	return append(terms, "No refund after that")
+}
+
+// notice formats a number of hours, using days when it is a whole number of them
+func notice(hours int) string {
+	switch {
+	case hours == 24:
+		return "1 day"
+	case hours%24 == 0:
+		return fmt.Sprintf("%d days", hours/24)
+	case hours == 1:
+		return "1 hour"
+	default:
+		return fmt.Sprintf("%d hours", hours)
+	}
+}
@@ -0,0 +1,74 @@
+package cancellation
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/msaufi2325/06_bookings/internal/models"
+)
+
+var flexible = models.CancellationPolicy{
+	Name: "Flexible",
+	Tiers: []models.CancellationTier{
+		{HoursBefore: 48, RefundPercent: 50},
+		{HoursBefore: 168, RefundPercent: 100},
+	},
+}
+
+var refundTests = []struct {
+	name     string
+	policy   models.CancellationPolicy
+	notice   time.Duration
+	expected int
+}{
+	{"two-weeks", flexible, 14 * 24 * time.Hour, 30000},
+	{"exactly-a-week", flexible, 168 * time.Hour, 30000},
+	{"six-days", flexible, 6 * 24 * time.Hour, 15000},
+	{"exactly-48-hours", flexible, 48 * time.Hour, 15000},
+	{"one-day", flexible, 24 * time.Hour, 0},
+	{"after-arrival", flexible, -2 * time.Hour, 0},
+	{"non-refundable", models.CancellationPolicy{}, 30 * 24 * time.Hour, 0},
+}
+
+func TestRefund(t *testing.T) {
+	arrival := time.Date(2050, 6, 1, 0, 0, 0, 0, time.UTC)
+	for _, e := range refundTests {
+		refund := Refund(e.policy, 30000, arrival, arrival.Add(-e.notice))
+		if refund != e.expected {
+			t.Errorf("%s: expected refund of %d, but got %d", e.name, e.expected, refund)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := Validate(flexible); err != nil {
+		t.Errorf("expected flexible policy to be valid, but got %s", err)
+	}
+
+	bad := models.CancellationPolicy{Tiers: []models.CancellationTier{{HoursBefore: 24, RefundPercent: 150}}}
+	if err := Validate(bad); !errors.Is(err, ErrInvalidTier) {
+		t.Errorf("expected ErrInvalidTier for a refund over 100%%, but got %v", err)
+	}
+
+	bad = models.CancellationPolicy{Tiers: []models.CancellationTier{{HoursBefore: -1, RefundPercent: 50}}}
+	if err := Validate(bad); !errors.Is(err, ErrInvalidTier) {
+		t.Errorf("expected ErrInvalidTier for negative notice, but got %v", err)
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	expected := []string{
+		"Full refund if cancelled at least 7 days before arrival",
+		"50% refund if cancelled at least 2 days before arrival",
+		"No refund after that",
+	}
+	if terms := Describe(flexible); !reflect.DeepEqual(terms, expected) {
+		t.Errorf("expected %v, but got %v", expected, terms)
+	}
+
+	if terms := Describe(models.CancellationPolicy{}); !reflect.DeepEqual(terms, []string{"Non-refundable"}) {
+		t.Errorf("expected a policy without tiers to be non-refundable, but got %v", terms)
+	}
+}
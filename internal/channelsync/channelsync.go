@@ -0,0 +1,169 @@
+package channelsync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/msaufi2325/06_bookings/internal/ical"
+	"github.com/msaufi2325/06_bookings/internal/models"
+	"github.com/msaufi2325/06_bookings/internal/repository"
+)
+
+// MaxFeedSize is the most that is read from one calendar, whether fetched or uploaded
+const MaxFeedSize = 5 << 20
+
+// FetchTimeout is how long fetching one room's feed may take
+const FetchTimeout = 30 * time.Second
+
+// ErrFeedTooLarge is returned for a calendar bigger than MaxFeedSize
+var ErrFeedTooLarge = errors.New("calendar is too large")
+
+// Blocks turns the events in a channel's calendar into channel blocks for roomID. Events that have
+// already ended by today, or that end before they start, are left out
+func Blocks(events []ical.Event, roomID int, today time.Time) []models.RoomRestriction {
+	var blocks []models.RoomRestriction
+
+	for _, e := range events {
+		if !e.End.After(e.Start) || !e.End.After(today) {
+			continue
+		}
+
+		reason := strings.TrimSpace(e.Summary)
+		if reason == "" {
+			reason = "Channel booking"
+		}
+
+		blocks = append(blocks, models.RoomRestriction{
+			RoomID:        roomID,
+			RestrictionID: models.ChannelRestrictionID,
+			StartDate:     e.Start,
+			EndDate:       e.End,
+			Reason:        reason,
+			ExternalUID:   e.UID,
+		})
+	}
+
+	return blocks
+}
+
+// Import reads a channel's calendar for roomID from r and brings the room's channel blocks in line
+// with it. The outcome is recorded against the room, whether or not the import worked
+func Import(ctx context.Context, db repository.DatabaseRepo, roomID int, r io.Reader) (models.CalendarImport, error) {
+	now := time.Now()
+	result := models.CalendarImport{
+		RoomID:       roomID,
+		LastSyncedAt: now,
+		LastStatus:   models.SyncSucceeded,
+	}
+
+	err := importFeed(ctx, db, &result, r, now)
+	if err != nil {
+		result.LastStatus = models.SyncFailed
+		result.LastError = err.Error()
+	}
+
+	if recordErr := db.RecordCalendarSync(ctx, result); recordErr != nil && err == nil {
+		err = recordErr
+	}
+
+	return result, err
+}
+
+func importFeed(ctx context.Context, db repository.DatabaseRepo, result *models.CalendarImport, r io.Reader, now time.Time) error {
+	data, err := io.ReadAll(io.LimitReader(r, MaxFeedSize+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > MaxFeedSize {
+		return ErrFeedTooLarge
+	}
+
+	events, err := ical.Parse(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	blocks := Blocks(events, result.RoomID, today)
+
+	conflicts, err := db.SyncChannelBlocks(ctx, result.RoomID, today, blocks)
+	if err != nil {
+		return err
+	}
+
+	result.EventsImported = len(blocks) - conflicts
+	result.Conflicts = conflicts
+
+	return nil
+}
+
+// Sync fetches the calendar at imp.URL and imports it for imp.RoomID. A feed that can't be fetched
+// is recorded as a failed sync, and the room's blocks are left as they were
+func Sync(ctx context.Context, db repository.DatabaseRepo, client *http.Client, imp models.CalendarImport) (models.CalendarImport, error) {
+	ctx, cancel := context.WithTimeout(ctx, FetchTimeout)
+	defer cancel()
+
+	body, err := fetch(ctx, client, imp.URL)
+	if err != nil {
+		result := models.CalendarImport{
+			RoomID:       imp.RoomID,
+			LastSyncedAt: time.Now(),
+			LastStatus:   models.SyncFailed,
+			LastError:    err.Error(),
+		}
+		if recordErr := db.RecordCalendarSync(ctx, result); recordErr != nil {
+			return result, recordErr
+		}
+		return result, err
+	}
+	defer body.Close()
+
+	return Import(ctx, db, imp.RoomID, body)
+}
+
+func fetch(ctx context.Context, client *http.Client, url string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/calendar")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("fetching calendar: %s", resp.Status)
+	}
+
+	return resp.Body, nil
+}
+
+// SyncAll syncs every room that has a feed URL. One room's feed failing doesn't stop the others;
+// their errors are returned together once every room has been tried
+func SyncAll(ctx context.Context, db repository.DatabaseRepo, client *http.Client) error {
+	imports, err := db.AllCalendarImports(ctx)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, imp := range imports {
+		if imp.URL == "" {
+			continue
+		}
+		if _, err := Sync(ctx, db, client, imp); err != nil {
+			errs = append(errs, fmt.Errorf("room %d: %w", imp.RoomID, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,134 @@
+package channelsync
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/msaufi2325/06_bookings/internal/config"
+	"github.com/msaufi2325/06_bookings/internal/ical"
+	"github.com/msaufi2325/06_bookings/internal/models"
+	"github.com/msaufi2325/06_bookings/internal/repository/dbrepo"
+)
+
+func date(s string) time.Time {
+	d, _ := time.Parse("2006-01-02", s)
+	return d
+}
+
+func feed(events ...ical.Event) string {
+	var b strings.Builder
+	ical.Write(&b, "Channel", events, time.Now())
+	return b.String()
+}
+
+func TestBlocks(t *testing.T) {
+	events := []ical.Event{
+		{UID: "future", Start: date("2050-01-10"), End: date("2050-01-12"), Summary: " Reserved "},
+		{UID: "current", Start: date("2040-01-01"), End: date("2040-01-05")},
+		{UID: "past", Start: date("2039-12-20"), End: date("2040-01-02")},
+		{UID: "backwards", Start: date("2050-01-12"), End: date("2050-01-10")},
+	}
+
+	blocks := Blocks(events, 3, date("2040-01-02"))
+
+	if len(blocks) != 2 {
+		t.Fatalf("expected 2 blocks, got %d: %+v", len(blocks), blocks)
+	}
+
+	b := blocks[0]
+	if b.ExternalUID != "future" || b.RoomID != 3 || b.RestrictionID != models.ChannelRestrictionID {
+		t.Errorf("unexpected block %+v", b)
+	}
+	if b.Reason != "Reserved" {
+		t.Errorf("expected reason Reserved, got %q", b.Reason)
+	}
+	if blocks[1].ExternalUID != "current" || blocks[1].Reason != "Channel booking" {
+		t.Errorf("unexpected block %+v", blocks[1])
+	}
+}
+
+var importTests = []struct {
+	name           string
+	roomID         int
+	in             string
+	wantErr        bool
+	expectedStatus string
+	imported       int
+	conflicts      int
+}{
+	{"imports", 1, feed(
+		ical.Event{UID: "a", Start: date("2050-01-10"), End: date("2050-01-12")},
+		ical.Event{UID: "b", Start: date("2070-01-01"), End: date("2070-01-03")},
+	), false, models.SyncSucceeded, 1, 1},
+	{"empty-calendar", 1, feed(), false, models.SyncSucceeded, 0, 0},
+	{"not-a-calendar", 1, "<html></html>", true, models.SyncFailed, 0, 0},
+	{"too-large", 1, strings.Repeat("x", MaxFeedSize+1), true, models.SyncFailed, 0, 0},
+	{"sync-fails", 100, feed(), true, models.SyncFailed, 0, 0},
+}
+
+func TestImport(t *testing.T) {
+	for _, e := range importTests {
+		db := dbrepo.NewRecordingRepo(&config.AppConfig{})
+
+		result, err := Import(context.Background(), db, e.roomID, strings.NewReader(e.in))
+		if (err != nil) != e.wantErr {
+			t.Errorf("%s: expected error %v, got %v", e.name, e.wantErr, err)
+		}
+
+		if len(db.CalendarSyncs) != 1 {
+			t.Fatalf("%s: expected the sync to be recorded once, got %d", e.name, len(db.CalendarSyncs))
+		}
+		if r := db.CalendarSyncs[0]; r.LastStatus != result.LastStatus || r.EventsImported != result.EventsImported {
+			t.Errorf("%s: recorded %+v, returned %+v", e.name, db.CalendarSyncs[0], result)
+		}
+		if result.LastStatus != e.expectedStatus {
+			t.Errorf("%s: expected status %s, got %s", e.name, e.expectedStatus, result.LastStatus)
+		}
+		if e.wantErr && result.LastError == "" {
+			t.Errorf("%s: expected the error to be recorded", e.name)
+		}
+		if result.EventsImported != e.imported || result.Conflicts != e.conflicts {
+			t.Errorf("%s: expected %d imported and %d conflicts, got %d and %d", e.name,
+				e.imported, e.conflicts, result.EventsImported, result.Conflicts)
+		}
+	}
+}
+
+func TestSyncAll(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ok.ics" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/calendar")
+		w.Write([]byte(feed(ical.Event{UID: "a", Start: date("2050-01-10"), End: date("2050-01-12")})))
+	}))
+	defer srv.Close()
+
+	db := dbrepo.NewRecordingRepo(&config.AppConfig{})
+	db.Imports = []models.CalendarImport{
+		{RoomID: 1, URL: srv.URL + "/ok.ics"},
+		{RoomID: 2},
+		{RoomID: 3, URL: srv.URL + "/missing.ics"},
+	}
+
+	err := SyncAll(context.Background(), db, srv.Client())
+	if err == nil || !strings.Contains(err.Error(), "room 3") {
+		t.Errorf("expected room 3's error to be returned, got %v", err)
+	}
+
+	// room 2 has no URL, so only rooms 1 and 3 are synced
+	if len(db.CalendarSyncs) != 2 {
+		t.Fatalf("expected 2 syncs to be recorded, got %+v", db.CalendarSyncs)
+	}
+	if r := db.CalendarSyncs[0]; r.RoomID != 1 || r.LastStatus != models.SyncSucceeded || r.EventsImported != 1 {
+		t.Errorf("unexpected result for room 1: %+v", r)
+	}
+	if r := db.CalendarSyncs[1]; r.RoomID != 3 || r.LastStatus != models.SyncFailed || !strings.Contains(r.LastError, "404") {
+		t.Errorf("unexpected result for room 3: %+v", r)
+	}
+}
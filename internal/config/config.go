@@ -3,18 +3,32 @@ package config
 import (
 	"html/template"
 	"log"
+	"time"
 
 	"github.com/alexedwards/scs/v2"
-	"github.com/msaufi2325/06_bookings/internal/models"
+	"github.com/msaufi2325/06_bookings/internal/apikeys"
+	"github.com/msaufi2325/06_bookings/internal/mailer"
+	"github.com/msaufi2325/06_bookings/internal/payments"
 )
 
 // AppConfig holds the application config
 type AppConfig struct {
-	UseCache      bool
-	TemplateCache map[string]*template.Template
-	InfoLog       *log.Logger
-	ErrorLog      *log.Logger
-	InProduction  bool
-	Session       *scs.SessionManager
-	MailChan      chan models.MailData
+	UseCache             bool
+	TemplateCache        map[string]*template.Template
+	EmailTemplateDir     string
+	InfoLog              *log.Logger
+	ErrorLog             *log.Logger
+	InProduction         bool
+	Session              *scs.SessionManager
+	Mailer               mailer.Mailer
+	MailWorkers          int
+	DBQueryTimeout       time.Duration
+	ReservationRetention time.Duration
+	BaseURL              string
+	LinkSecret           []byte
+	WaitlistHold         time.Duration
+	Payments             payments.Provider
+	DepositPercent       int
+	TaxPercent           int
+	APILimiter           *apikeys.Limiter
 }
@@ -0,0 +1,317 @@
+package emails
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"html"
+	"html/template"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/msaufi2325/06_bookings/internal/models"
+	"github.com/msaufi2325/06_bookings/internal/render"
+	"github.com/msaufi2325/06_bookings/internal/repository"
+)
+
+// The events that have an email template. Each ships as <event>.page.tmpl, and staff can save
+// their own versions of it in the database
+const (
+	ReservationConfirmation   = "reservation-confirmation"
+	OwnerNotification         = "owner-notification"
+	ReservationChanged        = "reservation-changed"
+	OwnerReservationChanged   = "owner-reservation-changed"
+	ReservationCancelled      = "reservation-cancelled"
+	OwnerReservationCancelled = "owner-reservation-cancelled"
+	ReservationReminder       = "reservation-reminder"
+	PasswordReset             = "password-reset"
+	WaitlistOffer             = "waitlist-offer"
+)
+
+// Events lists every event with an email template
+var Events = []string{
+	ReservationConfirmation,
+	OwnerNotification,
+	ReservationChanged,
+	OwnerReservationChanged,
+	ReservationCancelled,
+	OwnerReservationCancelled,
+	ReservationReminder,
+	PasswordReset,
+	WaitlistOffer,
+}
+
+// ConfirmationData is what a guest's booking confirmation is rendered from
+type ConfirmationData struct {
+	Reservation models.Reservation
+	Link        string
+}
+
+// OwnerNotificationData is what the owner's new booking email is rendered from
+type OwnerNotificationData struct {
+	Reservation models.Reservation
+}
+
+// ChangedData is what the emails about a guest changing their dates are rendered from. Before is
+// the reservation as it was
+type ChangedData struct {
+	Reservation models.Reservation
+	Before      models.Reservation
+	Link        string
+}
+
+// CancellationData is what the guest's and the owner's emails about a guest cancelling are rendered from
+type CancellationData struct {
+	Reservation models.Reservation
+	Refund      int
+}
+
+// ReminderData is what a guest's reminder of an upcoming stay is rendered from
+type ReminderData struct {
+	Reservation models.Reservation
+	Link        string
+}
+
+// PasswordResetData is what a staff password reset email is rendered from
+type PasswordResetData struct {
+	User    models.User
+	Link    string
+	Expires time.Time
+}
+
+// WaitlistOfferData is what the email offering a held room to a guest on the waitlist is rendered from
+type WaitlistOfferData struct {
+	Entry models.WaitlistEntry
+	Link  string
+}
+
+var functions = template.FuncMap{
+	"formatDate":     render.FormatDate,
+	"formatCurrency": render.FormatCurrency,
+}
+
+// ValidEvent reports whether event has an email template
+func ValidEvent(event string) bool {
+	for _, e := range Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Default returns the template for event as it ships, from <event>.page.tmpl in dir
+func Default(dir, event string) (string, error) {
+	b, err := os.ReadFile(filepath.Join(dir, event+".page.tmpl"))
+	return string(b), err
+}
+
+// Current returns the template emails for event are rendered from: its newest version in the
+// database, or the one in dir, as version 0, if none has been saved
+func Current(ctx context.Context, db repository.DatabaseRepo, dir, event string) (models.EmailTemplate, error) {
+	t, err := db.CurrentEmailTemplate(ctx, event)
+	if !errors.Is(err, sql.ErrNoRows) {
+		return t, err
+	}
+
+	source, err := Default(dir, event)
+	return models.EmailTemplate{Event: event, Source: source}, err
+}
+
+// Load parses the current template for event, with the layouts in dir
+func Load(ctx context.Context, db repository.DatabaseRepo, dir, event string) (*template.Template, error) {
+	t, err := Current(ctx, db, dir, event)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(dir, event, t.Source)
+}
+
+// Seed saves the template in dir as the first version of every event that has none saved yet
+func Seed(ctx context.Context, db repository.DatabaseRepo, dir string) error {
+	for _, event := range Events {
+		_, err := db.CurrentEmailTemplate(ctx, event)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+
+		source, err := Default(dir, event)
+		if err != nil {
+			return err
+		}
+		_, err = db.InsertEmailTemplate(ctx, models.EmailTemplate{
+			Event:  event,
+			Source: source,
+			Note:   "Copied from " + filepath.Base(dir),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Parse parses source as the page template for event, with the layouts in dir. It must define the
+// subject and body that Render makes an email from
+func Parse(dir, event, source string) (*template.Template, error) {
+	t, err := template.New(event).Funcs(functions).Parse(source)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err = t.ParseGlob(fmt.Sprintf("%s/*.layout.tmpl", dir))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range []string{"subject", "body"} {
+		if t.Lookup(name) == nil {
+			return nil, fmt.Errorf("the template must define %q", name)
+		}
+	}
+
+	return t, nil
+}
+
+// Check parses source as the template for event and renders it with sample data, so that a
+// template which would fail every email it rendered isn't saved
+func Check(dir, event, source string) error {
+	t, err := Parse(dir, event, source)
+	if err != nil {
+		return err
+	}
+	_, err = Render(t, Data(event, SampleReservation(), "https://example.com/sample-link"))
+	return err
+}
+
+// Render renders an email from t, the template for an event, and its data: the subject, the HTML
+// in the layout, and a plain text version of the body. Only To and From are left to fill in
+func Render(t *template.Template, data interface{}) (models.MailData, error) {
+	var subject, body, page bytes.Buffer
+	if err := t.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return models.MailData{}, err
+	}
+	if err := t.ExecuteTemplate(&body, "body", data); err != nil {
+		return models.MailData{}, err
+	}
+	if err := t.Execute(&page, data); err != nil {
+		return models.MailData{}, err
+	}
+
+	return models.MailData{
+		// the subject is a header, not HTML, so it mustn't stay escaped
+		Subject:  strings.TrimSpace(html.UnescapeString(subject.String())),
+		Content:  page.String(),
+		Text:     Text(body.String()),
+		Template: t.Name(),
+	}, nil
+}
+
+// SampleReservation is a made up booking, two weeks from now, for previewing and checking templates
+func SampleReservation() models.Reservation {
+	start := time.Now().AddDate(0, 0, 14).Truncate(24 * time.Hour)
+
+	return models.Reservation{
+		ID:            1234,
+		FirstName:     "Jane",
+		LastName:      "Doe",
+		Email:         "jane@example.com",
+		Phone:         "555-555-5555",
+		StartDate:     start,
+		EndDate:       start.AddDate(0, 0, 3),
+		RoomID:        1,
+		Room:          models.Room{ID: 1, RoomName: "General's Quarters"},
+		TotalPrice:    45000,
+		DepositAmount: 9000,
+		RefundAmount:  22500,
+		CancellationPolicy: models.CancellationPolicy{
+			Name: "Moderate",
+		},
+	}
+}
+
+// Data returns the data the template for event is rendered from, made from res. Events that aren't
+// about a reservation, like a password reset, take what they need from the guest's details
+func Data(event string, res models.Reservation, link string) interface{} {
+	switch event {
+	case ReservationConfirmation:
+		return ConfirmationData{Reservation: res, Link: link}
+	case OwnerNotification:
+		return OwnerNotificationData{Reservation: res}
+	case ReservationChanged, OwnerReservationChanged:
+		before := res
+		before.StartDate = res.StartDate.AddDate(0, 0, -1)
+		before.EndDate = res.EndDate.AddDate(0, 0, -1)
+		return ChangedData{Reservation: res, Before: before, Link: link}
+	case ReservationCancelled, OwnerReservationCancelled:
+		return CancellationData{Reservation: res, Refund: res.RefundAmount}
+	case ReservationReminder:
+		return ReminderData{Reservation: res, Link: link}
+	case PasswordReset:
+		return PasswordResetData{
+			User:    models.User{FirstName: res.FirstName, LastName: res.LastName, Email: res.Email},
+			Link:    link,
+			Expires: time.Now().Add(time.Hour),
+		}
+	case WaitlistOffer:
+		return WaitlistOfferData{
+			Entry: models.WaitlistEntry{
+				FirstName:     res.FirstName,
+				LastName:      res.LastName,
+				Email:         res.Email,
+				StartDate:     res.StartDate,
+				EndDate:       res.EndDate,
+				RoomID:        res.RoomID,
+				Room:          res.Room,
+				HoldRoomID:    res.RoomID,
+				HoldRoom:      res.Room,
+				HoldExpiresAt: time.Now().Add(time.Hour),
+			},
+			Link: link,
+		}
+	}
+	return nil
+}
+
+var (
+	linkTag     = regexp.MustCompile(`(?is)<a\s[^>]*href="([^"]*)"[^>]*>(.*?)</a>`)
+	lineBreak   = regexp.MustCompile(`(?i)<br\s*/?>|</(p|div|h[1-6]|tr|li|table)>`)
+	listItem    = regexp.MustCompile(`(?i)<li[^>]*>`)
+	anyTag      = regexp.MustCompile(`<[^>]*>`)
+	blankLines  = regexp.MustCompile(`\n{3,}`)
+	inlineSpace = regexp.MustCompile(`[ \t]+`)
+)
+
+// Text turns an email's HTML body into plain text: links are written out after their words, block
+// ends and breaks become new lines, and every other tag is dropped
+func Text(body string) string {
+	text := linkTag.ReplaceAllStringFunc(body, func(a string) string {
+		m := linkTag.FindStringSubmatch(a)
+		href, words := m[1], strings.TrimSpace(anyTag.ReplaceAllString(m[2], ""))
+		if words == "" || html.UnescapeString(words) == html.UnescapeString(href) {
+			return href
+		}
+		return words + " (" + href + ")"
+	})
+	text = listItem.ReplaceAllString(text, "- ")
+	text = lineBreak.ReplaceAllString(text, "\n")
+	text = anyTag.ReplaceAllString(text, "")
+	text = html.UnescapeString(text)
+
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(inlineSpace.ReplaceAllString(line, " "))
+	}
+	text = strings.Join(lines, "\n")
+
+	return strings.TrimSpace(blankLines.ReplaceAllString(text, "\n\n")) + "\n"
+}
@@ -0,0 +1,236 @@
+package emails
+
+import (
+	"context"
+	"database/sql"
+	"html/template"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/msaufi2325/06_bookings/internal/config"
+	"github.com/msaufi2325/06_bookings/internal/models"
+	"github.com/msaufi2325/06_bookings/internal/repository"
+	"github.com/msaufi2325/06_bookings/internal/repository/dbrepo"
+)
+
+var testRes = models.Reservation{
+	ID:         1,
+	FirstName:  "John",
+	LastName:   "Smith",
+	Email:      "john@smith.com",
+	StartDate:  time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC),
+	EndDate:    time.Date(2050, 1, 3, 0, 0, 0, 0, time.UTC),
+	TotalPrice: 20000,
+	Room:       models.Room{RoomName: "General's Quarters"},
+}
+
+var link = "http://localhost:8080/my-reservation?t=abc&x=1"
+
+var renderTests = []struct {
+	event   string
+	data    interface{}
+	subject string
+	text    string
+}{
+	{ReservationConfirmation, ConfirmationData{Reservation: testRes, Link: link}, "Reservation Confirmation", "Dear John"},
+	{OwnerNotification, OwnerNotificationData{Reservation: testRes}, "Reservation Notification", "General's Quarters"},
+	{ReservationChanged, ChangedData{Reservation: testRes, Before: testRes, Link: link}, "Reservation Changed", "Dear John"},
+	{OwnerReservationChanged, ChangedData{Reservation: testRes, Before: testRes}, "Reservation Changed", "2050-01-03"},
+	{ReservationCancelled, CancellationData{Reservation: testRes, Refund: 10000}, "Reservation Cancelled", "Dear John"},
+	{OwnerReservationCancelled, CancellationData{Reservation: testRes, Refund: 10000}, "Reservation Cancelled", "$100.00"},
+	{ReservationReminder, ReminderData{Reservation: testRes, Link: link}, "Your stay from 2050-01-01", "2050-01-03"},
+	{PasswordReset, PasswordResetData{User: models.User{FirstName: "Admin"}, Link: link, Expires: testRes.StartDate}, "Reset your password", "Admin"},
+	{WaitlistOffer, WaitlistOfferData{Entry: models.WaitlistEntry{FirstName: "Jane", HoldRoom: testRes.Room}, Link: link}, "A room is available", "Dear Jane"},
+}
+
+const dir = "./../../email-templates"
+
+// savedRepo is the testing repo with saved email templates kept in memory
+type savedRepo struct {
+	repository.DatabaseRepo
+	saved map[string]models.EmailTemplate
+}
+
+func (m *savedRepo) CurrentEmailTemplate(ctx context.Context, event string) (models.EmailTemplate, error) {
+	t, ok := m.saved[event]
+	if !ok {
+		return t, sql.ErrNoRows
+	}
+	return t, nil
+}
+
+func (m *savedRepo) InsertEmailTemplate(ctx context.Context, t models.EmailTemplate) (int, error) {
+	t.Version = m.saved[t.Event].Version + 1
+	m.saved[t.Event] = t
+	return len(m.saved), nil
+}
+
+func newSavedRepo() *savedRepo {
+	return &savedRepo{
+		DatabaseRepo: dbrepo.NewTestingRepo(&config.AppConfig{}),
+		saved:        make(map[string]models.EmailTemplate),
+	}
+}
+
+// load parses event's template as it ships
+func load(t *testing.T, event string) *template.Template {
+	t.Helper()
+
+	tmpl, err := Load(context.Background(), newSavedRepo(), dir, event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tmpl
+}
+
+func TestDefaults(t *testing.T) {
+	for _, event := range Events {
+		source, err := Default(dir, event)
+		if err != nil {
+			t.Errorf("%s: %s", event, err)
+			continue
+		}
+		if err := Check(dir, event, source); err != nil {
+			t.Errorf("%s: %s", event, err)
+		}
+	}
+}
+
+var checkTests = []struct {
+	name    string
+	source  string
+	wantErr bool
+}{
+	{"valid", `{{template "basic" .}}{{define "subject"}}Hi{{end}}{{define "body"}}Dear {{.Reservation.FirstName}}{{end}}`, false},
+	{"no-body", `{{template "basic" .}}{{define "subject"}}Hi{{end}}`, true},
+	{"no-subject", `{{template "basic" .}}{{define "body"}}Hi{{end}}`, true},
+	{"syntax", `{{template "basic" .}}{{define "subject"}}Hi{{end}}{{define "body"}}{{if}}{{end}}`, true},
+	{"unknown-field", `{{template "basic" .}}{{define "subject"}}Hi{{end}}{{define "body"}}{{.Reservation.Nickname}}{{end}}`, true},
+	{"unknown-layout", `{{template "fancy" .}}{{define "subject"}}Hi{{end}}{{define "body"}}Hi{{end}}`, true},
+}
+
+func TestCheck(t *testing.T) {
+	for _, e := range checkTests {
+		err := Check(dir, ReservationConfirmation, e.source)
+		if e.wantErr && err == nil {
+			t.Errorf("%s: expected error but got none", e.name)
+		}
+		if !e.wantErr && err != nil {
+			t.Errorf("%s: unexpected error %s", e.name, err)
+		}
+	}
+}
+
+func TestSeedAndLoad(t *testing.T) {
+	ctx := context.Background()
+	db := newSavedRepo()
+	db.saved[OwnerNotification] = models.EmailTemplate{
+		Event:   OwnerNotification,
+		Version: 4,
+		Source:  `{{template "basic" .}}{{define "subject"}}New booking{{end}}{{define "body"}}Booked{{end}}`,
+	}
+
+	if err := Seed(ctx, db, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, event := range Events {
+		saved := db.saved[event]
+		if event == OwnerNotification {
+			if saved.Version != 4 {
+				t.Errorf("seeding replaced the saved %s template", event)
+			}
+			continue
+		}
+		source, _ := Default(dir, event)
+		if saved.Version != 1 || saved.Source != source {
+			t.Errorf("%s wasn't seeded from its file", event)
+		}
+	}
+
+	tmpl, err := Load(ctx, db, dir, OwnerNotification)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := Render(tmpl, OwnerNotificationData{Reservation: testRes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Subject != "New booking" || msg.Template != OwnerNotification {
+		t.Errorf("expected the saved template to be used but got %+v", msg)
+	}
+}
+
+func TestRender(t *testing.T) {
+	for _, e := range renderTests {
+		msg, err := Render(load(t, e.event), e.data)
+		if err != nil {
+			t.Errorf("%s: %s", e.event, err)
+			continue
+		}
+
+		if !strings.Contains(msg.Subject, e.subject) {
+			t.Errorf("%s: expected subject to contain %q but got %q", e.event, e.subject, msg.Subject)
+		}
+		if !strings.Contains(msg.Text, e.text) {
+			t.Errorf("%s: expected text to contain %q but got %q", e.event, e.text, msg.Text)
+		}
+		if msg.Template != e.event {
+			t.Errorf("%s: expected template %s but got %s", e.event, e.event, msg.Template)
+		}
+		if !strings.Contains(msg.Content, "<html") || strings.Contains(msg.Text, "<") {
+			t.Errorf("%s: expected html content and plain text", e.event)
+		}
+	}
+
+	if _, err := Load(context.Background(), newSavedRepo(), dir, "carrier-pigeon"); err == nil {
+		t.Error("expected error for unknown event")
+	}
+
+	// the wrong data for the template fails rather than sending a half-filled email
+	if _, err := Render(load(t, ReservationConfirmation), WaitlistOfferData{}); err == nil {
+		t.Error("expected error for the wrong data")
+	}
+}
+
+func TestRenderEscapes(t *testing.T) {
+	res := testRes
+	res.FirstName = "<script>alert('x')</script>"
+
+	msg, err := Render(load(t, ReservationConfirmation), ConfirmationData{Reservation: res, Link: link})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(msg.Content, "<script>") {
+		t.Error("guest's name was not escaped in the html")
+	}
+	if !strings.Contains(msg.Text, "Dear <script>") {
+		t.Errorf("expected the guest's name as typed in the text but got %q", msg.Text)
+	}
+	if !strings.Contains(msg.Content, "t=abc&amp;x=1") || !strings.Contains(msg.Text, link) {
+		t.Error("link not carried through")
+	}
+}
+
+var textTests = []struct {
+	name     string
+	body     string
+	expected string
+}{
+	{"breaks", "<strong>Hi</strong><br>there<br/>", "Hi\nthere\n"},
+	{"link", `See <a href="http://x.com/a?b=1&amp;c=2">your booking</a>`, "See your booking (http://x.com/a?b=1&c=2)\n"},
+	{"bare-link", `<a href="http://x.com">http://x.com</a>`, "http://x.com\n"},
+	{"list", "<ul><li>one</li><li>two</li></ul>", "- one\n- two\n"},
+	{"entities", "Tom &amp; Jerry&#39;s", "Tom & Jerry's\n"},
+	{"blank-lines", "<p>a</p>\n\n\n\n<p>b</p>", "a\n\nb\n"},
+}
+
+func TestText(t *testing.T) {
+	for _, e := range textTests {
+		if got := Text(e.body); got != e.expected {
+			t.Errorf("%s: expected %q but got %q", e.name, e.expected, got)
+		}
+	}
+}
@@ -3,11 +3,16 @@ package forms
 import (
 	"fmt"
 	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/asaskevich/govalidator"
 )
 
+var colourPattern = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
 // Form creates a custom form struct, embeds a url.Values object
 type Form struct {
 	url.Values
@@ -63,3 +68,36 @@ func (f *Form) IsEmail(field string) {
 		f.Errors.Add(field, "Invalid email address")
 	}
 }
+
+// MinValue checks that a field is a whole number no smaller than min
+func (f *Form) MinValue(field string, min int) bool {
+	x, err := strconv.Atoi(strings.TrimSpace(f.Get(field)))
+	if err != nil {
+		f.Errors.Add(field, "This field must be a whole number")
+		return false
+	}
+	if x < min {
+		f.Errors.Add(field, fmt.Sprintf("This field must be at least %d", min))
+		return false
+	}
+	return true
+}
+
+// IsColour checks for a colour written as #rrggbb
+func (f *Form) IsColour(field string) {
+	if !colourPattern.MatchString(f.Get(field)) {
+		f.Errors.Add(field, "Invalid colour, use #rrggbb")
+	}
+}
+
+// DateLayout is the format dates are posted in
+const DateLayout = "2006-01-02"
+
+// IsDate checks for a date written as yyyy-mm-dd
+func (f *Form) IsDate(field string) bool {
+	if _, err := time.Parse(DateLayout, f.Get(field)); err != nil {
+		f.Errors.Add(field, "Invalid date, use yyyy-mm-dd")
+		return false
+	}
+	return true
+}
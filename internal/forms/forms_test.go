@@ -128,3 +128,81 @@ func TestForm_IsEmail(t *testing.T) {
 		t.Error("got valid for invalid email address")
 	}
 }
+
+func TestForm_MinValue(t *testing.T) {
+	postedValues := url.Values{}
+	postedValues.Add("a", "two")
+	postedValues.Add("b", "0")
+	postedValues.Add("c", "3")
+	form := New(postedValues)
+
+	if form.MinValue("a", 1) {
+		t.Error("shows min value for a non-numeric field")
+	}
+
+	if form.MinValue("b", 1) {
+		t.Error("shows min value when value is too small")
+	}
+
+	if !form.MinValue("c", 1) {
+		t.Error("shows min value not met when it is")
+	}
+
+	if form.Errors.Get("c") != "" {
+		t.Error("should not have an error, but got one")
+	}
+}
+
+func TestForm_IsColour(t *testing.T) {
+	postedValues := url.Values{}
+	form := New(postedValues)
+
+	form.IsColour("x")
+	if form.Valid() {
+		t.Error("form shows valid colour for non-existent field")
+	}
+
+	postedValues = url.Values{}
+	postedValues.Add("colour", "#1a2B3c")
+	form = New(postedValues)
+	form.IsColour("colour")
+	if !form.Valid() {
+		t.Error("got an invalid colour when we should not have")
+	}
+
+	postedValues = url.Values{}
+	postedValues.Add("colour", "red; background: url(x)")
+	form = New(postedValues)
+	form.IsColour("colour")
+	if form.Valid() {
+		t.Error("got valid for invalid colour")
+	}
+}
+
+func TestForm_IsDate(t *testing.T) {
+	postedValues := url.Values{}
+	postedValues.Add("a", "2050-01-10")
+	postedValues.Add("b", "10/01/2050")
+	postedValues.Add("c", "2050-02-30")
+	form := New(postedValues)
+
+	if !form.IsDate("a") {
+		t.Error("got an invalid date when we should not have")
+	}
+
+	if form.IsDate("b") {
+		t.Error("got valid for a date in the wrong format")
+	}
+
+	if form.IsDate("c") {
+		t.Error("got valid for a date that doesn't exist")
+	}
+
+	if form.IsDate("x") {
+		t.Error("form shows valid date for non-existent field")
+	}
+
+	if form.Errors.Get("a") != "" {
+		t.Error("should not have an error, but got one")
+	}
+}
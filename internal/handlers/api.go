@@ -0,0 +1,481 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/msaufi2325/06_bookings/internal/apikeys"
+	"github.com/msaufi2325/06_bookings/internal/forms"
+	"github.com/msaufi2325/06_bookings/internal/models"
+	"github.com/msaufi2325/06_bookings/internal/payments"
+	"github.com/msaufi2325/06_bookings/internal/repository"
+	"github.com/msaufi2325/06_bookings/internal/signedlink"
+)
+
+// maxAPIBody is the largest request body the API reads
+const maxAPIBody = 1 << 20
+
+// API error codes, returned in apiError.Code so clients needn't match on messages
+const (
+	apiBadRequest       = "bad_request"
+	apiValidationFailed = "validation_failed"
+	apiNotFound         = "not_found"
+	apiForbidden        = "forbidden"
+	apiUnauthorized     = "unauthorized"
+	apiScope            = "insufficient_scope"
+	apiRateLimited      = "rate_limited"
+	apiRoomUnavailable  = "room_unavailable"
+	apiPaymentDeclined  = "payment_declined"
+	apiPaymentFailed    = "payment_failed"
+	apiServerError      = "server_error"
+)
+
+// apiError is the body of every API response that isn't a success. Fields holds the validation
+// errors for each input field, when there are any
+type apiError struct {
+	Code    string              `json:"code"`
+	Message string              `json:"message"`
+	Fields  map[string][]string `json:"fields,omitempty"`
+}
+
+type apiRoom struct {
+	ID               int      `json:"id"`
+	Name             string   `json:"name"`
+	Slug             string   `json:"slug"`
+	Description      string   `json:"description"`
+	MaxOccupancy     int      `json:"max_occupancy"`
+	BedConfiguration string   `json:"bed_configuration"`
+	Amenities        []string `json:"amenities"`
+	NightlyRate      int      `json:"nightly_rate"`
+}
+
+type apiNight struct {
+	Date   string `json:"date"`
+	Season string `json:"season,omitempty"`
+	Rate   int    `json:"rate"`
+}
+
+type apiQuote struct {
+	Nights []apiNight `json:"nights"`
+	Total  int        `json:"total"`
+}
+
+type apiAvailability struct {
+	RoomID    int       `json:"room_id"`
+	StartDate string    `json:"start_date"`
+	EndDate   string    `json:"end_date"`
+	Available bool      `json:"available"`
+	Quote     *apiQuote `json:"quote,omitempty"`
+}
+
+type apiReservation struct {
+	ID            int    `json:"id"`
+	RoomID        int    `json:"room_id"`
+	FirstName     string `json:"first_name"`
+	LastName      string `json:"last_name"`
+	Email         string `json:"email"`
+	Phone         string `json:"phone"`
+	StartDate     string `json:"start_date"`
+	EndDate       string `json:"end_date"`
+	Status        string `json:"status"`
+	TotalPrice    int    `json:"total_price"`
+	PaymentStatus string `json:"payment_status"`
+	DepositAmount int    `json:"deposit_amount"`
+	Token         string `json:"token,omitempty"`
+}
+
+// apiReservationRequest is the body of POST /api/v1/reservations
+type apiReservationRequest struct {
+	RoomID       int    `json:"room_id"`
+	StartDate    string `json:"start_date"`
+	EndDate      string `json:"end_date"`
+	FirstName    string `json:"first_name"`
+	LastName     string `json:"last_name"`
+	Email        string `json:"email"`
+	Phone        string `json:"phone"`
+	PaymentToken string `json:"payment_token"`
+}
+
+// apiBlock is a block on a room, as sent in webhooks. Like a reservation, it ends on the morning
+// after the last night closed
+type apiBlock struct {
+	ID            int    `json:"id"`
+	RoomID        int    `json:"room_id"`
+	RestrictionID int    `json:"restriction_id"`
+	StartDate     string `json:"start_date"`
+	EndDate       string `json:"end_date"`
+	Reason        string `json:"reason"`
+}
+
+func toAPIRoom(room models.Room) apiRoom {
+	amenities := room.Amenities
+	if amenities == nil {
+		amenities = []string{}
+	}
+	return apiRoom{
+		ID:               room.ID,
+		Name:             room.RoomName,
+		Slug:             room.Slug,
+		Description:      room.Description,
+		MaxOccupancy:     room.MaxOccupancy,
+		BedConfiguration: room.BedConfiguration,
+		Amenities:        amenities,
+		NightlyRate:      room.NightlyRate,
+	}
+}
+
+func toAPIQuote(quote models.Quote) *apiQuote {
+	q := &apiQuote{Nights: []apiNight{}, Total: quote.Total}
+	for _, n := range quote.Nights {
+		q.Nights = append(q.Nights, apiNight{
+			Date:   n.Date.Format(forms.DateLayout),
+			Season: n.Season,
+			Rate:   n.Rate,
+		})
+	}
+	return q
+}
+
+func toAPIReservation(res models.Reservation) apiReservation {
+	return apiReservation{
+		ID:            res.ID,
+		RoomID:        res.RoomID,
+		FirstName:     res.FirstName,
+		LastName:      res.LastName,
+		Email:         res.Email,
+		Phone:         res.Phone,
+		StartDate:     res.StartDate.Format(forms.DateLayout),
+		EndDate:       res.EndDate.Format(forms.DateLayout),
+		Status:        res.Status,
+		TotalPrice:    res.TotalPrice,
+		PaymentStatus: res.PaymentStatus,
+		DepositAmount: res.DepositAmount,
+	}
+}
+
+func toAPIBlock(block models.RoomRestriction) apiBlock {
+	return apiBlock{
+		ID:            block.ID,
+		RoomID:        block.RoomID,
+		RestrictionID: block.RestrictionID,
+		StartDate:     block.StartDate.Format(forms.DateLayout),
+		EndDate:       block.EndDate.Format(forms.DateLayout),
+		Reason:        block.Reason,
+	}
+}
+
+// writeJSON sends v as the JSON body of a response with the given status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	out, err := json.Marshal(v)
+	if err != nil {
+		log.Println(err)
+		status = http.StatusInternalServerError
+		out = []byte(`{"code":"server_error","message":"Internal server error"}`)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(out)
+}
+
+// writeAPIError sends an apiError with the given status
+func writeAPIError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, apiError{Code: code, Message: message})
+}
+
+// writeAPIServerError logs err and sends a 500 that doesn't give its details away
+func writeAPIServerError(w http.ResponseWriter, err error) {
+	log.Println(err)
+	writeAPIError(w, http.StatusInternalServerError, apiServerError, "Internal server error")
+}
+
+// writeValidationErrors sends the errors on form as a 422
+func writeValidationErrors(w http.ResponseWriter, form *forms.Form) {
+	writeJSON(w, http.StatusUnprocessableEntity, apiError{
+		Code:    apiValidationFailed,
+		Message: "The request has invalid fields",
+		Fields:  form.Errors,
+	})
+}
+
+// validStay checks the start_date and end_date fields of form, and returns the dates when they make
+// up a stay of at least one night
+func validStay(form *forms.Form) (time.Time, time.Time, bool) {
+	form.Required("start_date", "end_date")
+	if form.Errors.Get("start_date") != "" || form.Errors.Get("end_date") != "" {
+		return time.Time{}, time.Time{}, false
+	}
+
+	startOK := form.IsDate("start_date")
+	endOK := form.IsDate("end_date")
+	if !startOK || !endOK {
+		return time.Time{}, time.Time{}, false
+	}
+
+	start, _ := time.Parse(forms.DateLayout, form.Get("start_date"))
+	end, _ := time.Parse(forms.DateLayout, form.Get("end_date"))
+	if !end.After(start) {
+		form.Errors.Add("end_date", "The end date must be after the start date")
+		return start, end, false
+	}
+
+	return start, end, true
+}
+
+// apiKeyContextKey is the request context key APIAuth stores the caller's models.APIKey under
+type apiKeyContextKey struct{}
+
+// APIAuth is middleware that lets through only requests with a live API key in their
+// "Authorization: Bearer" header, and only as fast as the key's rate limit allows
+func (m *Repository) APIAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		plain := apikeys.FromHeader(r.Header.Get("Authorization"))
+		if plain == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+			writeAPIError(w, http.StatusUnauthorized, apiUnauthorized, "An API key is needed in the Authorization header")
+			return
+		}
+
+		key, err := m.DB.GetAPIKeyByHash(r.Context(), apikeys.Hash(plain))
+		if errors.Is(err, sql.ErrNoRows) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="api", error="invalid_token"`)
+			writeAPIError(w, http.StatusUnauthorized, apiUnauthorized, "The API key is not valid or has been revoked")
+			return
+		}
+		if err != nil {
+			writeAPIServerError(w, err)
+			return
+		}
+
+		now := time.Now()
+		if ok, wait := m.App.APILimiter.Allow(key.ID, key.RateLimit, now); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeAPIError(w, http.StatusTooManyRequests, apiRateLimited,
+				fmt.Sprintf("This key is limited to %d requests a minute", key.RateLimit))
+			return
+		}
+
+		if err := m.DB.TouchAPIKey(r.Context(), key.ID, now); err != nil {
+			log.Println(err)
+		}
+
+		ctx := context.WithValue(r.Context(), apiKeyContextKey{}, key)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RequireAPIScope returns middleware that refuses a key APIAuth let in unless it has scope
+func (m *Repository) RequireAPIScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key, ok := r.Context().Value(apiKeyContextKey{}).(models.APIKey)
+			if !ok || !apikeys.Allows(key.Scopes, scope) {
+				writeAPIError(w, http.StatusForbidden, apiScope, fmt.Sprintf("This key does not have the %s scope", scope))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// apiRoomByID returns the in-service room with the id in the URL, or sends a 404 and returns false
+func (m *Repository) apiRoomByID(w http.ResponseWriter, r *http.Request) (models.Room, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, apiNotFound, "Room not found")
+		return models.Room{}, false
+	}
+
+	room, err := m.DB.GetRoomByID(r.Context(), id)
+	if err != nil || room.Archived == 1 {
+		writeAPIError(w, http.StatusNotFound, apiNotFound, "Room not found")
+		return models.Room{}, false
+	}
+	room.ID = id
+
+	return room, true
+}
+
+// APIRooms lists the rooms that are in service
+func (m *Repository) APIRooms(w http.ResponseWriter, r *http.Request) {
+	rooms, err := m.DB.AllRooms(r.Context())
+	if err != nil {
+		writeAPIServerError(w, err)
+		return
+	}
+
+	out := []apiRoom{}
+	for _, room := range rooms {
+		out = append(out, toAPIRoom(room))
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"rooms": out})
+}
+
+// APIRoomAvailability says whether a room is free from start_date to end_date, given in the query
+// string, and what the stay would cost if it is
+func (m *Repository) APIRoomAvailability(w http.ResponseWriter, r *http.Request) {
+	room, ok := m.apiRoomByID(w, r)
+	if !ok {
+		return
+	}
+
+	form := forms.New(r.URL.Query())
+	start, end, ok := validStay(form)
+	if !ok {
+		writeValidationErrors(w, form)
+		return
+	}
+
+	available, err := m.DB.SearchAvailabilityByDatesByRoomID(r.Context(), start, end, room.ID)
+	if err != nil {
+		writeAPIServerError(w, err)
+		return
+	}
+
+	out := apiAvailability{
+		RoomID:    room.ID,
+		StartDate: start.Format(forms.DateLayout),
+		EndDate:   end.Format(forms.DateLayout),
+		Available: available,
+	}
+
+	if available {
+		quote, err := m.quoteRoom(r.Context(), room.ID, start, end)
+		if err != nil {
+			writeAPIServerError(w, err)
+			return
+		}
+		out.Quote = toAPIQuote(quote)
+	}
+
+	writeJSON(w, http.StatusOK, out)
+}
+
+// APIPostReservation books a room from a JSON apiReservationRequest. The response holds the new
+// reservation and the token needed to read it back
+func (m *Repository) APIPostReservation(w http.ResponseWriter, r *http.Request) {
+	var body apiReservationRequest
+
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAPIBody))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&body); err != nil {
+		writeAPIError(w, http.StatusBadRequest, apiBadRequest, "The request body is not valid JSON: "+err.Error())
+		return
+	}
+
+	form := forms.New(url.Values{
+		"room_id":       {strconv.Itoa(body.RoomID)},
+		"start_date":    {body.StartDate},
+		"end_date":      {body.EndDate},
+		"first_name":    {body.FirstName},
+		"last_name":     {body.LastName},
+		"email":         {body.Email},
+		"phone":         {body.Phone},
+		"payment_token": {body.PaymentToken},
+	})
+
+	form.Required("first_name", "last_name", "email")
+	form.MinLength("first_name", 3)
+	form.IsEmail("email")
+	form.MinValue("room_id", 1)
+	start, end, _ := validStay(form)
+	if !form.Valid() {
+		writeValidationErrors(w, form)
+		return
+	}
+
+	room, err := m.DB.GetRoomByID(r.Context(), body.RoomID)
+	if err != nil || room.Archived == 1 {
+		form.Errors.Add("room_id", "There is no such room")
+		writeValidationErrors(w, form)
+		return
+	}
+	room.ID = body.RoomID
+
+	quote, err := m.quoteRoom(r.Context(), room.ID, start, end)
+	if err != nil {
+		writeAPIServerError(w, err)
+		return
+	}
+
+	reservation := models.Reservation{
+		FirstName:          body.FirstName,
+		LastName:           body.LastName,
+		Phone:              body.Phone,
+		Email:              body.Email,
+		StartDate:          start,
+		EndDate:            end,
+		RoomID:             room.ID,
+		Room:               room,
+		CancellationPolicy: room.CancellationPolicy,
+		Quote:              quote,
+		TotalPrice:         quote.Total,
+		Status:             models.StatusPending,
+	}
+
+	if payments.Deposit(reservation.TotalPrice, m.App.DepositPercent) > 0 {
+		form.Required("payment_token")
+		if !form.Valid() {
+			writeValidationErrors(w, form)
+			return
+		}
+	}
+
+	reservation, err = m.book(r.Context(), reservation, body.PaymentToken)
+	switch {
+	case errors.Is(err, payments.ErrDeclined):
+		writeAPIError(w, http.StatusPaymentRequired, apiPaymentDeclined, "The card was declined")
+		return
+	case errors.Is(err, repository.ErrRoomUnavailable):
+		writeAPIError(w, http.StatusConflict, apiRoomUnavailable, "The room is not available for those dates")
+		return
+	case errors.Is(err, errDepositNotAuthorized), errors.Is(err, errDepositNotCaptured):
+		log.Println(err)
+		writeAPIError(w, http.StatusBadGateway, apiPaymentFailed, "The deposit couldn't be taken, so the room has not been booked")
+		return
+	case err != nil:
+		writeAPIServerError(w, err)
+		return
+	}
+
+	out := toAPIReservation(reservation)
+	out.Token = m.guestToken(reservation)
+
+	w.Header().Set("Location", fmt.Sprintf("/api/v1/reservations/%d", reservation.ID))
+	writeJSON(w, http.StatusCreated, out)
+}
+
+// APIReservation returns one reservation. The token given when it was booked, or the one in the
+// guest's booking link, must be passed in the token query parameter
+func (m *Repository) APIReservation(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, apiNotFound, "Reservation not found")
+		return
+	}
+
+	tokenID, err := signedlink.Verify(m.App.LinkSecret, "reservation", r.URL.Query().Get("token"), time.Now())
+	if err != nil || tokenID != id {
+		writeAPIError(w, http.StatusForbidden, apiForbidden, "The token is missing, expired or not for this reservation")
+		return
+	}
+
+	res, err := m.DB.GetReservationByID(r.Context(), id)
+	if err != nil || !res.DeletedAt.IsZero() {
+		writeAPIError(w, http.StatusNotFound, apiNotFound, "Reservation not found")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, toAPIReservation(res))
+}
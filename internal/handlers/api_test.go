@@ -0,0 +1,373 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/msaufi2325/06_bookings/internal/signedlink"
+)
+
+// apiBookingBody books room 1 for two nights without a deposit
+const apiBookingBody = `{"room_id":1,"start_date":"2040-01-01","end_date":"2040-01-03","first_name":"John","last_name":"Smith","email":"john@smith.com"}`
+
+var apiTests = []struct {
+	name               string
+	key                string
+	method             string
+	url                string
+	body               string
+	depositPercent     int
+	expectedStatusCode int
+	expectedCode       string
+	expectedFields     []string
+	expectedContent    []string
+}{
+	{
+		name:               "rooms",
+		key:                "bk_test_availability",
+		method:             "GET",
+		url:                "/api/v1/rooms",
+		expectedStatusCode: http.StatusOK,
+		expectedContent:    []string{`"rooms":[]`},
+	},
+	{
+		name:               "available",
+		key:                "bk_test_availability",
+		method:             "GET",
+		url:                "/api/v1/rooms/1/availability?start_date=2040-01-01&end_date=2040-01-03",
+		expectedStatusCode: http.StatusOK,
+		expectedContent:    []string{`"available":true`, `"quote":{`, `"date":"2040-01-01"`},
+	},
+	{
+		name:               "not-available",
+		key:                "bk_test_availability",
+		method:             "GET",
+		url:                "/api/v1/rooms/1/availability?start_date=2050-01-01&end_date=2050-01-03",
+		expectedStatusCode: http.StatusOK,
+		expectedContent:    []string{`"available":false`},
+	},
+	{
+		name:               "availability-bad-dates",
+		key:                "bk_test_availability",
+		method:             "GET",
+		url:                "/api/v1/rooms/1/availability?start_date=01/01/2040&end_date=2040-01-03",
+		expectedStatusCode: http.StatusUnprocessableEntity,
+		expectedCode:       apiValidationFailed,
+		expectedFields:     []string{"start_date"},
+	},
+	{
+		name:               "availability-backwards",
+		key:                "bk_test_availability",
+		method:             "GET",
+		url:                "/api/v1/rooms/1/availability?start_date=2040-01-03&end_date=2040-01-01",
+		expectedStatusCode: http.StatusUnprocessableEntity,
+		expectedCode:       apiValidationFailed,
+		expectedFields:     []string{"end_date"},
+	},
+	{
+		name:               "availability-missing-dates",
+		key:                "bk_test_availability",
+		method:             "GET",
+		url:                "/api/v1/rooms/1/availability",
+		expectedStatusCode: http.StatusUnprocessableEntity,
+		expectedCode:       apiValidationFailed,
+		expectedFields:     []string{"start_date", "end_date"},
+	},
+	{
+		name:               "availability-unknown-room",
+		key:                "bk_test_availability",
+		method:             "GET",
+		url:                "/api/v1/rooms/3/availability?start_date=2040-01-01&end_date=2040-01-03",
+		expectedStatusCode: http.StatusNotFound,
+		expectedCode:       apiNotFound,
+	},
+	{
+		name:               "availability-database-error",
+		key:                "bk_test_availability",
+		method:             "GET",
+		url:                "/api/v1/rooms/1/availability?start_date=2060-01-01&end_date=2060-01-03",
+		expectedStatusCode: http.StatusInternalServerError,
+		expectedCode:       apiServerError,
+	},
+	{
+		name:               "book",
+		key:                "bk_test_booking",
+		method:             "POST",
+		url:                "/api/v1/reservations",
+		body:               apiBookingBody,
+		expectedStatusCode: http.StatusCreated,
+		expectedContent:    []string{`"id":1`, `"status":"pending"`, `"token":"`},
+	},
+	{
+		name:               "book-invalid-json",
+		key:                "bk_test_booking",
+		method:             "POST",
+		url:                "/api/v1/reservations",
+		body:               `{"room_id":"one"}`,
+		expectedStatusCode: http.StatusBadRequest,
+		expectedCode:       apiBadRequest,
+	},
+	{
+		name:               "book-unknown-field",
+		key:                "bk_test_booking",
+		method:             "POST",
+		url:                "/api/v1/reservations",
+		body:               `{"room":1}`,
+		expectedStatusCode: http.StatusBadRequest,
+		expectedCode:       apiBadRequest,
+	},
+	{
+		name:               "book-invalid-fields",
+		key:                "bk_test_booking",
+		method:             "POST",
+		url:                "/api/v1/reservations",
+		body:               `{"room_id":1,"start_date":"2040-01-01","end_date":"soon","first_name":"J","last_name":"","email":"john"}`,
+		expectedStatusCode: http.StatusUnprocessableEntity,
+		expectedCode:       apiValidationFailed,
+		expectedFields:     []string{"end_date", "first_name", "last_name", "email"},
+	},
+	{
+		name:               "book-unknown-room",
+		key:                "bk_test_booking",
+		method:             "POST",
+		url:                "/api/v1/reservations",
+		body:               `{"room_id":3,"start_date":"2040-01-01","end_date":"2040-01-03","first_name":"John","last_name":"Smith","email":"john@smith.com"}`,
+		expectedStatusCode: http.StatusUnprocessableEntity,
+		expectedCode:       apiValidationFailed,
+		expectedFields:     []string{"room_id"},
+	},
+	{
+		name:               "book-room-taken",
+		key:                "bk_test_booking",
+		method:             "POST",
+		url:                "/api/v1/reservations",
+		body:               `{"room_id":1,"start_date":"2070-01-01","end_date":"2070-01-03","first_name":"John","last_name":"Smith","email":"john@smith.com"}`,
+		expectedStatusCode: http.StatusConflict,
+		expectedCode:       apiRoomUnavailable,
+	},
+	{
+		name:               "book-insert-fails",
+		key:                "bk_test_booking",
+		method:             "POST",
+		url:                "/api/v1/reservations",
+		body:               `{"room_id":2,"start_date":"2040-01-01","end_date":"2040-01-03","first_name":"John","last_name":"Smith","email":"john@smith.com"}`,
+		expectedStatusCode: http.StatusInternalServerError,
+		expectedCode:       apiServerError,
+	},
+	{
+		name:               "book-deposit-missing-card",
+		key:                "bk_test_booking",
+		method:             "POST",
+		url:                "/api/v1/reservations",
+		body:               apiBookingBody,
+		depositPercent:     20,
+		expectedStatusCode: http.StatusUnprocessableEntity,
+		expectedCode:       apiValidationFailed,
+		expectedFields:     []string{"payment_token"},
+	},
+	{
+		name:               "book-deposit-declined",
+		key:                "bk_test_booking",
+		method:             "POST",
+		url:                "/api/v1/reservations",
+		body:               `{"room_id":1,"start_date":"2040-01-01","end_date":"2040-01-03","first_name":"John","last_name":"Smith","email":"john@smith.com","payment_token":"tok_decline"}`,
+		depositPercent:     20,
+		expectedStatusCode: http.StatusPaymentRequired,
+		expectedCode:       apiPaymentDeclined,
+	},
+	{
+		name:               "book-deposit-taken",
+		key:                "bk_test_booking",
+		method:             "POST",
+		url:                "/api/v1/reservations",
+		body:               `{"room_id":1,"start_date":"2040-01-01","end_date":"2040-01-03","first_name":"John","last_name":"Smith","email":"john@smith.com","payment_token":"tok_visa"}`,
+		depositPercent:     20,
+		expectedStatusCode: http.StatusCreated,
+		expectedContent:    []string{`"payment_status":"captured"`},
+	},
+	{
+		name:               "reservation",
+		key:                "bk_test_booking",
+		method:             "GET",
+		url:                "/api/v1/reservations/1?token=" + signedlink.Sign(linkSecret, "reservation", 1, time.Now().Add(time.Hour)),
+		expectedStatusCode: http.StatusOK,
+		expectedContent:    []string{`"id":1`, `"first_name":"John"`, `"start_date":"2050-01-10"`},
+	},
+	{
+		name:               "reservation-no-token",
+		key:                "bk_test_booking",
+		method:             "GET",
+		url:                "/api/v1/reservations/1",
+		expectedStatusCode: http.StatusForbidden,
+		expectedCode:       apiForbidden,
+	},
+	{
+		name:               "reservation-other-token",
+		key:                "bk_test_booking",
+		method:             "GET",
+		url:                "/api/v1/reservations/1?token=" + signedlink.Sign(linkSecret, "reservation", 2, time.Now().Add(time.Hour)),
+		expectedStatusCode: http.StatusForbidden,
+		expectedCode:       apiForbidden,
+	},
+	{
+		name:               "reservation-in-trash",
+		key:                "bk_test_booking",
+		method:             "GET",
+		url:                "/api/v1/reservations/4?token=" + signedlink.Sign(linkSecret, "reservation", 4, time.Now().Add(time.Hour)),
+		expectedStatusCode: http.StatusNotFound,
+		expectedCode:       apiNotFound,
+	},
+	{
+		name:               "no-key",
+		method:             "GET",
+		url:                "/api/v1/rooms",
+		expectedStatusCode: http.StatusUnauthorized,
+		expectedCode:       apiUnauthorized,
+	},
+	{
+		name:               "unknown-key",
+		key:                "bk_not_a_key",
+		method:             "GET",
+		url:                "/api/v1/rooms",
+		expectedStatusCode: http.StatusUnauthorized,
+		expectedCode:       apiUnauthorized,
+	},
+	{
+		name:               "revoked-key",
+		key:                "bk_test_revoked",
+		method:             "GET",
+		url:                "/api/v1/rooms",
+		expectedStatusCode: http.StatusUnauthorized,
+		expectedCode:       apiUnauthorized,
+	},
+	{
+		name:               "availability-key-can't-book",
+		key:                "bk_test_availability",
+		method:             "POST",
+		url:                "/api/v1/reservations",
+		body:               apiBookingBody,
+		expectedStatusCode: http.StatusForbidden,
+		expectedCode:       apiScope,
+	},
+	{
+		name:               "availability-key-can't-read-reservations",
+		key:                "bk_test_availability",
+		method:             "GET",
+		url:                "/api/v1/reservations/1?token=" + signedlink.Sign(linkSecret, "reservation", 1, time.Now().Add(time.Hour)),
+		expectedStatusCode: http.StatusForbidden,
+		expectedCode:       apiScope,
+	},
+	{
+		name:               "booking-key-reads-rooms",
+		key:                "bk_test_booking",
+		method:             "GET",
+		url:                "/api/v1/rooms",
+		expectedStatusCode: http.StatusOK,
+	},
+}
+
+func TestAPI(t *testing.T) {
+	ts := httptest.NewServer(getRoutes())
+	defer ts.Close()
+
+	for _, e := range apiTests {
+		app.DepositPercent = e.depositPercent
+
+		// no CSRF token is sent; the API is exempt
+		req, _ := http.NewRequest(e.method, ts.URL+e.url, strings.NewReader(e.body))
+		req.Header.Set("Content-Type", "application/json")
+		if e.key != "" {
+			req.Header.Set("Authorization", "Bearer "+e.key)
+		}
+
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d: %s", e.name, e.expectedStatusCode, resp.StatusCode, body)
+			continue
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("failed %s: expected json but got %s", e.name, ct)
+		}
+
+		for _, want := range e.expectedContent {
+			if !strings.Contains(string(body), want) {
+				t.Errorf("failed %s: expected body to contain %s, got %s", e.name, want, body)
+			}
+		}
+
+		if e.expectedCode == "" {
+			continue
+		}
+
+		var apiErr apiError
+		if err := json.Unmarshal(body, &apiErr); err != nil {
+			t.Errorf("failed %s: error body is not json: %s", e.name, body)
+			continue
+		}
+		if apiErr.Code != e.expectedCode || apiErr.Message == "" {
+			t.Errorf("failed %s: expected error code %s, but got %+v", e.name, e.expectedCode, apiErr)
+		}
+		if len(apiErr.Fields) != len(e.expectedFields) {
+			t.Errorf("failed %s: expected errors for %v, but got %v", e.name, e.expectedFields, apiErr.Fields)
+		}
+		for _, f := range e.expectedFields {
+			if len(apiErr.Fields[f]) == 0 {
+				t.Errorf("failed %s: expected an error for %s, but got %v", e.name, f, apiErr.Fields)
+			}
+		}
+	}
+	app.DepositPercent = 0
+
+	// a created reservation points at where it can be read back
+	req, _ := http.NewRequest("POST", ts.URL+"/api/v1/reservations", strings.NewReader(apiBookingBody))
+	req.Header.Set("Authorization", "Bearer bk_test_booking")
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if loc := resp.Header.Get("Location"); loc != "/api/v1/reservations/1" {
+		t.Errorf("expected location /api/v1/reservations/1, but got %q", loc)
+	}
+}
+
+func TestAPIRateLimit(t *testing.T) {
+	ts := httptest.NewServer(getRoutes())
+	defer ts.Close()
+
+	get := func() *http.Response {
+		req, _ := http.NewRequest("GET", ts.URL+"/api/v1/rooms", nil)
+		// the slow key is allowed one request a minute
+		req.Header.Set("Authorization", "Bearer bk_test_slow")
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	if resp := get(); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the first request to be allowed, but got %d", resp.StatusCode)
+	}
+
+	resp := get()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected the second request to be limited, but got %d", resp.StatusCode)
+	}
+	if wait, err := strconv.Atoi(resp.Header.Get("Retry-After")); err != nil || wait < 1 || wait > 60 {
+		t.Errorf("expected a Retry-After of up to a minute, but got %q", resp.Header.Get("Retry-After"))
+	}
+}
@@ -1,23 +1,42 @@
 package handlers
 
 import (
+	"bytes"
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/go-chi/chi"
+	"github.com/msaufi2325/06_bookings/internal/apikeys"
+	"github.com/msaufi2325/06_bookings/internal/cancellation"
+	"github.com/msaufi2325/06_bookings/internal/channelsync"
 	"github.com/msaufi2325/06_bookings/internal/config"
 	"github.com/msaufi2325/06_bookings/internal/driver"
+	"github.com/msaufi2325/06_bookings/internal/emails"
 	"github.com/msaufi2325/06_bookings/internal/forms"
 	"github.com/msaufi2325/06_bookings/internal/helpers"
+	"github.com/msaufi2325/06_bookings/internal/ical"
+	"github.com/msaufi2325/06_bookings/internal/invoice"
 	"github.com/msaufi2325/06_bookings/internal/models"
+	"github.com/msaufi2325/06_bookings/internal/payments"
+	"github.com/msaufi2325/06_bookings/internal/pricing"
 	"github.com/msaufi2325/06_bookings/internal/render"
 	"github.com/msaufi2325/06_bookings/internal/repository"
 	"github.com/msaufi2325/06_bookings/internal/repository/dbrepo"
+	"github.com/msaufi2325/06_bookings/internal/signedlink"
+	"github.com/msaufi2325/06_bookings/internal/status"
+	"github.com/msaufi2325/06_bookings/internal/waitlist"
+	"github.com/msaufi2325/06_bookings/internal/webhooks"
 )
 
 // Repo the repository used by the handlers
@@ -50,6 +69,130 @@ func NewHandlers(r *Repository) {
 	Repo = r
 }
 
+// quoteRoom prices a stay in a room using the room's current rate rules
+func (m *Repository) quoteRoom(ctx context.Context, roomID int, start, end time.Time) (models.Quote, error) {
+	rules, err := m.DB.GetRateRulesForRoom(ctx, roomID)
+	if err != nil {
+		return models.Quote{}, err
+	}
+	return pricing.Calculate(rules, start, end)
+}
+
+// audit records a change made by the logged in user. before and after are stored as JSON, and
+// either may be nil when the entity was created or deleted. Failing to write the entry is logged
+// rather than failing a change that has already been made
+func (m *Repository) audit(r *http.Request, action, entityType string, entityID int, before, after interface{}) {
+	entry := models.AuditEntry{
+		UserID:     m.App.Session.GetInt(r.Context(), "user_id"),
+		Action:     action,
+		EntityType: entityType,
+		EntityID:   entityID,
+		Before:     auditJSON(before),
+		After:      auditJSON(after),
+		IP:         clientIP(r),
+	}
+
+	err := m.DB.InsertAuditEntry(r.Context(), entry)
+	if err != nil {
+		log.Println("cannot write audit entry:", err)
+	}
+}
+
+// auditJSON encodes v for the audit log, or returns "" for nil
+func auditJSON(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Println(err)
+		return ""
+	}
+	return string(b)
+}
+
+// clientIP returns the address of the client that made r, without the port
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// auditAction names a save for the audit log: a new entity has id 0
+func auditAction(id int) string {
+	if id > 0 {
+		return "update"
+	}
+	return "create"
+}
+
+// changeStatus moves res to status to on behalf of userID. Cancelling works out the refund due under
+// the policy the reservation was made with, capped at what the guest has paid and not yet had back,
+// records it, and returns it. A room given back is offered to the waitlist
+func (m *Repository) changeStatus(ctx context.Context, res models.Reservation, to string, userID int) (int, error) {
+	refund := 0
+	var err error
+
+	if to == models.StatusCancelled {
+		var transactions []models.PaymentTransaction
+		transactions, err = m.DB.PaymentTransactions(ctx, res.ID)
+		if err != nil {
+			return refund, err
+		}
+
+		refund = cancellation.Refund(res.CancellationPolicy, res.TotalPrice, res.StartDate, time.Now())
+		s := invoice.Summarize(res, transactions, 0)
+		if refundable := s.Paid - s.Refunded; refund > refundable {
+			refund = refundable
+		}
+		if refund < 0 {
+			refund = 0
+		}
+
+		err = m.DB.CancelReservation(ctx, res.ID, res.Status, userID, refund)
+		if err == nil && refund > 0 {
+			m.refundDeposit(ctx, res, transactions, refund, models.PaymentRefunded)
+		}
+	} else {
+		err = m.DB.UpdateReservationStatus(ctx, res.ID, res.Status, to, userID)
+	}
+
+	if err != nil {
+		return refund, err
+	}
+
+	res.Status = to
+	if to == models.StatusCancelled {
+		m.notify(ctx, webhooks.EventReservationCancelled, toAPIReservation(res))
+	} else {
+		m.notify(ctx, webhooks.EventReservationUpdated, toAPIReservation(res))
+	}
+
+	if status.FreesRoom(to) {
+		m.offerFreedRooms(ctx)
+	}
+
+	return refund, nil
+}
+
+// offerFreedRooms offers rooms that have just been freed to the guests on the waitlist. Failures
+// are only logged, as whatever freed the room has already succeeded
+func (m *Repository) offerFreedRooms(ctx context.Context) {
+	if _, err := waitlist.OfferFreedRooms(ctx, m.DB, m.App); err != nil {
+		log.Println(err)
+	}
+}
+
+// notify queues event for the webhook subscriptions that want it. Failures are only logged, as
+// whatever the event reports has already happened
+func (m *Repository) notify(ctx context.Context, event string, data interface{}) {
+	if err := webhooks.Queue(ctx, m.DB, event, data); err != nil {
+		log.Println(err)
+	}
+}
+
 // Home is the home page handler
 func (m *Repository) Home(w http.ResponseWriter, r *http.Request) {
 	render.Template(w, r, "home.page.tmpl", &models.TemplateData{})
@@ -70,32 +213,19 @@ func (m *Repository) Reservation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	room, err := m.DB.GetRoomByID(res.RoomID)
-	if err != nil {
+	room, err := m.DB.GetRoomByID(r.Context(), res.RoomID)
+	if err != nil || room.Archived == 1 {
 		m.App.Session.Put(r.Context(), "error", "can't find room!")
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
 
 	res.Room.RoomName = room.RoomName
+	res.CancellationPolicy = room.CancellationPolicy
 
 	m.App.Session.Put(r.Context(), "reservation", res)
 
-	sd := res.StartDate.Format("2006-01-2")
-	ed := res.EndDate.Format("2006-01-2")
-
-	stringMap := make(map[string]string)
-	stringMap["start_date"] = sd
-	stringMap["end_date"] = ed
-
-	data := make(map[string]interface{})
-	data["reservation"] = res
-
-	render.Template(w, r, "make-reservation.page.tmpl", &models.TemplateData{
-		Form:      forms.New(nil),
-		Data:      data,
-		StringMap: stringMap,
-	})
+	m.renderReservationForm(w, r, res, forms.New(nil))
 }
 
 // PostReservation handles the posting of a reservation form
@@ -135,8 +265,8 @@ func (m *Repository) PostReservation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	room, err := m.DB.GetRoomByID(roomID)
-	if err != nil {
+	room, err := m.DB.GetRoomByID(r.Context(), roomID)
+	if err != nil || room.Archived == 1 {
 		m.App.Session.Put(r.Context(), "error", "can't find room!")
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
@@ -150,92 +280,349 @@ func (m *Repository) PostReservation(w http.ResponseWriter, r *http.Request) {
 		EndDate:   endDate,
 		RoomID:    roomID,
 		Room:      room,
+
+		CancellationPolicy: room.CancellationPolicy,
+	}
+
+	// price the stay again rather than trusting the quote held in the session
+	quote, err := m.quoteRoom(r.Context(), roomID, startDate, endDate)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't get a price for this room!")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
 	}
 
+	reservation.Quote = quote
+	reservation.TotalPrice = quote.Total
+
 	form := forms.New(r.PostForm)
 
 	form.Required("first_name", "last_name", "email")
 	form.MinLength("first_name", 3)
 	form.IsEmail("email")
 
+	deposit := payments.Deposit(reservation.TotalPrice, m.App.DepositPercent)
+	if deposit > 0 {
+		form.Required("payment_token")
+	}
+
 	if !form.Valid() {
-		data := make(map[string]interface{})
-		data["reservation"] = reservation
-		render.Template(w, r, "make-reservation.page.tmpl", &models.TemplateData{
-			Form: form,
-			Data: data,
-		})
+		m.renderReservationForm(w, r, reservation, form)
 		return
 	}
 
-	newReservationID, err := m.DB.InsertReservation(reservation)
+	reservation, err = m.book(r.Context(), reservation, r.Form.Get("payment_token"))
+	if errors.Is(err, payments.ErrDeclined) {
+		form.Errors.Add("payment_token", "Your card was declined")
+		m.renderReservationForm(w, r, reservation, form)
+		return
+	}
+	if errors.Is(err, repository.ErrRoomUnavailable) {
+		m.App.Session.Put(r.Context(), "error", "Sorry, this room was just booked by someone else for those dates, and any deposit taken has been refunded. Please search again.")
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
+	if errors.Is(err, errDepositNotAuthorized) {
+		log.Println(err)
+		m.App.Session.Put(r.Context(), "error", "can't take the deposit!")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	if errors.Is(err, errDepositNotCaptured) {
+		log.Println(err)
+		m.App.Session.Put(r.Context(), "error", "Sorry, we couldn't take your deposit, so the room has not been booked. Please try again.")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
 	if err != nil {
 		m.App.Session.Put(r.Context(), "error", "can't insert reservation into database!")
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
 
-	restriction := models.RoomRestriction{
-		StartDate:     startDate,
-		EndDate:       endDate,
-		RoomID:        roomID,
-		ReservationID: newReservationID,
-		RestrictionID: 1,
+	m.App.Session.Put(r.Context(), "reservation", reservation)
+
+	http.Redirect(w, r, "/reservation-summary", http.StatusSeeOther)
+
+}
+
+// errDepositNotAuthorized and errDepositNotCaptured are returned by book when the deposit can't
+// be held or taken. Either way nothing is booked and no money is kept
+var (
+	errDepositNotAuthorized = errors.New("deposit not authorized")
+	errDepositNotCaptured   = errors.New("deposit not captured")
+)
+
+// book takes the deposit res needs from the card paymentToken stands for, books the room and sends
+// the confirmation emails. The deposit is taken before the booking is saved, so the room is never
+// held by a booking that hasn't been paid for; if the room has gone in the meantime the deposit is
+// given back. A declined card returns payments.ErrDeclined, and a room that has gone
+// repository.ErrRoomUnavailable
+func (m *Repository) book(ctx context.Context, res models.Reservation, paymentToken string) (models.Reservation, error) {
+	deposit := payments.Deposit(res.TotalPrice, m.App.DepositPercent)
+
+	var auth payments.Result
+	if deposit > 0 {
+		var err error
+		auth, err = m.App.Payments.Authorize(ctx, payments.Charge{
+			Amount: deposit,
+			Token:  paymentToken,
+			Email:  res.Email,
+			Description: fmt.Sprintf("Deposit for %s from %s to %s", res.Room.RoomName,
+				res.StartDate.Format("2006-01-02"), res.EndDate.Format("2006-01-02")),
+		})
+		if errors.Is(err, payments.ErrDeclined) {
+			return res, err
+		}
+		if err != nil {
+			return res, fmt.Errorf("%w: %w", errDepositNotAuthorized, err)
+		}
+
+		_, err = m.App.Payments.Capture(ctx, auth.Reference, auth.Amount)
+		if err != nil {
+			m.releasePayment(ctx, auth)
+			return res, fmt.Errorf("%w: %w", errDepositNotCaptured, err)
+		}
+
+		res.PaymentStatus = models.PaymentCaptured
+		res.DepositAmount = deposit
+	}
+
+	// without a deposit the booking's emails are queued along with it; a paid booking's confirmation
+	// carries its invoice, which can only be issued once the booking and its payments are saved
+	var mail repository.MailFunc
+	if deposit == 0 {
+		mail = func(id int) []models.MailData {
+			booked := res
+			booked.ID = id
+			return m.confirmationMail(ctx, booked)
+		}
+	}
+
+	newReservationID, err := m.insertReservation(ctx, res, mail)
+	if err != nil {
+		if deposit > 0 {
+			m.releasePayment(ctx, auth)
+		}
+		return res, err
+	}
+
+	res.ID = newReservationID
+
+	if deposit > 0 {
+		m.recordPayment(ctx, res.ID, models.TransactionAuthorize, auth.Reference, auth.Amount, nil, models.PaymentAuthorized)
+		m.recordPayment(ctx, res.ID, models.TransactionCapture, auth.Reference, auth.Amount, nil, models.PaymentCaptured)
+		m.queueMail(ctx, m.confirmationMail(ctx, res)...)
 	}
 
-	err = m.DB.InsertRoomRestriction(restriction)
+	m.notify(ctx, webhooks.EventReservationCreated, toAPIReservation(res))
+
+	return res, nil
+}
+
+// confirmationMail returns the guest's confirmation, with the invoice for a paid booking, and the
+// email letting the property owner know about the booking
+func (m *Repository) confirmationMail(ctx context.Context, reservation models.Reservation) []models.MailData {
+	var msgs []models.MailData
+
+	msg, err := m.email(ctx, reservation.Email, emails.ReservationConfirmation, emails.ConfirmationData{
+		Reservation: reservation,
+		Link:        m.guestLink(reservation),
+	})
 	if err != nil {
-		m.App.Session.Put(r.Context(), "error", "Error inserting room restriction into database")
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		log.Println(err)
+	} else {
+		// a paid booking comes with its invoice
+		if reservation.PaymentStatus == models.PaymentCaptured {
+			inv, pdf, err := m.invoicePDF(ctx, reservation)
+			if err != nil {
+				log.Println(err)
+			} else {
+				msg.Attachments = append(msg.Attachments, models.MailAttachment{
+					Name:        invoice.Filename(inv),
+					ContentType: "application/pdf",
+					Data:        pdf,
+				})
+			}
+		}
+		msgs = append(msgs, msg)
+	}
+
+	msg, err = m.email(ctx, "me@here.com", emails.OwnerNotification, emails.OwnerNotificationData{Reservation: reservation})
+	if err != nil {
+		log.Println(err)
+	} else {
+		msgs = append(msgs, msg)
+	}
+
+	return msgs
+}
+
+// email renders the email for event from data with its current template, to be sent from the
+// property to to
+func (m *Repository) email(ctx context.Context, to, event string, data interface{}) (models.MailData, error) {
+	t, err := emails.Load(ctx, m.DB, m.App.EmailTemplateDir, event)
+	if err != nil {
+		return models.MailData{}, err
+	}
+
+	msg, err := emails.Render(t, data)
+	msg.To = to
+	msg.From = "me@here.com"
+	return msg, err
+}
+
+// queueEmail renders the email for event from data and adds it to the outbox, to be sent to to.
+// Failures are only logged, as whatever the email is about has already happened
+func (m *Repository) queueEmail(ctx context.Context, to, event string, data interface{}) {
+	msg, err := m.email(ctx, to, event, data)
+	if err != nil {
+		log.Println(err)
 		return
 	}
+	m.queueMail(ctx, msg)
+}
+
+// queueMail adds msgs to the outbox. Failures are only logged, as whatever the emails are about
+// has already happened
+func (m *Repository) queueMail(ctx context.Context, msgs ...models.MailData) {
+	if err := m.DB.QueueMail(ctx, msgs...); err != nil {
+		log.Println(err)
+	}
+}
+
+// renderReservationForm shows the make a reservation form for res, with the deposit it needs
+func (m *Repository) renderReservationForm(w http.ResponseWriter, r *http.Request, res models.Reservation, form *forms.Form) {
+	stringMap := make(map[string]string)
+	stringMap["start_date"] = res.StartDate.Format("2006-01-2")
+	stringMap["end_date"] = res.EndDate.Format("2006-01-2")
+
+	intMap := make(map[string]int)
+	intMap["deposit"] = payments.Deposit(res.TotalPrice, m.App.DepositPercent)
+
+	data := make(map[string]interface{})
+	data["reservation"] = res
 
-	// send notifications - first to guest
-	htmlMessage := fmt.Sprintf(`
-		<strong>Reservation Confirmation</strong><br>
-		Dear %s, <br>
-		This is to confirm your reservation from %s to %s.
-	`, reservation.FirstName, reservation.StartDate.Format("2006-01-2"), reservation.EndDate.Format("2006-01-2"))
+	render.Template(w, r, "make-reservation.page.tmpl", &models.TemplateData{
+		Form:      form,
+		Data:      data,
+		StringMap: stringMap,
+		IntMap:    intMap,
+	})
+}
 
-	msg := models.MailData{
-		To:       reservation.Email,
-		From:     "me@here.com",
-		Subject:  "Reservation Confirmation",
-		Content:  htmlMessage,
-		Template: "basic.html",
+// releasePayment gives back a payment that won't be used for a booking: an authorization is let go
+// of, and a deposit already taken refunded
+func (m *Repository) releasePayment(ctx context.Context, auth payments.Result) {
+	if _, err := m.App.Payments.Refund(ctx, auth.Reference, auth.Amount); err != nil {
+		log.Println(err)
 	}
+}
 
-	m.App.MailChan <- msg
+// refundDeposit gives back refund against the capture among transactions, moving the reservation
+// to paymentStatus. Failures are recorded and logged for staff to follow up, as the change the
+// refund is for has already happened
+func (m *Repository) refundDeposit(ctx context.Context, res models.Reservation, transactions []models.PaymentTransaction, refund int, paymentStatus string) {
+	for _, t := range transactions {
+		if t.Kind != models.TransactionCapture || t.Status != models.TransactionSucceeded {
+			continue
+		}
+
+		_, err := m.App.Payments.Refund(ctx, t.Reference, refund)
+		if err != nil {
+			log.Println(err)
+			m.recordPayment(ctx, res.ID, models.TransactionRefund, t.Reference, refund, err, res.PaymentStatus)
+			return
+		}
+
+		m.recordPayment(ctx, res.ID, models.TransactionRefund, t.Reference, refund, nil, paymentStatus)
+		return
+	}
+}
 
-	// send notifications - to property owner
-	htmlMessage = fmt.Sprintf(`
-		<strong>Reservation Notification</strong><br>
-		A reservation has been made for room %s from %s to %s.
-	`, reservation.Room.RoomName, reservation.StartDate.Format("2006-01-2"), reservation.EndDate.Format("2006-01-2"))
+// recordPayment stores the outcome of a call to the payment provider against a reservation
+func (m *Repository) recordPayment(ctx context.Context, reservationID int, kind, reference string, amount int, callErr error, paymentStatus string) {
+	t := models.PaymentTransaction{
+		ReservationID: reservationID,
+		Provider:      m.App.Payments.Name(),
+		Kind:          kind,
+		Reference:     reference,
+		Amount:        amount,
+		Status:        models.TransactionSucceeded,
+	}
+	if callErr != nil {
+		t.Status = models.TransactionFailed
+	}
 
-	msg = models.MailData{
-		To:      "me@here.com",
-		From:    "me@here.com",
-		Subject: "Reservation Notification",
-		Content: htmlMessage,
+	if err := m.DB.RecordPayment(ctx, t, paymentStatus); err != nil {
+		log.Println(err)
 	}
+}
 
-	m.App.MailChan <- msg
+// insertReservation books res, queueing the emails mail builds along with it. If the guest came
+// from a waitlist hold for this room and these dates, the hold is turned into the reservation, as
+// the room is already restricted by the hold. The hold stays in the session until the booking is
+// made, so a guest whose booking fails can try again
+func (m *Repository) insertReservation(ctx context.Context, res models.Reservation, mail repository.MailFunc) (int, error) {
+	entryID := m.App.Session.GetInt(ctx, "waitlist_entry_id")
+	if entryID == 0 {
+		return m.DB.InsertReservationWithRestriction(ctx, res, mail)
+	}
 
-	m.App.Session.Put(r.Context(), "reservation", reservation)
+	id, err := 0, repository.ErrHoldLapsed
+	entry, entryErr := m.DB.GetWaitlistEntryByID(ctx, entryID)
+	if entryErr == nil && entry.Status == models.WaitlistOffered && entry.HoldRoomID == res.RoomID &&
+		entry.StartDate.Equal(res.StartDate) && entry.EndDate.Equal(res.EndDate) {
+		id, err = m.DB.BookWaitlistHold(ctx, entryID, res, mail)
+	}
 
-	http.Redirect(w, r, "/reservation-summary", http.StatusSeeOther)
+	// a hold that has lapsed, or is for another room or other dates, doesn't keep the room for this
+	// booking, so it is booked like any other
+	if errors.Is(err, repository.ErrHoldLapsed) {
+		id, err = m.DB.InsertReservationWithRestriction(ctx, res, mail)
+	}
+	if err != nil {
+		return 0, err
+	}
 
+	m.App.Session.Remove(ctx, "waitlist_entry_id")
+	return id, nil
 }
 
-// Generals renders the room page
-func (m *Repository) Generals(w http.ResponseWriter, r *http.Request) {
-	render.Template(w, r, "generals.page.tmpl", &models.TemplateData{})
+// Rooms lists all rooms that are in service
+func (m *Repository) Rooms(w http.ResponseWriter, r *http.Request) {
+	rooms, err := m.DB.AllRooms(r.Context())
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["rooms"] = rooms
+
+	render.Template(w, r, "rooms.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
 }
 
-// Majors renders the room page
-func (m *Repository) Majors(w http.ResponseWriter, r *http.Request) {
-	render.Template(w, r, "majors.page.tmpl", &models.TemplateData{})
+// Room renders the page for a single room, looked up by its slug
+func (m *Repository) Room(w http.ResponseWriter, r *http.Request) {
+	room, err := m.DB.GetRoomBySlug(r.Context(), chi.URLParam(r, "slug"))
+	if errors.Is(err, sql.ErrNoRows) || room.Archived == 1 {
+		helpers.ClientError(w, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["room"] = room
+
+	render.Template(w, r, "room.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
 }
 
 // Availability renders the search availability page
@@ -269,7 +656,7 @@ func (m *Repository) PostAvailability(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rooms, err := m.DB.SearchAvailabilityForAllRooms(startDate, endDate)
+	rooms, err := m.DB.SearchAvailabilityForAllRooms(r.Context(), startDate, endDate)
 	if err != nil {
 		m.App.Session.Put(r.Context(), "error", "can't get availability for rooms")
 		http.Redirect(w, r, "/", http.StatusSeeOther)
@@ -278,13 +665,30 @@ func (m *Repository) PostAvailability(w http.ResponseWriter, r *http.Request) {
 
 	if len(rooms) == 0 {
 		// no availability
-		m.App.Session.Put(r.Context(), "error", "No availability")
-		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		m.App.Session.Put(r.Context(), "error", "No availability. Join the waitlist and we'll email you if a room frees up.")
+		http.Redirect(w, r, fmt.Sprintf("/waitlist?start=%s&end=%s", start, end), http.StatusSeeOther)
 		return
 	}
 
+	quotes := make(map[int]models.Quote)
+	for _, room := range rooms {
+		quote, err := m.quoteRoom(r.Context(), room.ID, startDate, endDate)
+		if errors.Is(err, pricing.ErrInvalidStay) {
+			m.App.Session.Put(r.Context(), "error", "Departure must be after arrival")
+			http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+			return
+		}
+		if err != nil {
+			m.App.Session.Put(r.Context(), "error", "can't get prices for rooms")
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+		quotes[room.ID] = quote
+	}
+
 	data := make(map[string]interface{})
 	data["rooms"] = rooms
+	data["quotes"] = quotes
 
 	res := models.Reservation{
 		StartDate: startDate,
@@ -332,7 +736,7 @@ func (m *Repository) AvailabilityJSON(w http.ResponseWriter, r *http.Request) {
 
 	roomID, _ := strconv.Atoi(r.Form.Get("room_id"))
 
-	available, err := m.DB.SearchAvailabilityByDatesByRoomID(startDate, endDate, roomID)
+	available, err := m.DB.SearchAvailabilityByDatesByRoomID(r.Context(), startDate, endDate, roomID)
 	if err != nil {
 		// got a database error, so return appropriate json
 		resp := jsonResponse{
@@ -386,6 +790,7 @@ func (m *Repository) ReservationSummary(w http.ResponseWriter, r *http.Request)
 	stringMap := make(map[string]string)
 	stringMap["start_date"] = sd
 	stringMap["end_date"] = ed
+	stringMap["manage_link"] = "/my-reservation?t=" + m.guestToken(reservation)
 
 	render.Template(w, r, "reservation-summary.page.tmpl", &models.TemplateData{
 		Data:      data,
@@ -423,6 +828,16 @@ func (m *Repository) ChooseRoom(w http.ResponseWriter, r *http.Request) {
 
 	res.RoomID = roomID
 
+	quote, err := m.quoteRoom(r.Context(), roomID, res.StartDate, res.EndDate)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Can't get a price for this room")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	res.Quote = quote
+	res.TotalPrice = quote.Total
+
 	m.App.Session.Put(r.Context(), "reservation", res)
 
 	http.Redirect(w, r, "/make-reservation", http.StatusSeeOther)
@@ -441,8 +856,8 @@ func (m *Repository) BookRoom(w http.ResponseWriter, r *http.Request) {
 
 	var res models.Reservation
 
-	room, err := m.DB.GetRoomByID(roomID)
-	if err != nil {
+	room, err := m.DB.GetRoomByID(r.Context(), roomID)
+	if err != nil || room.Archived == 1 {
 		m.App.Session.Put(r.Context(), "error", "Can't get room from db!")
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
@@ -453,385 +868,2940 @@ func (m *Repository) BookRoom(w http.ResponseWriter, r *http.Request) {
 	res.StartDate = startDate
 	res.EndDate = endDate
 
+	quote, err := m.quoteRoom(r.Context(), roomID, startDate, endDate)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Can't get a price for this room")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	res.Quote = quote
+	res.TotalPrice = quote.Total
+
 	m.App.Session.Put(r.Context(), "reservation", res)
 
 	http.Redirect(w, r, "/make-reservation", http.StatusSeeOther)
 }
 
-// ShowLogin shows the login page
-func (m *Repository) ShowLogin(w http.ResponseWriter, r *http.Request) {
-	render.Template(w, r, "login.page.tmpl", &models.TemplateData{
-		Form: forms.New(nil),
-	})
+// guestLinkGrace is how long after departure a guest's booking link keeps working
+const guestLinkGrace = 30 * 24 * time.Hour
+
+// guestToken signs res's id into a token that works until a while after departure
+func (m *Repository) guestToken(res models.Reservation) string {
+	return signedlink.Sign(m.App.LinkSecret, "reservation", res.ID, res.EndDate.Add(guestLinkGrace))
 }
 
-// PostShowLogin handles the login form post
-func (m *Repository) PostShowLogin(w http.ResponseWriter, r *http.Request) {
-	_ = m.App.Session.RenewToken(r.Context())
+// guestLink returns the signed link a guest uses to manage res without logging in
+func (m *Repository) guestLink(res models.Reservation) string {
+	return fmt.Sprintf("%s/my-reservation?t=%s", m.App.BaseURL, m.guestToken(res))
+}
 
-	err := r.ParseForm()
+// guestReservation returns the reservation the signed token was made for. If the token is bad
+// or expired, or the reservation has gone, the guest is redirected home and ok is false
+func (m *Repository) guestReservation(w http.ResponseWriter, r *http.Request, token string) (models.Reservation, bool) {
+	id, err := signedlink.Verify(m.App.LinkSecret, "reservation", token, time.Now())
+	if errors.Is(err, signedlink.ErrExpired) {
+		m.App.Session.Put(r.Context(), "error", "This link has expired. Please contact us about your booking.")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return models.Reservation{}, false
+	}
 	if err != nil {
-		log.Println(err)
+		m.App.Session.Put(r.Context(), "error", "This link is not valid")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return models.Reservation{}, false
 	}
 
-	email := r.Form.Get("email")
-	password := r.Form.Get("password")
+	res, err := m.DB.GetReservationByID(r.Context(), id)
+	if err != nil || !res.DeletedAt.IsZero() {
+		m.App.Session.Put(r.Context(), "error", "Can't find this reservation")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return models.Reservation{}, false
+	}
 
-	form := forms.New(r.PostForm)
-	form.Required("email", "password")
-	form.IsEmail("email")
+	return res, true
+}
 
-	if !form.Valid() {
-		render.Template(w, r, "login.page.tmpl", &models.TemplateData{
-			Form: form,
+// guestCanChange reports whether a guest may still change or cancel res themselves: it must be
+// pending or confirmed, and the stay must not have started
+func guestCanChange(res models.Reservation) bool {
+	if res.Status != models.StatusPending && res.Status != models.StatusConfirmed {
+		return false
+	}
+	return time.Now().Before(res.StartDate)
+}
+
+// uncoveredNights returns the parts of the stay from start to end that fall outside the stay from
+// oldStart to oldEnd, as pairs of arrival and departure dates
+func uncoveredNights(oldStart, oldEnd, start, end time.Time) [][2]time.Time {
+	if !start.Before(oldEnd) || !end.After(oldStart) {
+		return [][2]time.Time{{start, end}}
+	}
+
+	var ranges [][2]time.Time
+	if start.Before(oldStart) {
+		ranges = append(ranges, [2]time.Time{start, oldStart})
+	}
+	if end.After(oldEnd) {
+		ranges = append(ranges, [2]time.Time{oldEnd, end})
+	}
+	return ranges
+}
+
+// adjustedDeposit returns the deposit a booking that paid deposit on oldTotal needs at newTotal,
+// keeping it in the same proportion and rounding up as payments.Deposit does. A deposit is never
+// raised, as the guest's card can't be charged again; the rest is paid with the balance
+func adjustedDeposit(deposit, oldTotal, newTotal int) int {
+	if oldTotal <= 0 || newTotal >= oldTotal {
+		return deposit
+	}
+	return (deposit*newTotal + oldTotal - 1) / oldTotal
+}
+
+// renderMyReservation shows a guest their booking
+func (m *Repository) renderMyReservation(w http.ResponseWriter, r *http.Request, res models.Reservation, token string, form *forms.Form) {
+	stringMap := make(map[string]string)
+	stringMap["token"] = token
+	stringMap["start_date"] = res.StartDate.Format("2006-01-02")
+	stringMap["end_date"] = res.EndDate.Format("2006-01-02")
+
+	intMap := make(map[string]int)
+	intMap["refund_now"] = cancellation.Refund(res.CancellationPolicy, res.TotalPrice, res.StartDate, time.Now())
+
+	data := make(map[string]interface{})
+	data["reservation"] = res
+	data["can_change"] = guestCanChange(res)
+
+	render.Template(w, r, "my-reservation.page.tmpl", &models.TemplateData{
+		StringMap: stringMap,
+		IntMap:    intMap,
+		Data:      data,
+		Form:      form,
+	})
+}
+
+// MyReservation shows a guest their booking, from the signed link in their confirmation email
+func (m *Repository) MyReservation(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("t")
+	res, ok := m.guestReservation(w, r, token)
+	if !ok {
+		return
+	}
+
+	m.renderMyReservation(w, r, res, token, forms.New(nil))
+}
+
+// PostMyReservationContact lets a guest change their name, email and phone number
+func (m *Repository) PostMyReservationContact(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse form!")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	token := r.Form.Get("t")
+	res, ok := m.guestReservation(w, r, token)
+	if !ok {
+		return
+	}
+
+	before := res
+	res.FirstName = r.Form.Get("first_name")
+	res.LastName = r.Form.Get("last_name")
+	res.Email = r.Form.Get("email")
+	res.Phone = r.Form.Get("phone")
+
+	form := forms.New(r.PostForm)
+	form.Required("first_name", "last_name", "email")
+	form.MinLength("first_name", 3)
+	form.IsEmail("email")
+
+	if !form.Valid() {
+		m.renderMyReservation(w, r, res, token, form)
+		return
+	}
+
+	err = m.DB.UpdateReservation(r.Context(), res)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.audit(r, "guest-update", "reservation", res.ID, before, res)
+	m.notify(r.Context(), webhooks.EventReservationUpdated, toAPIReservation(res))
+	m.App.Session.Put(r.Context(), "flash", "Your contact details have been updated")
+	http.Redirect(w, r, "/my-reservation?t="+token, http.StatusSeeOther)
+}
+
+// PostMyReservationDates moves a guest's booking to new dates, if the room is free on every night
+// the booking doesn't already cover. A cheaper stay gets back the part of its deposit it no longer
+// needs, and nights given up are offered to the waitlist
+func (m *Repository) PostMyReservationDates(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse form!")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	token := r.Form.Get("t")
+	res, ok := m.guestReservation(w, r, token)
+	if !ok {
+		return
+	}
+
+	myURL := "/my-reservation?t=" + token
+
+	if !guestCanChange(res) {
+		m.App.Session.Put(r.Context(), "error", "This booking can no longer be changed online. Please contact us.")
+		http.Redirect(w, r, myURL, http.StatusSeeOther)
+		return
+	}
+
+	layout := "2006-01-02"
+	startDate, err := time.Parse(layout, r.Form.Get("start_date"))
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Invalid arrival date")
+		http.Redirect(w, r, myURL, http.StatusSeeOther)
+		return
+	}
+	endDate, err := time.Parse(layout, r.Form.Get("end_date"))
+	if err != nil || !endDate.After(startDate) {
+		m.App.Session.Put(r.Context(), "error", "Departure must be after arrival")
+		http.Redirect(w, r, myURL, http.StatusSeeOther)
+		return
+	}
+	if !startDate.After(time.Now()) {
+		m.App.Session.Put(r.Context(), "error", "Arrival must be in the future")
+		http.Redirect(w, r, myURL, http.StatusSeeOther)
+		return
+	}
+
+	for _, nights := range uncoveredNights(res.StartDate, res.EndDate, startDate, endDate) {
+		available, err := m.DB.SearchAvailabilityByDatesByRoomID(r.Context(), nights[0], nights[1], res.RoomID)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+		if !available {
+			m.App.Session.Put(r.Context(), "error", "Sorry, the room isn't available for those dates")
+			http.Redirect(w, r, myURL, http.StatusSeeOther)
+			return
+		}
+	}
+
+	quote, err := m.quoteRoom(r.Context(), res.RoomID, startDate, endDate)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	before := res
+	res.StartDate = startDate
+	res.EndDate = endDate
+	res.Quote = quote
+	res.TotalPrice = quote.Total
+	if res.PaymentStatus == models.PaymentCaptured {
+		res.DepositAmount = adjustedDeposit(before.DepositAmount, before.TotalPrice, res.TotalPrice)
+	}
+
+	err = m.DB.ChangeReservationDates(r.Context(), res)
+	if errors.Is(err, repository.ErrRoomUnavailable) {
+		m.App.Session.Put(r.Context(), "error", "Sorry, the room isn't available for those dates")
+		http.Redirect(w, r, myURL, http.StatusSeeOther)
+		return
+	}
+	if errors.Is(err, repository.ErrStatusChanged) {
+		m.App.Session.Put(r.Context(), "error", "This booking can no longer be changed online. Please contact us.")
+		http.Redirect(w, r, myURL, http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	if refund := before.DepositAmount - res.DepositAmount; refund > 0 {
+		transactions, err := m.DB.PaymentTransactions(r.Context(), res.ID)
+		if err != nil {
+			log.Println(err)
+		} else {
+			m.refundDeposit(r.Context(), res, transactions, refund, res.PaymentStatus)
+		}
+	}
+
+	if len(uncoveredNights(startDate, endDate, before.StartDate, before.EndDate)) > 0 {
+		m.offerFreedRooms(r.Context())
+	}
+
+	m.audit(r, "guest-dates", "reservation", res.ID, before, res)
+	m.notify(r.Context(), webhooks.EventReservationUpdated, toAPIReservation(res))
+
+	// the link in the first email expires a while after the old departure date, so send a new one
+	changed := emails.ChangedData{Reservation: res, Before: before, Link: m.guestLink(res)}
+	m.queueEmail(r.Context(), res.Email, emails.ReservationChanged, changed)
+	m.queueEmail(r.Context(), "me@here.com", emails.OwnerReservationChanged, changed)
+
+	m.App.Session.Put(r.Context(), "flash", "Your dates have been changed")
+	http.Redirect(w, r, "/my-reservation?t="+m.guestToken(res), http.StatusSeeOther)
+}
+
+// PostMyReservationCancel lets a guest cancel their booking
+func (m *Repository) PostMyReservationCancel(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse form!")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	token := r.Form.Get("t")
+	res, ok := m.guestReservation(w, r, token)
+	if !ok {
+		return
+	}
+
+	myURL := "/my-reservation?t=" + token
+
+	if !guestCanChange(res) {
+		m.App.Session.Put(r.Context(), "error", "This booking can no longer be cancelled online. Please contact us.")
+		http.Redirect(w, r, myURL, http.StatusSeeOther)
+		return
+	}
+
+	refund, err := m.changeStatus(r.Context(), res, models.StatusCancelled, 0)
+	if err != nil {
+		log.Println(err)
+		m.App.Session.Put(r.Context(), "error", "Can't cancel this booking. Please contact us.")
+		http.Redirect(w, r, myURL, http.StatusSeeOther)
+		return
+	}
+
+	m.audit(r, "status", "reservation", res.ID, map[string]interface{}{"Status": res.Status},
+		map[string]interface{}{"Status": models.StatusCancelled, "RefundAmount": refund})
+
+	cancelled := emails.CancellationData{
+		Reservation: res,
+		Refund:      refund,
+	}
+	m.queueEmail(r.Context(), res.Email, emails.ReservationCancelled, cancelled)
+	m.queueEmail(r.Context(), "me@here.com", emails.OwnerReservationCancelled, cancelled)
+
+	m.App.Session.Put(r.Context(), "flash", "Your booking has been cancelled. You will be refunded "+render.FormatCurrency(refund))
+	http.Redirect(w, r, myURL, http.StatusSeeOther)
+}
+
+// renderWaitlistForm shows the form for joining the waitlist
+func (m *Repository) renderWaitlistForm(w http.ResponseWriter, r *http.Request, entry models.WaitlistEntry, stringMap map[string]string, form *forms.Form) {
+	rooms, err := m.DB.AllRooms(r.Context())
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["entry"] = entry
+	data["rooms"] = rooms
+
+	render.Template(w, r, "waitlist.page.tmpl", &models.TemplateData{
+		StringMap: stringMap,
+		Data:      data,
+		Form:      form,
+	})
+}
+
+// Waitlist shows the form for joining the waitlist, with the dates of the search that found nothing
+func (m *Repository) Waitlist(w http.ResponseWriter, r *http.Request) {
+	stringMap := make(map[string]string)
+	stringMap["start_date"] = r.URL.Query().Get("start")
+	stringMap["end_date"] = r.URL.Query().Get("end")
+
+	m.renderWaitlistForm(w, r, models.WaitlistEntry{}, stringMap, forms.New(nil))
+}
+
+// PostWaitlist puts a guest on the waitlist for a date range and, optionally, a room
+func (m *Repository) PostWaitlist(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse form!")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	roomID, _ := strconv.Atoi(r.Form.Get("room_id"))
+
+	entry := models.WaitlistEntry{
+		FirstName: r.Form.Get("first_name"),
+		LastName:  r.Form.Get("last_name"),
+		Email:     r.Form.Get("email"),
+		Phone:     r.Form.Get("phone"),
+		RoomID:    roomID,
+	}
+
+	stringMap := make(map[string]string)
+	stringMap["start_date"] = r.Form.Get("start_date")
+	stringMap["end_date"] = r.Form.Get("end_date")
+
+	form := forms.New(r.PostForm)
+	form.Required("first_name", "last_name", "email", "start_date", "end_date")
+	form.MinLength("first_name", 3)
+	form.IsEmail("email")
+
+	layout := "2006-01-02"
+	entry.StartDate, err = time.Parse(layout, r.Form.Get("start_date"))
+	if err != nil {
+		form.Errors.Add("start_date", "Invalid date")
+	}
+	entry.EndDate, err = time.Parse(layout, r.Form.Get("end_date"))
+	if err != nil {
+		form.Errors.Add("end_date", "Invalid date")
+	}
+	if form.Errors.Get("start_date") == "" && form.Errors.Get("end_date") == "" {
+		if !entry.EndDate.After(entry.StartDate) {
+			form.Errors.Add("end_date", "Departure must be after arrival")
+		} else if !entry.StartDate.After(time.Now()) {
+			form.Errors.Add("start_date", "Arrival must be in the future")
+		}
+	}
+
+	if !form.Valid() {
+		m.renderWaitlistForm(w, r, entry, stringMap, form)
+		return
+	}
+
+	_, err = m.DB.InsertWaitlistEntry(r.Context(), entry)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't add you to the waitlist!")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "You're on the waitlist. We'll email you if a room frees up for your dates.")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// WaitlistHold starts a booking for the room held for a waitlisted guest, from the signed link in
+// the email offering it to them
+func (m *Repository) WaitlistHold(w http.ResponseWriter, r *http.Request) {
+	id, err := signedlink.Verify(m.App.LinkSecret, waitlist.LinkPurpose, r.URL.Query().Get("t"), time.Now())
+	if errors.Is(err, signedlink.ErrExpired) {
+		m.App.Session.Put(r.Context(), "error", "Sorry, the hold on this room has expired")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "This link is not valid")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	entry, err := m.DB.GetWaitlistEntryByID(r.Context(), id)
+	if err != nil || entry.Status != models.WaitlistOffered || !time.Now().Before(entry.HoldExpiresAt) {
+		m.App.Session.Put(r.Context(), "error", "Sorry, this room is no longer being held for you")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	quote, err := m.quoteRoom(r.Context(), entry.HoldRoomID, entry.StartDate, entry.EndDate)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't get a price for this room!")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	res := models.Reservation{
+		FirstName:  entry.FirstName,
+		LastName:   entry.LastName,
+		Email:      entry.Email,
+		Phone:      entry.Phone,
+		StartDate:  entry.StartDate,
+		EndDate:    entry.EndDate,
+		RoomID:     entry.HoldRoomID,
+		Quote:      quote,
+		TotalPrice: quote.Total,
+	}
+
+	m.App.Session.Put(r.Context(), "reservation", res)
+	m.App.Session.Put(r.Context(), "waitlist_entry_id", entry.ID)
+
+	http.Redirect(w, r, "/make-reservation", http.StatusSeeOther)
+}
+
+// maxWebhookBytes caps how much of a webhook request body is read
+const maxWebhookBytes = 1 << 20
+
+// PaymentWebhook records what the payment provider reports about a payment after the fact, such as
+// a refund made from the provider's own dashboard. Events for payments we didn't make are ignored
+func (m *Repository) PaymentWebhook(w http.ResponseWriter, r *http.Request) {
+	payload, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookBytes))
+	if err != nil {
+		http.Error(w, "can't read body", http.StatusBadRequest)
+		return
+	}
+
+	event, err := m.App.Payments.VerifyWebhook(payload, r.Header.Get("X-Payment-Signature"))
+	// the event id is what keeps a redelivered event from being recorded twice
+	if err != nil || event.ID == "" {
+		http.Error(w, "invalid webhook", http.StatusBadRequest)
+		return
+	}
+
+	var kind, outcome, paymentStatus string
+	switch event.Type {
+	case payments.EventCaptured:
+		kind, outcome, paymentStatus = models.TransactionCapture, models.TransactionSucceeded, models.PaymentCaptured
+	case payments.EventRefunded:
+		kind, outcome, paymentStatus = models.TransactionRefund, models.TransactionSucceeded, models.PaymentRefunded
+	case payments.EventFailed:
+		kind, outcome, paymentStatus = models.TransactionCapture, models.TransactionFailed, models.PaymentFailed
+	default:
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	original, err := m.DB.GetPaymentTransactionByReference(r.Context(), event.Reference)
+	if errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	err = m.DB.RecordPayment(r.Context(), models.PaymentTransaction{
+		ReservationID: original.ReservationID,
+		Provider:      m.App.Payments.Name(),
+		Kind:          kind,
+		Reference:     event.Reference,
+		Amount:        event.Amount,
+		Status:        outcome,
+		EventID:       event.ID,
+	}, paymentStatus)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// Calendar feed link purposes
+const (
+	roomCalendarPurpose  = "ical-room"
+	staffCalendarPurpose = "ical-staff"
+)
+
+// roomCalendarURL returns the secret address of a room's availability feed, for other booking sites
+func (m *Repository) roomCalendarURL(roomID int) string {
+	return fmt.Sprintf("%s/ical/rooms/%d.ics?token=%s", m.App.BaseURL, roomID,
+		signedlink.Token(m.App.LinkSecret, roomCalendarPurpose, roomID))
+}
+
+// staffCalendarURL returns the secret address of the arrivals and departures feed
+func (m *Repository) staffCalendarURL() string {
+	return fmt.Sprintf("%s/ical/staff.ics?token=%s", m.App.BaseURL,
+		signedlink.Token(m.App.LinkSecret, staffCalendarPurpose, 0))
+}
+
+// calendarUID returns a UID for an event about the record kind id that stays the same every time
+// the feed is generated, so calendars update the event rather than adding another
+func (m *Repository) calendarUID(kind string, id int) string {
+	host := "localhost"
+	if u, err := url.Parse(m.App.BaseURL); err == nil && u.Hostname() != "" {
+		host = u.Hostname()
+	}
+	return fmt.Sprintf("%s-%d@%s", kind, id, host)
+}
+
+// writeCalendar sends events as an iCalendar feed
+func writeCalendar(w http.ResponseWriter, name string, events []ical.Event) {
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	if err := ical.Write(w, name, events, time.Now()); err != nil {
+		log.Println(err)
+	}
+}
+
+// RoomCalendar is a room's availability feed for other booking sites. Every restriction on the room
+// is an event, with no guest details, as the feed leaves the building. Blocks imported from other
+// channels are left out, so a channel never sees its own bookings handed back as ours
+func (m *Repository) RoomCalendar(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil || !signedlink.CheckToken(m.App.LinkSecret, roomCalendarPurpose, id, r.URL.Query().Get("token")) {
+		http.NotFound(w, r)
+		return
+	}
+
+	room, err := m.DB.GetRoomByID(r.Context(), id)
+	if err != nil || room.Archived == 1 {
+		http.NotFound(w, r)
+		return
+	}
+
+	restrictions, err := m.DB.GetRestrictionsForRoomByDate(r.Context(), id, time.Time{}, time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	events := make([]ical.Event, 0, len(restrictions))
+	for _, rr := range restrictions {
+		if rr.RestrictionID == models.ChannelRestrictionID {
+			continue
+		}
+		events = append(events, ical.Event{
+			UID:     m.calendarUID("restriction", rr.ID),
+			Start:   rr.StartDate,
+			End:     rr.EndDate,
+			Summary: "Unavailable (" + rr.Restriction.RestrictionName + ")",
+		})
+	}
+
+	writeCalendar(w, room.RoomName, events)
+}
+
+// staffCalendarWindow is how far back and ahead of today the staff feed reaches
+const (
+	staffCalendarPast   = 30 * 24 * time.Hour
+	staffCalendarFuture = 365 * 24 * time.Hour
+)
+
+// StaffCalendar is a feed of every arrival and departure, for staff to subscribe to on their phones
+func (m *Repository) StaffCalendar(w http.ResponseWriter, r *http.Request) {
+	if !signedlink.CheckToken(m.App.LinkSecret, staffCalendarPurpose, 0, r.URL.Query().Get("token")) {
+		http.NotFound(w, r)
+		return
+	}
+
+	now := time.Now()
+	reservations, err := m.DB.ReservationsBetween(r.Context(), now.Add(-staffCalendarPast), now.Add(staffCalendarFuture))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	var events []ical.Event
+	for _, res := range reservations {
+		guest := fmt.Sprintf("%s %s", res.FirstName, res.LastName)
+		description := fmt.Sprintf("Reservation %d, %s to %s\nPhone: %s\nEmail: %s", res.ID,
+			res.StartDate.Format("2006-01-02"), res.EndDate.Format("2006-01-02"), res.Phone, res.Email)
+
+		events = append(events, ical.Event{
+			UID:         m.calendarUID("arrival", res.ID),
+			Start:       res.StartDate,
+			End:         res.StartDate.AddDate(0, 0, 1),
+			Summary:     fmt.Sprintf("Arrival: %s (%s)", guest, res.Room.RoomName),
+			Description: description,
+		}, ical.Event{
+			UID:         m.calendarUID("departure", res.ID),
+			Start:       res.EndDate,
+			End:         res.EndDate.AddDate(0, 0, 1),
+			Summary:     fmt.Sprintf("Departure: %s (%s)", guest, res.Room.RoomName),
+			Description: description,
+		})
+	}
+
+	writeCalendar(w, "Arrivals and Departures", events)
+}
+
+// ShowLogin shows the login page
+func (m *Repository) ShowLogin(w http.ResponseWriter, r *http.Request) {
+	render.Template(w, r, "login.page.tmpl", &models.TemplateData{
+		Form: forms.New(nil),
+	})
+}
+
+// PostShowLogin handles the login form post
+func (m *Repository) PostShowLogin(w http.ResponseWriter, r *http.Request) {
+	_ = m.App.Session.RenewToken(r.Context())
+
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+	}
+
+	email := r.Form.Get("email")
+	password := r.Form.Get("password")
+
+	form := forms.New(r.PostForm)
+	form.Required("email", "password")
+	form.IsEmail("email")
+
+	if !form.Valid() {
+		render.Template(w, r, "login.page.tmpl", &models.TemplateData{
+			Form: form,
+		})
+		return
+	}
+
+	id, _, err := m.DB.Authenticate(r.Context(), email, password)
+	if err != nil {
+		log.Println(err)
+
+		m.App.Session.Put(r.Context(), "error", "Invalid login credentials")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "user_id", id)
+	m.App.Session.Put(r.Context(), "flash", "Logged in successfully")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// Logout clears the session and redirects the user to the home page
+func (m *Repository) Logout(w http.ResponseWriter, r *http.Request) {
+	_ = m.App.Session.Destroy(r.Context())
+	_ = m.App.Session.RenewToken(r.Context())
+
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
+
+// AdminDashBoard shows the admin dashboard
+func (m *Repository) AdminDashBoard(w http.ResponseWriter, r *http.Request) {
+	render.Template(w, r, "admin-dashboard.page.tmpl", &models.TemplateData{})
+}
+
+// AdminNewReservations shows all new reservations on the admin dashboard
+func (m *Repository) AdminNewReservations(w http.ResponseWriter, r *http.Request) {
+	reservations, err := m.DB.AllNewReservations(r.Context())
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Can't get all new reservations")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["reservations"] = reservations
+
+	render.Template(w, r, "admin-new-reservations.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// AdminAllReservations shows all reservations on the admin dashboard
+func (m *Repository) AdminAllReservations(w http.ResponseWriter, r *http.Request) {
+	reservations, err := m.DB.AllReservations(r.Context())
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Can't get all reservations")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["reservations"] = reservations
+
+	render.Template(w, r, "admin-all-reservations.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// AdminShowReservation shows the reservation on the admin dashboard
+func (m *Repository) AdminShowReservation(w http.ResponseWriter, r *http.Request) {
+	// get the URL parameters
+	exploded := strings.Split(r.RequestURI, "/")
+	id, err := strconv.Atoi(exploded[4])
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "missing url parameter")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	src := exploded[3]
+	stringMap := make(map[string]string)
+	stringMap["src"] = src
+
+	year := r.URL.Query().Get("y")
+	month := r.URL.Query().Get("m")
+
+	stringMap["year"] = year
+	stringMap["month"] = month
+
+	// get reservation from the database
+	res, err := m.DB.GetReservationByID(r.Context(), id)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Can't find reservation")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	history, err := m.DB.GetReservationStatusHistory(r.Context(), id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	transactions, err := m.DB.PaymentTransactions(r.Context(), id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["reservation"] = res
+	data["history"] = history
+	data["payments"] = transactions
+	data["next_statuses"] = status.Next(res.Status)
+
+	render.Template(w, r, "admin-reservation-show.page.tmpl", &models.TemplateData{
+		StringMap: stringMap,
+		Data:      data,
+		Form:      forms.New(nil),
+	})
+}
+
+// invoicePDF issues the invoice for res, if it hasn't been already, and renders it as a PDF
+func (m *Repository) invoicePDF(ctx context.Context, res models.Reservation) (models.Invoice, []byte, error) {
+	inv, err := m.DB.IssueInvoice(ctx, res.ID)
+	if err != nil {
+		return inv, nil, err
+	}
+
+	transactions, err := m.DB.PaymentTransactions(ctx, res.ID)
+	if err != nil {
+		return inv, nil, err
+	}
+
+	var buf bytes.Buffer
+	err = invoice.Write(&buf, inv, res, invoice.Summarize(res, transactions, m.App.TaxPercent))
+	if err != nil {
+		return inv, nil, err
+	}
+
+	return inv, buf.Bytes(), nil
+}
+
+// AdminReservationInvoice downloads the PDF invoice for a reservation
+func (m *Repository) AdminReservationInvoice(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	res, err := m.DB.GetReservationByID(r.Context(), id)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Can't find reservation")
+		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+		return
+	}
+
+	inv, pdf, err := m.invoicePDF(r.Context(), res)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, invoice.Filename(inv)))
+	_, _ = w.Write(pdf)
+}
+
+// AdminPostShowReservation updates a reservation on the admin dashboard
+func (m *Repository) AdminPostShowReservation(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Can't parse form")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	exploded := strings.Split(r.RequestURI, "/")
+	id, err := strconv.Atoi(exploded[4])
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	src := exploded[3]
+
+	stringMap := make(map[string]string)
+	stringMap["src"] = src
+
+	res, err := m.DB.GetReservationByID(r.Context(), id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	before := res
+
+	// update the reservation
+	res.FirstName = r.Form.Get("first_name")
+	res.LastName = r.Form.Get("last_name")
+	res.Email = r.Form.Get("email")
+	res.Phone = r.Form.Get("phone")
+
+	err = m.DB.UpdateReservation(r.Context(), res)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.audit(r, "update", "reservation", res.ID, before, res)
+	m.notify(r.Context(), webhooks.EventReservationUpdated, toAPIReservation(res))
+
+	month := r.Form.Get("month")
+	year := r.Form.Get("year")
+
+	m.App.Session.Put(r.Context(), "flash", "Changes saved")
+
+	if year == "" {
+		http.Redirect(w, r, fmt.Sprintf("/admin/reservations-%s", src), http.StatusSeeOther)
+	} else {
+		http.Redirect(w, r, fmt.Sprintf("/admin/reservations-calendar?y=%s&m=%s", year, month), http.StatusSeeOther)
+	}
+}
+
+// AdminReservationsCalendar shows the reservation calendar on the admin dashboard
+func (m *Repository) AdminReservationsCalendar(w http.ResponseWriter, r *http.Request) {
+	// assume that there is no month/year specified
+	now := time.Now()
+
+	if r.URL.Query().Get("y") != "" {
+		year, err := strconv.Atoi(r.URL.Query().Get("y"))
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+
+		month, err := strconv.Atoi(r.URL.Query().Get("m"))
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+
+		now = time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC)
+	}
+
+	data := make(map[string]interface{})
+	data["now"] = now
+
+	next := now.AddDate(0, 1, 0)
+	last := now.AddDate(0, -1, 0)
+
+	nextMonth := next.Format("01")
+	nextMonthYear := next.Format("2006")
+
+	lastMonth := last.Format("01")
+	lastMonthYear := last.Format("2006")
+
+	stringMap := make(map[string]string)
+	stringMap["next_month"] = nextMonth
+	stringMap["next_month_year"] = nextMonthYear
+	stringMap["last_month"] = lastMonth
+	stringMap["last_month_year"] = lastMonthYear
+
+	stringMap["this_month"] = now.Format("01")
+	stringMap["this_month_year"] = now.Format("2006")
+
+	// get the first and last day of the month
+	currentYear, currentMonth, _ := now.Date()
+	currentLocation := now.Location()
+	firstOfMonth := time.Date(currentYear, currentMonth, 1, 0, 0, 0, 0, currentLocation)
+	lastOfMonth := firstOfMonth.AddDate(0, 1, -1)
+
+	intMap := make(map[string]int)
+	intMap["days_in_month"] = lastOfMonth.Day()
+	intMap["channel_restriction_id"] = models.ChannelRestrictionID
+
+	rooms, err := m.DB.AllRooms(r.Context())
+	if err != nil {
+		helpers.ServerError(w, err)
+	}
+
+	data["rooms"] = rooms
+
+	cells := make(map[int][]calendarCell)
+	occupied := make(map[int]int)
+	for _, x := range rooms {
+		// get all restrictions for the current room
+		roomRestrictions, err := m.DB.GetRestrictionsForRoomByDate(r.Context(), x.ID, firstOfMonth, lastOfMonth)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+
+		cells[x.ID] = buildCalendarCells(firstOfMonth, lastOfMonth, roomRestrictions)
+		occupied[x.ID] = occupiedNights(firstOfMonth, roomRestrictions)
+	}
+	data["cells"] = cells
+	data["occupied"] = occupied
+
+	restrictions, err := m.DB.AllRestrictions(r.Context())
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	data["restrictions"] = restrictions
+
+	render.Template(w, r, "admin-reservations-calendar.page.tmpl", &models.TemplateData{
+		StringMap: stringMap,
+		Data:      data,
+		IntMap:    intMap,
+	})
+}
+
+// AdminProcessReservation moves a reservation to the status given in the query string, or
+// confirms it when none is given
+func (m *Repository) AdminProcessReservation(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+	src := chi.URLParam(r, "src")
+
+	to := r.URL.Query().Get("status")
+	if to == "" {
+		to = models.StatusConfirmed
+	}
+
+	var refund int
+	res, err := m.DB.GetReservationByID(r.Context(), id)
+	if err == nil {
+		err = status.Validate(res.Status, to)
+	}
+	if err == nil {
+		refund, err = m.changeStatus(r.Context(), res, to, m.App.Session.GetInt(r.Context(), "user_id"))
+	}
+
+	switch {
+	case errors.Is(err, status.ErrInvalidTransition):
+		m.App.Session.Put(r.Context(), "error", fmt.Sprintf("A %s reservation can't be marked as %s",
+			strings.ToLower(status.Label(res.Status)), strings.ToLower(status.Label(to))))
+	case errors.Is(err, repository.ErrStatusChanged):
+		m.App.Session.Put(r.Context(), "error", "This reservation was changed by someone else, please try again")
+	case err != nil:
+		log.Println(err)
+		m.App.Session.Put(r.Context(), "error", "Can't change reservation status")
+	case to == models.StatusCancelled:
+		m.audit(r, "status", "reservation", id, map[string]interface{}{"Status": res.Status},
+			map[string]interface{}{"Status": to, "RefundAmount": refund})
+		m.App.Session.Put(r.Context(), "flash", "Reservation cancelled, refund due "+render.FormatCurrency(refund))
+	default:
+		m.audit(r, "status", "reservation", id, map[string]interface{}{"Status": res.Status}, map[string]interface{}{"Status": to})
+		m.App.Session.Put(r.Context(), "flash", "Reservation marked as "+strings.ToLower(status.Label(to)))
+	}
+
+	year := r.URL.Query().Get("y")
+	month := r.URL.Query().Get("m")
+
+	if year == "" {
+		http.Redirect(w, r, "/admin/reservations-"+src, http.StatusSeeOther)
+	} else {
+		http.Redirect(w, r, fmt.Sprintf("/admin/reservations-calendar?y=%s&m=%s", year, month), http.StatusSeeOther)
+	}
+}
+
+// AdminDeleteReservation moves a reservation to the trash
+func (m *Repository) AdminDeleteReservation(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+	src := chi.URLParam(r, "src")
+	before, err := m.DB.GetReservationByID(r.Context(), id)
+	if err == nil {
+		err = m.DB.DeleteReservation(r.Context(), id, m.App.Session.GetInt(r.Context(), "user_id"))
+	}
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		m.App.Session.Put(r.Context(), "error", "This reservation has already been deleted")
+	case err != nil:
+		log.Println(err)
+		m.App.Session.Put(r.Context(), "error", "Can't delete reservation")
+	default:
+		m.audit(r, "delete", "reservation", id, before, nil)
+		m.offerFreedRooms(r.Context())
+		m.App.Session.Put(r.Context(), "flash", "Reservation moved to deleted reservations")
+	}
+
+	year := r.URL.Query().Get("y")
+	month := r.URL.Query().Get("m")
+
+	if year == "" {
+		http.Redirect(w, r, "/admin/reservations-"+src, http.StatusSeeOther)
+	} else {
+		http.Redirect(w, r, fmt.Sprintf("/admin/reservations-calendar?y=%s&m=%s", year, month), http.StatusSeeOther)
+	}
+
+}
+
+// AdminDeletedReservations shows the reservations in the trash
+func (m *Repository) AdminDeletedReservations(w http.ResponseWriter, r *http.Request) {
+	reservations, err := m.DB.AllDeletedReservations(r.Context())
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Can't get deleted reservations")
+		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["reservations"] = reservations
+
+	render.Template(w, r, "admin-deleted-reservations.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// AdminRestoreReservation takes a reservation out of the trash, provided its room is still free
+func (m *Repository) AdminRestoreReservation(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+	err := m.DB.RestoreReservation(r.Context(), id)
+	if errors.Is(err, repository.ErrRoomUnavailable) {
+		m.App.Session.Put(r.Context(), "error", "Can't restore this reservation, the room has since been booked or blocked for those dates")
+	} else if err != nil {
+		log.Println(err)
+		m.App.Session.Put(r.Context(), "error", "Can't restore reservation")
+	} else {
+		m.audit(r, "restore", "reservation", id, nil, nil)
+		m.App.Session.Put(r.Context(), "flash", "Reservation restored")
+	}
+
+	http.Redirect(w, r, "/admin/reservations-deleted", http.StatusSeeOther)
+}
+
+// calendarCell is one cell in a room's row on the reservations calendar. A block is drawn
+// as a single cell spanning every night it covers in the month. A night held for a guest on the
+// waitlist is neither a block nor a reservation, and is drawn as held
+type calendarCell struct {
+	Date              time.Time
+	Span              int
+	ReservationID     int
+	ReservationStatus string
+	WaitlistEntryID   int
+	Restriction       models.Restriction
+	Block             models.RoomRestriction
+}
+
+// buildCalendarCells lays out the restrictions for one room over the days of a month
+func buildCalendarCells(firstOfMonth, lastOfMonth time.Time, restrictions []models.RoomRestriction) []calendarCell {
+	days := lastOfMonth.Day()
+	blocks := make([]models.RoomRestriction, days+1)
+	reservations := make([]models.RoomRestriction, days+1)
+	holds := make([]models.RoomRestriction, days+1)
+
+	inMonth := func(d time.Time) bool {
+		return d.Year() == firstOfMonth.Year() && d.Month() == firstOfMonth.Month()
+	}
+
+	for _, y := range restrictions {
+		switch {
+		case y.ReservationID > 0:
+			for d := y.StartDate; !d.After(y.EndDate); d = d.AddDate(0, 0, 1) {
+				if inMonth(d) {
+					reservations[d.Day()] = y
+				}
+			}
+		case y.WaitlistEntryID > 0:
+			for d := y.StartDate; d.Before(y.EndDate); d = d.AddDate(0, 0, 1) {
+				if inMonth(d) {
+					holds[d.Day()] = y
+				}
+			}
+		default:
+			// blocks end on the morning of EndDate, so that night is not covered
+			for d := y.StartDate; d.Before(y.EndDate); d = d.AddDate(0, 0, 1) {
+				if inMonth(d) {
+					blocks[d.Day()] = y
+				}
+			}
+		}
+	}
+
+	var cells []calendarCell
+	for day := 1; day <= days; day++ {
+		cell := calendarCell{
+			Date:              firstOfMonth.AddDate(0, 0, day-1),
+			Span:              1,
+			ReservationID:     reservations[day].ReservationID,
+			ReservationStatus: reservations[day].Reservation.Status,
+			Restriction:       reservations[day].Restriction,
+			Block:             blocks[day],
+		}
+		if cell.ReservationID == 0 && holds[day].ID > 0 {
+			cell.WaitlistEntryID = holds[day].WaitlistEntryID
+			cell.Restriction = holds[day].Restriction
+		}
+		if cell.Block.ID > 0 {
+			cell.Restriction = cell.Block.Restriction
+			for day < days && blocks[day+1].ID == cell.Block.ID {
+				cell.Span++
+				day++
+			}
+		}
+		cells = append(cells, cell)
+	}
+
+	return cells
+}
+
+// occupiedNights counts the nights in the month covered by restrictions whose type counts toward occupancy
+func occupiedNights(firstOfMonth time.Time, restrictions []models.RoomRestriction) int {
+	nights := make(map[int]bool)
+	for _, y := range restrictions {
+		if !y.Restriction.CountsTowardOccupancy {
+			continue
+		}
+		for d := y.StartDate; d.Before(y.EndDate); d = d.AddDate(0, 0, 1) {
+			if d.Year() == firstOfMonth.Year() && d.Month() == firstOfMonth.Month() {
+				nights[d.Day()] = true
+			}
+		}
+	}
+	return len(nights)
+}
+
+// AdminShowBlock shows the form to add or edit a block of dates for a room
+func (m *Repository) AdminShowBlock(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "missing url parameter")
+		http.Redirect(w, r, "/admin/reservations-calendar", http.StatusSeeOther)
+		return
+	}
+
+	var block models.RoomRestriction
+	if id > 0 {
+		block, err = m.DB.GetBlockByID(r.Context(), id)
+		if err != nil {
+			m.App.Session.Put(r.Context(), "error", "Can't find block")
+			http.Redirect(w, r, "/admin/reservations-calendar", http.StatusSeeOther)
+			return
+		}
+	} else {
+		// the calendar links here with the room and first night already chosen
+		block.RoomID, _ = strconv.Atoi(r.URL.Query().Get("room_id"))
+		block.StartDate, _ = time.Parse("2006-01-02", r.URL.Query().Get("start"))
+		block.EndDate = block.StartDate.AddDate(0, 0, 1)
+	}
+
+	stringMap := make(map[string]string)
+	if !block.StartDate.IsZero() {
+		stringMap["start_date"] = block.StartDate.Format("2006-01-02")
+		stringMap["end_date"] = block.EndDate.AddDate(0, 0, -1).Format("2006-01-02")
+	}
+
+	m.renderBlockForm(w, r, block, stringMap, forms.New(nil))
+}
+
+// AdminPostShowBlock inserts a new block (id 0) or updates an existing one. Blocks can only be put
+// on rooms that are in service
+func (m *Repository) AdminPostShowBlock(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	block := models.RoomRestriction{
+		ID:     id,
+		Reason: strings.TrimSpace(r.Form.Get("reason")),
+	}
+	block.RoomID, _ = strconv.Atoi(r.Form.Get("room_id"))
+	block.RestrictionID, _ = strconv.Atoi(r.Form.Get("restriction_id"))
+
+	stringMap := make(map[string]string)
+	stringMap["start_date"] = r.Form.Get("start_date")
+	stringMap["end_date"] = r.Form.Get("end_date")
+
+	form := forms.New(r.PostForm)
+	form.Required("room_id", "restriction_id", "start_date", "end_date")
+
+	types, err := m.blockTypes(r.Context())
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	if form.Has("restriction_id") && !containsRestriction(types, block.RestrictionID) {
+		form.Errors.Add("restriction_id", "Choose one of the block types")
+	}
+
+	if form.Has("room_id") {
+		room, err := m.DB.GetRoomByID(r.Context(), block.RoomID)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			helpers.ServerError(w, err)
+			return
+		}
+		if err != nil || room.Archived == 1 {
+			form.Errors.Add("room_id", "Choose one of the rooms")
+		}
+	}
+
+	layout := "2006-01-02"
+	startDate, err := time.Parse(layout, r.Form.Get("start_date"))
+	if form.Has("start_date") && err != nil {
+		form.Errors.Add("start_date", "Invalid date")
+	}
+	endDate, err := time.Parse(layout, r.Form.Get("end_date"))
+	if form.Has("end_date") && err != nil {
+		form.Errors.Add("end_date", "Invalid date")
+	}
+	if form.Valid() && endDate.Before(startDate) {
+		form.Errors.Add("end_date", "The last night can't be before the first night")
+	}
+
+	// the form asks for the last night closed; restrictions end on the following morning
+	block.StartDate = startDate
+	block.EndDate = endDate.AddDate(0, 0, 1)
+
+	if form.Valid() {
+		var before interface{}
+		if id > 0 {
+			if old, err := m.DB.GetBlockByID(r.Context(), id); err == nil {
+				before = old
+			}
+			err = m.DB.UpdateBlock(r.Context(), block)
+		} else {
+			block.ID, err = m.DB.InsertBlock(r.Context(), block)
+		}
+		if err == nil {
+			m.audit(r, auditAction(id), "block", block.ID, before, block)
+			if id > 0 {
+				m.notify(r.Context(), webhooks.EventBlockUpdated, toAPIBlock(block))
+			} else {
+				m.notify(r.Context(), webhooks.EventBlockCreated, toAPIBlock(block))
+			}
+		}
+		if errors.Is(err, repository.ErrRoomUnavailable) {
+			form.Errors.Add("start_date", "These dates overlap a reservation or another block for this room")
+		} else if err != nil {
+			log.Println(err)
+			m.App.Session.Put(r.Context(), "error", "Can't save block")
+			http.Redirect(w, r, "/admin/reservations-calendar", http.StatusSeeOther)
+			return
+		}
+	}
+
+	if !form.Valid() {
+		m.renderBlockForm(w, r, block, stringMap, form)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Block saved")
+	http.Redirect(w, r, fmt.Sprintf("/admin/reservations-calendar?y=%d&m=%d", startDate.Year(), startDate.Month()), http.StatusSeeOther)
+}
+
+// blockTypes returns the restriction types staff can pick for a block. The reservation and channel
+// types are written by the booking process and the calendar importer, so they are left out
+func (m *Repository) blockTypes(ctx context.Context) ([]models.Restriction, error) {
+	restrictions, err := m.DB.AllRestrictions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var types []models.Restriction
+	for _, x := range restrictions {
+		if x.ID != models.ReservationRestrictionID && x.ID != models.ChannelRestrictionID {
+			types = append(types, x)
+		}
+	}
+	return types, nil
+}
+
+// containsRestriction reports whether id is one of restrictions
+func containsRestriction(restrictions []models.Restriction, id int) bool {
+	for _, x := range restrictions {
+		if x.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// renderBlockForm renders the add/edit block form
+func (m *Repository) renderBlockForm(w http.ResponseWriter, r *http.Request, block models.RoomRestriction, stringMap map[string]string, form *forms.Form) {
+	rooms, err := m.DB.AllRooms(r.Context())
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	types, err := m.blockTypes(r.Context())
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["block"] = block
+	data["rooms"] = rooms
+	data["restrictions"] = types
+
+	render.Template(w, r, "admin-block-show.page.tmpl", &models.TemplateData{
+		StringMap: stringMap,
+		Data:      data,
+		Form:      form,
+	})
+}
+
+// AdminDeleteBlock deletes a block, reopening the room for its dates
+func (m *Repository) AdminDeleteBlock(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+	before, _ := m.DB.GetBlockByID(r.Context(), id)
+	err := m.DB.DeleteBlockByID(r.Context(), id)
+	if err != nil {
+		log.Println(err)
+		m.App.Session.Put(r.Context(), "error", "Can't delete block")
+	} else {
+		m.audit(r, "delete", "block", id, before, nil)
+		// subscribers still get the id if the block couldn't be read before it went
+		before.ID = id
+		m.notify(r.Context(), webhooks.EventBlockDeleted, toAPIBlock(before))
+		m.offerFreedRooms(r.Context())
+		m.App.Session.Put(r.Context(), "flash", "Block deleted")
+	}
+
+	year := r.URL.Query().Get("y")
+	month := r.URL.Query().Get("m")
+
+	if year == "" {
+		http.Redirect(w, r, "/admin/reservations-calendar", http.StatusSeeOther)
+	} else {
+		http.Redirect(w, r, fmt.Sprintf("/admin/reservations-calendar?y=%s&m=%s", year, month), http.StatusSeeOther)
+	}
+}
+
+// AdminRestrictions lists the restriction types that can be put on a room
+func (m *Repository) AdminRestrictions(w http.ResponseWriter, r *http.Request) {
+	restrictions, err := m.DB.AllRestrictions(r.Context())
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["restrictions"] = restrictions
+
+	intMap := make(map[string]int)
+	intMap["reservation_restriction_id"] = models.ReservationRestrictionID
+	intMap["channel_restriction_id"] = models.ChannelRestrictionID
+
+	render.Template(w, r, "admin-restrictions.page.tmpl", &models.TemplateData{
+		Data:   data,
+		IntMap: intMap,
+	})
+}
+
+// AdminShowRestriction shows the form to add (id 0) or edit a restriction type
+func (m *Repository) AdminShowRestriction(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "missing url parameter")
+		http.Redirect(w, r, "/admin/restrictions", http.StatusSeeOther)
+		return
+	}
+
+	restriction := models.Restriction{Colour: "#6c757d"}
+	if id > 0 {
+		restriction, err = m.DB.GetRestrictionByID(r.Context(), id)
+		if err != nil {
+			m.App.Session.Put(r.Context(), "error", "Can't find restriction type")
+			http.Redirect(w, r, "/admin/restrictions", http.StatusSeeOther)
+			return
+		}
+	}
+
+	data := make(map[string]interface{})
+	data["restriction"] = restriction
+
+	render.Template(w, r, "admin-restriction-show.page.tmpl", &models.TemplateData{
+		Data: data,
+		Form: forms.New(nil),
+	})
+}
+
+// AdminPostShowRestriction inserts a new restriction type (id 0) or updates an existing one
+func (m *Repository) AdminPostShowRestriction(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	restriction := models.Restriction{
+		ID:                    id,
+		RestrictionName:       strings.TrimSpace(r.Form.Get("restriction_name")),
+		Colour:                r.Form.Get("colour"),
+		CountsTowardOccupancy: r.Form.Get("counts_toward_occupancy") == "1",
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("restriction_name")
+	form.IsColour("colour")
+
+	if !form.Valid() {
+		data := make(map[string]interface{})
+		data["restriction"] = restriction
+		render.Template(w, r, "admin-restriction-show.page.tmpl", &models.TemplateData{
+			Form: form,
+			Data: data,
+		})
+		return
+	}
+
+	var before interface{}
+	if id > 0 {
+		if old, err := m.DB.GetRestrictionByID(r.Context(), id); err == nil {
+			before = old
+		}
+		err = m.DB.UpdateRestriction(r.Context(), restriction)
+	} else {
+		restriction.ID, err = m.DB.InsertRestriction(r.Context(), restriction)
+	}
+	if err != nil {
+		log.Println(err)
+		m.App.Session.Put(r.Context(), "error", "Can't save restriction type")
+		http.Redirect(w, r, "/admin/restrictions", http.StatusSeeOther)
+		return
+	}
+
+	m.audit(r, auditAction(id), "restriction", restriction.ID, before, restriction)
+
+	m.App.Session.Put(r.Context(), "flash", "Restriction type saved")
+	http.Redirect(w, r, "/admin/restrictions", http.StatusSeeOther)
+}
+
+// AdminDeleteRestriction deletes a restriction type that nothing uses
+func (m *Repository) AdminDeleteRestriction(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+	before, _ := m.DB.GetRestrictionByID(r.Context(), id)
+	err := m.DB.DeleteRestriction(r.Context(), id)
+	if errors.Is(err, repository.ErrRestrictionInUse) {
+		m.App.Session.Put(r.Context(), "error", "This restriction type is still used by reservations or blocks")
+	} else if err != nil {
+		log.Println(err)
+		m.App.Session.Put(r.Context(), "error", "Can't delete restriction type")
+	} else {
+		m.audit(r, "delete", "restriction", id, before, nil)
+		m.App.Session.Put(r.Context(), "flash", "Restriction type deleted")
+	}
+
+	http.Redirect(w, r, "/admin/restrictions", http.StatusSeeOther)
+}
+
+// AdminCancellationPolicies lists the cancellation policies that can be given to rooms
+func (m *Repository) AdminCancellationPolicies(w http.ResponseWriter, r *http.Request) {
+	policies, err := m.DB.AllCancellationPolicies(r.Context())
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["policies"] = policies
+
+	render.Template(w, r, "admin-cancellation-policies.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// policyTierRows is how many refund tiers the cancellation policy form offers
+const policyTierRows = 4
+
+// renderPolicyForm shows the cancellation policy form, with blank rows for any tiers not yet used
+func renderPolicyForm(w http.ResponseWriter, r *http.Request, policy models.CancellationPolicy, form *forms.Form) {
+	tiers := make([]models.CancellationTier, policyTierRows)
+	copy(tiers, policy.Tiers)
+
+	data := make(map[string]interface{})
+	data["policy"] = policy
+	data["tiers"] = tiers
+
+	render.Template(w, r, "admin-cancellation-policy-show.page.tmpl", &models.TemplateData{
+		Data: data,
+		Form: form,
+	})
+}
+
+// AdminShowCancellationPolicy shows the form to add (id 0) or edit a cancellation policy
+func (m *Repository) AdminShowCancellationPolicy(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "missing url parameter")
+		http.Redirect(w, r, "/admin/cancellation-policies", http.StatusSeeOther)
+		return
+	}
+
+	var policy models.CancellationPolicy
+	if id > 0 {
+		policy, err = m.DB.GetCancellationPolicyByID(r.Context(), id)
+		if err != nil {
+			m.App.Session.Put(r.Context(), "error", "Can't find cancellation policy")
+			http.Redirect(w, r, "/admin/cancellation-policies", http.StatusSeeOther)
+			return
+		}
+	}
+
+	renderPolicyForm(w, r, policy, forms.New(nil))
+}
+
+// AdminPostShowCancellationPolicy inserts a new cancellation policy (id 0) or updates an existing one.
+// Each tier is a row of hours before arrival and the percentage refunded; blank rows are ignored
+func (m *Repository) AdminPostShowCancellationPolicy(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	policy := models.CancellationPolicy{
+		ID:          id,
+		Name:        strings.TrimSpace(r.Form.Get("name")),
+		Description: strings.TrimSpace(r.Form.Get("description")),
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("name")
+
+	for i := 0; i < policyTierRows; i++ {
+		hours := strings.TrimSpace(r.Form.Get(fmt.Sprintf("tier_hours_%d", i)))
+		percent := strings.TrimSpace(r.Form.Get(fmt.Sprintf("tier_percent_%d", i)))
+		if hours == "" && percent == "" {
+			continue
+		}
+
+		var tier models.CancellationTier
+		tier.HoursBefore, err = strconv.Atoi(hours)
+		if err == nil {
+			tier.RefundPercent, err = strconv.Atoi(percent)
+		}
+		if err != nil {
+			form.Errors.Add("tiers", "Enter whole numbers of hours and percent for each tier")
+			break
+		}
+		policy.Tiers = append(policy.Tiers, tier)
+	}
+
+	if err := cancellation.Validate(policy); err != nil {
+		form.Errors.Add("tiers", "Hours can't be negative, and refunds must be between 0 and 100 percent")
+	}
+
+	if !form.Valid() {
+		renderPolicyForm(w, r, policy, form)
+		return
+	}
+
+	var before interface{}
+	if id > 0 {
+		if old, err := m.DB.GetCancellationPolicyByID(r.Context(), id); err == nil {
+			before = old
+		}
+		err = m.DB.UpdateCancellationPolicy(r.Context(), policy)
+	} else {
+		policy.ID, err = m.DB.InsertCancellationPolicy(r.Context(), policy)
+	}
+	if err != nil {
+		log.Println(err)
+		m.App.Session.Put(r.Context(), "error", "Can't save cancellation policy")
+		http.Redirect(w, r, "/admin/cancellation-policies", http.StatusSeeOther)
+		return
+	}
+
+	m.audit(r, auditAction(id), "cancellation_policy", policy.ID, before, policy)
+
+	m.App.Session.Put(r.Context(), "flash", "Cancellation policy saved")
+	http.Redirect(w, r, "/admin/cancellation-policies", http.StatusSeeOther)
+}
+
+// AdminDeleteCancellationPolicy deletes a cancellation policy. Rooms using it are left without one,
+// and existing reservations keep their copy
+func (m *Repository) AdminDeleteCancellationPolicy(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+	before, _ := m.DB.GetCancellationPolicyByID(r.Context(), id)
+	err := m.DB.DeleteCancellationPolicy(r.Context(), id)
+	if err != nil {
+		log.Println(err)
+		m.App.Session.Put(r.Context(), "error", "Can't delete cancellation policy")
+	} else {
+		m.audit(r, "delete", "cancellation_policy", id, before, nil)
+		m.App.Session.Put(r.Context(), "flash", "Cancellation policy deleted")
+	}
+
+	http.Redirect(w, r, "/admin/cancellation-policies", http.StatusSeeOther)
+}
+
+// AdminWaitlist shows the guests on the waitlist and any rooms held for them
+func (m *Repository) AdminWaitlist(w http.ResponseWriter, r *http.Request) {
+	entries, err := m.DB.AllWaitlistEntries(r.Context())
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["entries"] = entries
+
+	render.Template(w, r, "admin-waitlist.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// AdminDeleteWaitlistEntry takes a guest off the waitlist. A room held for them is released along
+// with the entry and offered to the next guest in line
+func (m *Repository) AdminDeleteWaitlistEntry(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+	before, _ := m.DB.GetWaitlistEntryByID(r.Context(), id)
+	err := m.DB.DeleteWaitlistEntry(r.Context(), id)
+	if err != nil {
+		log.Println(err)
+		m.App.Session.Put(r.Context(), "error", "Can't delete waitlist entry")
+	} else {
+		m.audit(r, "delete", "waitlist_entry", id, before, nil)
+		m.offerFreedRooms(r.Context())
+		m.App.Session.Put(r.Context(), "flash", "Waitlist entry deleted")
+	}
+
+	http.Redirect(w, r, "/admin/waitlist", http.StatusSeeOther)
+}
+
+// AdminRooms shows all rooms, including archived ones, on the admin dashboard
+func (m *Repository) AdminRooms(w http.ResponseWriter, r *http.Request) {
+	rooms, err := m.DB.AllRoomsWithArchived(r.Context())
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Can't get all rooms")
+		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+		return
+	}
+
+	imports, err := m.DB.AllCalendarImports(r.Context())
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	calendarImports := make(map[int]models.CalendarImport)
+	for _, imp := range imports {
+		calendarImports[imp.RoomID] = imp
+	}
+
+	stringMap := make(map[string]string)
+	stringMap["staff_calendar_url"] = m.staffCalendarURL()
+
+	data := make(map[string]interface{})
+	data["rooms"] = rooms
+	data["calendar_imports"] = calendarImports
+
+	render.Template(w, r, "admin-rooms.page.tmpl", &models.TemplateData{
+		StringMap: stringMap,
+		Data:      data,
+	})
+}
+
+// AdminShowRoom shows the form to add a room (id 0) or edit an existing one
+func (m *Repository) AdminShowRoom(w http.ResponseWriter, r *http.Request) {
+	exploded := strings.Split(r.RequestURI, "/")
+	id, err := strconv.Atoi(exploded[3])
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "missing url parameter")
+		http.Redirect(w, r, "/admin/rooms", http.StatusSeeOther)
+		return
+	}
+
+	var room models.Room
+	if id > 0 {
+		room, err = m.DB.GetRoomByID(r.Context(), id)
+		if err != nil {
+			m.App.Session.Put(r.Context(), "error", "Can't find room")
+			http.Redirect(w, r, "/admin/rooms", http.StatusSeeOther)
+			return
+		}
+	}
+
+	policies, err := m.DB.AllCancellationPolicies(r.Context())
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["room"] = room
+	data["policies"] = policies
+
+	stringMap := make(map[string]string)
+	if room.ID > 0 {
+		stringMap["calendar_url"] = m.roomCalendarURL(room.ID)
+
+		imp, err := m.DB.GetCalendarImportByRoomID(r.Context(), room.ID)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+		data["calendar_import"] = imp
+	}
+
+	render.Template(w, r, "admin-room-show.page.tmpl", &models.TemplateData{
+		StringMap: stringMap,
+		Data:      data,
+		Form:      forms.New(nil),
+	})
+}
+
+// AdminPostShowRoom inserts a new room (id 0) or updates an existing one
+func (m *Repository) AdminPostShowRoom(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Can't parse form")
+		http.Redirect(w, r, "/admin/rooms", http.StatusSeeOther)
+		return
+	}
+
+	exploded := strings.Split(r.RequestURI, "/")
+	id, err := strconv.Atoi(exploded[3])
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	var room models.Room
+	if id > 0 {
+		room, err = m.DB.GetRoomByID(r.Context(), id)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+	}
+
+	var before interface{}
+	if id > 0 {
+		before = room
+	}
+
+	room.RoomName = strings.TrimSpace(r.Form.Get("room_name"))
+	room.Slug = helpers.Slugify(r.Form.Get("slug"))
+	if room.Slug == "" {
+		room.Slug = helpers.Slugify(room.RoomName)
+	}
+	room.Description = strings.TrimSpace(r.Form.Get("description"))
+	room.BedConfiguration = strings.TrimSpace(r.Form.Get("bed_configuration"))
+	room.MaxOccupancy, _ = strconv.Atoi(strings.TrimSpace(r.Form.Get("max_occupancy")))
+	room.Amenities = helpers.SplitLines(r.Form.Get("amenities"))
+	room.Photos = parseRoomPhotos(r.Form.Get("photos"))
+	room.CancellationPolicyID, _ = strconv.Atoi(r.Form.Get("cancellation_policy_id"))
+
+	form := forms.New(r.PostForm)
+	form.Required("room_name", "nightly_rate")
+	form.MinValue("max_occupancy", 1)
+
+	if form.Has("nightly_rate") {
+		room.NightlyRate, err = helpers.ParseCents(r.Form.Get("nightly_rate"))
+		if err != nil {
+			form.Errors.Add("nightly_rate", "Enter an amount such as 125.00")
+		}
+	}
+
+	if room.Slug == "" {
+		form.Errors.Add("slug", "This field cannot be blank")
+	} else {
+		existing, err := m.DB.GetRoomBySlug(r.Context(), room.Slug)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			helpers.ServerError(w, err)
+			return
+		}
+		if err == nil && existing.ID != id {
+			form.Errors.Add("slug", "This slug is already used by another room")
+		}
+	}
+
+	if !form.Valid() {
+		policies, err := m.DB.AllCancellationPolicies(r.Context())
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+
+		data := make(map[string]interface{})
+		data["room"] = room
+		data["policies"] = policies
+		render.Template(w, r, "admin-room-show.page.tmpl", &models.TemplateData{
+			Form: form,
+			Data: data,
+		})
+		return
+	}
+
+	if id > 0 {
+		err = m.DB.UpdateRoom(r.Context(), room)
+	} else {
+		room.ID, err = m.DB.InsertRoom(r.Context(), room)
+	}
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Can't save room")
+		http.Redirect(w, r, "/admin/rooms", http.StatusSeeOther)
+		return
+	}
+
+	m.audit(r, auditAction(id), "room", room.ID, before, room)
+
+	m.App.Session.Put(r.Context(), "flash", "Room saved")
+	http.Redirect(w, r, "/admin/rooms", http.StatusSeeOther)
+}
+
+// parseRoomPhotos reads one photo per line, as "path" or "path | caption", keeping their order
+func parseRoomPhotos(s string) []models.RoomPhoto {
+	var photos []models.RoomPhoto
+	for i, line := range helpers.SplitLines(s) {
+		path, caption, _ := strings.Cut(line, "|")
+		photos = append(photos, models.RoomPhoto{
+			Path:      strings.TrimSpace(path),
+			Caption:   strings.TrimSpace(caption),
+			SortOrder: i,
+		})
+	}
+	return photos
+}
+
+// AdminPostRoomCalendar saves the address a room's bookings on another channel are imported from,
+// then syncs the room straight away: from an uploaded .ics file if one was sent, otherwise from the
+// address. Scheduled syncs carry on from the address
+func (m *Repository) AdminPostRoomCalendar(w http.ResponseWriter, r *http.Request) {
+	roomID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "missing url parameter")
+		http.Redirect(w, r, "/admin/rooms", http.StatusSeeOther)
+		return
+	}
+
+	redirect := fmt.Sprintf("/admin/rooms/%d/show", roomID)
+
+	r.Body = http.MaxBytesReader(w, r.Body, channelsync.MaxFeedSize+(1<<20))
+	err = r.ParseMultipartForm(channelsync.MaxFeedSize)
+	if err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		m.App.Session.Put(r.Context(), "error", "Can't read the uploaded calendar")
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+
+	before, err := m.DB.GetCalendarImportByRoomID(r.Context(), roomID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	feedURL := strings.TrimSpace(r.FormValue("url"))
+	if feedURL != "" {
+		u, err := url.Parse(feedURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			m.App.Session.Put(r.Context(), "error", "The calendar address must be an http or https URL")
+			http.Redirect(w, r, redirect, http.StatusSeeOther)
+			return
+		}
+	}
+
+	if feedURL != before.URL {
+		if err := m.DB.UpdateCalendarImportURL(r.Context(), roomID, feedURL); err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+		after := before
+		after.URL = feedURL
+		m.audit(r, "update", "calendar_import", roomID, before, after)
+	}
+
+	var result models.CalendarImport
+	file, _, fileErr := r.FormFile("calendar")
+	if fileErr == nil {
+		defer file.Close()
+		result, err = channelsync.Import(r.Context(), m.DB, roomID, file)
+	} else if feedURL != "" {
+		client := &http.Client{Timeout: channelsync.FetchTimeout}
+		result, err = channelsync.Sync(r.Context(), m.DB, client, models.CalendarImport{RoomID: roomID, URL: feedURL})
+	} else {
+		m.App.Session.Put(r.Context(), "flash", "Calendar import saved")
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+
+	if result.LastStatus == models.SyncFailed {
+		m.App.Session.Put(r.Context(), "error", "Calendar sync failed: "+result.LastError)
+	} else if err != nil {
+		helpers.ServerError(w, err)
+		return
+	} else {
+		m.App.Session.Put(r.Context(), "flash", syncSummary(result))
+	}
+
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
+
+// syncSummary describes a successful calendar sync for staff
+func syncSummary(imp models.CalendarImport) string {
+	msg := fmt.Sprintf("Calendar synced: %d stays blocked", imp.EventsImported)
+	if imp.Conflicts > 0 {
+		msg += fmt.Sprintf(", %d clash with bookings already here", imp.Conflicts)
+	}
+	return msg
+}
+
+// AdminRoomRates shows the seasonal and weekday rates for a room
+func (m *Repository) AdminRoomRates(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "missing url parameter")
+		http.Redirect(w, r, "/admin/rooms", http.StatusSeeOther)
+		return
+	}
+
+	room, err := m.DB.GetRoomByID(r.Context(), id)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Can't find room")
+		http.Redirect(w, r, "/admin/rooms", http.StatusSeeOther)
+		return
+	}
+
+	rules, err := m.DB.GetRateRulesForRoom(r.Context(), id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	// one row per weekday, Sunday first, so days without an adjustment still get an input
+	weekdays := make([]models.RateAdjustment, 7)
+	for i := range weekdays {
+		weekdays[i].Weekday = time.Weekday(i)
+	}
+	for _, a := range rules.Adjustments {
+		weekdays[a.Weekday].Percent = a.Percent
+	}
+
+	data := make(map[string]interface{})
+	data["room"] = room
+	data["seasons"] = rules.Seasons
+	data["weekdays"] = weekdays
+
+	render.Template(w, r, "admin-room-rates.page.tmpl", &models.TemplateData{
+		Data: data,
+		Form: forms.New(nil),
+	})
+}
+
+// AdminPostRoomRates saves the weekday adjustments for a room and optionally adds a season
+func (m *Repository) AdminPostRoomRates(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "missing url parameter")
+		http.Redirect(w, r, "/admin/rooms", http.StatusSeeOther)
+		return
+	}
+
+	ratesURL := fmt.Sprintf("/admin/rooms/%d/rates", id)
+
+	var adjustments []models.RateAdjustment
+	for i := 0; i < 7; i++ {
+		value := strings.TrimSpace(r.Form.Get(fmt.Sprintf("weekday_%d", i)))
+		if value == "" {
+			continue
+		}
+		percent, err := strconv.Atoi(value)
+		if err != nil || percent <= -100 {
+			m.App.Session.Put(r.Context(), "error", fmt.Sprintf("Invalid adjustment for %s", time.Weekday(i)))
+			http.Redirect(w, r, ratesURL, http.StatusSeeOther)
+			return
+		}
+		adjustments = append(adjustments, models.RateAdjustment{
+			RoomID:  id,
+			Weekday: time.Weekday(i),
+			Percent: percent,
 		})
+	}
+
+	var before []models.RateAdjustment
+	if rules, err := m.DB.GetRateRulesForRoom(r.Context(), id); err == nil {
+		before = rules.Adjustments
+	}
+
+	err = m.DB.UpdateRateAdjustments(r.Context(), id, adjustments)
+	if err != nil {
+		log.Println(err)
+		m.App.Session.Put(r.Context(), "error", "Can't save weekday rates")
+		http.Redirect(w, r, ratesURL, http.StatusSeeOther)
+		return
+	}
+
+	m.audit(r, "update", "rate_adjustments", id, before, adjustments)
+
+	if r.Form.Get("season_name") != "" || r.Form.Get("season_start") != "" {
+		layout := "2006-01-02"
+		startDate, err := time.Parse(layout, r.Form.Get("season_start"))
+		if err != nil {
+			m.App.Session.Put(r.Context(), "error", "Invalid season start date")
+			http.Redirect(w, r, ratesURL, http.StatusSeeOther)
+			return
+		}
+		endDate, err := time.Parse(layout, r.Form.Get("season_end"))
+		if err != nil || endDate.Before(startDate) {
+			m.App.Session.Put(r.Context(), "error", "Invalid season end date")
+			http.Redirect(w, r, ratesURL, http.StatusSeeOther)
+			return
+		}
+		rate, err := helpers.ParseCents(r.Form.Get("season_rate"))
+		if err != nil {
+			m.App.Session.Put(r.Context(), "error", "Invalid season rate")
+			http.Redirect(w, r, ratesURL, http.StatusSeeOther)
+			return
+		}
+
+		season := models.RateSeason{
+			RoomID:      id,
+			Name:        strings.TrimSpace(r.Form.Get("season_name")),
+			StartDate:   startDate,
+			EndDate:     endDate,
+			NightlyRate: rate,
+		}
+		season.ID, err = m.DB.InsertRateSeason(r.Context(), season)
+		if err != nil {
+			log.Println(err)
+			m.App.Session.Put(r.Context(), "error", "Can't save season")
+			http.Redirect(w, r, ratesURL, http.StatusSeeOther)
+			return
+		}
+
+		m.audit(r, "create", "rate_season", season.ID, nil, season)
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Rates saved")
+	http.Redirect(w, r, ratesURL, http.StatusSeeOther)
+}
+
+// AdminDeleteRateSeason removes a seasonal rate from a room
+func (m *Repository) AdminDeleteRateSeason(w http.ResponseWriter, r *http.Request) {
+	roomID, _ := strconv.Atoi(chi.URLParam(r, "roomID"))
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	err := m.DB.DeleteRateSeason(r.Context(), id)
+	if err != nil {
+		log.Println(err)
+		m.App.Session.Put(r.Context(), "error", "Can't delete season")
+	} else {
+		m.audit(r, "delete", "rate_season", id, nil, nil)
+		m.App.Session.Put(r.Context(), "flash", "Season deleted")
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/admin/rooms/%d/rates", roomID), http.StatusSeeOther)
+}
+
+// AdminArchiveRoom takes a room out of service
+func (m *Repository) AdminArchiveRoom(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+	err := m.DB.ArchiveRoom(r.Context(), id)
+	if err != nil {
+		log.Println(err)
+		m.App.Session.Put(r.Context(), "error", "Can't archive room")
+		http.Redirect(w, r, "/admin/rooms", http.StatusSeeOther)
 		return
 	}
 
-	id, _, err := m.DB.Authenticate(email, password)
+	m.audit(r, "archive", "room", id, nil, nil)
+	m.App.Session.Put(r.Context(), "flash", "Room taken out of service")
+	http.Redirect(w, r, "/admin/rooms", http.StatusSeeOther)
+}
+
+// AdminRestoreRoom puts an archived room back into service
+func (m *Repository) AdminRestoreRoom(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+	err := m.DB.RestoreRoom(r.Context(), id)
 	if err != nil {
 		log.Println(err)
+		m.App.Session.Put(r.Context(), "error", "Can't restore room")
+		http.Redirect(w, r, "/admin/rooms", http.StatusSeeOther)
+		return
+	}
 
-		m.App.Session.Put(r.Context(), "error", "Invalid login credentials")
-		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+	m.audit(r, "restore", "room", id, nil, nil)
+	m.App.Session.Put(r.Context(), "flash", "Room back in service")
+	http.Redirect(w, r, "/admin/rooms", http.StatusSeeOther)
+}
+
+// AdminAPIKeys lists the keys partners use to call the API
+func (m *Repository) AdminAPIKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := m.DB.AllAPIKeys(r.Context())
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["keys"] = keys
+
+	render.Template(w, r, "admin-api-keys.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// AdminShowAPIKey shows the form to add (id 0) or edit an API key. Straight after a key is created
+// or rotated, it also shows the key itself, which can't be seen again
+func (m *Repository) AdminShowAPIKey(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "missing url parameter")
+		http.Redirect(w, r, "/admin/api-keys", http.StatusSeeOther)
+		return
+	}
+
+	key := models.APIKey{
+		Scopes:    []string{apikeys.ScopeAvailability},
+		RateLimit: apikeys.DefaultRateLimit,
+	}
+	if id > 0 {
+		key, err = m.DB.GetAPIKeyByID(r.Context(), id)
+		if err != nil {
+			m.App.Session.Put(r.Context(), "error", "Can't find API key")
+			http.Redirect(w, r, "/admin/api-keys", http.StatusSeeOther)
+			return
+		}
+	}
+
+	m.renderAPIKeyForm(w, r, key, m.App.Session.PopString(r.Context(), "new_api_key"), forms.New(nil))
+}
+
+// renderAPIKeyForm renders the add/edit API key form. newKey is the key just issued, if any
+func (m *Repository) renderAPIKeyForm(w http.ResponseWriter, r *http.Request, key models.APIKey, newKey string, form *forms.Form) {
+	stringMap := make(map[string]string)
+	stringMap["new_api_key"] = newKey
+	if len(key.Scopes) > 0 {
+		stringMap["scope"] = key.Scopes[0]
+	}
+
+	data := make(map[string]interface{})
+	data["key"] = key
+	data["scopes"] = apikeys.Scopes
+
+	render.Template(w, r, "admin-api-key-show.page.tmpl", &models.TemplateData{
+		StringMap: stringMap,
+		Data:      data,
+		Form:      form,
+	})
+}
+
+// AdminPostShowAPIKey creates a new API key (id 0) or changes an existing one's name, scope and
+// rate limit. A new key is shown once, on the page the admin is sent to
+func (m *Repository) AdminPostShowAPIKey(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	key := models.APIKey{
+		ID:     id,
+		Name:   strings.TrimSpace(r.Form.Get("name")),
+		Scopes: []string{r.Form.Get("scope")},
+	}
+	key.RateLimit, _ = strconv.Atoi(r.Form.Get("rate_limit"))
+
+	form := forms.New(r.PostForm)
+	form.Required("name", "scope", "rate_limit")
+	form.MinValue("rate_limit", 1)
+	if form.Has("scope") && !apikeys.ValidScope(r.Form.Get("scope")) {
+		form.Errors.Add("scope", "Pick one of the scopes")
+	}
+
+	var before models.APIKey
+	if id > 0 {
+		before, err = m.DB.GetAPIKeyByID(r.Context(), id)
+		if err != nil {
+			m.App.Session.Put(r.Context(), "error", "Can't find API key")
+			http.Redirect(w, r, "/admin/api-keys", http.StatusSeeOther)
+			return
+		}
+		key.Prefix = before.Prefix
+		key.LastUsedAt = before.LastUsedAt
+		key.RevokedAt = before.RevokedAt
+		key.CreatedAt = before.CreatedAt
+	}
+
+	if !form.Valid() {
+		m.renderAPIKeyForm(w, r, key, "", form)
+		return
+	}
+
+	if id > 0 {
+		err = m.DB.UpdateAPIKey(r.Context(), key)
+		if err == nil {
+			m.App.APILimiter.Reset(id)
+			m.audit(r, "update", "api_key", id, before, key)
+		}
+	} else {
+		var plain, hash string
+		plain, key.Prefix, hash, err = apikeys.Generate()
+		if err == nil {
+			key.ID, err = m.DB.InsertAPIKey(r.Context(), key, hash)
+		}
+		if err == nil {
+			m.audit(r, "create", "api_key", key.ID, nil, key)
+			m.App.Session.Put(r.Context(), "new_api_key", plain)
+		}
+	}
+	if err != nil {
+		log.Println(err)
+		m.App.Session.Put(r.Context(), "error", "Can't save API key")
+		http.Redirect(w, r, "/admin/api-keys", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "API key saved")
+	http.Redirect(w, r, fmt.Sprintf("/admin/api-keys/%d/show", key.ID), http.StatusSeeOther)
+}
+
+// AdminRotateAPIKey gives an API key a new value, keeping its name, scope and limit. The old value
+// stops working straight away
+func (m *Repository) AdminRotateAPIKey(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	plain, prefix, hash, err := apikeys.Generate()
+	if err == nil {
+		err = m.DB.RotateAPIKey(r.Context(), id, prefix, hash)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		m.App.Session.Put(r.Context(), "error", "Only a key that hasn't been revoked can be rotated")
+		http.Redirect(w, r, "/admin/api-keys", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		m.App.Session.Put(r.Context(), "error", "Can't rotate API key")
+		http.Redirect(w, r, "/admin/api-keys", http.StatusSeeOther)
+		return
+	}
+
+	m.App.APILimiter.Reset(id)
+	m.audit(r, "rotate", "api_key", id, nil, nil)
+	m.App.Session.Put(r.Context(), "new_api_key", plain)
+	m.App.Session.Put(r.Context(), "flash", "API key rotated")
+	http.Redirect(w, r, fmt.Sprintf("/admin/api-keys/%d/show", id), http.StatusSeeOther)
+}
+
+// AdminRevokeAPIKey stops an API key working for good
+func (m *Repository) AdminRevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+	err := m.DB.RevokeAPIKey(r.Context(), id)
+	if err != nil {
+		log.Println(err)
+		m.App.Session.Put(r.Context(), "error", "Can't revoke API key")
+	} else {
+		m.audit(r, "revoke", "api_key", id, nil, nil)
+		m.App.Session.Put(r.Context(), "flash", "API key revoked")
+	}
+
+	http.Redirect(w, r, "/admin/api-keys", http.StatusSeeOther)
+}
+
+// AdminWebhooks lists the outside systems that are sent booking events
+func (m *Repository) AdminWebhooks(w http.ResponseWriter, r *http.Request) {
+	subs, err := m.DB.AllWebhookSubscriptions(r.Context())
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["subscriptions"] = subs
+
+	render.Template(w, r, "admin-webhooks.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// AdminShowWebhook shows the form to add (id 0) or edit a webhook subscription
+func (m *Repository) AdminShowWebhook(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "missing url parameter")
+		http.Redirect(w, r, "/admin/webhooks", http.StatusSeeOther)
+		return
+	}
+
+	sub := models.WebhookSubscription{Active: true}
+	if id > 0 {
+		sub, err = m.DB.GetWebhookSubscriptionByID(r.Context(), id)
+		if err != nil {
+			m.App.Session.Put(r.Context(), "error", "Can't find webhook")
+			http.Redirect(w, r, "/admin/webhooks", http.StatusSeeOther)
+			return
+		}
+	}
+
+	renderWebhookForm(w, r, sub, forms.New(nil))
+}
+
+// renderWebhookForm renders the add/edit webhook subscription form
+func renderWebhookForm(w http.ResponseWriter, r *http.Request, sub models.WebhookSubscription, form *forms.Form) {
+	subscribed := make(map[string]bool)
+	for _, e := range sub.Events {
+		subscribed[e] = true
+	}
+
+	data := make(map[string]interface{})
+	data["subscription"] = sub
+	data["events"] = webhooks.Events
+	data["subscribed"] = subscribed
+
+	render.Template(w, r, "admin-webhook-show.page.tmpl", &models.TemplateData{
+		Data: data,
+		Form: form,
+	})
+}
+
+// withoutSecret is sub as it is written to the audit log, which has no need of the signing secret
+func withoutSecret(sub models.WebhookSubscription) models.WebhookSubscription {
+	sub.Secret = ""
+	return sub
+}
+
+// AdminPostShowWebhook creates a new webhook subscription (id 0), with a new signing secret, or
+// changes an existing one's address, events and whether it is active
+func (m *Repository) AdminPostShowWebhook(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	sub := models.WebhookSubscription{
+		ID:     id,
+		URL:    strings.TrimSpace(r.Form.Get("url")),
+		Events: r.Form["events"],
+		Active: r.Form.Get("active") == "1",
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("url")
+	if form.Has("url") {
+		u, err := url.Parse(sub.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			form.Errors.Add("url", "The address must be an http or https URL")
+		}
+	}
+	if len(sub.Events) == 0 {
+		form.Errors.Add("events", "Pick at least one event")
+	}
+	for _, e := range sub.Events {
+		if !webhooks.ValidEvent(e) {
+			form.Errors.Add("events", "Pick from the events listed")
+			break
+		}
+	}
+
+	var before models.WebhookSubscription
+	if id > 0 {
+		before, err = m.DB.GetWebhookSubscriptionByID(r.Context(), id)
+		if err != nil {
+			m.App.Session.Put(r.Context(), "error", "Can't find webhook")
+			http.Redirect(w, r, "/admin/webhooks", http.StatusSeeOther)
+			return
+		}
+		sub.Secret = before.Secret
+	}
+
+	if !form.Valid() {
+		renderWebhookForm(w, r, sub, form)
+		return
+	}
+
+	if id > 0 {
+		err = m.DB.UpdateWebhookSubscription(r.Context(), sub)
+		if err == nil {
+			m.audit(r, "update", "webhook_subscription", id, withoutSecret(before), withoutSecret(sub))
+		}
+	} else {
+		sub.Secret, err = webhooks.NewSecret()
+		if err == nil {
+			sub.ID, err = m.DB.InsertWebhookSubscription(r.Context(), sub)
+		}
+		if err == nil {
+			m.audit(r, "create", "webhook_subscription", sub.ID, nil, withoutSecret(sub))
+		}
+	}
+	if err != nil {
+		log.Println(err)
+		m.App.Session.Put(r.Context(), "error", "Can't save webhook")
+		http.Redirect(w, r, "/admin/webhooks", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Webhook saved")
+	http.Redirect(w, r, fmt.Sprintf("/admin/webhooks/%d/show", sub.ID), http.StatusSeeOther)
+}
+
+// AdminDeleteWebhook deletes a webhook subscription and its delivery log
+func (m *Repository) AdminDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+	before, _ := m.DB.GetWebhookSubscriptionByID(r.Context(), id)
+	err := m.DB.DeleteWebhookSubscription(r.Context(), id)
+	if err != nil {
+		log.Println(err)
+		m.App.Session.Put(r.Context(), "error", "Can't delete webhook")
+	} else {
+		m.audit(r, "delete", "webhook_subscription", id, withoutSecret(before), nil)
+		m.App.Session.Put(r.Context(), "flash", "Webhook deleted")
+	}
+
+	http.Redirect(w, r, "/admin/webhooks", http.StatusSeeOther)
+}
+
+// webhookLogSize is how many of a subscription's latest deliveries its delivery log shows
+const webhookLogSize = 100
+
+// AdminWebhookDeliveries shows a subscription's latest deliveries and how each went
+func (m *Repository) AdminWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	sub, err := m.DB.GetWebhookSubscriptionByID(r.Context(), id)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Can't find webhook")
+		http.Redirect(w, r, "/admin/webhooks", http.StatusSeeOther)
+		return
+	}
+
+	deliveries, err := m.DB.WebhookDeliveries(r.Context(), id, webhookLogSize)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["subscription"] = sub
+	data["deliveries"] = deliveries
+
+	render.Template(w, r, "admin-webhook-deliveries.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// AdminRedeliverWebhook sends a delivery again straight away, whether it went through before or
+// not, and says how it went
+func (m *Repository) AdminRedeliverWebhook(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	d, err := m.DB.GetWebhookDeliveryByID(r.Context(), id)
+	if err != nil {
+		log.Println(err)
+		m.App.Session.Put(r.Context(), "error", "Can't find delivery")
+		http.Redirect(w, r, "/admin/webhooks", http.StatusSeeOther)
 		return
 	}
 
-	m.App.Session.Put(r.Context(), "user_id", id)
-	m.App.Session.Put(r.Context(), "flash", "Logged in successfully")
-	http.Redirect(w, r, "/", http.StatusSeeOther)
-}
-
-// Logout clears the session and redirects the user to the home page
-func (m *Repository) Logout(w http.ResponseWriter, r *http.Request) {
-	_ = m.App.Session.Destroy(r.Context())
-	_ = m.App.Session.RenewToken(r.Context())
+	client := &http.Client{Timeout: webhooks.Timeout}
+	d, err = webhooks.Deliver(r.Context(), m.DB, client, d, time.Now())
+	switch {
+	case err != nil:
+		log.Println(err)
+		m.App.Session.Put(r.Context(), "error", "Can't record the redelivery")
+	case d.Status == models.DeliveryDelivered:
+		m.App.Session.Put(r.Context(), "flash", "Delivery sent")
+	default:
+		m.App.Session.Put(r.Context(), "error", "Redelivery failed: "+d.LastError)
+	}
 
-	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+	http.Redirect(w, r, fmt.Sprintf("/admin/webhooks/%d/deliveries", d.SubscriptionID), http.StatusSeeOther)
 }
 
-// AdminDashBoard shows the admin dashboard
-func (m *Repository) AdminDashBoard(w http.ResponseWriter, r *http.Request) {
-	render.Template(w, r, "admin-dashboard.page.tmpl", &models.TemplateData{})
-}
+// outboxPageSize is how many of the latest messages the outbox page shows
+const outboxPageSize = 200
 
-// AdminNewReservations shows all new reservations on the admin dashboard
-func (m *Repository) AdminNewReservations(w http.ResponseWriter, r *http.Request) {
-	reservations, err := m.DB.AllNewReservations()
+// AdminOutbox lists the latest emails in the outbox, filtered by the status query parameter
+func (m *Repository) AdminOutbox(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status != models.MailPending && status != models.MailSent && status != models.MailDead {
+		status = ""
+	}
+
+	msgs, err := m.DB.OutboxMessages(r.Context(), status, outboxPageSize)
 	if err != nil {
-		m.App.Session.Put(r.Context(), "error", "Can't get all new reservations")
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		helpers.ServerError(w, err)
 		return
 	}
 
+	stringMap := make(map[string]string)
+	stringMap["status"] = status
+
 	data := make(map[string]interface{})
-	data["reservations"] = reservations
+	data["messages"] = msgs
+	data["statuses"] = []string{models.MailPending, models.MailSent, models.MailDead}
 
-	render.Template(w, r, "admin-new-reservations.page.tmpl", &models.TemplateData{
-		Data: data,
+	render.Template(w, r, "admin-outbox.page.tmpl", &models.TemplateData{
+		StringMap: stringMap,
+		Data:      data,
 	})
 }
 
-// AdminAllReservations shows all reservations on the admin dashboard
-func (m *Repository) AdminAllReservations(w http.ResponseWriter, r *http.Request) {
-	reservations, err := m.DB.AllReservations()
+// AdminShowOutboxMessage shows one email in the outbox and how sending it has gone
+func (m *Repository) AdminShowOutboxMessage(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	msg, err := m.DB.GetOutboxMessageByID(r.Context(), id)
 	if err != nil {
-		m.App.Session.Put(r.Context(), "error", "Can't get all reservations")
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		m.App.Session.Put(r.Context(), "error", "Can't find email")
+		http.Redirect(w, r, "/admin/outbox", http.StatusSeeOther)
 		return
 	}
 
 	data := make(map[string]interface{})
-	data["reservations"] = reservations
+	data["message"] = msg
 
-	render.Template(w, r, "admin-all-reservations.page.tmpl", &models.TemplateData{
+	render.Template(w, r, "admin-outbox-show.page.tmpl", &models.TemplateData{
 		Data: data,
 	})
 }
 
-// AdminShowReservation shows the reservation on the admin dashboard
-func (m *Repository) AdminShowReservation(w http.ResponseWriter, r *http.Request) {
-	// get the URL parameters
-	exploded := strings.Split(r.RequestURI, "/")
-	id, err := strconv.Atoi(exploded[4])
+// AdminResendOutboxMessage puts a dead email back in the outbox to be sent again
+func (m *Repository) AdminResendOutboxMessage(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	err := m.DB.ResendOutboxMessage(r.Context(), id)
 	if err != nil {
-		m.App.Session.Put(r.Context(), "error", "missing url parameter")
-		http.Redirect(w, r, "/", http.StatusSeeOther)
-		return
+		log.Println(err)
+		m.App.Session.Put(r.Context(), "error", "Only emails that have given up can be resent")
+	} else {
+		m.audit(r, "resend", "outbox_message", id, map[string]interface{}{"Status": models.MailDead},
+			map[string]interface{}{"Status": models.MailPending})
+		m.App.Session.Put(r.Context(), "flash", "Email queued to be sent again")
 	}
 
-	src := exploded[3]
-	stringMap := make(map[string]string)
-	stringMap["src"] = src
-
-	year := r.URL.Query().Get("y")
-	month := r.URL.Query().Get("m")
-
-	stringMap["year"] = year
-	stringMap["month"] = month
+	http.Redirect(w, r, fmt.Sprintf("/admin/outbox/%d/show", id), http.StatusSeeOther)
+}
 
-	// get reservation from the database
-	res, err := m.DB.GetReservationByID(id)
+// AdminEmailTemplates lists the email events and the version of each one's template in use
+func (m *Repository) AdminEmailTemplates(w http.ResponseWriter, r *http.Request) {
+	saved, err := m.DB.CurrentEmailTemplates(r.Context())
 	if err != nil {
-		m.App.Session.Put(r.Context(), "error", "Can't find reservation")
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		helpers.ServerError(w, err)
 		return
 	}
 
+	current := make(map[string]models.EmailTemplate)
+	for _, t := range saved {
+		current[t.Event] = t
+	}
+
 	data := make(map[string]interface{})
-	data["reservation"] = res
+	data["events"] = emails.Events
+	data["current"] = current
 
-	render.Template(w, r, "admin-reservation-show.page.tmpl", &models.TemplateData{
-		StringMap: stringMap,
-		Data:      data,
-		Form:      forms.New(nil),
+	render.Template(w, r, "admin-email-templates.page.tmpl", &models.TemplateData{
+		Data: data,
 	})
 }
 
-// AdminPostShowReservation updates a reservation on the admin dashboard
-func (m *Repository) AdminPostShowReservation(w http.ResponseWriter, r *http.Request) {
-	err := r.ParseForm()
-	if err != nil {
-		m.App.Session.Put(r.Context(), "error", "Can't parse form")
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+// AdminShowEmailTemplate shows the editor for an event's email template, with its version history
+func (m *Repository) AdminShowEmailTemplate(w http.ResponseWriter, r *http.Request) {
+	event := chi.URLParam(r, "event")
+	if !emails.ValidEvent(event) {
+		m.App.Session.Put(r.Context(), "error", "Can't find email template")
+		http.Redirect(w, r, "/admin/email-templates", http.StatusSeeOther)
 		return
 	}
 
-	exploded := strings.Split(r.RequestURI, "/")
-	id, err := strconv.Atoi(exploded[4])
+	current, err := emails.Current(r.Context(), m.DB, m.App.EmailTemplateDir, event)
 	if err != nil {
 		helpers.ServerError(w, err)
 		return
 	}
 
-	src := exploded[3]
-
-	stringMap := make(map[string]string)
-	stringMap["src"] = src
+	m.renderEmailTemplateForm(w, r, current, forms.New(nil))
+}
 
-	res, err := m.DB.GetReservationByID(id)
+// renderEmailTemplateForm renders the email template editor for tmpl, which may hold unsaved changes
+func (m *Repository) renderEmailTemplateForm(w http.ResponseWriter, r *http.Request, tmpl models.EmailTemplate, form *forms.Form) {
+	versions, err := m.DB.EmailTemplateVersions(r.Context(), tmpl.Event)
 	if err != nil {
 		helpers.ServerError(w, err)
 		return
 	}
 
-	// update the reservation
-	res.FirstName = r.Form.Get("first_name")
-	res.LastName = r.Form.Get("last_name")
-	res.Email = r.Form.Get("email")
-	res.Phone = r.Form.Get("phone")
+	data := make(map[string]interface{})
+	data["template"] = tmpl
+	data["versions"] = versions
+
+	render.Template(w, r, "admin-email-template-show.page.tmpl", &models.TemplateData{
+		Data: data,
+		Form: form,
+	})
+}
 
-	err = m.DB.UpdateReservation(res)
+// AdminPostShowEmailTemplate saves the edited source as the newest version of an event's email
+// template, or, when action is "test", emails it rendered for the preview reservation to the
+// signed in user without saving it. Either way it must render with sample data first. A save is
+// refused if another version has been saved since the posted one was loaded
+func (m *Repository) AdminPostShowEmailTemplate(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
 	if err != nil {
 		helpers.ServerError(w, err)
 		return
 	}
 
-	month := r.Form.Get("month")
-	year := r.Form.Get("year")
-
-	m.App.Session.Put(r.Context(), "flash", "Changes saved")
+	event := chi.URLParam(r, "event")
+	if !emails.ValidEvent(event) {
+		m.App.Session.Put(r.Context(), "error", "Can't find email template")
+		http.Redirect(w, r, "/admin/email-templates", http.StatusSeeOther)
+		return
+	}
 
-	if year == "" {
-		http.Redirect(w, r, fmt.Sprintf("/admin/reservations-%s", src), http.StatusSeeOther)
-	} else {
-		http.Redirect(w, r, fmt.Sprintf("/admin/reservations-calendar?y=%s&m=%s", year, month), http.StatusSeeOther)
+	current, err := emails.Current(r.Context(), m.DB, m.App.EmailTemplateDir, event)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
 	}
-}
 
-// AdminReservationsCalendar shows the reservation calendar on the admin dashboard
-func (m *Repository) AdminReservationsCalendar(w http.ResponseWriter, r *http.Request) {
-	// assume that there is no month/year specified
-	now := time.Now()
+	tmpl := models.EmailTemplate{
+		Event:  event,
+		Source: r.Form.Get("source"),
+		Note:   strings.TrimSpace(r.Form.Get("note")),
+		UserID: m.App.Session.GetInt(r.Context(), "user_id"),
+	}
+	tmpl.Version, _ = strconv.Atoi(r.Form.Get("version"))
 
-	if r.URL.Query().Get("y") != "" {
-		year, err := strconv.Atoi(r.URL.Query().Get("y"))
-		if err != nil {
-			helpers.ServerError(w, err)
-			return
+	form := forms.New(r.PostForm)
+	form.Required("source")
+	if form.Has("source") {
+		if err := emails.Check(m.App.EmailTemplateDir, event, tmpl.Source); err != nil {
+			form.Errors.Add("source", err.Error())
 		}
+	}
+	if r.Form.Get("action") != "test" && tmpl.Version != current.Version {
+		form.Errors.Add("source", errNewerEmailTemplate)
+	}
 
-		month, err := strconv.Atoi(r.URL.Query().Get("m"))
+	if !form.Valid() {
+		m.renderEmailTemplateForm(w, r, tmpl, form)
+		return
+	}
+
+	if r.Form.Get("action") == "test" {
+		to, err := m.sendTestEmail(r, tmpl)
 		if err != nil {
-			helpers.ServerError(w, err)
-			return
+			log.Println(err)
+			m.App.Session.Put(r.Context(), "error", "Can't send test email: "+err.Error())
+		} else {
+			m.App.Session.Put(r.Context(), "flash", "Test email queued to "+to)
 		}
-
-		now = time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC)
+		m.renderEmailTemplateForm(w, r, tmpl, form)
+		return
 	}
 
-	data := make(map[string]interface{})
-	data["now"] = now
-
-	next := now.AddDate(0, 1, 0)
-	last := now.AddDate(0, -1, 0)
+	id, err := m.DB.InsertEmailTemplate(r.Context(), tmpl)
+	if errors.Is(err, repository.ErrTemplateChanged) {
+		form.Errors.Add("source", errNewerEmailTemplate)
+		m.renderEmailTemplateForm(w, r, tmpl, form)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		m.App.Session.Put(r.Context(), "error", "Can't save email template")
+		m.renderEmailTemplateForm(w, r, tmpl, form)
+		return
+	}
 
-	nextMonth := next.Format("01")
-	nextMonthYear := next.Format("2006")
+	tmpl.Version++
+	m.audit(r, "update", "email_template", id, current, tmpl)
+	m.App.Session.Put(r.Context(), "flash", "Email template saved")
+	http.Redirect(w, r, fmt.Sprintf("/admin/email-templates/%s/show", event), http.StatusSeeOther)
+}
 
-	lastMonth := last.Format("01")
-	lastMonthYear := last.Format("2006")
+// errNewerEmailTemplate is the form error for saving an email template that had another version
+// saved while it was being edited
+const errNewerEmailTemplate = "A newer version was saved while you were editing. Reload the page to see it, then make your changes again"
+
+// emailPreview is the JSON response of AdminPreviewEmailTemplate
+type emailPreview struct {
+	OK      bool   `json:"ok"`
+	Subject string `json:"subject"`
+	HTML    string `json:"html"`
+	Text    string `json:"text"`
+	Error   string `json:"error"`
+}
 
-	stringMap := make(map[string]string)
-	stringMap["next_month"] = nextMonth
-	stringMap["next_month_year"] = nextMonthYear
-	stringMap["last_month"] = lastMonth
-	stringMap["last_month_year"] = lastMonthYear
+// AdminPreviewEmailTemplate renders the posted, unsaved, source of an event's email template for
+// the reservation_id reservation, or a sample one, and sends back the email as JSON
+func (m *Repository) AdminPreviewEmailTemplate(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, emailPreview{Error: "Can't read the form"})
+		return
+	}
 
-	stringMap["this_month"] = now.Format("01")
-	stringMap["this_month_year"] = now.Format("2006")
+	event := chi.URLParam(r, "event")
+	if !emails.ValidEvent(event) {
+		writeJSON(w, http.StatusNotFound, emailPreview{Error: "Can't find email template"})
+		return
+	}
 
-	// get the first and last day of the month
-	currentYear, currentMonth, _ := now.Date()
-	currentLocation := now.Location()
-	firstOfMonth := time.Date(currentYear, currentMonth, 1, 0, 0, 0, 0, currentLocation)
-	lastOfMonth := firstOfMonth.AddDate(0, 1, -1)
+	msg, err := m.previewEmail(r, models.EmailTemplate{Event: event, Source: r.Form.Get("source")})
+	if err != nil {
+		writeJSON(w, http.StatusOK, emailPreview{Error: err.Error()})
+		return
+	}
 
-	intMap := make(map[string]int)
-	intMap["days_in_month"] = lastOfMonth.Day()
+	writeJSON(w, http.StatusOK, emailPreview{
+		OK:      true,
+		Subject: msg.Subject,
+		HTML:    msg.Content,
+		Text:    msg.Text,
+	})
+}
 
-	rooms, err := m.DB.AllRooms()
+// previewEmail renders tmpl's source for the reservation in the reservation_id form field, or for
+// a sample reservation if there is none
+func (m *Repository) previewEmail(r *http.Request, tmpl models.EmailTemplate) (models.MailData, error) {
+	t, err := emails.Parse(m.App.EmailTemplateDir, tmpl.Event, tmpl.Source)
 	if err != nil {
-		helpers.ServerError(w, err)
+		return models.MailData{}, err
 	}
 
-	data["rooms"] = rooms
-
-	for _, x := range rooms {
-		// create maps
-		blockMap := make(map[string]int)
-		reservationMap := make(map[string]int)
+	res := emails.SampleReservation()
+	link := m.App.BaseURL + "/my-reservation?t=sample"
 
-		for d := firstOfMonth; !d.After(lastOfMonth); d = d.AddDate(0, 0, 1) {
-			blockMap[d.Format("2006-01-2")] = 0
-			reservationMap[d.Format("2006-01-2")] = 0
+	if id := r.Form.Get("reservation_id"); strings.TrimSpace(id) != "" {
+		resID, err := strconv.Atoi(strings.TrimSpace(id))
+		if err != nil {
+			return models.MailData{}, errors.New("the reservation must be a number")
 		}
-
-		// get all restrictions for the current room
-		roomRestrictions, err := m.DB.GetRestrictionsForRoomByDate(x.ID, firstOfMonth, lastOfMonth)
+		res, err = m.DB.GetReservationByID(r.Context(), resID)
 		if err != nil {
-			helpers.ServerError(w, err)
-			return
+			return models.MailData{}, fmt.Errorf("can't find reservation %d", resID)
 		}
+		link = m.guestLink(res)
+	}
 
-		for _, y := range roomRestrictions {
-			if y.ReservationID > 0 {
-				for d := y.StartDate; !d.After(y.EndDate); d = d.AddDate(0, 0, 1) {
-					reservationMap[d.Format("2006-01-2")] = y.ReservationID
-				}
-			} else {
-				blockMap[y.StartDate.Format("2006-01-2")] = y.ID
-			}
-		}
-		data[fmt.Sprintf("block_map_%d", x.ID)] = blockMap
-		data[fmt.Sprintf("reservation_map_%d", x.ID)] = reservationMap
+	return emails.Render(t, emails.Data(tmpl.Event, res, link))
+}
+
+// sendTestEmail queues tmpl, rendered as previewEmail does, to the signed in user, and returns
+// where it went
+func (m *Repository) sendTestEmail(r *http.Request, tmpl models.EmailTemplate) (string, error) {
+	u, err := m.DB.GetUserByID(r.Context(), m.App.Session.GetInt(r.Context(), "user_id"))
+	if err != nil {
+		return "", fmt.Errorf("can't find your account: %w", err)
+	}
 
-		m.App.Session.Put(r.Context(), fmt.Sprintf("block_map_%d", x.ID), blockMap)
+	msg, err := m.previewEmail(r, tmpl)
+	if err != nil {
+		return "", err
 	}
+	msg.To = u.Email
+	msg.From = "me@here.com"
+	msg.Subject = "[Test] " + msg.Subject
 
-	render.Template(w, r, "admin-reservations-calendar.page.tmpl", &models.TemplateData{
-		StringMap: stringMap,
-		Data:      data,
-		IntMap:    intMap,
-	})
+	return u.Email, m.DB.QueueMail(r.Context(), msg)
 }
 
-// AdminProcessReservation marks a reservation as processed
-func (m *Repository) AdminProcessReservation(w http.ResponseWriter, r *http.Request) {
+// AdminRollbackEmailTemplate saves an old version of an email template again as its newest, as
+// long as it still renders
+func (m *Repository) AdminRollbackEmailTemplate(w http.ResponseWriter, r *http.Request) {
 	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
-	src := chi.URLParam(r, "src")
-	err := m.DB.UpdateProcessedForReservation(id, 1)
+
+	old, err := m.DB.GetEmailTemplateByID(r.Context(), id)
 	if err != nil {
 		log.Println(err)
+		m.App.Session.Put(r.Context(), "error", "Can't find that version")
+		http.Redirect(w, r, "/admin/email-templates", http.StatusSeeOther)
+		return
 	}
 
-	year := r.URL.Query().Get("y")
-	month := r.URL.Query().Get("m")
+	showURL := fmt.Sprintf("/admin/email-templates/%s/show", old.Event)
 
-	m.App.Session.Put(r.Context(), "flash", "Reservation marked as processed")
-
-	if year == "" {
-		http.Redirect(w, r, "/admin/reservations-"+src, http.StatusSeeOther)
-	} else {
-		http.Redirect(w, r, fmt.Sprintf("/admin/reservations-calendar?y=%s&m=%s", year, month), http.StatusSeeOther)
+	err = emails.Check(m.App.EmailTemplateDir, old.Event, old.Source)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", fmt.Sprintf("Version %d no longer renders: %s", old.Version, err))
+		http.Redirect(w, r, showURL, http.StatusSeeOther)
+		return
 	}
-}
-
-// AdminDeleteReservation deletes a reservation
-func (m *Repository) AdminDeleteReservation(w http.ResponseWriter, r *http.Request) {
-	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
-	src := chi.URLParam(r, "src")
-	_ = m.DB.DeleteReservation(id)
 
-	year := r.URL.Query().Get("y")
-	month := r.URL.Query().Get("m")
+	current, err := emails.Current(r.Context(), m.DB, m.App.EmailTemplateDir, old.Event)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
 
-	m.App.Session.Put(r.Context(), "flash", "Reservation deleted")
+	tmpl := models.EmailTemplate{
+		Event:   old.Event,
+		Version: current.Version,
+		Source:  old.Source,
+		Note:    fmt.Sprintf("Rolled back to version %d", old.Version),
+		UserID:  m.App.Session.GetInt(r.Context(), "user_id"),
+	}
 
-	if year == "" {
-		http.Redirect(w, r, "/admin/reservations-"+src, http.StatusSeeOther)
+	newID, err := m.DB.InsertEmailTemplate(r.Context(), tmpl)
+	if errors.Is(err, repository.ErrTemplateChanged) {
+		m.App.Session.Put(r.Context(), "error", "Another version was saved at the same time, please try again")
+	} else if err != nil {
+		log.Println(err)
+		m.App.Session.Put(r.Context(), "error", "Can't roll back email template")
 	} else {
-		http.Redirect(w, r, fmt.Sprintf("/admin/reservations-calendar?y=%s&m=%s", year, month), http.StatusSeeOther)
+		m.audit(r, "rollback", "email_template", newID, current, tmpl)
+		m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("Rolled back to version %d", old.Version))
 	}
 
+	http.Redirect(w, r, showURL, http.StatusSeeOther)
 }
 
-// AdminPostReservationsCalendar handles post of reservation calendar
-func (m *Repository) AdminPostReservationsCalendar(w http.ResponseWriter, r *http.Request) {
-	err := r.ParseForm()
+// AdminAudit shows the audit log, filtered by the user, entity, from and to query parameters
+func (m *Repository) AdminAudit(w http.ResponseWriter, r *http.Request) {
+	layout := "2006-01-02"
+	query := r.URL.Query()
+	stringMap := make(map[string]string)
+
+	var filter models.AuditFilter
+	filter.UserID, _ = strconv.Atoi(query.Get("user_id"))
+	filter.EntityType = query.Get("entity")
+	stringMap["user_id"] = query.Get("user_id")
+	stringMap["entity"] = filter.EntityType
+
+	if from, err := time.Parse(layout, query.Get("from")); err == nil {
+		filter.From = from
+		stringMap["from"] = query.Get("from")
+	}
+	// the to date is inclusive, so match everything before the next morning
+	if to, err := time.Parse(layout, query.Get("to")); err == nil {
+		filter.To = to.AddDate(0, 0, 1)
+		stringMap["to"] = query.Get("to")
+	}
+
+	entries, err := m.DB.AuditEntries(r.Context(), filter)
 	if err != nil {
 		helpers.ServerError(w, err)
 		return
 	}
 
-	year, _ := strconv.Atoi(r.Form.Get("y"))
-	month, _ := strconv.Atoi(r.Form.Get("m"))
-
-	// process blocks
-	rooms, err := m.DB.AllRooms()
+	users, err := m.DB.ListUsers(r.Context())
 	if err != nil {
 		helpers.ServerError(w, err)
 		return
 	}
 
-	form := forms.New(r.PostForm)
-
-	for _, x := range rooms {
-		// Get the block map from the session. Loop through entire map, if we have an entry in the map that is not in our posted data, and if the restriction id > 0, then it is a block we need to remove
-		curMap := m.App.Session.Get(r.Context(), fmt.Sprintf("block_map_%d", x.ID)).(map[string]int)
-		for name, value := range curMap {
-			// ok will be false if the value is not in the map
-			if val, ok := curMap[name]; ok {
-				// only pay attention to values > 0, and that are not in the form post
-				// the rest are just placeholders for days without blocks
-				if val > 0 {
-					if !form.Has(fmt.Sprintf("remove_block_%d_%s", x.ID, name)) {
-						// delete the restriction by id
-						err := m.DB.DeleteBlockByID(value)
-						if err != nil {
-							log.Println(err)
-						}
-					}
-				}
-			}
-		}
-	}
-
-	// now handle new blocks
-	for name := range r.PostForm {
-		if strings.HasPrefix(name, "add_block") {
-			exploded := strings.Split(name, "_")
-			roomID, _ := strconv.Atoi(exploded[2])
-			t, _ := time.Parse("2006-01-2", exploded[3])
-			// insert a new block
-			err := m.DB.InsertBlockForRoom(roomID, t)
-			if err != nil {
-				log.Println(err)
-			}
-		}
-	}
-
-	m.App.Session.Put(r.Context(), "flash", "Changes saved")
-	http.Redirect(w, r, fmt.Sprintf("/admin/reservations-calendar?y=%d&m=%d", year, month), http.StatusSeeOther)
+	data := make(map[string]interface{})
+	data["entries"] = entries
+	data["users"] = users
+	data["entities"] = []string{"reservation", "block", "room", "restriction", "rate_adjustments", "rate_season", "cancellation_policy",
+		"waitlist_entry", "calendar_import", "api_key", "webhook_subscription", "outbox_message", "email_template"}
 
+	render.Template(w, r, "admin-audit.page.tmpl", &models.TemplateData{
+		StringMap: stringMap,
+		Data:      data,
+	})
 }
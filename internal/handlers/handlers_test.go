@@ -1,10 +1,14 @@
 package handlers
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -13,8 +17,13 @@ import (
 	"testing"
 	"time"
 
+	"github.com/go-chi/chi"
+	"github.com/msaufi2325/06_bookings/internal/apikeys"
 	"github.com/msaufi2325/06_bookings/internal/driver"
+	"github.com/msaufi2325/06_bookings/internal/emails"
 	"github.com/msaufi2325/06_bookings/internal/models"
+	"github.com/msaufi2325/06_bookings/internal/payments"
+	"github.com/msaufi2325/06_bookings/internal/signedlink"
 )
 
 type postData struct {
@@ -30,8 +39,11 @@ var theTests = []struct {
 }{
 	{"home", "/", "GET", http.StatusOK},
 	{"about", "/about", "GET", http.StatusOK},
-	{"gq", "/generals-quarters", "GET", http.StatusOK},
-	{"ms", "/majors-suite", "GET", http.StatusOK},
+	{"rooms", "/rooms", "GET", http.StatusOK},
+	{"gq", "/rooms/generals-quarters", "GET", http.StatusOK},
+	{"ms", "/rooms/majors-suite", "GET", http.StatusOK},
+	{"archived room", "/rooms/old-barn", "GET", http.StatusNotFound},
+	{"non-existent room", "/rooms/green-eggs", "GET", http.StatusNotFound},
 	{"sa", "/search-availability", "GET", http.StatusOK},
 	{"contact", "/contact", "GET", http.StatusOK},
 	{"non-existent", "/green/eggs/and/ham", "GET", http.StatusNotFound},
@@ -44,6 +56,44 @@ var theTests = []struct {
 	{"show res", "/admin/reservations/new/1/show", "GET", http.StatusOK},
 	{"show res cal", "/admin/reservations-calendar", "GET", http.StatusOK},
 	{"show res cal with params", "/admin/reservations-calendar?y=2050&m=1", "GET", http.StatusOK},
+	{"admin new block", "/admin/blocks/0/show?room_id=1&start=2050-01-05", "GET", http.StatusOK},
+	{"admin show block", "/admin/blocks/1/show", "GET", http.StatusOK},
+	{"admin delete block", "/admin/delete-block/1/do?y=2050&m=01", "GET", http.StatusOK},
+	{"admin restrictions", "/admin/restrictions", "GET", http.StatusOK},
+	{"admin deleted reservations", "/admin/reservations-deleted", "GET", http.StatusOK},
+	{"admin new restriction", "/admin/restrictions/0/show", "GET", http.StatusOK},
+	{"admin show restriction", "/admin/restrictions/2/show", "GET", http.StatusOK},
+	{"admin rooms", "/admin/rooms", "GET", http.StatusOK},
+	{"admin new room", "/admin/rooms/0/show", "GET", http.StatusOK},
+	{"admin show room", "/admin/rooms/1/show", "GET", http.StatusOK},
+	{"admin room rates", "/admin/rooms/1/rates", "GET", http.StatusOK},
+	{"admin audit", "/admin/audit", "GET", http.StatusOK},
+	{"admin cancellation policies", "/admin/cancellation-policies", "GET", http.StatusOK},
+	{"admin new cancellation policy", "/admin/cancellation-policies/0/show", "GET", http.StatusOK},
+	{"admin show cancellation policy", "/admin/cancellation-policies/1/show", "GET", http.StatusOK},
+	{"admin delete cancellation policy", "/admin/delete-cancellation-policy/1/do", "GET", http.StatusOK},
+	{"admin audit filtered", "/admin/audit?user_id=1&entity=reservation&from=2050-01-01&to=2050-01-31", "GET", http.StatusOK},
+	{"admin audit other entity", "/admin/audit?entity=room", "GET", http.StatusOK},
+	{"show res with payments", "/admin/reservations/all/5/show", "GET", http.StatusOK},
+	{"waitlist", "/waitlist", "GET", http.StatusOK},
+	{"waitlist with dates", "/waitlist?start=2050-01-01&end=2050-01-02", "GET", http.StatusOK},
+	{"admin waitlist", "/admin/waitlist", "GET", http.StatusOK},
+	{"admin delete waitlist entry", "/admin/delete-waitlist-entry/1/do", "GET", http.StatusOK},
+	{"admin api keys", "/admin/api-keys", "GET", http.StatusOK},
+	{"admin new api key", "/admin/api-keys/0/show", "GET", http.StatusOK},
+	{"admin show api key", "/admin/api-keys/1/show", "GET", http.StatusOK},
+	{"admin webhooks", "/admin/webhooks", "GET", http.StatusOK},
+	{"admin new webhook", "/admin/webhooks/0/show", "GET", http.StatusOK},
+	{"admin show webhook", "/admin/webhooks/1/show", "GET", http.StatusOK},
+	{"admin webhook deliveries", "/admin/webhooks/1/deliveries", "GET", http.StatusOK},
+	{"admin delete webhook", "/admin/delete-webhook/2/do", "GET", http.StatusOK},
+	{"admin outbox", "/admin/outbox", "GET", http.StatusOK},
+	{"admin outbox dead", "/admin/outbox?status=dead", "GET", http.StatusOK},
+	{"admin show outbox message", "/admin/outbox/2/show", "GET", http.StatusOK},
+	{"admin show sent outbox message", "/admin/outbox/1/show", "GET", http.StatusOK},
+	{"admin email templates", "/admin/email-templates", "GET", http.StatusOK},
+	{"admin show email template", "/admin/email-templates/reservation-confirmation/show", "GET", http.StatusOK},
+	{"admin show unknown email template", "/admin/email-templates/carrier-pigeon/show", "GET", http.StatusOK},
 
 	//{"post-search-avail", "/search-availability", "POST", []postData{
 	//	{key: "start", value: "2020-01-01"},
@@ -140,6 +190,7 @@ func TestRepository_PostReservation(t *testing.T) {
 
 	rr := httptest.NewRecorder()
 
+	testMailer.Reset()
 	handler := http.HandlerFunc(Repo.PostReservation)
 
 	handler.ServeHTTP(rr, req)
@@ -148,6 +199,19 @@ func TestRepository_PostReservation(t *testing.T) {
 		t.Errorf("PostReservation handler returned wrong response code: got %d, wanted %d", rr.Code, http.StatusSeeOther)
 	}
 
+	// the guest is sent their confirmation, and the owner told of the booking
+	sent := testMailer.Messages()
+	if len(sent) != 2 {
+		t.Fatalf("PostReservation sent %d emails, wanted 2", len(sent))
+	}
+	if sent[0].To != "john@smith.com" || sent[0].Subject != "Reservation Confirmation" || sent[0].Template != emails.ReservationConfirmation ||
+		!strings.Contains(sent[0].Content, "/my-reservation?t=") || !strings.Contains(sent[0].Text, "Dear John") {
+		t.Errorf("PostReservation sent an unexpected confirmation: %+v", sent[0])
+	}
+	if sent[1].To != "me@here.com" || sent[1].Subject != "Reservation Notification" {
+		t.Errorf("PostReservation sent an unexpected notification: %+v", sent[1])
+	}
+
 	// test for missing post body
 	req, _ = http.NewRequest("POST", "/make-reservation", nil)
 	ctx = getCtx(req)
@@ -300,6 +364,39 @@ func TestRepository_PostReservation(t *testing.T) {
 	if rr.Code != http.StatusSeeOther {
 		t.Errorf("PostReservation handler failed when trying to fail inserting reservation: got %d, wanted %d", rr.Code, http.StatusSeeOther)
 	}
+
+	// test for room booked by someone else between search and submit
+	reqBody = "start_date=2070-01-01"
+	reqBody = fmt.Sprintf("%s&%s", reqBody, "end_date=2070-01-02")
+	reqBody = fmt.Sprintf("%s&%s", reqBody, "first_name=John")
+	reqBody = fmt.Sprintf("%s&%s", reqBody, "last_name=Smith")
+	reqBody = fmt.Sprintf("%s&%s", reqBody, "email=john@smith.com")
+	reqBody = fmt.Sprintf("%s&%s", reqBody, "phone=123456789")
+	reqBody = fmt.Sprintf("%s&%s", reqBody, "room_id=1")
+
+	req, _ = http.NewRequest("POST", "/make-reservation", strings.NewReader(reqBody))
+	ctx = getCtx(req)
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr = httptest.NewRecorder()
+
+	testMailer.Reset()
+	handler = http.HandlerFunc(Repo.PostReservation)
+
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusSeeOther {
+		t.Errorf("PostReservation handler failed when room was already taken: got %d, wanted %d", rr.Code, http.StatusSeeOther)
+	}
+
+	actualLoc, _ := rr.Result().Location()
+	if actualLoc.String() != "/search-availability" {
+		t.Errorf("PostReservation handler redirected to wrong location when room was already taken: got %s, wanted %s", actualLoc.String(), "/search-availability")
+	}
+
+	if n := len(testMailer.Messages()); n != 0 {
+		t.Errorf("PostReservation sent %d emails when room was already taken, wanted none", n)
+	}
 }
 
 func TestNewRepo(t *testing.T) {
@@ -344,6 +441,12 @@ func TestRepository_PostAvailability(t *testing.T) {
 		t.Errorf("Post availability when no rooms available gave wrong status code: got %d, wanted %d", rr.Code, http.StatusSeeOther)
 	}
 
+	// and the guest is offered the waitlist for their dates
+	actualLoc, _ := rr.Result().Location()
+	if actualLoc.String() != "/waitlist?start=2050-01-01&end=2050-01-02" {
+		t.Errorf("Post availability when no rooms available redirected to wrong location: got %s", actualLoc.String())
+	}
+
 	/*****************************************
 	// second case -- rooms are available
 	*****************************************/
@@ -495,6 +598,39 @@ func TestRepository_PostAvailability(t *testing.T) {
 	if rr.Code != http.StatusSeeOther {
 		t.Errorf("Post availability when database query fails gave wrong status code: got %d, wanted %d", rr.Code, http.StatusSeeOther)
 	}
+
+	/*****************************************
+	// seventh case -- client went away
+	*****************************************/
+	// this time, the request context is canceled before the handler runs,
+	// so the query should not succeed even though rooms are available
+	reqBody = "start=2040-01-01"
+	reqBody = fmt.Sprintf("%s&%s", reqBody, "end=2040-01-02")
+	req, _ = http.NewRequest("POST", "/search-availability", strings.NewReader(reqBody))
+
+	// get the context with session, and cancel it
+	ctx = getCtx(req)
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	req = req.WithContext(ctx)
+
+	// set the request header
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	// create our response recorder, which satisfies the requirements
+	// for http.ResponseWriter
+	rr = httptest.NewRecorder()
+
+	// make our handler a http.HandlerFunc
+	handler = http.HandlerFunc(Repo.PostAvailability)
+
+	// make the request to our handler
+	handler.ServeHTTP(rr, req)
+
+	// since the query was canceled, we expect to get status http.StatusSeeOther
+	if rr.Code != http.StatusSeeOther {
+		t.Errorf("Post availability with canceled context gave wrong status code: got %d, wanted %d", rr.Code, http.StatusSeeOther)
+	}
 }
 
 func TestRepository_AvailabilityJSON(t *testing.T) {
@@ -978,168 +1114,2317 @@ func TestAdminPostShowReservation(t *testing.T) {
 	}
 }
 
-var adminPostReservationCalendarTests = []struct {
-	name                 string
-	postedData           url.Values
-	expectedResponseCode int
-	expectedLocation     string
-	expectedHTML         string
-	blocks               int
-	reservations         int
+var adminPostShowBlockTests = []struct {
+	name               string
+	url                string
+	id                 string
+	postedData         url.Values
+	expectedStatusCode int
+	expectedLocation   string
+	expectedHTML       string
 }{
 	{
-		name: "cal",
+		name: "new-block",
+		url:  "/admin/blocks/0",
+		id:   "0",
 		postedData: url.Values{
-			"year":  {time.Now().Format("2006")},
-			"month": {time.Now().Format("01")},
-			fmt.Sprintf("add_block_1_%s", time.Now().AddDate(0, 0, 2).Format("2006-01-2")): {"1"},
+			"room_id":        {"1"},
+			"restriction_id": {"2"},
+			"start_date":     {"2050-03-01"},
+			"end_date":       {"2050-03-14"},
+			"reason":         {"Repainting"},
 		},
-		expectedResponseCode: http.StatusSeeOther,
+		expectedStatusCode: http.StatusSeeOther,
+		expectedLocation:   "/admin/reservations-calendar?y=2050&m=3",
 	},
 	{
-		name:                 "cal-blocks",
-		postedData:           url.Values{},
-		expectedResponseCode: http.StatusSeeOther,
-		blocks:               1,
+		name: "update-block",
+		url:  "/admin/blocks/1",
+		id:   "1",
+		postedData: url.Values{
+			"room_id":        {"1"},
+			"restriction_id": {"2"},
+			"start_date":     {"2050-01-10"},
+			"end_date":       {"2050-01-10"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedLocation:   "/admin/reservations-calendar?y=2050&m=1",
 	},
 	{
-		name:                 "cal-res",
-		postedData:           url.Values{},
-		expectedResponseCode: http.StatusSeeOther,
-		reservations:         1,
+		name: "missing-dates",
+		url:  "/admin/blocks/0",
+		id:   "0",
+		postedData: url.Values{
+			"room_id":        {"1"},
+			"restriction_id": {"2"},
+		},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       `action="/admin/blocks/0"`,
+	},
+	{
+		name: "reservation-type",
+		url:  "/admin/blocks/0",
+		id:   "0",
+		postedData: url.Values{
+			"room_id":        {"1"},
+			"restriction_id": {"1"},
+			"start_date":     {"2050-03-01"},
+			"end_date":       {"2050-03-14"},
+		},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "Choose one of the block types",
+	},
+	{
+		name: "end-before-start",
+		url:  "/admin/blocks/0",
+		id:   "0",
+		postedData: url.Values{
+			"room_id":        {"1"},
+			"restriction_id": {"2"},
+			"start_date":     {"2050-03-14"},
+			"end_date":       {"2050-03-01"},
+		},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "The last night can&#39;t be before the first night",
+	},
+	{
+		name: "overlaps",
+		url:  "/admin/blocks/0",
+		id:   "0",
+		postedData: url.Values{
+			"room_id":        {"1"},
+			"restriction_id": {"2"},
+			"start_date":     {"2070-01-01"},
+			"end_date":       {"2070-01-03"},
+		},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "These dates overlap a reservation or another block for this room",
+	},
+	{
+		name: "no-such-room",
+		url:  "/admin/blocks/0",
+		id:   "0",
+		postedData: url.Values{
+			"room_id":        {"4"},
+			"restriction_id": {"2"},
+			"start_date":     {"2050-03-01"},
+			"end_date":       {"2050-03-14"},
+		},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "Choose one of the rooms",
+	},
+	{
+		name: "archived-room",
+		url:  "/admin/blocks/0",
+		id:   "0",
+		postedData: url.Values{
+			"room_id":        {"3"},
+			"restriction_id": {"2"},
+			"start_date":     {"2050-03-01"},
+			"end_date":       {"2050-03-14"},
+		},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "Choose one of the rooms",
+	},
+	{
+		name: "room-lookup-fails",
+		url:  "/admin/blocks/0",
+		id:   "0",
+		postedData: url.Values{
+			"room_id":        {"100"},
+			"restriction_id": {"2"},
+			"start_date":     {"2050-03-01"},
+			"end_date":       {"2050-03-14"},
+		},
+		expectedStatusCode: http.StatusInternalServerError,
+	},
+	{
+		name: "update-missing-block",
+		url:  "/admin/blocks/7",
+		id:   "7",
+		postedData: url.Values{
+			"room_id":        {"1"},
+			"restriction_id": {"2"},
+			"start_date":     {"2050-01-10"},
+			"end_date":       {"2050-01-10"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedLocation:   "/admin/reservations-calendar",
 	},
 }
 
-func TestPostReservationCalendar(t *testing.T) {
-	for _, e := range adminPostReservationCalendarTests {
-		var req *http.Request
-		if e.postedData != nil {
-			req, _ = http.NewRequest("POST", "/admin/reservations-calendar", strings.NewReader(e.postedData.Encode()))
-		} else {
-			req, _ = http.NewRequest("POST", "/admin/reservations-calendar", nil)
-		}
+// TestAdminPostShowBlock tests the AdminPostShowBlock handler
+func TestAdminPostShowBlock(t *testing.T) {
+	for _, e := range adminPostShowBlockTests {
+		req, _ := http.NewRequest("POST", e.url, strings.NewReader(e.postedData.Encode()))
 		ctx := getCtx(req)
-		req = req.WithContext(ctx)
 
-		now := time.Now()
-		bm := make(map[string]int)
-		rm := make(map[string]int)
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("id", e.id)
+		ctx = context.WithValue(ctx, chi.RouteCtxKey, rctx)
+		req = req.WithContext(ctx)
 
-		currentYear, currentMonth, _ := now.Date()
-		currentLocation := now.Location()
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
 
-		firstOfMonth := time.Date(currentYear, currentMonth, 1, 0, 0, 0, 0, currentLocation)
-		lastOfMonth := firstOfMonth.AddDate(0, 1, -1)
+		handler := http.HandlerFunc(Repo.AdminPostShowBlock)
+		handler.ServeHTTP(rr, req)
 
-		for d := firstOfMonth; d.After(lastOfMonth) == false; d = d.AddDate(0, 0, 1) {
-			rm[d.Format("2006-01-2")] = 0
-			bm[d.Format("2006-01-2")] = 0
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedStatusCode, rr.Code)
 		}
 
-		if e.blocks > 0 {
-			bm[firstOfMonth.Format("2006-01-2")] = e.blocks
+		if e.expectedLocation != "" {
+			actualLoc, _ := rr.Result().Location()
+			if actualLoc.String() != e.expectedLocation {
+				t.Errorf("failed %s: expected location %s, but got location %s", e.name, e.expectedLocation, actualLoc.String())
+			}
 		}
 
-		if e.reservations > 0 {
-			rm[lastOfMonth.Format("2006-01-2")] = e.reservations
+		if e.expectedHTML != "" {
+			html := rr.Body.String()
+			if !strings.Contains(html, e.expectedHTML) {
+				t.Errorf("failed %s: expected to find %s but did not", e.name, e.expectedHTML)
+			}
 		}
+	}
+}
 
-		session.Put(ctx, "block_map_1", bm)
-		session.Put(ctx, "reservation_map_1", rm)
+func TestAdminDeleteBlock(t *testing.T) {
+	tests := []struct {
+		name          string
+		id            string
+		expectedError bool
+	}{
+		{"block", "1", false},
+		{"not-a-block", "7", true},
+	}
 
-		// set the header
-		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-		rr := httptest.NewRecorder()
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/admin/delete-block/"+e.id+"/do", nil)
+		ctx := getCtx(req)
+
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("id", e.id)
+		ctx = context.WithValue(ctx, chi.RouteCtxKey, rctx)
+		req = req.WithContext(ctx)
 
-		// cal the handler
-		handler := http.HandlerFunc(Repo.AdminPostReservationsCalendar)
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(Repo.AdminDeleteBlock)
 		handler.ServeHTTP(rr, req)
 
-		if rr.Code != e.expectedResponseCode {
-			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedResponseCode, rr.Code)
+		if rr.Code != http.StatusSeeOther {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, http.StatusSeeOther, rr.Code)
+		}
+		if session.Exists(ctx, "error") != e.expectedError {
+			t.Errorf("failed %s: expected error in session to be %t", e.name, e.expectedError)
 		}
 	}
 }
 
-var adminProcessReservationTests = []struct {
-	name                 string
-	queryParams          string
-	expectedResponseCode int
-	expectedLocation     string
-}{
-	{
-		name:                 "process-reservation",
-		queryParams:          "",
-		expectedResponseCode: http.StatusSeeOther,
-		expectedLocation:     "",
-	},
-	{
-		name:                 "process-reservation-back-to-cal",
-		queryParams:          "?y=2025&m=01",
-		expectedResponseCode: http.StatusSeeOther,
-		expectedLocation:     "",
-	},
+// TestBuildCalendarCells tests that a block is drawn as one cell spanning its nights
+func TestBuildCalendarCells(t *testing.T) {
+	firstOfMonth := time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC)
+	lastOfMonth := firstOfMonth.AddDate(0, 1, -1)
+
+	restrictions := []models.RoomRestriction{
+		// closed the nights of the 30th of December to the 3rd of January
+		{ID: 7, StartDate: firstOfMonth.AddDate(0, 0, -2), EndDate: firstOfMonth.AddDate(0, 0, 3)},
+		// reserved from the 10th, leaving on the 12th
+		{ID: 8, ReservationID: 4, StartDate: firstOfMonth.AddDate(0, 0, 9), EndDate: firstOfMonth.AddDate(0, 0, 11)},
+		// closed the night of the 31st, running into February
+		{ID: 9, StartDate: lastOfMonth, EndDate: lastOfMonth.AddDate(0, 0, 5)},
+		// held for waitlist entry 3 the nights of the 20th and 21st
+		{ID: 10, WaitlistEntryID: 3, StartDate: firstOfMonth.AddDate(0, 0, 19), EndDate: firstOfMonth.AddDate(0, 0, 21)},
+	}
+
+	cells := buildCalendarCells(firstOfMonth, lastOfMonth, restrictions)
+
+	// 31 days, with the first three merged into one cell
+	if len(cells) != 29 {
+		t.Fatalf("expected 29 cells, but got %d", len(cells))
+	}
+
+	if cells[0].Block.ID != 7 || cells[0].Span != 3 {
+		t.Errorf("expected the first cell to be block 7 spanning 3 nights, but got block %d spanning %d", cells[0].Block.ID, cells[0].Span)
+	}
+
+	if cells[1].Date.Day() != 4 || cells[1].Block.ID != 0 {
+		t.Errorf("expected the second cell to be an open night on the 4th, but got %v", cells[1])
+	}
+
+	for _, day := range []int{10, 11, 12} {
+		if cells[day-3].ReservationID != 4 {
+			t.Errorf("expected reservation 4 on the %dth, but got %d", day, cells[day-3].ReservationID)
+		}
+	}
+
+	for _, day := range []int{20, 21} {
+		if cells[day-3].Block.ID != 0 || cells[day-3].WaitlistEntryID != 3 {
+			t.Errorf("expected the %dth to be held for waitlist entry 3, not a block, but got %v", day, cells[day-3])
+		}
+	}
+
+	last := cells[len(cells)-1]
+	if last.Block.ID != 9 || last.Span != 1 || last.Date.Day() != 31 {
+		t.Errorf("expected the last cell to be block 9 on the 31st only, but got %v", last)
+	}
 }
 
-func TestAdminProcessReservation(t *testing.T) {
-	for _, e := range adminProcessReservationTests {
-		req, _ := http.NewRequest("GET", fmt.Sprintf("/admin/process-reservation/cal/1/do%s", e.queryParams), nil)
+// TestAdminRestoreReservation tests that a reservation is only restored while its room is free
+func TestAdminRestoreReservation(t *testing.T) {
+	tests := []struct {
+		id            string
+		expectedError bool
+	}{
+		{"1", false},
+		{"2", true},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/admin/restore-reservation/"+e.id+"/do", nil)
 		ctx := getCtx(req)
+
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("id", e.id)
+		ctx = context.WithValue(ctx, chi.RouteCtxKey, rctx)
 		req = req.WithContext(ctx)
 
 		rr := httptest.NewRecorder()
-
-		handler := http.HandlerFunc(Repo.AdminProcessReservation)
+		handler := http.HandlerFunc(Repo.AdminRestoreReservation)
 		handler.ServeHTTP(rr, req)
 
 		if rr.Code != http.StatusSeeOther {
-			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedResponseCode, rr.Code)
+			t.Errorf("reservation %s: expected code %d, but got %d", e.id, http.StatusSeeOther, rr.Code)
+		}
+
+		actualLoc, _ := rr.Result().Location()
+		if actualLoc.String() != "/admin/reservations-deleted" {
+			t.Errorf("reservation %s: expected location /admin/reservations-deleted, but got %s", e.id, actualLoc.String())
+		}
+
+		if session.Exists(ctx, "error") != e.expectedError {
+			t.Errorf("reservation %s: expected error in session to be %t", e.id, e.expectedError)
 		}
 	}
 }
 
-var adminDeleteReservationTests = []struct {
-	name                 string
-	queryParams          string
-	expectedResponseCode int
-	expectedLocation     string
+// TestOccupiedNights tests that only types counting toward occupancy are counted
+func TestOccupiedNights(t *testing.T) {
+	firstOfMonth := time.Date(2050, 2, 1, 0, 0, 0, 0, time.UTC)
+
+	restrictions := []models.RoomRestriction{
+		// a reservation from the 30th of January, leaving on the 3rd of February: 2 nights this month
+		{ReservationID: 1, StartDate: firstOfMonth.AddDate(0, 0, -2), EndDate: firstOfMonth.AddDate(0, 0, 2),
+			Restriction: models.Restriction{CountsTowardOccupancy: true}},
+		// staff use on the 10th and 11th
+		{StartDate: firstOfMonth.AddDate(0, 0, 9), EndDate: firstOfMonth.AddDate(0, 0, 11),
+			Restriction: models.Restriction{CountsTowardOccupancy: true}},
+		// maintenance the whole month, which doesn't count
+		{StartDate: firstOfMonth, EndDate: firstOfMonth.AddDate(0, 1, 0)},
+	}
+
+	if n := occupiedNights(firstOfMonth, restrictions); n != 4 {
+		t.Errorf("expected 4 occupied nights, but got %d", n)
+	}
+}
+
+var adminPostShowRestrictionTests = []struct {
+	name               string
+	id                 string
+	postedData         url.Values
+	expectedStatusCode int
+	expectedHTML       string
 }{
 	{
-		name:                 "delete-reservation",
-		queryParams:          "",
-		expectedResponseCode: http.StatusSeeOther,
-		expectedLocation:     "",
+		name: "new-restriction",
+		id:   "0",
+		postedData: url.Values{
+			"restriction_name":        {"Deep Clean"},
+			"colour":                  {"#17a2b8"},
+			"counts_toward_occupancy": {"1"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
 	},
 	{
-		name:                 "delete-reservation-back-to-cal",
-		queryParams:          "?y=2021&m=12",
-		expectedResponseCode: http.StatusSeeOther,
-		expectedLocation:     "",
+		name: "update-restriction",
+		id:   "2",
+		postedData: url.Values{
+			"restriction_name": {"Owner Block"},
+			"colour":           {"#ffc107"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+	},
+	{
+		name: "missing-name",
+		id:   "0",
+		postedData: url.Values{
+			"restriction_name": {""},
+			"colour":           {"#17a2b8"},
+		},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "This field cannot be blank",
+	},
+	{
+		name: "invalid-colour",
+		id:   "0",
+		postedData: url.Values{
+			"restriction_name": {"Maintenance"},
+			"colour":           {"grey"},
+		},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "Invalid colour, use #rrggbb",
+	},
+	{
+		name: "insert-fails",
+		id:   "0",
+		postedData: url.Values{
+			"restriction_name": {"fail"},
+			"colour":           {"#17a2b8"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
 	},
 }
 
-func TestAdminDeleteReservation(t *testing.T) {
-	for _, e := range adminDeleteReservationTests {
-		req, _ := http.NewRequest("GET", fmt.Sprintf("/admin/process-reservation/cal/1/do%s", e.queryParams), nil)
+// TestAdminPostShowRestriction tests the AdminPostShowRestriction handler
+func TestAdminPostShowRestriction(t *testing.T) {
+	for _, e := range adminPostShowRestrictionTests {
+		req, _ := http.NewRequest("POST", "/admin/restrictions/"+e.id, strings.NewReader(e.postedData.Encode()))
 		ctx := getCtx(req)
+
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("id", e.id)
+		ctx = context.WithValue(ctx, chi.RouteCtxKey, rctx)
 		req = req.WithContext(ctx)
 
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 		rr := httptest.NewRecorder()
 
-		handler := http.HandlerFunc(Repo.AdminDeleteReservation)
+		handler := http.HandlerFunc(Repo.AdminPostShowRestriction)
 		handler.ServeHTTP(rr, req)
 
-		if rr.Code != http.StatusSeeOther {
-			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedResponseCode, rr.Code)
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+
+		if e.expectedHTML != "" {
+			html := rr.Body.String()
+			if !strings.Contains(html, e.expectedHTML) {
+				t.Errorf("failed %s: expected to find %s but did not", e.name, e.expectedHTML)
+			}
 		}
 	}
 }
 
-// getCtx is a helper function that returns a context with session
-func getCtx(req *http.Request) context.Context {
-	ctx, err := session.Load(req.Context(), req.Header.Get("X-Session"))
-	if err != nil {
-		log.Println(err)
+// TestAdminDeleteRestriction tests that a restriction type in use is not deleted
+func TestAdminDeleteRestriction(t *testing.T) {
+	tests := []struct {
+		id            string
+		expectedError bool
+	}{
+		{"2", true},
+		{"3", false},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/admin/delete-restriction/"+e.id+"/do", nil)
+		ctx := getCtx(req)
+
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("id", e.id)
+		ctx = context.WithValue(ctx, chi.RouteCtxKey, rctx)
+		req = req.WithContext(ctx)
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(Repo.AdminDeleteRestriction)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusSeeOther {
+			t.Errorf("restriction %s: expected code %d, but got %d", e.id, http.StatusSeeOther, rr.Code)
+		}
+
+		if session.Exists(ctx, "error") != e.expectedError {
+			t.Errorf("restriction %s: expected error in session to be %t", e.id, e.expectedError)
+		}
+	}
+}
+
+var adminProcessReservationTests = []struct {
+	name                 string
+	id                   string
+	queryParams          string
+	expectedResponseCode int
+	expectedFlashError   bool
+}{
+	{
+		name:                 "process-reservation",
+		id:                   "1",
+		queryParams:          "",
+		expectedResponseCode: http.StatusSeeOther,
+	},
+	{
+		name:                 "process-reservation-back-to-cal",
+		id:                   "1",
+		queryParams:          "?y=2025&m=01",
+		expectedResponseCode: http.StatusSeeOther,
+	},
+	{
+		name:                 "cancel-pending",
+		id:                   "1",
+		queryParams:          "?status=cancelled",
+		expectedResponseCode: http.StatusSeeOther,
+	},
+	{
+		name:                 "cancel-with-deposit",
+		id:                   "5",
+		queryParams:          "?status=cancelled",
+		expectedResponseCode: http.StatusSeeOther,
+	},
+	{
+		name:                 "check-in-pending",
+		id:                   "1",
+		queryParams:          "?status=checked-in",
+		expectedResponseCode: http.StatusSeeOther,
+		expectedFlashError:   true,
+	},
+	{
+		name:                 "confirm-checked-out",
+		id:                   "3",
+		queryParams:          "",
+		expectedResponseCode: http.StatusSeeOther,
+		expectedFlashError:   true,
+	},
+	{
+		name:                 "changed-by-someone-else",
+		id:                   "2",
+		queryParams:          "",
+		expectedResponseCode: http.StatusSeeOther,
+		expectedFlashError:   true,
+	},
+}
+
+func TestAdminProcessReservation(t *testing.T) {
+	for _, e := range adminProcessReservationTests {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("/admin/process-reservation/cal/%s/do%s", e.id, e.queryParams), nil)
+		ctx := getCtx(req)
+
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("src", "cal")
+		rctx.URLParams.Add("id", e.id)
+		ctx = context.WithValue(ctx, chi.RouteCtxKey, rctx)
+		req = req.WithContext(ctx)
+
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.AdminProcessReservation)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedResponseCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedResponseCode, rr.Code)
+		}
+
+		if session.Exists(ctx, "error") != e.expectedFlashError {
+			t.Errorf("failed %s: expected error in session to be %t", e.name, e.expectedFlashError)
+		}
+	}
+}
+
+var adminDeleteReservationTests = []struct {
+	name                 string
+	id                   string
+	queryParams          string
+	expectedResponseCode int
+	expectedLocation     string
+	expectedFlashError   bool
+}{
+	{
+		name:                 "delete-reservation",
+		id:                   "1",
+		queryParams:          "",
+		expectedResponseCode: http.StatusSeeOther,
+		expectedLocation:     "",
+	},
+	{
+		name:                 "delete-reservation-back-to-cal",
+		id:                   "1",
+		queryParams:          "?y=2021&m=12",
+		expectedResponseCode: http.StatusSeeOther,
+		expectedLocation:     "",
+	},
+	{
+		name:                 "already-deleted",
+		id:                   "4",
+		expectedResponseCode: http.StatusSeeOther,
+		expectedFlashError:   true,
+	},
+	{
+		name:                 "lookup-fails",
+		id:                   "100",
+		expectedResponseCode: http.StatusSeeOther,
+		expectedFlashError:   true,
+	},
+}
+
+func TestAdminDeleteReservation(t *testing.T) {
+	for _, e := range adminDeleteReservationTests {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("/admin/delete-reservation/cal/%s/do%s", e.id, e.queryParams), nil)
+		ctx := getCtx(req)
+
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("id", e.id)
+		rctx.URLParams.Add("src", "cal")
+		ctx = context.WithValue(ctx, chi.RouteCtxKey, rctx)
+		req = req.WithContext(ctx)
+
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.AdminDeleteReservation)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusSeeOther {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedResponseCode, rr.Code)
+		}
+		if session.Exists(ctx, "error") != e.expectedFlashError {
+			t.Errorf("failed %s: expected error in session to be %t", e.name, e.expectedFlashError)
+		}
+	}
+}
+
+var adminPostShowRoomTests = []struct {
+	name               string
+	url                string
+	postedData         url.Values
+	expectedStatusCode int
+	expectedLocation   string
+	expectedHTML       string
+}{
+	{
+		name: "new-room",
+		url:  "/admin/rooms/0",
+		postedData: url.Values{
+			"room_name":     {"Colonel's Cabin"},
+			"slug":          {""},
+			"max_occupancy": {"4"},
+			"nightly_rate":  {"175.00"},
+			"amenities":     {"Fireplace\nFree Wi-Fi"},
+			"photos":        {"/static/images/colonels-cabin.png | Living room"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedLocation:   "/admin/rooms",
+	},
+	{
+		name: "update-room",
+		url:  "/admin/rooms/1",
+		postedData: url.Values{
+			"room_name":     {"General's Quarters"},
+			"slug":          {"generals-quarters"},
+			"max_occupancy": {"2"},
+			"nightly_rate":  {"$150"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedLocation:   "/admin/rooms",
+	},
+	{
+		name: "missing-name",
+		url:  "/admin/rooms/0",
+		postedData: url.Values{
+			"room_name":     {""},
+			"slug":          {""},
+			"max_occupancy": {"2"},
+			"nightly_rate":  {"$150"},
+		},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       `action="/admin/rooms/0"`,
+	},
+	{
+		name: "duplicate-slug",
+		url:  "/admin/rooms/0",
+		postedData: url.Values{
+			"room_name":     {"Another Suite"},
+			"slug":          {"majors-suite"},
+			"max_occupancy": {"2"},
+			"nightly_rate":  {"$150"},
+		},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "This slug is already used by another room",
+	},
+	{
+		name: "slug-lookup-fails",
+		url:  "/admin/rooms/0",
+		postedData: url.Values{
+			"room_name": {"Error"},
+			"slug":      {"error"},
+		},
+		expectedStatusCode: http.StatusInternalServerError,
+	},
+	{
+		name: "invalid-occupancy",
+		url:  "/admin/rooms/0",
+		postedData: url.Values{
+			"room_name":     {"Tiny Room"},
+			"max_occupancy": {"0"},
+			"nightly_rate":  {"$150"},
+		},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "This field must be at least 1",
+	},
+	{
+		name: "insert-fails",
+		url:  "/admin/rooms/0",
+		postedData: url.Values{
+			"room_name":     {"fail"},
+			"max_occupancy": {"2"},
+			"nightly_rate":  {"$150"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedLocation:   "/admin/rooms",
+	},
+	{
+		name: "invalid-rate",
+		url:  "/admin/rooms/0",
+		postedData: url.Values{
+			"room_name":     {"Cheap Room"},
+			"max_occupancy": {"2"},
+			"nightly_rate":  {"12.345"},
+		},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "Enter an amount such as 125.00",
+	},
+}
+
+// TestAdminPostShowRoom tests the AdminPostShowRoom handler
+func TestAdminPostShowRoom(t *testing.T) {
+	for _, e := range adminPostShowRoomTests {
+		req, _ := http.NewRequest("POST", e.url, strings.NewReader(e.postedData.Encode()))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.RequestURI = e.url
+
+		// set the header
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+
+		// call the handler
+		handler := http.HandlerFunc(Repo.AdminPostShowRoom)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+
+		if e.expectedLocation != "" {
+			actualLoc, _ := rr.Result().Location()
+			if actualLoc.String() != e.expectedLocation {
+				t.Errorf("failed %s: expected location %s, but got location %s", e.name, e.expectedLocation, actualLoc.String())
+			}
+		}
+
+		if e.expectedHTML != "" {
+			html := rr.Body.String()
+			if !strings.Contains(html, e.expectedHTML) {
+				t.Errorf("failed %s: expected to find %s but did not", e.name, e.expectedHTML)
+			}
+		}
+	}
+}
+
+func TestAdminArchiveAndRestoreRoom(t *testing.T) {
+	for _, h := range []http.HandlerFunc{Repo.AdminArchiveRoom, Repo.AdminRestoreRoom} {
+		req, _ := http.NewRequest("GET", "/admin/archive-room/1/do", nil)
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusSeeOther {
+			t.Errorf("expected code %d, but got %d", http.StatusSeeOther, rr.Code)
+		}
+	}
+}
+
+// getCtx is a helper function that returns a context with session
+func getCtx(req *http.Request) context.Context {
+	ctx, err := session.Load(req.Context(), req.Header.Get("X-Session"))
+	if err != nil {
+		log.Println(err)
+	}
+	return ctx
+}
+
+var adminPostRoomRatesTests = []struct {
+	name               string
+	postedData         url.Values
+	expectedLocation   string
+	expectedFlashError bool
+}{
+	{
+		name: "weekdays-only",
+		postedData: url.Values{
+			"weekday_5": {"10"},
+			"weekday_6": {"20"},
+		},
+		expectedLocation: "/admin/rooms/1/rates",
+	},
+	{
+		name: "add-season",
+		postedData: url.Values{
+			"season_name":  {"Summer"},
+			"season_start": {"2050-06-01"},
+			"season_end":   {"2050-08-31"},
+			"season_rate":  {"180.00"},
+		},
+		expectedLocation: "/admin/rooms/1/rates",
+	},
+	{
+		name: "invalid-weekday",
+		postedData: url.Values{
+			"weekday_0": {"-100"},
+		},
+		expectedLocation:   "/admin/rooms/1/rates",
+		expectedFlashError: true,
+	},
+	{
+		name: "season-ends-before-start",
+		postedData: url.Values{
+			"season_name":  {"Backwards"},
+			"season_start": {"2050-08-31"},
+			"season_end":   {"2050-06-01"},
+			"season_rate":  {"180.00"},
+		},
+		expectedLocation:   "/admin/rooms/1/rates",
+		expectedFlashError: true,
+	},
+	{
+		name: "invalid-season-rate",
+		postedData: url.Values{
+			"season_name":  {"Summer"},
+			"season_start": {"2050-06-01"},
+			"season_end":   {"2050-08-31"},
+			"season_rate":  {"lots"},
+		},
+		expectedLocation:   "/admin/rooms/1/rates",
+		expectedFlashError: true,
+	},
+}
+
+// TestAdminPostRoomRates tests the AdminPostRoomRates handler
+func TestAdminPostRoomRates(t *testing.T) {
+	for _, e := range adminPostRoomRatesTests {
+		req, _ := http.NewRequest("POST", "/admin/rooms/1/rates", strings.NewReader(e.postedData.Encode()))
+		ctx := getCtx(req)
+
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("id", "1")
+		ctx = context.WithValue(ctx, chi.RouteCtxKey, rctx)
+		req = req.WithContext(ctx)
+
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.AdminPostRoomRates)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusSeeOther {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, http.StatusSeeOther, rr.Code)
+		}
+
+		actualLoc, _ := rr.Result().Location()
+		if actualLoc.String() != e.expectedLocation {
+			t.Errorf("failed %s: expected location %s, but got location %s", e.name, e.expectedLocation, actualLoc.String())
+		}
+
+		if session.Exists(ctx, "error") != e.expectedFlashError {
+			t.Errorf("failed %s: expected error in session to be %t", e.name, e.expectedFlashError)
+		}
+	}
+}
+
+// TestClientIP tests the clientIP function
+func TestClientIP(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/admin/audit", nil)
+
+	req.RemoteAddr = "203.0.113.7:51234"
+	if ip := clientIP(req); ip != "203.0.113.7" {
+		t.Errorf("expected 203.0.113.7, but got %s", ip)
+	}
+
+	req.RemoteAddr = "203.0.113.7"
+	if ip := clientIP(req); ip != "203.0.113.7" {
+		t.Errorf("expected the address without a port to be returned as is, but got %s", ip)
+	}
+}
+
+// TestAuditJSON tests the auditJSON function
+func TestAuditJSON(t *testing.T) {
+	if s := auditJSON(nil); s != "" {
+		t.Errorf("expected nil to encode as an empty string, but got %s", s)
+	}
+
+	if s := auditJSON(map[string]string{"Status": "confirmed"}); s != `{"Status":"confirmed"}` {
+		t.Errorf("unexpected encoding %s", s)
+	}
+}
+
+// guestToken returns a signed link token for reservation id that expires after expires
+func guestToken(id int, expires time.Time) string {
+	return signedlink.Sign(linkSecret, "reservation", id, expires)
+}
+
+var myReservationTests = []struct {
+	name               string
+	token              string
+	expectedStatusCode int
+	expectedFlashError bool
+}{
+	{"valid-link", guestToken(1, time.Now().Add(time.Hour)), http.StatusOK, false},
+	{"expired-link", guestToken(1, time.Now().Add(-time.Hour)), http.StatusSeeOther, true},
+	{"tampered-link", guestToken(1, time.Now().Add(time.Hour)) + "x", http.StatusSeeOther, true},
+	{"no-link", "", http.StatusSeeOther, true},
+	{"deleted-reservation", guestToken(4, time.Now().Add(time.Hour)), http.StatusSeeOther, true},
+	{"missing-reservation", guestToken(100, time.Now().Add(time.Hour)), http.StatusSeeOther, true},
+}
+
+// TestMyReservation tests the MyReservation handler
+func TestMyReservation(t *testing.T) {
+	for _, e := range myReservationTests {
+		req, _ := http.NewRequest("GET", "/my-reservation?t="+url.QueryEscape(e.token), nil)
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.MyReservation)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+
+		if session.Exists(ctx, "error") != e.expectedFlashError {
+			t.Errorf("failed %s: expected error in session to be %t", e.name, e.expectedFlashError)
+		}
+	}
+}
+
+var postMyReservationTests = []struct {
+	name               string
+	url                string
+	postedData         url.Values
+	expectedStatusCode int
+	expectedLocation   string
+	expectedFlashError bool
+	expectedMailTo     []string
+}{
+	{
+		name: "contact-valid",
+		url:  "/my-reservation/contact",
+		postedData: url.Values{
+			"t":          {guestToken(1, time.Now().Add(time.Hour))},
+			"first_name": {"John"},
+			"last_name":  {"Smith"},
+			"email":      {"john@smith.com"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedLocation:   "/my-reservation?t=" + guestToken(1, time.Now().Add(time.Hour)),
+	},
+	{
+		name: "contact-invalid-email",
+		url:  "/my-reservation/contact",
+		postedData: url.Values{
+			"t":          {guestToken(1, time.Now().Add(time.Hour))},
+			"first_name": {"John"},
+			"last_name":  {"Smith"},
+			"email":      {"john"},
+		},
+		expectedStatusCode: http.StatusOK,
+	},
+	{
+		name: "contact-bad-link",
+		url:  "/my-reservation/contact",
+		postedData: url.Values{
+			"t":          {"bad"},
+			"first_name": {"John"},
+			"last_name":  {"Smith"},
+			"email":      {"john@smith.com"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedLocation:   "/",
+		expectedFlashError: true,
+	},
+	{
+		name: "dates-available",
+		url:  "/my-reservation/dates",
+		postedData: url.Values{
+			"t":          {guestToken(1, time.Now().Add(time.Hour))},
+			"start_date": {"2049-12-20"},
+			"end_date":   {"2049-12-22"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedLocation:   "/my-reservation?t=" + guestToken(1, time.Date(2049, 12, 22, 0, 0, 0, 0, time.UTC).Add(guestLinkGrace)),
+	},
+	{
+		name: "dates-unavailable",
+		url:  "/my-reservation/dates",
+		postedData: url.Values{
+			"t":          {guestToken(1, time.Now().Add(time.Hour))},
+			"start_date": {"2050-01-10"},
+			"end_date":   {"2050-01-15"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedLocation:   "/my-reservation?t=" + guestToken(1, time.Now().Add(time.Hour)),
+		expectedFlashError: true,
+	},
+	{
+		name: "dates-shorter-taken-meanwhile",
+		url:  "/my-reservation/dates",
+		postedData: url.Values{
+			"t":          {guestToken(2, time.Now().Add(time.Hour))},
+			"start_date": {"2050-01-10"},
+			"end_date":   {"2050-01-11"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedLocation:   "/my-reservation?t=" + guestToken(2, time.Now().Add(time.Hour)),
+		expectedFlashError: true,
+	},
+	{
+		name: "dates-backwards",
+		url:  "/my-reservation/dates",
+		postedData: url.Values{
+			"t":          {guestToken(1, time.Now().Add(time.Hour))},
+			"start_date": {"2050-01-12"},
+			"end_date":   {"2050-01-10"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedLocation:   "/my-reservation?t=" + guestToken(1, time.Now().Add(time.Hour)),
+		expectedFlashError: true,
+	},
+	{
+		name: "dates-cancelled-meanwhile",
+		url:  "/my-reservation/dates",
+		postedData: url.Values{
+			"t":          {guestToken(6, time.Now().Add(time.Hour))},
+			"start_date": {"2050-01-10"},
+			"end_date":   {"2050-01-11"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedLocation:   "/my-reservation?t=" + guestToken(6, time.Now().Add(time.Hour)),
+		expectedFlashError: true,
+	},
+	{
+		name: "dates-shorter-with-deposit",
+		url:  "/my-reservation/dates",
+		postedData: url.Values{
+			"t":          {guestToken(5, time.Now().Add(time.Hour))},
+			"start_date": {"2050-01-10"},
+			"end_date":   {"2050-01-11"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedLocation:   "/my-reservation?t=" + guestToken(5, time.Date(2050, 1, 11, 0, 0, 0, 0, time.UTC).Add(guestLinkGrace)),
+	},
+	{
+		name: "dates-after-check-out",
+		url:  "/my-reservation/dates",
+		postedData: url.Values{
+			"t":          {guestToken(3, time.Now().Add(time.Hour))},
+			"start_date": {"2049-12-20"},
+			"end_date":   {"2049-12-22"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedLocation:   "/my-reservation?t=" + guestToken(3, time.Now().Add(time.Hour)),
+		expectedFlashError: true,
+	},
+	{
+		name: "cancel",
+		url:  "/my-reservation/cancel",
+		postedData: url.Values{
+			"t": {guestToken(1, time.Now().Add(time.Hour))},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedLocation:   "/my-reservation?t=" + guestToken(1, time.Now().Add(time.Hour)),
+		expectedMailTo:     []string{"john@smith.com", "me@here.com"},
+	},
+	{
+		name: "cancel-after-check-out",
+		url:  "/my-reservation/cancel",
+		postedData: url.Values{
+			"t": {guestToken(3, time.Now().Add(time.Hour))},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedLocation:   "/my-reservation?t=" + guestToken(3, time.Now().Add(time.Hour)),
+		expectedFlashError: true,
+	},
+}
+
+// TestPostMyReservation tests the handlers a guest uses to change their booking
+func TestPostMyReservation(t *testing.T) {
+	handlers := map[string]http.HandlerFunc{
+		"/my-reservation/contact": Repo.PostMyReservationContact,
+		"/my-reservation/dates":   Repo.PostMyReservationDates,
+		"/my-reservation/cancel":  Repo.PostMyReservationCancel,
+	}
+
+	for _, e := range postMyReservationTests {
+		req, _ := http.NewRequest("POST", e.url, strings.NewReader(e.postedData.Encode()))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+
+		testMailer.Reset()
+		handlers[e.url].ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+
+		if e.expectedLocation != "" {
+			actualLoc, _ := rr.Result().Location()
+			if actualLoc.String() != e.expectedLocation {
+				t.Errorf("failed %s: expected location %s, but got location %s", e.name, e.expectedLocation, actualLoc.String())
+			}
+		}
+
+		if session.Exists(ctx, "error") != e.expectedFlashError {
+			t.Errorf("failed %s: expected error in session to be %t", e.name, e.expectedFlashError)
+		}
+
+		if e.expectedMailTo != nil {
+			var to []string
+			for _, msg := range testMailer.Messages() {
+				to = append(to, msg.To)
+			}
+			if strings.Join(to, ",") != strings.Join(e.expectedMailTo, ",") {
+				t.Errorf("failed %s: expected mail to %v, but got %v", e.name, e.expectedMailTo, to)
+			}
+		}
+	}
+}
+
+var changeStatusRefundTests = []struct {
+	name     string
+	id       int
+	expected int
+}{
+	{"nothing-paid", 1, 0},
+	{"capped-at-deposit", 5, 6000},
+}
+
+// TestChangeStatusRefund tests that cancelling never refunds more than was captured
+func TestChangeStatusRefund(t *testing.T) {
+	for _, e := range changeStatusRefundTests {
+		res, _ := Repo.DB.GetReservationByID(context.Background(), e.id)
+
+		refund, err := Repo.changeStatus(context.Background(), res, models.StatusCancelled, 1)
+		if err != nil {
+			t.Errorf("failed %s: %s", e.name, err)
+			continue
+		}
+		if refund != e.expected {
+			t.Errorf("failed %s: expected refund %d but got %d", e.name, e.expected, refund)
+		}
+	}
+}
+
+var adjustedDepositTests = []struct {
+	name     string
+	deposit  int
+	oldTotal int
+	newTotal int
+	expected int
+}{
+	{"same-price", 6000, 30000, 30000, 6000},
+	{"cheaper", 6000, 30000, 15000, 3000},
+	{"rounded-up", 6000, 30000, 10001, 2001},
+	{"dearer", 6000, 30000, 45000, 6000},
+	{"no-deposit", 0, 30000, 15000, 0},
+}
+
+func TestAdjustedDeposit(t *testing.T) {
+	for _, e := range adjustedDepositTests {
+		if got := adjustedDeposit(e.deposit, e.oldTotal, e.newTotal); got != e.expected {
+			t.Errorf("failed %s: expected %d but got %d", e.name, e.expected, got)
+		}
+	}
+}
+
+var uncoveredNightsTests = []struct {
+	name     string
+	start    string
+	end      string
+	expected [][2]string
+}{
+	{"same-dates", "2050-01-10", "2050-01-12", nil},
+	{"shorter", "2050-01-10", "2050-01-11", nil},
+	{"earlier-arrival", "2050-01-08", "2050-01-12", [][2]string{{"2050-01-08", "2050-01-10"}}},
+	{"later-departure", "2050-01-11", "2050-01-14", [][2]string{{"2050-01-12", "2050-01-14"}}},
+	{"both-ends", "2050-01-09", "2050-01-13", [][2]string{{"2050-01-09", "2050-01-10"}, {"2050-01-12", "2050-01-13"}}},
+	{"no-overlap", "2050-02-01", "2050-02-03", [][2]string{{"2050-02-01", "2050-02-03"}}},
+	{"back-to-back", "2050-01-12", "2050-01-14", [][2]string{{"2050-01-12", "2050-01-14"}}},
+}
+
+// TestUncoveredNights tests the uncoveredNights function
+func TestUncoveredNights(t *testing.T) {
+	layout := "2006-01-02"
+	oldStart, _ := time.Parse(layout, "2050-01-10")
+	oldEnd, _ := time.Parse(layout, "2050-01-12")
+
+	for _, e := range uncoveredNightsTests {
+		start, _ := time.Parse(layout, e.start)
+		end, _ := time.Parse(layout, e.end)
+
+		var actual [][2]string
+		for _, nights := range uncoveredNights(oldStart, oldEnd, start, end) {
+			actual = append(actual, [2]string{nights[0].Format(layout), nights[1].Format(layout)})
+		}
+
+		if !reflect.DeepEqual(actual, e.expected) {
+			t.Errorf("%s: expected %v, but got %v", e.name, e.expected, actual)
+		}
+	}
+}
+
+var adminPostShowCancellationPolicyTests = []struct {
+	name               string
+	id                 string
+	postedData         url.Values
+	expectedStatusCode int
+	expectedHTML       string
+}{
+	{
+		name: "new-policy",
+		id:   "0",
+		postedData: url.Values{
+			"name":           {"Moderate"},
+			"tier_hours_0":   {"120"},
+			"tier_percent_0": {"100"},
+			"tier_hours_1":   {""},
+			"tier_percent_1": {""},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+	},
+	{
+		name: "non-refundable",
+		id:   "2",
+		postedData: url.Values{
+			"name": {"Non-refundable"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+	},
+	{
+		name: "missing-name",
+		id:   "0",
+		postedData: url.Values{
+			"name":           {""},
+			"tier_hours_0":   {"48"},
+			"tier_percent_0": {"50"},
+		},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       `value="48"`,
+	},
+	{
+		name: "refund-over-100",
+		id:   "1",
+		postedData: url.Values{
+			"name":           {"Generous"},
+			"tier_hours_0":   {"48"},
+			"tier_percent_0": {"150"},
+		},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "refunds must be between 0 and 100 percent",
+	},
+	{
+		name: "hours-not-a-number",
+		id:   "1",
+		postedData: url.Values{
+			"name":           {"Flexible"},
+			"tier_hours_0":   {"a week"},
+			"tier_percent_0": {"100"},
+		},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "Enter whole numbers",
+	},
+}
+
+// TestAdminPostShowCancellationPolicy tests the AdminPostShowCancellationPolicy handler
+func TestAdminPostShowCancellationPolicy(t *testing.T) {
+	for _, e := range adminPostShowCancellationPolicyTests {
+		req, _ := http.NewRequest("POST", "/admin/cancellation-policies/"+e.id, strings.NewReader(e.postedData.Encode()))
+		ctx := getCtx(req)
+
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("id", e.id)
+		ctx = context.WithValue(ctx, chi.RouteCtxKey, rctx)
+		req = req.WithContext(ctx)
+
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.AdminPostShowCancellationPolicy)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+
+		if e.expectedHTML != "" {
+			html := rr.Body.String()
+			if !strings.Contains(html, e.expectedHTML) {
+				t.Errorf("failed %s: expected to find %s but did not", e.name, e.expectedHTML)
+			}
+		}
+	}
+}
+
+var postWaitlistTests = []struct {
+	name               string
+	postedData         url.Values
+	expectedStatusCode int
+	expectedFlashError bool
+}{
+	{
+		name: "valid",
+		postedData: url.Values{
+			"first_name": {"Jane"},
+			"last_name":  {"Doe"},
+			"email":      {"jane@doe.com"},
+			"start_date": {"2050-01-01"},
+			"end_date":   {"2050-01-03"},
+			"room_id":    {"0"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+	},
+	{
+		name: "invalid-email",
+		postedData: url.Values{
+			"first_name": {"Jane"},
+			"last_name":  {"Doe"},
+			"email":      {"jane"},
+			"start_date": {"2050-01-01"},
+			"end_date":   {"2050-01-03"},
+		},
+		expectedStatusCode: http.StatusOK,
+	},
+	{
+		name: "departure-before-arrival",
+		postedData: url.Values{
+			"first_name": {"Jane"},
+			"last_name":  {"Doe"},
+			"email":      {"jane@doe.com"},
+			"start_date": {"2050-01-03"},
+			"end_date":   {"2050-01-01"},
+		},
+		expectedStatusCode: http.StatusOK,
+	},
+	{
+		name: "past-dates",
+		postedData: url.Values{
+			"first_name": {"Jane"},
+			"last_name":  {"Doe"},
+			"email":      {"jane@doe.com"},
+			"start_date": {"2000-01-01"},
+			"end_date":   {"2000-01-03"},
+		},
+		expectedStatusCode: http.StatusOK,
+	},
+	{
+		name: "bad-date",
+		postedData: url.Values{
+			"first_name": {"Jane"},
+			"last_name":  {"Doe"},
+			"email":      {"jane@doe.com"},
+			"start_date": {"invalid"},
+			"end_date":   {"2050-01-03"},
+		},
+		expectedStatusCode: http.StatusOK,
+	},
+	{
+		name: "database-insert-fails",
+		postedData: url.Values{
+			"first_name": {"Jane"},
+			"last_name":  {"Doe"},
+			"email":      {"jane@doe.com"},
+			"start_date": {"2050-01-01"},
+			"end_date":   {"2050-01-03"},
+			"room_id":    {"2"},
+		},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedFlashError: true,
+	},
+}
+
+func TestPostWaitlist(t *testing.T) {
+	for _, e := range postWaitlistTests {
+		req, _ := http.NewRequest("POST", "/waitlist", strings.NewReader(e.postedData.Encode()))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.PostWaitlist)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+
+		if session.Exists(ctx, "error") != e.expectedFlashError {
+			t.Errorf("failed %s: expected error in session to be %t", e.name, e.expectedFlashError)
+		}
+	}
+}
+
+var waitlistHoldTests = []struct {
+	name             string
+	token            string
+	expectedLocation string
+	expectedEntryID  int
+}{
+	{"held", signedlink.Sign(linkSecret, "waitlist", 1, time.Now().Add(time.Hour)), "/make-reservation", 1},
+	{"hold-run-out", signedlink.Sign(linkSecret, "waitlist", 2, time.Now().Add(time.Hour)), "/", 0},
+	{"not-offered", signedlink.Sign(linkSecret, "waitlist", 3, time.Now().Add(time.Hour)), "/", 0},
+	{"no-such-entry", signedlink.Sign(linkSecret, "waitlist", 100, time.Now().Add(time.Hour)), "/", 0},
+	{"expired-link", signedlink.Sign(linkSecret, "waitlist", 1, time.Now().Add(-time.Hour)), "/", 0},
+	{"reservation-link", guestToken(1, time.Now().Add(time.Hour)), "/", 0},
+	{"bad-link", "bad", "/", 0},
+}
+
+func TestWaitlistHold(t *testing.T) {
+	for _, e := range waitlistHoldTests {
+		req, _ := http.NewRequest("GET", "/waitlist/hold?t="+url.QueryEscape(e.token), nil)
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.WaitlistHold)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusSeeOther {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, http.StatusSeeOther, rr.Code)
+		}
+
+		actualLoc, _ := rr.Result().Location()
+		if actualLoc.String() != e.expectedLocation {
+			t.Errorf("failed %s: expected location %s, but got location %s", e.name, e.expectedLocation, actualLoc.String())
+		}
+
+		if id := session.GetInt(ctx, "waitlist_entry_id"); id != e.expectedEntryID {
+			t.Errorf("failed %s: expected waitlist entry %d in session, but got %d", e.name, e.expectedEntryID, id)
+		}
+
+		if e.expectedEntryID > 0 {
+			res, _ := session.Get(ctx, "reservation").(models.Reservation)
+			if res.RoomID != 1 || res.Email != "jane@doe.com" {
+				t.Errorf("failed %s: session reservation not filled from the hold: %+v", e.name, res)
+			}
+		}
+	}
+}
+
+var postReservationFromWaitlistTests = []struct {
+	name             string
+	entryID          int
+	roomID           string
+	expectedLocation string
+	expectedEntryID  int
+}{
+	{"hold-booked", 1, "1", "/reservation-summary", 0},
+	{"hold-lapsed", 2, "1", "/reservation-summary", 0},
+	{"booking-fails", 1, "2", "/", 1},
+}
+
+func TestPostReservationFromWaitlist(t *testing.T) {
+	for _, e := range postReservationFromWaitlistTests {
+		postedData := url.Values{
+			"start_date": {"2050-01-10"},
+			"end_date":   {"2050-01-12"},
+			"first_name": {"Jane"},
+			"last_name":  {"Doe"},
+			"email":      {"jane@doe.com"},
+			"room_id":    {e.roomID},
+		}
+
+		req, _ := http.NewRequest("POST", "/make-reservation", strings.NewReader(postedData.Encode()))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		session.Put(ctx, "waitlist_entry_id", e.entryID)
+
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.PostReservation)
+		handler.ServeHTTP(rr, req)
+
+		actualLoc, _ := rr.Result().Location()
+		if rr.Code != http.StatusSeeOther || actualLoc.String() != e.expectedLocation {
+			t.Errorf("failed %s: expected a redirect to %s but got %d to %s", e.name, e.expectedLocation, rr.Code, actualLoc.String())
+		}
+
+		if id := session.GetInt(ctx, "waitlist_entry_id"); id != e.expectedEntryID {
+			t.Errorf("failed %s: expected waitlist entry %d in session, but got %d", e.name, e.expectedEntryID, id)
+		}
+	}
+}
+
+var postReservationDepositTests = []struct {
+	name               string
+	token              string
+	expectedStatusCode int
+	expectedLocation   string
+}{
+	{"card-accepted", "tok_visa", http.StatusSeeOther, "/reservation-summary"},
+	{"card-declined", payments.FakeDeclineToken, http.StatusOK, ""},
+	{"no-card", "", http.StatusOK, ""},
+}
+
+func TestPostReservationDeposit(t *testing.T) {
+	app.DepositPercent = 20
+	defer func() { app.DepositPercent = 0 }()
+
+	for _, e := range postReservationDepositTests {
+		postedData := url.Values{
+			"start_date":    {"2050-01-01"},
+			"end_date":      {"2050-01-02"},
+			"first_name":    {"John"},
+			"last_name":     {"Smith"},
+			"email":         {"john@smith.com"},
+			"room_id":       {"1"},
+			"payment_token": {e.token},
+		}
+
+		req, _ := http.NewRequest("POST", "/make-reservation", strings.NewReader(postedData.Encode()))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.PostReservation)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+
+		if e.expectedLocation != "" {
+			actualLoc, _ := rr.Result().Location()
+			if actualLoc.String() != e.expectedLocation {
+				t.Errorf("failed %s: expected location %s, but got location %s", e.name, e.expectedLocation, actualLoc.String())
+			}
+
+			res, _ := session.Get(ctx, "reservation").(models.Reservation)
+			if res.PaymentStatus != models.PaymentCaptured || res.DepositAmount != payments.Deposit(res.TotalPrice, 20) {
+				t.Errorf("failed %s: expected a captured deposit but got %s %d", e.name, res.PaymentStatus, res.DepositAmount)
+			}
+		}
+	}
+}
+
+// failingCapture is a payment provider that holds deposits but can't take them
+type failingCapture struct {
+	payments.Provider
+	released int
+}
+
+func (p *failingCapture) Capture(ctx context.Context, reference string, amount int) (payments.Result, error) {
+	return payments.Result{}, errors.New("capture failed")
+}
+
+func (p *failingCapture) Refund(ctx context.Context, reference string, amount int) (payments.Result, error) {
+	p.released++
+	return p.Provider.Refund(ctx, reference, amount)
+}
+
+func TestBookCaptureFails(t *testing.T) {
+	app.DepositPercent = 20
+	provider := &failingCapture{Provider: app.Payments}
+	app.Payments = provider
+	defer func() {
+		app.DepositPercent = 0
+		app.Payments = provider.Provider
+	}()
+
+	testMailer.Reset()
+
+	res := models.Reservation{
+		FirstName:  "John",
+		LastName:   "Smith",
+		Email:      "john@smith.com",
+		RoomID:     1,
+		StartDate:  time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC),
+		EndDate:    time.Date(2050, 1, 2, 0, 0, 0, 0, time.UTC),
+		TotalPrice: 10000,
+	}
+
+	res, err := Repo.book(context.Background(), res, "tok_visa")
+	if !errors.Is(err, errDepositNotCaptured) {
+		t.Fatalf("expected errDepositNotCaptured but got %v", err)
+	}
+	if res.ID != 0 {
+		t.Errorf("expected nothing booked but got reservation %d", res.ID)
+	}
+	if provider.released != 1 {
+		t.Errorf("expected the authorization to be released once but it was released %d times", provider.released)
+	}
+	if len(testMailer.Messages()) != 0 {
+		t.Errorf("expected no emails but got %d", len(testMailer.Messages()))
+	}
+}
+
+var paymentWebhookTests = []struct {
+	name               string
+	payload            string
+	signed             bool
+	expectedStatusCode int
+}{
+	{"refunded", `{"id":"evt_1","type":"payment.refunded","reference":"fake_test","amount":6000}`, true, http.StatusOK},
+	{"failed", `{"id":"evt_2","type":"payment.failed","reference":"fake_test","amount":6000}`, true, http.StatusOK},
+	{"not-our-payment", `{"id":"evt_3","type":"payment.refunded","reference":"fake_other","amount":6000}`, true, http.StatusOK},
+	{"unknown-event", `{"id":"evt_4","type":"payment.disputed","reference":"fake_test","amount":6000}`, true, http.StatusOK},
+	{"unsigned", `{"id":"evt_5","type":"payment.refunded","reference":"fake_test","amount":6000}`, false, http.StatusBadRequest},
+	{"malformed", `not json`, true, http.StatusBadRequest},
+	{"no-event-id", `{"type":"payment.refunded","reference":"fake_test","amount":6000}`, true, http.StatusBadRequest},
+}
+
+func TestPaymentWebhook(t *testing.T) {
+	provider := payments.NewFake(paymentSecret)
+
+	for _, e := range paymentWebhookTests {
+		req, _ := http.NewRequest("POST", "/payments/webhook", strings.NewReader(e.payload))
+		if e.signed {
+			req.Header.Set("X-Payment-Signature", provider.SignWebhook([]byte(e.payload)))
+		}
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.PaymentWebhook)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+	}
+}
+
+var adminReservationInvoiceTests = []struct {
+	name               string
+	id                 string
+	expectedStatusCode int
+	expectedFilename   string
+}{
+	{"paid-deposit", "5", http.StatusOK, "INV-000005.pdf"},
+	{"unpaid", "1", http.StatusOK, "INV-000001.pdf"},
+	{"no-such-reservation", "100", http.StatusSeeOther, ""},
+}
+
+func TestAdminReservationInvoice(t *testing.T) {
+	for _, e := range adminReservationInvoiceTests {
+		req, _ := http.NewRequest("GET", "/admin/reservations/all/"+e.id+"/invoice", nil)
+		ctx := getCtx(req)
+
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("src", "all")
+		rctx.URLParams.Add("id", e.id)
+		ctx = context.WithValue(ctx, chi.RouteCtxKey, rctx)
+		req = req.WithContext(ctx)
+
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.AdminReservationInvoice)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+
+		if e.expectedFilename == "" {
+			continue
+		}
+
+		if ct := rr.Header().Get("Content-Type"); ct != "application/pdf" {
+			t.Errorf("failed %s: expected a pdf but got %s", e.name, ct)
+		}
+		if cd := rr.Header().Get("Content-Disposition"); !strings.Contains(cd, e.expectedFilename) {
+			t.Errorf("failed %s: expected %s to be downloaded but got %s", e.name, e.expectedFilename, cd)
+		}
+	}
+}
+
+var calendarTests = []struct {
+	name               string
+	url                string
+	expectedStatusCode int
+	expectedContent    []string
+	unexpectedContent  []string
+}{
+	{
+		name:               "room-feed",
+		url:                "/ical/rooms/1.ics?token=" + signedlink.Token(linkSecret, "ical-room", 1),
+		expectedStatusCode: http.StatusOK,
+		expectedContent:    []string{"BEGIN:VCALENDAR", "UID:restriction-1@localhost", "UID:restriction-2@localhost", "SUMMARY:Unavailable (Owner Block)"},
+		unexpectedContent:  []string{"Painting", "UID:restriction-3@localhost"},
+	},
+	{
+		name:               "room-feed-archived-room",
+		url:                "/ical/rooms/3.ics?token=" + signedlink.Token(linkSecret, "ical-room", 3),
+		expectedStatusCode: http.StatusNotFound,
+	},
+	{
+		name:               "room-feed-other-rooms-token",
+		url:                "/ical/rooms/1.ics?token=" + signedlink.Token(linkSecret, "ical-room", 2),
+		expectedStatusCode: http.StatusNotFound,
+	},
+	{
+		name:               "room-feed-no-token",
+		url:                "/ical/rooms/1.ics",
+		expectedStatusCode: http.StatusNotFound,
+	},
+	{
+		name:               "room-feed-no-such-room",
+		url:                "/ical/rooms/100.ics?token=" + signedlink.Token(linkSecret, "ical-room", 100),
+		expectedStatusCode: http.StatusNotFound,
+	},
+	{
+		name:               "staff-feed",
+		url:                "/ical/staff.ics?token=" + signedlink.Token(linkSecret, "ical-staff", 0),
+		expectedStatusCode: http.StatusOK,
+		expectedContent:    []string{"SUMMARY:Arrival: John Smith (General's Quarters)", "DTSTART;VALUE=DATE:20500112", "UID:departure-1@localhost"},
+	},
+	{
+		name:               "staff-feed-room-token",
+		url:                "/ical/staff.ics?token=" + signedlink.Token(linkSecret, "ical-room", 0),
+		expectedStatusCode: http.StatusNotFound,
+	},
+}
+
+func TestCalendars(t *testing.T) {
+	routes := getRoutes()
+	ts := httptest.NewTLSServer(routes)
+	defer ts.Close()
+
+	for _, e := range calendarTests {
+		resp, err := ts.Client().Get(ts.URL + e.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedStatusCode, resp.StatusCode)
+			continue
+		}
+
+		for _, want := range e.expectedContent {
+			if !strings.Contains(string(body), want) {
+				t.Errorf("failed %s: expected feed to contain %q", e.name, want)
+			}
+		}
+		for _, unwanted := range e.unexpectedContent {
+			if strings.Contains(string(body), unwanted) {
+				t.Errorf("failed %s: expected feed not to contain %q", e.name, unwanted)
+			}
+		}
+	}
+}
+
+// channelFeed is a channel's calendar with one stay that can be blocked and one that clashes with
+// a booking the testing repo already has
+const channelFeed = "BEGIN:VCALENDAR\r\nVERSION:2.0\r\n" +
+	"BEGIN:VEVENT\r\nUID:stay-1@channel.example\r\nDTSTART;VALUE=DATE:20500110\r\nDTEND;VALUE=DATE:20500112\r\nSUMMARY:Reserved\r\nEND:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\nUID:stay-2@channel.example\r\nDTSTART;VALUE=DATE:20700101\r\nDTEND;VALUE=DATE:20700103\r\nSUMMARY:Reserved\r\nEND:VEVENT\r\n" +
+	"END:VCALENDAR\r\n"
+
+var adminPostRoomCalendarTests = []struct {
+	name               string
+	roomID             string
+	url                string
+	file               string
+	expectedStatusCode int
+	expectedFlash      string
+	expectedError      string
+}{
+	{"upload", "1", "https://channel.example/rooms/1.ics", channelFeed, http.StatusSeeOther, "1 stays blocked, 1 clash", ""},
+	{"upload-not-a-calendar", "1", "https://channel.example/rooms/1.ics", "<html></html>", http.StatusSeeOther, "", "Calendar sync failed"},
+	{"fetch", "2", "/channel.ics", "", http.StatusSeeOther, "1 stays blocked, 1 clash", ""},
+	{"fetch-fails", "2", "/missing.ics", "", http.StatusSeeOther, "", "Calendar sync failed"},
+	{"bad-address", "2", "ftp://channel.example/rooms/2.ics", "", http.StatusSeeOther, "", "must be an http or https URL"},
+	{"clear-address", "1", "", "", http.StatusSeeOther, "Calendar import saved", ""},
+	{"unknown-room", "100", "", "", http.StatusInternalServerError, "", ""},
+}
+
+func TestAdminPostRoomCalendar(t *testing.T) {
+	channel := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/channel.ics" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(channelFeed))
+	}))
+	defer channel.Close()
+
+	for _, e := range adminPostRoomCalendarTests {
+		feedURL := e.url
+		if strings.HasPrefix(feedURL, "/") {
+			feedURL = channel.URL + feedURL
+		}
+
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		mw.WriteField("url", feedURL)
+		if e.file != "" {
+			fw, _ := mw.CreateFormFile("calendar", "channel.ics")
+			fw.Write([]byte(e.file))
+		}
+		mw.Close()
+
+		req, _ := http.NewRequest("POST", "/admin/rooms/"+e.roomID+"/calendar", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		ctx := getCtx(req)
+
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("id", e.roomID)
+		ctx = context.WithValue(ctx, chi.RouteCtxKey, rctx)
+		req = req.WithContext(ctx)
+
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.AdminPostRoomCalendar)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedStatusCode, rr.Code)
+			continue
+		}
+
+		if flash := session.GetString(ctx, "flash"); !strings.Contains(flash, e.expectedFlash) || (e.expectedFlash == "" && flash != "") {
+			t.Errorf("failed %s: expected flash %q, but got %q", e.name, e.expectedFlash, flash)
+		}
+		if msg := session.GetString(ctx, "error"); !strings.Contains(msg, e.expectedError) || (e.expectedError == "" && msg != "") {
+			t.Errorf("failed %s: expected error %q, but got %q", e.name, e.expectedError, msg)
+		}
+	}
+}
+
+var adminPostShowAPIKeyTests = []struct {
+	name               string
+	id                 string
+	postedData         url.Values
+	expectedStatusCode int
+	expectedHTML       string
+	expectNewKey       bool
+}{
+	{
+		name:               "new-key",
+		id:                 "0",
+		postedData:         url.Values{"name": {"Channel Partner"}, "scope": {"booking"}, "rate_limit": {"120"}},
+		expectedStatusCode: http.StatusSeeOther,
+		expectNewKey:       true,
+	},
+	{
+		name:               "edit-key",
+		id:                 "1",
+		postedData:         url.Values{"name": {"Rate Checker"}, "scope": {"availability"}, "rate_limit": {"30"}},
+		expectedStatusCode: http.StatusSeeOther,
+	},
+	{
+		name:               "missing-name",
+		id:                 "0",
+		postedData:         url.Values{"name": {""}, "scope": {"booking"}, "rate_limit": {"60"}},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "This field cannot be blank",
+	},
+	{
+		name:               "unknown-scope",
+		id:                 "1",
+		postedData:         url.Values{"name": {"Rate Checker"}, "scope": {"admin"}, "rate_limit": {"60"}},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "Pick one of the scopes",
+	},
+	{
+		name:               "zero-rate-limit",
+		id:                 "1",
+		postedData:         url.Values{"name": {"Rate Checker"}, "scope": {"booking"}, "rate_limit": {"0"}},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       `value="0"`,
+	},
+	{
+		name:               "insert-fails",
+		id:                 "0",
+		postedData:         url.Values{"name": {"fail"}, "scope": {"booking"}, "rate_limit": {"60"}},
+		expectedStatusCode: http.StatusSeeOther,
+	},
+}
+
+func TestAdminPostShowAPIKey(t *testing.T) {
+	for _, e := range adminPostShowAPIKeyTests {
+		req, _ := http.NewRequest("POST", "/admin/api-keys/"+e.id, strings.NewReader(e.postedData.Encode()))
+		ctx := getCtx(req)
+
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("id", e.id)
+		ctx = context.WithValue(ctx, chi.RouteCtxKey, rctx)
+		req = req.WithContext(ctx)
+
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.AdminPostShowAPIKey)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+
+		if e.expectedHTML != "" && !strings.Contains(rr.Body.String(), e.expectedHTML) {
+			t.Errorf("failed %s: expected to find %s but did not", e.name, e.expectedHTML)
+		}
+
+		newKey := session.GetString(ctx, "new_api_key")
+		if e.expectNewKey != strings.HasPrefix(newKey, apikeys.Prefix) {
+			t.Errorf("failed %s: expected new key to be shown to be %t, but got %q", e.name, e.expectNewKey, newKey)
+		}
+	}
+}
+
+func TestAdminRotateAndRevokeAPIKey(t *testing.T) {
+	tests := []struct {
+		name          string
+		handler       http.HandlerFunc
+		id            string
+		expectNewKey  bool
+		expectedError bool
+	}{
+		{"rotate", Repo.AdminRotateAPIKey, "2", true, false},
+		{"rotate-revoked", Repo.AdminRotateAPIKey, "4", false, true},
+		{"revoke", Repo.AdminRevokeAPIKey, "2", false, false},
+		{"revoke-fails", Repo.AdminRevokeAPIKey, "100", false, true},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/admin/"+e.name+"/"+e.id+"/do", nil)
+		ctx := getCtx(req)
+
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("id", e.id)
+		ctx = context.WithValue(ctx, chi.RouteCtxKey, rctx)
+		req = req.WithContext(ctx)
+
+		rr := httptest.NewRecorder()
+		e.handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusSeeOther {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, http.StatusSeeOther, rr.Code)
+		}
+		if session.Exists(ctx, "error") != e.expectedError {
+			t.Errorf("failed %s: expected error in session to be %t", e.name, e.expectedError)
+		}
+		if newKey := session.GetString(ctx, "new_api_key"); e.expectNewKey != strings.HasPrefix(newKey, apikeys.Prefix) {
+			t.Errorf("failed %s: expected new key to be shown to be %t, but got %q", e.name, e.expectNewKey, newKey)
+		}
+	}
+}
+
+var adminPostShowWebhookTests = []struct {
+	name               string
+	id                 string
+	postedData         url.Values
+	expectedStatusCode int
+	expectedHTML       string
+	expectedLocation   string
+}{
+	{
+		name:               "new-webhook",
+		id:                 "0",
+		postedData:         url.Values{"url": {"https://housekeeping.example.com/hook"}, "events": {"reservation.created", "block.created"}, "active": {"1"}},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedLocation:   "/admin/webhooks/3/show",
+	},
+	{
+		name:               "edit-webhook",
+		id:                 "1",
+		postedData:         url.Values{"url": {"https://housekeeping.example.com/hook"}, "events": {"reservation.cancelled"}},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedLocation:   "/admin/webhooks/1/show",
+	},
+	{
+		name:               "missing-url",
+		id:                 "0",
+		postedData:         url.Values{"url": {""}, "events": {"reservation.created"}},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "This field cannot be blank",
+	},
+	{
+		name:               "not-http",
+		id:                 "0",
+		postedData:         url.Values{"url": {"ftp://example.com"}, "events": {"reservation.created"}},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "must be an http or https URL",
+	},
+	{
+		name:               "no-events",
+		id:                 "1",
+		postedData:         url.Values{"url": {"https://example.com/hook"}},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "Pick at least one event",
+	},
+	{
+		name:               "unknown-event",
+		id:                 "1",
+		postedData:         url.Values{"url": {"https://example.com/hook"}, "events": {"room.created"}},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       "Pick from the events listed",
+	},
+	{
+		name:               "unknown-webhook",
+		id:                 "100",
+		postedData:         url.Values{"url": {"https://example.com/hook"}, "events": {"reservation.created"}},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedLocation:   "/admin/webhooks",
+	},
+	{
+		name:               "insert-fails",
+		id:                 "0",
+		postedData:         url.Values{"url": {"https://example.com/fail"}, "events": {"reservation.created"}},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedLocation:   "/admin/webhooks",
+	},
+}
+
+func TestAdminPostShowWebhook(t *testing.T) {
+	for _, e := range adminPostShowWebhookTests {
+		req, _ := http.NewRequest("POST", "/admin/webhooks/"+e.id, strings.NewReader(e.postedData.Encode()))
+		ctx := getCtx(req)
+
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("id", e.id)
+		ctx = context.WithValue(ctx, chi.RouteCtxKey, rctx)
+		req = req.WithContext(ctx)
+
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.AdminPostShowWebhook)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+
+		if e.expectedHTML != "" && !strings.Contains(rr.Body.String(), e.expectedHTML) {
+			t.Errorf("failed %s: expected to find %s but did not", e.name, e.expectedHTML)
+		}
+
+		if e.expectedLocation != "" {
+			actualLoc, _ := rr.Result().Location()
+			if actualLoc.String() != e.expectedLocation {
+				t.Errorf("failed %s: expected location %s, but got %s", e.name, e.expectedLocation, actualLoc.String())
+			}
+		}
+	}
+}
+
+func TestAdminRedeliverWebhook(t *testing.T) {
+	tests := []struct {
+		name          string
+		id            string
+		expectedError string
+	}{
+		// nothing listens at the testing subscription's address
+		{"unreachable", "2", "Redelivery failed"},
+		{"record-fails", "100", "Can't find delivery"},
+		{"unknown-delivery", "7", "Can't find delivery"},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/admin/redeliver-webhook/"+e.id+"/do", nil)
+		ctx := getCtx(req)
+
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("id", e.id)
+		ctx = context.WithValue(ctx, chi.RouteCtxKey, rctx)
+		req = req.WithContext(ctx)
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(Repo.AdminRedeliverWebhook)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusSeeOther {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, http.StatusSeeOther, rr.Code)
+		}
+		if msg := session.GetString(ctx, "error"); !strings.Contains(msg, e.expectedError) {
+			t.Errorf("failed %s: expected error %q, but got %q", e.name, e.expectedError, msg)
+		}
+	}
+}
+
+func TestAdminResendOutboxMessage(t *testing.T) {
+	tests := []struct {
+		name          string
+		id            string
+		expectedError bool
+	}{
+		{"dead", "2", false},
+		{"already-sent", "1", true},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/admin/resend-outbox-message/"+e.id+"/do", nil)
+		ctx := getCtx(req)
+
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("id", e.id)
+		ctx = context.WithValue(ctx, chi.RouteCtxKey, rctx)
+		req = req.WithContext(ctx)
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(Repo.AdminResendOutboxMessage)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusSeeOther {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, http.StatusSeeOther, rr.Code)
+		}
+		if session.Exists(ctx, "error") != e.expectedError {
+			t.Errorf("failed %s: expected error in session to be %t", e.name, e.expectedError)
+		}
+		if loc, _ := rr.Result().Location(); loc.String() != "/admin/outbox/"+e.id+"/show" {
+			t.Errorf("failed %s: unexpected location %s", e.name, loc)
+		}
+	}
+}
+
+const testEmailSource = `{{template "basic" .}}
+{{define "subject"}}Booked: {{.Reservation.FirstName}}{{end}}
+{{define "body"}}Dear {{.Reservation.FirstName}}, see <a href="{{.Link}}">your booking</a>{{end}}`
+
+var adminPostShowEmailTemplateTests = []struct {
+	name               string
+	event              string
+	postedData         url.Values
+	expectedStatusCode int
+	expectedHTML       string
+	expectedLocation   string
+	expectedMail       string
+}{
+	{
+		name:               "save",
+		event:              "reservation-confirmation",
+		postedData:         url.Values{"source": {testEmailSource}, "note": {"Friendlier"}, "action": {"save"}},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedLocation:   "/admin/email-templates/reservation-confirmation/show",
+	},
+	{
+		name:               "no-body",
+		event:              "reservation-confirmation",
+		postedData:         url.Values{"source": {`{{define "subject"}}Hi{{end}}`}, "action": {"save"}},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       `the template must define &#34;body&#34;`,
+	},
+	{
+		name:               "wrong-data",
+		event:              "waitlist-offer",
+		postedData:         url.Values{"source": {testEmailSource}, "action": {"save"}},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       `is-invalid`,
+	},
+	{
+		name:               "blank",
+		event:              "reservation-confirmation",
+		postedData:         url.Values{"source": {" "}, "action": {"save"}},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       `This field cannot be blank`,
+	},
+	{
+		name:               "newer-version-saved",
+		event:              "reservation-confirmation",
+		postedData:         url.Values{"source": {testEmailSource}, "version": {"2"}, "action": {"save"}},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       `A newer version was saved while you were editing`,
+	},
+	{
+		name:               "saved-meanwhile",
+		event:              "reservation-confirmation",
+		postedData:         url.Values{"source": {testEmailSource}, "note": {"race"}, "action": {"save"}},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       `A newer version was saved while you were editing`,
+	},
+	{
+		name:               "save-fails",
+		event:              "reservation-confirmation",
+		postedData:         url.Values{"source": {testEmailSource}, "note": {"fail"}, "action": {"save"}},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       `save email template`,
+	},
+	{
+		name:               "send-test",
+		event:              "reservation-confirmation",
+		postedData:         url.Values{"source": {testEmailSource}, "reservation_id": {"7"}, "action": {"test"}},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       `Test email queued to me@here.ca`,
+		expectedMail:       "[Test] Booked: John",
+	},
+	{
+		name:               "send-test-sample",
+		event:              "reservation-confirmation",
+		postedData:         url.Values{"source": {testEmailSource}, "action": {"test"}},
+		expectedStatusCode: http.StatusOK,
+		expectedMail:       "[Test] Booked: Jane",
+	},
+	{
+		name:               "send-test-unknown-reservation",
+		event:              "reservation-confirmation",
+		postedData:         url.Values{"source": {testEmailSource}, "reservation_id": {"100"}, "action": {"test"}},
+		expectedStatusCode: http.StatusOK,
+		expectedHTML:       `find reservation 100`,
+	},
+	{
+		name:               "unknown-event",
+		event:              "carrier-pigeon",
+		postedData:         url.Values{"source": {testEmailSource}, "action": {"save"}},
+		expectedStatusCode: http.StatusSeeOther,
+		expectedLocation:   "/admin/email-templates",
+	},
+}
+
+func TestAdminPostShowEmailTemplate(t *testing.T) {
+	for _, e := range adminPostShowEmailTemplateTests {
+		testMailer.Reset()
+
+		req, _ := http.NewRequest("POST", "/admin/email-templates/"+e.event, strings.NewReader(e.postedData.Encode()))
+		ctx := getCtx(req)
+		session.Put(ctx, "user_id", 1)
+
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("event", e.event)
+		ctx = context.WithValue(ctx, chi.RouteCtxKey, rctx)
+		req = req.WithContext(ctx)
+
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.AdminPostShowEmailTemplate)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+
+		if e.expectedHTML != "" && !strings.Contains(rr.Body.String(), e.expectedHTML) {
+			t.Errorf("failed %s: expected to find %s but did not", e.name, e.expectedHTML)
+		}
+
+		if e.expectedLocation != "" {
+			actualLoc, _ := rr.Result().Location()
+			if actualLoc.String() != e.expectedLocation {
+				t.Errorf("failed %s: expected location %s, but got %s", e.name, e.expectedLocation, actualLoc.String())
+			}
+		}
+
+		sent := testMailer.Messages()
+		if e.expectedMail == "" {
+			if len(sent) != 0 {
+				t.Errorf("failed %s: expected no email but got %d", e.name, len(sent))
+			}
+			continue
+		}
+		if len(sent) != 1 || sent[0].Subject != e.expectedMail || sent[0].To != "me@here.ca" {
+			t.Errorf("failed %s: expected a test email %q to me@here.ca but got %+v", e.name, e.expectedMail, sent)
+		}
+	}
+}
+
+func TestAdminPreviewEmailTemplate(t *testing.T) {
+	tests := []struct {
+		name               string
+		event              string
+		postedData         url.Values
+		expectedStatusCode int
+		expectedOK         bool
+		expected           string
+	}{
+		{"sample", "reservation-confirmation", url.Values{"source": {testEmailSource}}, http.StatusOK, true, "Booked: Jane"},
+		{"reservation", "reservation-confirmation", url.Values{"source": {testEmailSource}, "reservation_id": {"7"}}, http.StatusOK, true, "Booked: John"},
+		{"unknown-reservation", "reservation-confirmation", url.Values{"source": {testEmailSource}, "reservation_id": {"100"}}, http.StatusOK, false, "can't find reservation 100"},
+		{"bad-reservation", "reservation-confirmation", url.Values{"source": {testEmailSource}, "reservation_id": {"seven"}}, http.StatusOK, false, "must be a number"},
+		{"syntax", "reservation-confirmation", url.Values{"source": {`{{define "subject"}}`}}, http.StatusOK, false, "unexpected EOF"},
+		{"unknown-event", "carrier-pigeon", url.Values{"source": {testEmailSource}}, http.StatusNotFound, false, "Can't find email template"},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("POST", "/admin/email-templates/"+e.event+"/preview", strings.NewReader(e.postedData.Encode()))
+		ctx := getCtx(req)
+
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("event", e.event)
+		ctx = context.WithValue(ctx, chi.RouteCtxKey, rctx)
+		req = req.WithContext(ctx)
+
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(Repo.AdminPreviewEmailTemplate)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+
+		var resp emailPreview
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Errorf("failed %s: can't parse json: %s", e.name, err)
+			continue
+		}
+		if resp.OK != e.expectedOK {
+			t.Errorf("failed %s: expected ok to be %t but got %+v", e.name, e.expectedOK, resp)
+		}
+		if e.expectedOK && (resp.Subject != e.expected || !strings.Contains(resp.HTML, "<html") || !strings.Contains(resp.Text, "your booking (")) {
+			t.Errorf("failed %s: unexpected preview %+v", e.name, resp)
+		}
+		if !e.expectedOK && !strings.Contains(resp.Error, e.expected) {
+			t.Errorf("failed %s: expected error %q but got %q", e.name, e.expected, resp.Error)
+		}
+	}
+}
+
+func TestAdminRollbackEmailTemplate(t *testing.T) {
+	tests := []struct {
+		name             string
+		id               string
+		expectedError    string
+		expectedLocation string
+	}{
+		{"renders", "1", "", "/admin/email-templates/reservation-confirmation/show"},
+		{"no-longer-renders", "2", "Version 2 no longer renders", "/admin/email-templates/reservation-confirmation/show"},
+		{"unknown-version", "7", "Can't find that version", "/admin/email-templates"},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/admin/rollback-email-template/"+e.id+"/do", nil)
+		ctx := getCtx(req)
+
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("id", e.id)
+		ctx = context.WithValue(ctx, chi.RouteCtxKey, rctx)
+		req = req.WithContext(ctx)
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(Repo.AdminRollbackEmailTemplate)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusSeeOther {
+			t.Errorf("failed %s: expected code %d, but got %d", e.name, http.StatusSeeOther, rr.Code)
+		}
+		msg := session.GetString(ctx, "error")
+		if (e.expectedError == "" && msg != "") || !strings.Contains(msg, e.expectedError) {
+			t.Errorf("failed %s: expected error %q, but got %q", e.name, e.expectedError, msg)
+		}
+		if loc, _ := rr.Result().Location(); loc.String() != e.expectedLocation {
+			t.Errorf("failed %s: unexpected location %s", e.name, loc)
+		}
 	}
-	return ctx
 }
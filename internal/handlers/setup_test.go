@@ -16,19 +16,31 @@ import (
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
 	"github.com/justinas/nosurf"
+	"github.com/msaufi2325/06_bookings/internal/apikeys"
+	"github.com/msaufi2325/06_bookings/internal/cancellation"
 	"github.com/msaufi2325/06_bookings/internal/config"
+	"github.com/msaufi2325/06_bookings/internal/helpers"
+	"github.com/msaufi2325/06_bookings/internal/mailer"
 	"github.com/msaufi2325/06_bookings/internal/models"
+	"github.com/msaufi2325/06_bookings/internal/payments"
 	"github.com/msaufi2325/06_bookings/internal/render"
+	"github.com/msaufi2325/06_bookings/internal/status"
 )
 
 var app config.AppConfig
 var session *scs.SessionManager
 var pathToTemplates = "./../../templates"
+var linkSecret = []byte("test-secret")
+var paymentSecret = []byte("test-payment-secret")
+var testMailer = mailer.NewMemory()
 var functions = template.FuncMap{
-	"humanDate":  render.HumanDate,
-	"formatDate": render.FormatDate,
-	"iterate":    render.Iterate,
-	"add":        render.Add,
+	"humanDate":      render.HumanDate,
+	"formatDate":     render.FormatDate,
+	"iterate":        render.Iterate,
+	"add":            render.Add,
+	"formatCurrency": render.FormatCurrency,
+	"statusLabel":    status.Label,
+	"policyTerms":    cancellation.Describe,
 }
 
 func TestMain(m *testing.M) {
@@ -40,6 +52,12 @@ func TestMain(m *testing.M) {
 
 	// change this to true when in production
 	app.InProduction = false
+	app.BaseURL = "http://localhost:8080"
+	app.LinkSecret = linkSecret
+	app.WaitlistHold = time.Hour
+	app.Payments = payments.NewFake(paymentSecret)
+	app.APILimiter = apikeys.NewLimiter()
+	app.Mailer = testMailer
 
 	infoLog := log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
 	app.InfoLog = infoLog
@@ -55,35 +73,24 @@ func TestMain(m *testing.M) {
 
 	app.Session = session
 
-	mailChan := make(chan models.MailData)
-	app.MailChan = mailChan
-	defer close(mailChan)
-
-	listenForMail()
-
 	tc, err := CreateTemplateCache()
 	if err != nil {
 		log.Fatal("cannot create template cache")
 	}
 
 	app.TemplateCache = tc
+
+	app.EmailTemplateDir = "./../../email-templates"
 	app.UseCache = true
 
 	repo := NewTestRepo(&app)
 	NewHandlers(repo)
 	render.NewRenderer(&app)
+	helpers.NewHelpers(&app)
 
 	os.Exit(m.Run())
 }
 
-func listenForMail() {
-	go func() {
-		for {
-			<-app.MailChan
-		}
-	}()
-}
-
 func getRoutes() http.Handler {
 
 	mux := chi.NewRouter()
@@ -94,8 +101,8 @@ func getRoutes() http.Handler {
 
 	mux.Get("/", Repo.Home)
 	mux.Get("/about", Repo.About)
-	mux.Get("/generals-quarters", Repo.Generals)
-	mux.Get("/majors-suite", Repo.Majors)
+	mux.Get("/rooms", Repo.Rooms)
+	mux.Get("/rooms/{slug}", Repo.Room)
 
 	mux.Get("/search-availability", Repo.Availability)
 	mux.Post("/search-availability", Repo.PostAvailability)
@@ -107,6 +114,36 @@ func getRoutes() http.Handler {
 	mux.Post("/make-reservation", Repo.PostReservation)
 	mux.Get("/reservation-summary", Repo.ReservationSummary)
 
+	mux.Get("/my-reservation", Repo.MyReservation)
+	mux.Post("/my-reservation/contact", Repo.PostMyReservationContact)
+	mux.Post("/my-reservation/dates", Repo.PostMyReservationDates)
+	mux.Post("/my-reservation/cancel", Repo.PostMyReservationCancel)
+
+	mux.Get("/waitlist", Repo.Waitlist)
+	mux.Post("/waitlist", Repo.PostWaitlist)
+	mux.Get("/waitlist/hold", Repo.WaitlistHold)
+
+	mux.Post("/payments/webhook", Repo.PaymentWebhook)
+
+	mux.Get("/ical/rooms/{id}.ics", Repo.RoomCalendar)
+	mux.Get("/ical/staff.ics", Repo.StaffCalendar)
+
+	mux.Route("/api/v1", func(mux chi.Router) {
+		mux.Use(Repo.APIAuth)
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(Repo.RequireAPIScope(apikeys.ScopeAvailability))
+			mux.Get("/rooms", Repo.APIRooms)
+			mux.Get("/rooms/{id}/availability", Repo.APIRoomAvailability)
+		})
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(Repo.RequireAPIScope(apikeys.ScopeBooking))
+			mux.Post("/reservations", Repo.APIPostReservation)
+			mux.Get("/reservations/{id}", Repo.APIReservation)
+		})
+	})
+
 	mux.Get("/user/login", Repo.ShowLogin)
 	mux.Post("/user/login", Repo.PostShowLogin)
 	mux.Get("/user/logout", Repo.Logout)
@@ -115,15 +152,67 @@ func getRoutes() http.Handler {
 
 	mux.Get("/admin/reservations-new", Repo.AdminNewReservations)
 	mux.Get("/admin/reservations-all", Repo.AdminAllReservations)
+	mux.Get("/admin/reservations-deleted", Repo.AdminDeletedReservations)
 	mux.Get("/admin/reservations-calendar", Repo.AdminReservationsCalendar)
-	mux.Post("/admin/reservations-calendar", Repo.AdminPostReservationsCalendar)
+	mux.Get("/admin/blocks/{id}/show", Repo.AdminShowBlock)
+	mux.Post("/admin/blocks/{id}", Repo.AdminPostShowBlock)
+	mux.Get("/admin/delete-block/{id}/do", Repo.AdminDeleteBlock)
+
+	mux.Get("/admin/restrictions", Repo.AdminRestrictions)
+	mux.Get("/admin/restrictions/{id}/show", Repo.AdminShowRestriction)
+	mux.Post("/admin/restrictions/{id}", Repo.AdminPostShowRestriction)
+	mux.Get("/admin/delete-restriction/{id}/do", Repo.AdminDeleteRestriction)
+
+	mux.Get("/admin/cancellation-policies", Repo.AdminCancellationPolicies)
+	mux.Get("/admin/cancellation-policies/{id}/show", Repo.AdminShowCancellationPolicy)
+	mux.Post("/admin/cancellation-policies/{id}", Repo.AdminPostShowCancellationPolicy)
+	mux.Get("/admin/delete-cancellation-policy/{id}/do", Repo.AdminDeleteCancellationPolicy)
+	mux.Get("/admin/waitlist", Repo.AdminWaitlist)
+	mux.Get("/admin/delete-waitlist-entry/{id}/do", Repo.AdminDeleteWaitlistEntry)
 
 	mux.Get("/admin/process-reservation/{src}/{id}/do", Repo.AdminProcessReservation)
 	mux.Get("/admin/delete-reservation/{src}/{id}/do", Repo.AdminDeleteReservation)
+	mux.Get("/admin/restore-reservation/{id}/do", Repo.AdminRestoreReservation)
 
 	mux.Get("/admin/reservations/{src}/{id}/show", Repo.AdminShowReservation)
+	mux.Get("/admin/reservations/{src}/{id}/invoice", Repo.AdminReservationInvoice)
 	mux.Post("/admin/reservations/{src}/{id}", Repo.AdminPostShowReservation)
 
+	mux.Get("/admin/rooms", Repo.AdminRooms)
+	mux.Get("/admin/rooms/{id}/show", Repo.AdminShowRoom)
+	mux.Post("/admin/rooms/{id}", Repo.AdminPostShowRoom)
+	mux.Get("/admin/rooms/{id}/rates", Repo.AdminRoomRates)
+	mux.Post("/admin/rooms/{id}/rates", Repo.AdminPostRoomRates)
+	mux.Post("/admin/rooms/{id}/calendar", Repo.AdminPostRoomCalendar)
+	mux.Get("/admin/delete-rate-season/{roomID}/{id}/do", Repo.AdminDeleteRateSeason)
+	mux.Get("/admin/archive-room/{id}/do", Repo.AdminArchiveRoom)
+	mux.Get("/admin/restore-room/{id}/do", Repo.AdminRestoreRoom)
+
+	mux.Get("/admin/api-keys", Repo.AdminAPIKeys)
+	mux.Get("/admin/api-keys/{id}/show", Repo.AdminShowAPIKey)
+	mux.Post("/admin/api-keys/{id}", Repo.AdminPostShowAPIKey)
+	mux.Get("/admin/rotate-api-key/{id}/do", Repo.AdminRotateAPIKey)
+	mux.Get("/admin/revoke-api-key/{id}/do", Repo.AdminRevokeAPIKey)
+
+	mux.Get("/admin/webhooks", Repo.AdminWebhooks)
+	mux.Get("/admin/webhooks/{id}/show", Repo.AdminShowWebhook)
+	mux.Post("/admin/webhooks/{id}", Repo.AdminPostShowWebhook)
+	mux.Get("/admin/webhooks/{id}/deliveries", Repo.AdminWebhookDeliveries)
+	mux.Get("/admin/delete-webhook/{id}/do", Repo.AdminDeleteWebhook)
+	mux.Get("/admin/redeliver-webhook/{id}/do", Repo.AdminRedeliverWebhook)
+
+	mux.Get("/admin/outbox", Repo.AdminOutbox)
+	mux.Get("/admin/outbox/{id}/show", Repo.AdminShowOutboxMessage)
+	mux.Get("/admin/resend-outbox-message/{id}/do", Repo.AdminResendOutboxMessage)
+
+	mux.Get("/admin/email-templates", Repo.AdminEmailTemplates)
+	mux.Get("/admin/email-templates/{event}/show", Repo.AdminShowEmailTemplate)
+	mux.Post("/admin/email-templates/{event}", Repo.AdminPostShowEmailTemplate)
+	mux.Post("/admin/email-templates/{event}/preview", Repo.AdminPreviewEmailTemplate)
+	mux.Get("/admin/rollback-email-template/{id}/do", Repo.AdminRollbackEmailTemplate)
+
+	mux.Get("/admin/audit", Repo.AdminAudit)
+
 	fileServer := http.FileServer(http.Dir("./static/"))
 	mux.Handle("/static/*", http.StripPrefix("/static", fileServer))
 
@@ -140,6 +229,13 @@ func NoSurf(next http.Handler) http.Handler {
 		Secure:   app.InProduction,
 		SameSite: http.SameSiteLaxMode,
 	})
+
+	// the payment provider signs its webhooks instead
+	csrfHandler.ExemptPath("/payments/webhook")
+
+	// API clients don't hold a session cookie to tie a token to
+	csrfHandler.ExemptRegexp("^/api/")
+
 	return csrfHandler
 }
 
@@ -1,15 +1,22 @@
 package helpers
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+	"regexp"
 	"runtime/debug"
+	"strconv"
+	"strings"
 
 	"github.com/msaufi2325/06_bookings/internal/config"
 )
 
 var app *config.AppConfig
 
+var nonSlugChars = regexp.MustCompile(`[^a-z0-9]+`)
+var amountPattern = regexp.MustCompile(`^[0-9]+(\.[0-9]{1,2})?$`)
+
 // NewHelpers sets up the app config for the helpers
 func NewHelpers(a *config.AppConfig) {
 	app = a
@@ -30,3 +37,39 @@ func IsAuthenticated(r *http.Request) bool {
 	exixts := app.Session.Exists(r.Context(), "user_id")
 	return exixts
 }
+
+// Slugify turns a name into a url friendly slug, e.g. "General's Quarters" becomes "generals-quarters"
+func Slugify(s string) string {
+	s = strings.ToLower(strings.ReplaceAll(s, "'", ""))
+	return strings.Trim(nonSlugChars.ReplaceAllString(s, "-"), "-")
+}
+
+// SplitLines splits text into its trimmed, non-empty lines
+func SplitLines(s string) []string {
+	var lines []string
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// ParseCents parses a dollar amount such as "125", "125.5" or "$125.50" into cents
+func ParseCents(s string) (int, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "$")
+	if !amountPattern.MatchString(s) {
+		return 0, errors.New("invalid amount")
+	}
+
+	dollars, fraction, _ := strings.Cut(s, ".")
+	whole, err := strconv.Atoi(dollars)
+	if err != nil {
+		return 0, err
+	}
+
+	cents, _ := strconv.Atoi((fraction + "00")[:2])
+
+	return whole*100 + cents, nil
+}
@@ -0,0 +1,251 @@
+package ical
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// ErrNotCalendar is returned by Parse for input that has no VCALENDAR in it
+var ErrNotCalendar = errors.New("not an iCalendar file")
+
+// ProductID identifies this application in the calendars it writes
+const ProductID = "-//Fort Smythe Bed and Breakfast//Bookings//EN"
+
+// dateLayout is the iCalendar DATE format
+const dateLayout = "20060102"
+
+// stampLayout is the iCalendar UTC DATE-TIME format
+const stampLayout = "20060102T150405Z"
+
+// maxLineOctets is the longest a content line may be before it is folded
+const maxLineOctets = 75
+
+// Event is an all-day calendar event. End is exclusive, so a stay's departure date is its end
+type Event struct {
+	UID         string
+	Start       time.Time
+	End         time.Time
+	Summary     string
+	Description string
+}
+
+// Write writes a calendar called name holding events to w. Stamp is the DTSTAMP given to every event,
+// normally the time the feed was generated
+func Write(w io.Writer, name string, events []Event, stamp time.Time) error {
+	bw := bufio.NewWriter(w)
+
+	line := func(s string) {
+		bw.WriteString(fold(s))
+		bw.WriteString("\r\n")
+	}
+
+	line("BEGIN:VCALENDAR")
+	line("VERSION:2.0")
+	line("PRODID:" + ProductID)
+	line("CALSCALE:GREGORIAN")
+	line("METHOD:PUBLISH")
+	line("X-WR-CALNAME:" + escape(name))
+
+	for _, e := range events {
+		line("BEGIN:VEVENT")
+		line("UID:" + escape(e.UID))
+		line("DTSTAMP:" + stamp.UTC().Format(stampLayout))
+		line("DTSTART;VALUE=DATE:" + e.Start.Format(dateLayout))
+		line("DTEND;VALUE=DATE:" + e.End.Format(dateLayout))
+		line("SUMMARY:" + escape(e.Summary))
+		if e.Description != "" {
+			line("DESCRIPTION:" + escape(e.Description))
+		}
+		line("TRANSP:OPAQUE")
+		line("END:VEVENT")
+	}
+
+	line("END:VCALENDAR")
+
+	return bw.Flush()
+}
+
+// Parse reads the events in an iCalendar feed. Times are reduced to their dates, since rooms are
+// booked by the night: an event starting at 3pm on the 10th and ending at 11am on the 12th covers
+// the nights of the 10th and 11th. An event with no DTEND lasts one day. Cancelled events, and
+// events without a UID or start, are left out
+func Parse(r io.Reader) ([]Event, error) {
+	var events []Event
+
+	lines, err := unfold(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		found   bool
+		inEvent bool
+		e       Event
+		skip    bool
+	)
+
+	for n, l := range lines {
+		name, params, value := split(l)
+
+		switch {
+		case name == "BEGIN" && value == "VCALENDAR":
+			found = true
+		case name == "BEGIN" && value == "VEVENT":
+			inEvent = true
+			e = Event{}
+			skip = false
+		case name == "END" && value == "VEVENT":
+			inEvent = false
+			if skip || e.UID == "" || e.Start.IsZero() {
+				continue
+			}
+			if e.End.IsZero() {
+				e.End = e.Start.AddDate(0, 0, 1)
+			}
+			events = append(events, e)
+		case !inEvent:
+			continue
+		case name == "UID":
+			e.UID = unescape(value)
+		case name == "SUMMARY":
+			e.Summary = unescape(value)
+		case name == "DESCRIPTION":
+			e.Description = unescape(value)
+		case name == "STATUS":
+			skip = strings.EqualFold(value, "CANCELLED")
+		case name == "DTSTART", name == "DTEND":
+			d, err := parseDate(value, params)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", n+1, err)
+			}
+			if name == "DTSTART" {
+				e.Start = d
+			} else {
+				e.End = d
+			}
+		}
+	}
+
+	if !found {
+		return nil, ErrNotCalendar
+	}
+
+	return events, nil
+}
+
+// unfold reads r into content lines, joining continuation lines back onto the line they belong to
+func unfold(r io.Reader) ([]string, error) {
+	var lines []string
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		l := strings.TrimRight(scanner.Text(), "\r")
+		if l == "" {
+			continue
+		}
+		if (l[0] == ' ' || l[0] == '\t') && len(lines) > 0 {
+			lines[len(lines)-1] += l[1:]
+			continue
+		}
+		lines = append(lines, l)
+	}
+
+	return lines, scanner.Err()
+}
+
+// split breaks a content line into its upper-cased name, its parameters and its value. The value
+// starts at the first colon that isn't inside a quoted parameter
+func split(l string) (name string, params map[string]string, value string) {
+	quoted := false
+	end := len(l)
+	for i, r := range l {
+		if r == '"' {
+			quoted = !quoted
+		} else if r == ':' && !quoted {
+			end = i
+			break
+		}
+	}
+	if end < len(l) {
+		value = l[end+1:]
+	}
+
+	parts := strings.Split(l[:end], ";")
+	name = strings.ToUpper(parts[0])
+	params = make(map[string]string)
+	for _, p := range parts[1:] {
+		k, v, _ := strings.Cut(p, "=")
+		params[strings.ToUpper(k)] = strings.Trim(v, `"`)
+	}
+
+	return name, params, value
+}
+
+// parseDate reads a DATE or DATE-TIME value as the date it falls on. UTC times are taken on their
+// UTC date; local and floating times on the date written
+func parseDate(value string, params map[string]string) (time.Time, error) {
+	if params["VALUE"] == "DATE" || len(value) == len(dateLayout) {
+		return time.Parse(dateLayout, value)
+	}
+
+	for _, layout := range []string{stampLayout, "20060102T150405"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC), nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("invalid date %q", value)
+}
+
+// unescape reverses escape
+func unescape(s string) string {
+	return strings.NewReplacer(
+		`\\`, `\`,
+		`\;`, ";",
+		`\,`, ",",
+		`\n`, "\n",
+		`\N`, "\n",
+	).Replace(s)
+}
+
+// escape escapes the characters that are special in iCalendar TEXT values
+func escape(s string) string {
+	return strings.NewReplacer(
+		`\`, `\\`,
+		";", `\;`,
+		",", `\,`,
+		"\r\n", `\n`,
+		"\n", `\n`,
+	).Replace(s)
+}
+
+// fold splits a content line longer than maxLineOctets into continuation lines, each starting with
+// a space, without splitting a UTF-8 character
+func fold(s string) string {
+	if len(s) <= maxLineOctets {
+		return s
+	}
+
+	var b strings.Builder
+	limit := maxLineOctets
+	n := 0
+	for _, r := range s {
+		size := utf8.RuneLen(r)
+		if n+size > limit {
+			b.WriteString("\r\n ")
+			// the leading space counts toward the continuation line's length
+			limit = maxLineOctets - 1
+			n = 0
+		}
+		b.WriteRune(r)
+		n += size
+	}
+
+	return b.String()
+}
@@ -0,0 +1,175 @@
+package ical
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWrite(t *testing.T) {
+	events := []Event{
+		{
+			UID:         "restriction-1@localhost",
+			Start:       time.Date(2050, 1, 10, 0, 0, 0, 0, time.UTC),
+			End:         time.Date(2050, 1, 12, 0, 0, 0, 0, time.UTC),
+			Summary:     "Arrival: Smith, John",
+			Description: "Room: General's Quarters\nNotes; none",
+		},
+	}
+
+	var buf bytes.Buffer
+	err := Write(&buf, "General's Quarters", events, time.Date(2049, 12, 1, 8, 30, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := buf.String()
+	for _, want := range []string{
+		"BEGIN:VCALENDAR\r\n",
+		"X-WR-CALNAME:General's Quarters\r\n",
+		"UID:restriction-1@localhost\r\n",
+		"DTSTAMP:20491201T083000Z\r\n",
+		"DTSTART;VALUE=DATE:20500110\r\n",
+		"DTEND;VALUE=DATE:20500112\r\n",
+		"SUMMARY:Arrival: Smith\\, John\r\n",
+		"DESCRIPTION:Room: General's Quarters\\nNotes\\; none\r\n",
+		"END:VCALENDAR\r\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected output to contain %q, got:\n%s", want, out)
+		}
+	}
+}
+
+var foldTests = []struct {
+	name string
+	in   string
+}{
+	{"short", "SUMMARY:short"},
+	{"exactly-75", "SUMMARY:" + strings.Repeat("a", 67)},
+	{"long", "DESCRIPTION:" + strings.Repeat("a", 200)},
+	{"multibyte", "DESCRIPTION:" + strings.Repeat("é", 100)},
+}
+
+func TestFold(t *testing.T) {
+	for _, e := range foldTests {
+		folded := fold(e.in)
+
+		for _, l := range strings.Split(folded, "\r\n") {
+			if len(l) > maxLineOctets {
+				t.Errorf("%s: line of %d octets is longer than %d", e.name, len(l), maxLineOctets)
+			}
+		}
+
+		if unfolded := strings.ReplaceAll(folded, "\r\n ", ""); unfolded != e.in {
+			t.Errorf("%s: unfolding gave %q, wanted %q", e.name, unfolded, e.in)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	feed := strings.Join([]string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//Other Channel//EN",
+		"BEGIN:VEVENT",
+		"UID:abc123@otherchannel.example",
+		"DTSTART;VALUE=DATE:20500110",
+		"DTEND;VALUE=DATE:20500112",
+		"SUMMARY:Reserved\\, 2 guests",
+		"DESCRIPTION:Line one\\nLine two that goes on long enough that the exporter decided to fo",
+		" ld it",
+		"END:VEVENT",
+		"BEGIN:VEVENT",
+		"UID:timed@otherchannel.example",
+		"DTSTART;TZID=\"Europe/London\":20500201T150000",
+		"DTEND;TZID=\"Europe/London\":20500203T110000",
+		"END:VEVENT",
+		"BEGIN:VEVENT",
+		"UID:single@otherchannel.example",
+		"DTSTART:20500301",
+		"END:VEVENT",
+		"BEGIN:VEVENT",
+		"UID:cancelled@otherchannel.example",
+		"DTSTART;VALUE=DATE:20500401",
+		"DTEND;VALUE=DATE:20500402",
+		"STATUS:CANCELLED",
+		"END:VEVENT",
+		"BEGIN:VEVENT",
+		"SUMMARY:No UID",
+		"DTSTART;VALUE=DATE:20500501",
+		"END:VEVENT",
+		"END:VCALENDAR",
+	}, "\r\n")
+
+	events, err := Parse(strings.NewReader(feed))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	date := func(y int, m time.Month, d int) time.Time {
+		return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	}
+
+	want := []Event{
+		{
+			UID:         "abc123@otherchannel.example",
+			Start:       date(2050, 1, 10),
+			End:         date(2050, 1, 12),
+			Summary:     "Reserved, 2 guests",
+			Description: "Line one\nLine two that goes on long enough that the exporter decided to fold it",
+		},
+		{UID: "timed@otherchannel.example", Start: date(2050, 2, 1), End: date(2050, 2, 3)},
+		{UID: "single@otherchannel.example", Start: date(2050, 3, 1), End: date(2050, 3, 2)},
+	}
+
+	if len(events) != len(want) {
+		t.Fatalf("expected %d events, got %d: %+v", len(want), len(events), events)
+	}
+	for i := range want {
+		if events[i] != want[i] {
+			t.Errorf("event %d: got %+v, wanted %+v", i, events[i], want[i])
+		}
+	}
+}
+
+func TestParseRoundTrip(t *testing.T) {
+	events := []Event{
+		{
+			UID:     "restriction-1@localhost",
+			Start:   time.Date(2050, 1, 10, 0, 0, 0, 0, time.UTC),
+			End:     time.Date(2050, 1, 12, 0, 0, 0, 0, time.UTC),
+			Summary: "Unavailable (Owner Block); back soon, " + strings.Repeat("really ", 20),
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := Write(&buf, "Room", events, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := Parse(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed) != 1 || parsed[0] != events[0] {
+		t.Errorf("round trip gave %+v, wanted %+v", parsed, events)
+	}
+}
+
+var parseErrorTests = []struct {
+	name string
+	in   string
+}{
+	{"not-a-calendar", "<html><body>Not found</body></html>"},
+	{"bad-date", "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nUID:x\r\nDTSTART:tomorrow\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"},
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, e := range parseErrorTests {
+		if _, err := Parse(strings.NewReader(e.in)); err == nil {
+			t.Errorf("%s: expected an error", e.name)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package invoice
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/jung-kurt/gofpdf"
+	"github.com/msaufi2325/06_bookings/internal/models"
+	"github.com/msaufi2325/06_bookings/internal/render"
+)
+
+// BusinessName is printed at the top of every invoice
+const BusinessName = "Fort Smythe Bed and Breakfast"
+
+// Summary is the money side of an invoice. Prices include tax, so Tax is the part of Total that
+// is tax rather than an amount added to it. All amounts are in cents
+type Summary struct {
+	Total      int
+	TaxPercent int
+	Tax        int
+	Paid       int
+	Refunded   int
+	Balance    int
+}
+
+// Summarize works out what res cost, how much of that was tax, and what is still owed after the
+// payments in transactions. Nothing is owed on a cancelled reservation
+func Summarize(res models.Reservation, transactions []models.PaymentTransaction, taxPercent int) Summary {
+	s := Summary{
+		Total:      res.TotalPrice,
+		TaxPercent: taxPercent,
+	}
+
+	if taxPercent > 0 {
+		s.Tax = s.Total - (s.Total*100+(100+taxPercent)/2)/(100+taxPercent)
+	}
+
+	for _, t := range transactions {
+		if t.Status != models.TransactionSucceeded {
+			continue
+		}
+		switch t.Kind {
+		case models.TransactionCapture:
+			s.Paid += t.Amount
+		case models.TransactionRefund:
+			s.Refunded += t.Amount
+		}
+	}
+
+	if res.Status != models.StatusCancelled {
+		s.Balance = s.Total - s.Paid + s.Refunded
+	}
+
+	return s
+}
+
+// Filename returns the name an invoice is downloaded or attached as
+func Filename(inv models.Invoice) string {
+	return inv.Number + ".pdf"
+}
+
+// Write renders the invoice for res as a PDF to w
+func Write(w io.Writer, inv models.Invoice, res models.Reservation, s Summary) error {
+	pdf := gofpdf.New("P", "mm", "A4", "")
+	pdf.SetTitle("Invoice "+inv.Number, true)
+	pdf.SetMargins(20, 20, 20)
+	pdf.AddPage()
+
+	// gofpdf's core fonts are latin-1, so names are converted before they are written
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+
+	pdf.SetFont("Helvetica", "B", 16)
+	pdf.CellFormat(0, 10, tr(BusinessName), "", 1, "L", false, 0, "")
+
+	pdf.SetFont("Helvetica", "", 11)
+	pdf.CellFormat(0, 6, "Invoice "+inv.Number, "", 1, "L", false, 0, "")
+	pdf.CellFormat(0, 6, "Issued "+inv.IssuedAt.Format("2 January 2006"), "", 1, "L", false, 0, "")
+	pdf.Ln(6)
+
+	pdf.CellFormat(0, 6, tr(fmt.Sprintf("Billed to: %s %s", res.FirstName, res.LastName)), "", 1, "L", false, 0, "")
+	pdf.CellFormat(0, 6, tr(res.Email), "", 1, "L", false, 0, "")
+	pdf.Ln(4)
+
+	pdf.CellFormat(0, 6, tr("Room: "+res.Room.RoomName), "", 1, "L", false, 0, "")
+	pdf.CellFormat(0, 6, fmt.Sprintf("Stay: %s to %s", res.StartDate.Format("2 January 2006"),
+		res.EndDate.Format("2 January 2006")), "", 1, "L", false, 0, "")
+	pdf.CellFormat(0, 6, fmt.Sprintf("Reservation: %d", res.ID), "", 1, "L", false, 0, "")
+	if res.Status == models.StatusCancelled {
+		pdf.CellFormat(0, 6, "This reservation has been cancelled", "", 1, "L", false, 0, "")
+	}
+	pdf.Ln(6)
+
+	pdf.SetFont("Helvetica", "B", 11)
+	pdf.CellFormat(120, 7, "Night", "B", 0, "L", false, 0, "")
+	pdf.CellFormat(50, 7, "Rate", "B", 1, "R", false, 0, "")
+
+	pdf.SetFont("Helvetica", "", 11)
+	for _, n := range res.Quote.Nights {
+		description := n.Date.Format("Mon 2 January 2006")
+		if n.Season != "" {
+			description += " (" + n.Season + ")"
+		}
+		pdf.CellFormat(120, 7, tr(description), "", 0, "L", false, 0, "")
+		pdf.CellFormat(50, 7, render.FormatCurrency(n.Rate), "", 1, "R", false, 0, "")
+	}
+	pdf.Ln(2)
+
+	row := func(label string, amount int, bold bool) {
+		style := ""
+		if bold {
+			style = "B"
+		}
+		pdf.SetFont("Helvetica", style, 11)
+		pdf.CellFormat(120, 7, label, "", 0, "R", false, 0, "")
+		pdf.CellFormat(50, 7, render.FormatCurrency(amount), "", 1, "R", false, 0, "")
+	}
+
+	row("Total", s.Total, true)
+	if s.TaxPercent > 0 {
+		row(fmt.Sprintf("Includes tax at %d%%", s.TaxPercent), s.Tax, false)
+	}
+	row("Paid", s.Paid, false)
+	if s.Refunded > 0 {
+		row("Refunded", s.Refunded, false)
+	}
+	row("Balance due", s.Balance, true)
+
+	return pdf.Output(w)
+}
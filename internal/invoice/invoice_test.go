@@ -0,0 +1,81 @@
+package invoice
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/msaufi2325/06_bookings/internal/models"
+)
+
+var paid = []models.PaymentTransaction{
+	{Kind: models.TransactionAuthorize, Amount: 6000, Status: models.TransactionSucceeded},
+	{Kind: models.TransactionCapture, Amount: 6000, Status: models.TransactionSucceeded},
+}
+
+var summarizeTests = []struct {
+	name         string
+	status       string
+	transactions []models.PaymentTransaction
+	taxPercent   int
+	expected     Summary
+}{
+	{"unpaid", models.StatusPending, nil, 0, Summary{Total: 30000, Balance: 30000}},
+	{"deposit-paid", models.StatusConfirmed, paid, 0, Summary{Total: 30000, Paid: 6000, Balance: 24000}},
+	{"with-tax", models.StatusPending, nil, 10, Summary{Total: 30000, TaxPercent: 10, Tax: 2727, Balance: 30000}},
+	{
+		"failed-capture",
+		models.StatusPending,
+		[]models.PaymentTransaction{{Kind: models.TransactionCapture, Amount: 6000, Status: models.TransactionFailed}},
+		0,
+		Summary{Total: 30000, Balance: 30000},
+	},
+	{
+		"cancelled-and-refunded",
+		models.StatusCancelled,
+		append(paid, models.PaymentTransaction{Kind: models.TransactionRefund, Amount: 3000, Status: models.TransactionSucceeded}),
+		0,
+		Summary{Total: 30000, Paid: 6000, Refunded: 3000},
+	},
+}
+
+func TestSummarize(t *testing.T) {
+	for _, e := range summarizeTests {
+		res := models.Reservation{TotalPrice: 30000, Status: e.status}
+		if got := Summarize(res, e.transactions, e.taxPercent); got != e.expected {
+			t.Errorf("%s: expected %+v but got %+v", e.name, e.expected, got)
+		}
+	}
+}
+
+func TestWrite(t *testing.T) {
+	inv := models.Invoice{Number: "INV-000001", IssuedAt: time.Now()}
+	res := models.Reservation{
+		ID:         1,
+		FirstName:  "Zoë",
+		LastName:   "Smith",
+		StartDate:  time.Date(2050, 1, 10, 0, 0, 0, 0, time.UTC),
+		EndDate:    time.Date(2050, 1, 12, 0, 0, 0, 0, time.UTC),
+		Room:       models.Room{RoomName: "General's Quarters"},
+		TotalPrice: 30000,
+		Quote: models.Quote{Nights: []models.QuoteNight{
+			{Date: time.Date(2050, 1, 10, 0, 0, 0, 0, time.UTC), Rate: 15000},
+			{Date: time.Date(2050, 1, 11, 0, 0, 0, 0, time.UTC), Rate: 15000, Season: "Winter"},
+		}},
+	}
+
+	var buf bytes.Buffer
+	if err := Write(&buf, inv, res, Summarize(res, paid, 10)); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.HasPrefix(buf.Bytes(), []byte("%PDF-")) {
+		t.Error("expected a PDF")
+	}
+}
+
+func TestFilename(t *testing.T) {
+	if got := Filename(models.Invoice{Number: "INV-000042"}); got != "INV-000042.pdf" {
+		t.Errorf("unexpected filename %s", got)
+	}
+}
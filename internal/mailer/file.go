@@ -0,0 +1,48 @@
+package mailer
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/msaufi2325/06_bookings/internal/models"
+)
+
+// File drops each email into a directory as an .eml file, which mail clients can open, instead of
+// sending it
+type File struct {
+	dir string
+}
+
+// NewFile returns a File mailer writing to dir, creating it if it doesn't exist
+func NewFile(dir string) (*File, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &File{dir: dir}, nil
+}
+
+// Send writes msg to a new file, named for when it was sent
+func (f *File) Send(_ context.Context, msg models.MailData) error {
+	email, err := newEmail(msg)
+	if err != nil {
+		return err
+	}
+
+	out, err := os.CreateTemp(f.dir, time.Now().UTC().Format("20060102-150405")+"-*.eml")
+	if err != nil {
+		return err
+	}
+
+	if _, err = out.WriteString(email.GetMessage()); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// Close does nothing, as every file is closed once it is written
+func (f *File) Close() error {
+	return nil
+}
@@ -0,0 +1,29 @@
+package mailer
+
+import (
+	"context"
+	"log"
+
+	"github.com/msaufi2325/06_bookings/internal/models"
+)
+
+// Log only logs who each email is to and what it is about, without sending it
+type Log struct {
+	log *log.Logger
+}
+
+// NewLog returns a Log mailer writing to l
+func NewLog(l *log.Logger) *Log {
+	return &Log{log: l}
+}
+
+// Send logs msg
+func (l *Log) Send(_ context.Context, msg models.MailData) error {
+	l.log.Printf("Email to %s from %s: %q (%d attachments)", msg.To, msg.From, msg.Subject, len(msg.Attachments))
+	return nil
+}
+
+// Close does nothing
+func (l *Log) Close() error {
+	return nil
+}
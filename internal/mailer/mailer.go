@@ -0,0 +1,74 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/msaufi2325/06_bookings/internal/models"
+	mail "github.com/xhit/go-simple-mail/v2"
+)
+
+// The drivers a Mailer can be made with
+const (
+	DriverSMTP   = "smtp"
+	DriverFile   = "file"
+	DriverLog    = "log"
+	DriverMemory = "memory"
+)
+
+// Mailer sends email
+type Mailer interface {
+	// Send sends msg
+	Send(ctx context.Context, msg models.MailData) error
+	// Close lets go of anything the Mailer holds open
+	Close() error
+}
+
+// Config chooses a Mailer's driver and holds what that driver needs: SMTP for smtp, Dir for file,
+// and Log for log
+type Config struct {
+	Driver string
+	SMTP   SMTPConfig
+	Dir    string
+	Log    *log.Logger
+}
+
+// New returns the Mailer config asks for, or why it can't be made
+func New(config Config) (Mailer, error) {
+	switch config.Driver {
+	case DriverSMTP:
+		return NewSMTP(config.SMTP)
+	case DriverFile:
+		return NewFile(config.Dir)
+	case DriverLog:
+		if config.Log == nil {
+			return nil, fmt.Errorf("the %s mail driver needs a logger", DriverLog)
+		}
+		return NewLog(config.Log), nil
+	case DriverMemory:
+		return NewMemory(), nil
+	}
+
+	return nil, fmt.Errorf("mail driver %q is not one of %s, %s, %s or %s", config.Driver, DriverSMTP, DriverFile, DriverLog, DriverMemory)
+}
+
+// newEmail builds the email for msg, with its plain text version, if it has one, as an alternative
+// to its HTML
+func newEmail(msg models.MailData) (*mail.Email, error) {
+	email := mail.NewMSG()
+	email.SetFrom(msg.From).AddTo(msg.To).SetSubject(msg.Subject)
+
+	if msg.Text == "" {
+		email.SetBody(mail.TextHTML, msg.Content)
+	} else {
+		email.SetBody(mail.TextPlain, msg.Text)
+		email.AddAlternative(mail.TextHTML, msg.Content)
+	}
+
+	for _, a := range msg.Attachments {
+		email.Attach(&mail.File{Name: a.Name, MimeType: a.ContentType, Data: a.Data})
+	}
+
+	return email, email.GetError()
+}
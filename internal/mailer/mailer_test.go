@@ -0,0 +1,117 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/msaufi2325/06_bookings/internal/models"
+)
+
+var testMsg = models.MailData{
+	To:      "john@smith.com",
+	From:    "me@here.com",
+	Subject: "Reservation Confirmation",
+	Content: "<strong>Reservation Confirmation</strong>",
+	Attachments: []models.MailAttachment{
+		{Name: "invoice.pdf", ContentType: "application/pdf", Data: []byte("%PDF-1.4")},
+	},
+}
+
+var newTests = []struct {
+	name     string
+	config   Config
+	expected interface{}
+	wantErr  bool
+}{
+	{"smtp", Config{Driver: DriverSMTP, SMTP: validConfig()}, &SMTP{}, false},
+	{"smtp-invalid", Config{Driver: DriverSMTP}, nil, true},
+	{"file", Config{Driver: DriverFile}, &File{}, false},
+	{"log", Config{Driver: DriverLog, Log: log.New(os.Stdout, "", 0)}, &Log{}, false},
+	{"log-without-logger", Config{Driver: DriverLog}, nil, true},
+	{"memory", Config{Driver: DriverMemory}, &Memory{}, false},
+	{"unknown", Config{Driver: "carrier-pigeon"}, nil, true},
+}
+
+func TestNew(t *testing.T) {
+	for _, e := range newTests {
+		if e.config.Driver == DriverFile {
+			e.config.Dir = t.TempDir()
+		}
+
+		m, err := New(e.config)
+		if e.wantErr != (err != nil) {
+			t.Errorf("%s: expected error %t, got %v", e.name, e.wantErr, err)
+			continue
+		}
+		if e.wantErr {
+			continue
+		}
+
+		if fmt.Sprintf("%T", m) != fmt.Sprintf("%T", e.expected) {
+			t.Errorf("%s: expected a %T, got %T", e.name, e.expected, m)
+		}
+	}
+}
+
+func TestFile(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "mail")
+
+	f, err := NewFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := f.Send(context.Background(), testMsg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if len(files) != 2 {
+		t.Fatalf("expected 2 .eml files, got %d", len(files))
+	}
+
+	data, _ := os.ReadFile(files[0])
+	for _, want := range []string{"To: <john@smith.com>", "Subject: Reservation Confirmation", "invoice.pdf"} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("expected the file to contain %q", want)
+		}
+	}
+}
+
+func TestLog(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewLog(log.New(&buf, "", 0))
+
+	if err := l.Send(context.Background(), testMsg); err != nil {
+		t.Fatal(err)
+	}
+
+	got := buf.String()
+	if !strings.Contains(got, "john@smith.com") || !strings.Contains(got, "Reservation Confirmation") || strings.Contains(got, "<strong>") {
+		t.Errorf("unexpected log line %q", got)
+	}
+}
+
+func TestMemory(t *testing.T) {
+	m := NewMemory()
+	m.Send(context.Background(), testMsg)
+	m.Send(context.Background(), models.MailData{To: "me@here.com", Subject: "Reservation Notification"})
+
+	msgs := m.Messages()
+	if len(msgs) != 2 || msgs[0].To != "john@smith.com" || msgs[1].Subject != "Reservation Notification" {
+		t.Errorf("unexpected messages %+v", msgs)
+	}
+
+	m.Reset()
+	if len(m.Messages()) != 0 {
+		t.Error("expected no messages after Reset")
+	}
+}
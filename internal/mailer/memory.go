@@ -0,0 +1,49 @@
+package mailer
+
+import (
+	"context"
+	"sync"
+
+	"github.com/msaufi2325/06_bookings/internal/models"
+)
+
+// Memory keeps every email it is given instead of sending it, so tests can check what was sent
+type Memory struct {
+	mu       sync.Mutex
+	messages []models.MailData
+}
+
+// NewMemory returns an empty Memory mailer
+func NewMemory() *Memory {
+	return &Memory{}
+}
+
+// Send keeps msg
+func (m *Memory) Send(_ context.Context, msg models.MailData) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.messages = append(m.messages, msg)
+	return nil
+}
+
+// Messages returns the emails sent so far, in the order they were sent
+func (m *Memory) Messages() []models.MailData {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]models.MailData(nil), m.messages...)
+}
+
+// Reset forgets the emails sent so far
+func (m *Memory) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.messages = nil
+}
+
+// Close does nothing
+func (m *Memory) Close() error {
+	return nil
+}
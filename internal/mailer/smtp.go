@@ -0,0 +1,168 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/msaufi2325/06_bookings/internal/models"
+	mail "github.com/xhit/go-simple-mail/v2"
+)
+
+// How the connection to the mail server is encrypted
+const (
+	EncryptionNone     = "none"
+	EncryptionSTARTTLS = "starttls"
+	EncryptionTLS      = "tls"
+)
+
+// SMTPConfig is how to reach the mail server. A Username means logging in, which is only allowed
+// over an encrypted connection unless the server is on this machine
+type SMTPConfig struct {
+	Host           string
+	Port           int
+	Username       string
+	Password       string
+	Encryption     string
+	ConnectTimeout time.Duration
+	SendTimeout    time.Duration
+	KeepAlive      bool
+}
+
+// Validate reports the first thing wrong with c, in words fit for the start up log
+func (c SMTPConfig) Validate() error {
+	switch {
+	case c.Host == "":
+		return errors.New("no SMTP host given")
+	case c.Port < 1 || c.Port > 65535:
+		return fmt.Errorf("SMTP port %d is not between 1 and 65535", c.Port)
+	case c.Encryption != EncryptionNone && c.Encryption != EncryptionSTARTTLS && c.Encryption != EncryptionTLS:
+		return fmt.Errorf("SMTP encryption %q is not one of %s, %s or %s", c.Encryption, EncryptionNone, EncryptionSTARTTLS, EncryptionTLS)
+	case c.ConnectTimeout <= 0 || c.SendTimeout <= 0:
+		return errors.New("SMTP connect and send timeouts must be more than zero")
+	case c.Username == "" && c.Password != "":
+		return errors.New("an SMTP password was given without a username")
+	case c.Username != "" && c.Password == "":
+		return fmt.Errorf("no SMTP password given for %s", c.Username)
+	case c.Username != "" && c.Encryption == EncryptionNone && !isLocal(c.Host):
+		return fmt.Errorf("won't send the SMTP password to %s unencrypted; use %s or %s", c.Host, EncryptionSTARTTLS, EncryptionTLS)
+	}
+	return nil
+}
+
+// isLocal reports whether host is this machine
+func isLocal(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// SMTP sends email through a mail server. With KeepAlive one connection is kept open and shared,
+// so sends take turns on it; it is opened again if the server has dropped it
+type SMTP struct {
+	config SMTPConfig
+
+	mu     sync.Mutex
+	client *mail.SMTPClient
+}
+
+// NewSMTP returns an SMTP sender for config, or why config won't work
+func NewSMTP(config SMTPConfig) (*SMTP, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return &SMTP{config: config}, nil
+}
+
+func (s *SMTP) server() *mail.SMTPServer {
+	server := mail.NewSMTPClient()
+	server.Host = s.config.Host
+	server.Port = s.config.Port
+	server.Username = s.config.Username
+	server.Password = s.config.Password
+	server.ConnectTimeout = s.config.ConnectTimeout
+	server.SendTimeout = s.config.SendTimeout
+	server.KeepAlive = s.config.KeepAlive
+
+	switch s.config.Encryption {
+	case EncryptionSTARTTLS:
+		server.Encryption = mail.EncryptionSTARTTLS
+	case EncryptionTLS:
+		server.Encryption = mail.EncryptionSSLTLS
+	default:
+		server.Encryption = mail.EncryptionNone
+	}
+	if s.config.Username == "" {
+		server.Authentication = mail.AuthNone
+	}
+
+	return server
+}
+
+// connect returns a connection to the server: the kept one, if it still answers, or a new one
+func (s *SMTP) connect() (*mail.SMTPClient, error) {
+	if s.client != nil {
+		if s.client.Noop() == nil {
+			return s.client, nil
+		}
+		s.client.Close()
+		s.client = nil
+	}
+
+	client, err := s.server().Connect()
+	if err != nil {
+		if client != nil {
+			client.Close()
+		}
+		return nil, fmt.Errorf("connecting to %s:%d: %w", s.config.Host, s.config.Port, err)
+	}
+
+	if s.config.KeepAlive {
+		s.client = client
+	}
+	return client, nil
+}
+
+// Send sends msg through the mail server
+func (s *SMTP) Send(_ context.Context, msg models.MailData) error {
+	email, err := newEmail(msg)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	client, err := s.connect()
+	if err != nil {
+		return err
+	}
+
+	err = email.Send(client)
+	if err != nil && s.client != nil {
+		// the connection may be in any state, so don't reuse it
+		s.client.Close()
+		s.client = nil
+	}
+
+	return err
+}
+
+// Close closes the kept connection, if there is one
+func (s *SMTP) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.client == nil {
+		return nil
+	}
+
+	err := s.client.Quit()
+	s.client = nil
+	return err
+}
@@ -0,0 +1,211 @@
+package mailer
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/msaufi2325/06_bookings/internal/models"
+)
+
+func validConfig() SMTPConfig {
+	return SMTPConfig{
+		Host:           "localhost",
+		Port:           1025,
+		Encryption:     EncryptionNone,
+		ConnectTimeout: time.Second,
+		SendTimeout:    time.Second,
+	}
+}
+
+var validateTests = []struct {
+	name    string
+	change  func(c *SMTPConfig)
+	wantErr string
+}{
+	{"valid", func(c *SMTPConfig) {}, ""},
+	{"no-host", func(c *SMTPConfig) { c.Host = "" }, "no SMTP host"},
+	{"bad-port", func(c *SMTPConfig) { c.Port = 70000 }, "not between"},
+	{"bad-encryption", func(c *SMTPConfig) { c.Encryption = "ssl" }, "not one of"},
+	{"no-timeout", func(c *SMTPConfig) { c.SendTimeout = 0 }, "timeouts"},
+	{"password-without-user", func(c *SMTPConfig) { c.Password = "secret" }, "without a username"},
+	{"user-without-password", func(c *SMTPConfig) { c.Username = "me" }, "no SMTP password"},
+	{"local-login-unencrypted", func(c *SMTPConfig) { c.Username, c.Password = "me", "secret" }, ""},
+	{"remote-login-unencrypted", func(c *SMTPConfig) {
+		c.Host, c.Username, c.Password = "smtp.example.com", "me", "secret"
+	}, "unencrypted"},
+	{"remote-login-starttls", func(c *SMTPConfig) {
+		c.Host, c.Port, c.Username, c.Password, c.Encryption = "smtp.example.com", 587, "me", "secret", EncryptionSTARTTLS
+	}, ""},
+}
+
+func TestValidate(t *testing.T) {
+	for _, e := range validateTests {
+		c := validConfig()
+		e.change(&c)
+
+		err := c.Validate()
+		if e.wantErr == "" && err != nil {
+			t.Errorf("%s: expected no error, got %v", e.name, err)
+		}
+		if e.wantErr != "" && (err == nil || !strings.Contains(err.Error(), e.wantErr)) {
+			t.Errorf("%s: expected error containing %q, got %v", e.name, e.wantErr, err)
+		}
+	}
+
+	if _, err := NewSMTP(SMTPConfig{}); err == nil {
+		t.Error("NewSMTP should refuse an invalid config")
+	}
+}
+
+// fakeServer is a bare SMTP server that accepts every message, counting connections and messages
+type fakeServer struct {
+	listener net.Listener
+
+	mu          sync.Mutex
+	connections int
+	messages    []string
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &fakeServer{listener: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.connections++
+			s.mu.Unlock()
+			go s.serve(conn)
+		}
+	}()
+
+	return s
+}
+
+func (s *fakeServer) port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+// counts returns how many connections and messages there have been, and the latest message
+func (s *fakeServer) counts() (int, int, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	last := ""
+	if len(s.messages) > 0 {
+		last = s.messages[len(s.messages)-1]
+	}
+	return s.connections, len(s.messages), last
+}
+
+func (s *fakeServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+
+	reply("220 localhost ready")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"):
+			reply("250-localhost")
+			reply("250 8BITMIME")
+		case cmd == "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(l)
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, data.String())
+			s.mu.Unlock()
+			reply("250 queued")
+		case cmd == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func TestSMTPSend(t *testing.T) {
+	server := newFakeServer(t)
+	defer server.listener.Close()
+
+	msg := models.MailData{To: "john@smith.com", From: "me@here.com", Subject: "Hello", Content: "<p>Hi</p>"}
+
+	for _, keepAlive := range []bool{true, false} {
+		before, sent, _ := server.counts()
+
+		c := validConfig()
+		c.Host = "127.0.0.1"
+		c.Port = server.port()
+		c.KeepAlive = keepAlive
+
+		s, err := NewSMTP(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 3; i++ {
+			if err := s.Send(context.Background(), msg); err != nil {
+				t.Fatalf("keep alive %t: %v", keepAlive, err)
+			}
+		}
+		s.Close()
+
+		connections, messages, last := server.counts()
+		expected := 3
+		if keepAlive {
+			expected = 1
+		}
+		if connections-before != expected {
+			t.Errorf("keep alive %t: expected %d connections, got %d", keepAlive, expected, connections-before)
+		}
+		if messages-sent != 3 || !strings.Contains(last, "Subject: Hello") {
+			t.Errorf("keep alive %t: expected 3 messages, got %d ending with %q", keepAlive, messages-sent, last)
+		}
+	}
+}
+
+func TestSMTPSendUnreachable(t *testing.T) {
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	c := validConfig()
+	c.Host = "127.0.0.1"
+	c.Port = port
+
+	s, _ := NewSMTP(c)
+	err := s.Send(context.Background(), models.MailData{To: "john@smith.com", From: "me@here.com"})
+	if err == nil || !strings.Contains(err.Error(), "127.0.0.1:"+strconv.Itoa(port)) {
+		t.Errorf("expected a connection error naming the server, got %v", err)
+	}
+}
@@ -18,56 +18,413 @@ type User struct {
 
 // Room is the room model
 type Room struct {
+	ID                   int
+	RoomName             string
+	Slug                 string
+	Description          string
+	MaxOccupancy         int
+	BedConfiguration     string
+	Amenities            []string
+	Photos               []RoomPhoto
+	NightlyRate          int
+	CancellationPolicyID int
+	CancellationPolicy   CancellationPolicy
+	Archived             int
+	CreatedAt            time.Time
+	UpdatedAt            time.Time
+}
+
+// RoomPhoto is the room photo model
+type RoomPhoto struct {
 	ID        int
-	RoomName  string
+	RoomID    int
+	Path      string
+	Caption   string
+	SortOrder int
 	CreatedAt time.Time
 	UpdatedAt time.Time
 }
 
+// ReservationRestrictionID is the restriction type written for every booking. Staff can
+// rename and recolour it, but it can't be deleted or picked for a block
+const ReservationRestrictionID = 1
+
+// ChannelRestrictionID is the restriction type of blocks imported from other booking channels'
+// calendars. Like ReservationRestrictionID it can't be deleted or picked for a block, since the
+// importer owns every block of this type
+const ChannelRestrictionID = 100
+
 // Restriction is the restriction model
 type Restriction struct {
-	ID              int
-	RestrictionName string
-	CreatedAt       time.Time
-	UpdatedAt       time.Time
+	ID                    int
+	RestrictionName       string
+	Colour                string
+	CountsTowardOccupancy bool
+	CreatedAt             time.Time
+	UpdatedAt             time.Time
 }
 
+// Reservation statuses. A new booking is pending until staff confirm it
+const (
+	StatusPending    = "pending"
+	StatusConfirmed  = "confirmed"
+	StatusCheckedIn  = "checked-in"
+	StatusCheckedOut = "checked-out"
+	StatusCancelled  = "cancelled"
+	StatusNoShow     = "no-show"
+)
+
 // Reservation is the reservation model
 type Reservation struct {
+	ID                 int
+	FirstName          string
+	LastName           string
+	Email              string
+	Phone              string
+	StartDate          time.Time
+	EndDate            time.Time
+	RoomID             int
+	CreatedAt          time.Time
+	UpdatedAt          time.Time
+	Room               Room
+	Status             string
+	TotalPrice         int
+	Quote              Quote
+	CancellationPolicy CancellationPolicy
+	RefundAmount       int
+	CancelledAt        time.Time
+	DeletedAt          time.Time
+	DeletedBy          User
+	PaymentStatus      string
+	DepositAmount      int
+}
+
+// Reservation payment statuses. A reservation without a deposit stays at PaymentNone
+const (
+	PaymentNone       = "none"
+	PaymentAuthorized = "authorized"
+	PaymentCaptured   = "captured"
+	PaymentRefunded   = "refunded"
+	PaymentFailed     = "failed"
+)
+
+// Payment transaction kinds
+const (
+	TransactionAuthorize = "authorize"
+	TransactionCapture   = "capture"
+	TransactionRefund    = "refund"
+)
+
+// Invoice is the numbered invoice issued for a reservation. A reservation has at most one, and its
+// number never changes once issued
+type Invoice struct {
+	ID            int
+	ReservationID int
+	Number        string
+	IssuedAt      time.Time
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+// Payment transaction outcomes
+const (
+	TransactionSucceeded = "succeeded"
+	TransactionFailed    = "failed"
+)
+
+// PaymentTransaction is one call to the payment provider for a reservation. Reference is the
+// provider's id for the authorization the transaction belongs to, and EventID the id of the
+// provider's webhook event the transaction was reported by, once it has been
+type PaymentTransaction struct {
+	ID            int
+	ReservationID int
+	Provider      string
+	Kind          string
+	Reference     string
+	Amount        int
+	Status        string
+	EventID       string
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+// ReservationStatusChange records one move of a reservation from one status to another. FromStatus
+// is empty for the change that created the reservation, and UserID is 0 when no staff member made it
+type ReservationStatusChange struct {
+	ID            int
+	ReservationID int
+	FromStatus    string
+	ToStatus      string
+	UserID        int
+	User          User
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+// RateSeason overrides a room's nightly rate for nights from StartDate up to, but not including, EndDate
+type RateSeason struct {
+	ID          int
+	RoomID      int
+	Name        string
+	StartDate   time.Time
+	EndDate     time.Time
+	NightlyRate int
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// RateAdjustment raises or lowers a room's nightly rate by Percent on one day of the week
+type RateAdjustment struct {
 	ID        int
-	FirstName string
-	LastName  string
-	Email     string
-	Phone     string
-	StartDate time.Time
-	EndDate   time.Time
 	RoomID    int
+	Weekday   time.Weekday
+	Percent   int
 	CreatedAt time.Time
 	UpdatedAt time.Time
-	Room      Room
-	Processed int
 }
 
-// RoomRestriction is the room restriction model
-type RoomRestriction struct {
+// RateRules holds everything needed to price a stay in a room. Amounts are in cents
+type RateRules struct {
+	RoomID      int
+	NightlyRate int
+	Seasons     []RateSeason
+	Adjustments []RateAdjustment
+}
+
+// Quote is an itemized price for a stay. Amounts are in cents
+type Quote struct {
+	RoomID    int
+	StartDate time.Time
+	EndDate   time.Time
+	Nights    []QuoteNight
+	Total     int
+}
+
+// QuoteNight is the price of a single night in a quote
+type QuoteNight struct {
+	Date              time.Time
+	BaseRate          int
+	Season            string
+	AdjustmentPercent int
+	Rate              int
+}
+
+// CancellationPolicy decides how much of a reservation's total is refunded when it is cancelled.
+// A copy is kept on each reservation, so later changes to the policy don't affect existing bookings
+type CancellationPolicy struct {
+	ID          int
+	Name        string
+	Description string
+	Tiers       []CancellationTier
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// CancellationTier refunds RefundPercent of the total when a reservation is cancelled at least
+// HoursBefore hours before arrival
+type CancellationTier struct {
+	HoursBefore   int
+	RefundPercent int
+}
+
+// Waitlist entry statuses. A waiting entry is offered a hold on a room when one frees up, and the
+// hold either becomes a booking or expires
+const (
+	WaitlistWaiting = "waiting"
+	WaitlistOffered = "offered"
+	WaitlistBooked  = "booked"
+	WaitlistExpired = "expired"
+)
+
+// WaitlistEntry is a guest waiting for a room to free up for their dates. RoomID is 0 when any room
+// will do. Once offered, HoldRoomID is the room held for them until HoldExpiresAt
+type WaitlistEntry struct {
 	ID            int
+	FirstName     string
+	LastName      string
+	Email         string
+	Phone         string
 	StartDate     time.Time
 	EndDate       time.Time
 	RoomID        int
-	ReservationID int
-	RestrictionID int
+	Room          Room
+	Status        string
+	HoldRoomID    int
+	HoldRoom      Room
+	HoldExpiresAt time.Time
 	CreatedAt     time.Time
 	UpdatedAt     time.Time
-	Room          Room
-	Reservation   Reservation
-	Restriction   Restriction
 }
 
-// MailData holds an email message
+// RoomRestriction is the room restriction model
+type RoomRestriction struct {
+	ID              int
+	StartDate       time.Time
+	EndDate         time.Time
+	RoomID          int
+	ReservationID   int
+	WaitlistEntryID int
+	RestrictionID   int
+	Reason          string
+	ExternalUID     string
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+	Room            Room
+	Reservation     Reservation
+	Restriction     Restriction
+}
+
+// Calendar sync outcomes
+const (
+	SyncSucceeded = "ok"
+	SyncFailed    = "failed"
+)
+
+// CalendarImport is where a room's bookings on another channel are read from, and how the last
+// sync went. URL is empty when the feed is only ever uploaded by hand. Conflicts counts events that
+// couldn't be blocked because they overlap a booking already in this system
+type CalendarImport struct {
+	ID             int
+	RoomID         int
+	URL            string
+	LastSyncedAt   time.Time
+	LastStatus     string
+	LastError      string
+	EventsImported int
+	Conflicts      int
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+	Room           Room
+}
+
+// APIKey lets a partner's integration use the API. Only a hash of the key is stored, so Prefix, the
+// start of the key, is what tells keys apart. RateLimit is in requests a minute
+type APIKey struct {
+	ID         int
+	Name       string
+	Prefix     string
+	Scopes     []string
+	RateLimit  int
+	LastUsedAt time.Time
+	RevokedAt  time.Time
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+// WebhookSubscription is an outside system that is sent the events it asks for. Secret signs every
+// delivery, so the subscriber can tell they came from here
+type WebhookSubscription struct {
+	ID        int
+	URL       string
+	Secret    string
+	Events    []string
+	Active    bool
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// Webhook delivery states
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// WebhookDelivery is one event queued for one subscription, and how sending it has gone. A pending
+// delivery is next tried at NextAttemptAt; a failed one has run out of attempts
+type WebhookDelivery struct {
+	ID             int
+	SubscriptionID int
+	Event          string
+	Payload        string
+	Status         string
+	Attempts       int
+	NextAttemptAt  time.Time
+	LastAttemptAt  time.Time
+	ResponseStatus int
+	LastError      string
+	DeliveredAt    time.Time
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+	Subscription   WebhookSubscription
+}
+
+// AuditEntry records one change made by staff. Before and After hold the entity as JSON, and are
+// empty when it was created or deleted respectively. UserID is 0 when nobody was logged in
+type AuditEntry struct {
+	ID         int
+	UserID     int
+	User       User
+	Action     string
+	EntityType string
+	EntityID   int
+	Before     string
+	After      string
+	IP         string
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+// AuditFilter narrows the audit log; zero values match everything
+type AuditFilter struct {
+	UserID     int
+	EntityType string
+	From       time.Time
+	To         time.Time
+}
+
+// MailData holds an email message. Content is its HTML and Text its plain text version; Template
+// names the email template it was rendered from
 type MailData struct {
-	To       string
-	From     string
-	Subject  string
-	Content  string
-	Template string
+	To          string
+	From        string
+	Subject     string
+	Content     string
+	Text        string
+	Template    string
+	Attachments []MailAttachment
+}
+
+// MailAttachment is a file sent along with an email
+type MailAttachment struct {
+	Name        string
+	ContentType string
+	Data        []byte
+}
+
+// Outbox message states
+const (
+	MailPending = "pending"
+	MailSent    = "sent"
+	MailDead    = "dead"
+)
+
+// OutboxMessage is an email waiting in the outbox, or one that has left it. A pending message is
+// next tried at NextAttemptAt; a dead one has run out of attempts and waits for staff to resend it
+type OutboxMessage struct {
+	ID            int
+	Mail          MailData
+	Status        string
+	Attempts      int
+	NextAttemptAt time.Time
+	LastAttemptAt time.Time
+	LastError     string
+	SentAt        time.Time
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+// EmailTemplate is one saved version of the template for an email event. Versions are never
+// changed; an event's emails are rendered from its newest one, and rolling back saves an old one's
+// source again as the newest
+type EmailTemplate struct {
+	ID        int
+	Event     string
+	Version   int
+	Source    string
+	Note      string
+	UserID    int
+	User      User
+	CreatedAt time.Time
+	UpdatedAt time.Time
 }
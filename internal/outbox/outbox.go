@@ -0,0 +1,96 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/msaufi2325/06_bookings/internal/models"
+	"github.com/msaufi2325/06_bookings/internal/repository"
+	"github.com/msaufi2325/06_bookings/internal/retry"
+)
+
+// MaxAttempts is how many times a message is tried before it is dead, and left for staff to resend
+const MaxAttempts = 8
+
+// Lease is how long a claimed message is kept from other workers while it is being sent. It must
+// be longer than sending one message can take
+const Lease = 5 * time.Minute
+
+// BatchSize is the most messages SendDue claims in one go
+const BatchSize = 50
+
+// SendFunc sends one email
+type SendFunc func(ctx context.Context, msg models.MailData) error
+
+// Send sends msg and records how it went. Once sent it is done with; otherwise it is tried again
+// after retry.Backoff, until MaxAttempts have failed and it is dead. The error is only for failing
+// to record the attempt; a failed send shows in the returned message's LastError
+func Send(ctx context.Context, db repository.DatabaseRepo, send SendFunc, msg models.OutboxMessage, now time.Time) (models.OutboxMessage, error) {
+	msg.Attempts++
+	msg.LastAttemptAt = now
+	msg.LastError = ""
+
+	err := send(ctx, msg.Mail)
+	switch {
+	case err == nil:
+		msg.Status = models.MailSent
+		msg.SentAt = now
+		msg.NextAttemptAt = time.Time{}
+	case msg.Attempts >= MaxAttempts:
+		msg.Status = models.MailDead
+		msg.LastError = err.Error()
+		msg.NextAttemptAt = time.Time{}
+	default:
+		msg.Status = models.MailPending
+		msg.LastError = err.Error()
+		msg.NextAttemptAt = now.Add(retry.Backoff(msg.Attempts))
+	}
+
+	return msg, db.RecordMailAttempt(ctx, msg)
+}
+
+// SendDue claims the messages that have fallen due and sends them with a pool of workers. One
+// message failing doesn't stop the others; errors recording attempts are returned together once
+// every message has been tried. It returns how many were claimed
+func SendDue(ctx context.Context, db repository.DatabaseRepo, send SendFunc, workers int) (int, error) {
+	now := time.Now()
+
+	due, err := db.ClaimDueMail(ctx, now, now.Add(Lease), BatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	if workers < 1 {
+		workers = 1
+	}
+
+	jobs := make(chan models.OutboxMessage)
+	var mu sync.Mutex
+	var errs []error
+	var wg sync.WaitGroup
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for msg := range jobs {
+				if _, err := Send(ctx, db, send, msg, time.Now()); err != nil {
+					mu.Lock()
+					errs = append(errs, fmt.Errorf("outbox message %d: %w", msg.ID, err))
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	for _, msg := range due {
+		jobs <- msg
+	}
+	close(jobs)
+	wg.Wait()
+
+	return len(due), errors.Join(errs...)
+}
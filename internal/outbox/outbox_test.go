@@ -0,0 +1,101 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/msaufi2325/06_bookings/internal/config"
+	"github.com/msaufi2325/06_bookings/internal/models"
+	"github.com/msaufi2325/06_bookings/internal/repository/dbrepo"
+)
+
+var errRefused = errors.New("connection refused")
+
+var sendTests = []struct {
+	name           string
+	attempts       int
+	sendErr        error
+	expectedStatus string
+	expectedNext   time.Duration
+}{
+	{"sent", 0, nil, models.MailSent, 0},
+	{"sent-on-retry", 3, nil, models.MailSent, 0},
+	{"first-failure", 0, errRefused, models.MailPending, time.Minute},
+	{"third-failure", 2, errRefused, models.MailPending, 4 * time.Minute},
+	{"last-failure", MaxAttempts - 1, errRefused, models.MailDead, 0},
+}
+
+func TestSend(t *testing.T) {
+	now := time.Date(2050, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, e := range sendTests {
+		db := dbrepo.NewRecordingRepo(&config.AppConfig{})
+		msg := models.OutboxMessage{ID: 1, Status: models.MailPending, Attempts: e.attempts, LastError: "earlier failure"}
+		send := func(ctx context.Context, m models.MailData) error { return e.sendErr }
+
+		got, err := Send(context.Background(), db, send, msg, now)
+		if err != nil {
+			t.Fatalf("%s: %v", e.name, err)
+		}
+
+		if got.Status != e.expectedStatus || got.Attempts != e.attempts+1 {
+			t.Errorf("%s: expected %s after %d attempts, got %s after %d", e.name, e.expectedStatus, e.attempts+1, got.Status, got.Attempts)
+		}
+		if e.expectedNext == 0 && !got.NextAttemptAt.IsZero() {
+			t.Errorf("%s: expected no next attempt, got %s", e.name, got.NextAttemptAt)
+		}
+		if e.expectedNext > 0 && !got.NextAttemptAt.Equal(now.Add(e.expectedNext)) {
+			t.Errorf("%s: expected next attempt in %s, got %s", e.name, e.expectedNext, got.NextAttemptAt)
+		}
+		if (e.sendErr == nil) != (got.LastError == "") {
+			t.Errorf("%s: unexpected last error %q", e.name, got.LastError)
+		}
+		if e.sendErr == nil && !got.SentAt.Equal(now) {
+			t.Errorf("%s: expected sent at %s, got %s", e.name, now, got.SentAt)
+		}
+		if len(db.MailAttempts) != 1 {
+			t.Errorf("%s: expected the attempt to be recorded", e.name)
+		}
+	}
+}
+
+func TestSendDue(t *testing.T) {
+	var due []models.OutboxMessage
+	for i := 1; i <= 10; i++ {
+		due = append(due, models.OutboxMessage{ID: i, Status: models.MailPending, Mail: models.MailData{To: "john@smith.com"}})
+	}
+	// recording this one fails
+	due = append(due, models.OutboxMessage{ID: 100, Status: models.MailPending, Mail: models.MailData{To: "fail@here.com"}})
+
+	db := dbrepo.NewRecordingRepo(&config.AppConfig{})
+	db.DueMail = due
+
+	var mu sync.Mutex
+	sent := 0
+	send := func(ctx context.Context, m models.MailData) error {
+		if m.To == "fail@here.com" {
+			return errRefused
+		}
+		mu.Lock()
+		sent++
+		mu.Unlock()
+		return nil
+	}
+
+	n, err := SendDue(context.Background(), db, send, 3)
+	if n != len(due) {
+		t.Errorf("expected %d claimed, got %d", len(due), n)
+	}
+	if err == nil {
+		t.Error("expected the failure to record message 100")
+	}
+	if db.Lease != Lease {
+		t.Errorf("expected the messages to be claimed for %s, got %s", Lease, db.Lease)
+	}
+	if sent != 10 || len(db.MailAttempts) != len(due) {
+		t.Errorf("expected every message tried, got %d sent and %d recorded", sent, len(db.MailAttempts))
+	}
+}
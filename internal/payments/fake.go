@@ -0,0 +1,126 @@
+package payments
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// FakeDeclineToken is the card token the fake provider always declines
+const FakeDeclineToken = "tok_decline"
+
+// Fake is an in-process Provider for development and tests. It keeps its authorizations in memory,
+// approves every token except FakeDeclineToken, and signs webhooks with an HMAC of the payload
+type Fake struct {
+	secret []byte
+
+	mu      sync.Mutex
+	next    int
+	charges map[string]*fakeCharge
+}
+
+type fakeCharge struct {
+	authorized int
+	captured   int
+	refunded   int
+	released   bool
+}
+
+// NewFake returns a fake provider that signs and verifies webhooks with secret
+func NewFake(secret []byte) *Fake {
+	return &Fake{
+		secret:  secret,
+		charges: make(map[string]*fakeCharge),
+	}
+}
+
+// Name returns the provider's name
+func (f *Fake) Name() string {
+	return "fake"
+}
+
+// Authorize holds charge.Amount, unless the token is FakeDeclineToken
+func (f *Fake) Authorize(ctx context.Context, charge Charge) (Result, error) {
+	if charge.Amount <= 0 {
+		return Result{}, ErrInvalidAmount
+	}
+	if charge.Token == "" || charge.Token == FakeDeclineToken {
+		return Result{}, ErrDeclined
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.next++
+	reference := fmt.Sprintf("fake_%d", f.next)
+	f.charges[reference] = &fakeCharge{authorized: charge.Amount}
+
+	return Result{Reference: reference, Amount: charge.Amount}, nil
+}
+
+// Capture takes up to the authorized amount
+func (f *Fake) Capture(ctx context.Context, reference string, amount int) (Result, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c, ok := f.charges[reference]
+	if !ok || c.released {
+		return Result{}, ErrUnknownReference
+	}
+	if amount <= 0 || c.captured+amount > c.authorized {
+		return Result{}, ErrInvalidAmount
+	}
+
+	c.captured += amount
+	return Result{Reference: reference, Amount: amount}, nil
+}
+
+// Refund gives back up to the captured amount, or releases an authorization nothing was captured from
+func (f *Fake) Refund(ctx context.Context, reference string, amount int) (Result, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c, ok := f.charges[reference]
+	if !ok || c.released {
+		return Result{}, ErrUnknownReference
+	}
+
+	if c.captured == 0 {
+		c.released = true
+		return Result{Reference: reference}, nil
+	}
+
+	if amount <= 0 || c.refunded+amount > c.captured {
+		return Result{}, ErrInvalidAmount
+	}
+
+	c.refunded += amount
+	return Result{Reference: reference, Amount: amount}, nil
+}
+
+// SignWebhook returns the signature VerifyWebhook expects for payload, for sending test events
+func (f *Fake) SignWebhook(payload []byte) string {
+	mac := hmac.New(sha256.New, f.secret)
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhook checks payload was signed with the provider's secret and decodes the event in it.
+// Without a secret every webhook is refused, as anyone could sign one
+func (f *Fake) VerifyWebhook(payload []byte, signature string) (Event, error) {
+	var event Event
+
+	if len(f.secret) == 0 || !hmac.Equal([]byte(signature), []byte(f.SignWebhook(payload))) {
+		return event, ErrInvalidSignature
+	}
+
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return event, err
+	}
+
+	return event, nil
+}
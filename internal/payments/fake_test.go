@@ -0,0 +1,96 @@
+package payments
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestFakeAuthorize(t *testing.T) {
+	f := NewFake([]byte("secret"))
+	ctx := context.Background()
+
+	if _, err := f.Authorize(ctx, Charge{Amount: 1000, Token: FakeDeclineToken}); !errors.Is(err, ErrDeclined) {
+		t.Errorf("expected decline but got %v", err)
+	}
+	if _, err := f.Authorize(ctx, Charge{Amount: 0, Token: "tok_visa"}); !errors.Is(err, ErrInvalidAmount) {
+		t.Errorf("expected invalid amount but got %v", err)
+	}
+
+	first, err := f.Authorize(ctx, Charge{Amount: 1000, Token: "tok_visa"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := f.Authorize(ctx, Charge{Amount: 1000, Token: "tok_visa"})
+	if first.Reference == second.Reference {
+		t.Errorf("expected a new reference for each authorization, got %s twice", first.Reference)
+	}
+}
+
+func TestFakeCaptureAndRefund(t *testing.T) {
+	f := NewFake([]byte("secret"))
+	ctx := context.Background()
+
+	auth, _ := f.Authorize(ctx, Charge{Amount: 1000, Token: "tok_visa"})
+
+	if _, err := f.Capture(ctx, "fake_missing", 1000); !errors.Is(err, ErrUnknownReference) {
+		t.Errorf("expected unknown reference but got %v", err)
+	}
+	if _, err := f.Capture(ctx, auth.Reference, 1001); !errors.Is(err, ErrInvalidAmount) {
+		t.Errorf("expected capturing more than authorized to fail but got %v", err)
+	}
+	if _, err := f.Capture(ctx, auth.Reference, 1000); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.Refund(ctx, auth.Reference, 600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Refund(ctx, auth.Reference, 600); !errors.Is(err, ErrInvalidAmount) {
+		t.Errorf("expected refunding more than captured to fail but got %v", err)
+	}
+	if _, err := f.Refund(ctx, auth.Reference, 400); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFakeRefundReleasesAuthorization(t *testing.T) {
+	f := NewFake([]byte("secret"))
+	ctx := context.Background()
+
+	auth, _ := f.Authorize(ctx, Charge{Amount: 1000, Token: "tok_visa"})
+
+	if _, err := f.Refund(ctx, auth.Reference, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Capture(ctx, auth.Reference, 1000); !errors.Is(err, ErrUnknownReference) {
+		t.Errorf("expected a released authorization not to be captured but got %v", err)
+	}
+}
+
+func TestFakeVerifyWebhook(t *testing.T) {
+	f := NewFake([]byte("secret"))
+	payload := []byte(`{"id":"evt_1","type":"payment.refunded","reference":"fake_1","amount":500}`)
+
+	event, err := f.VerifyWebhook(payload, f.SignWebhook(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Type != EventRefunded || event.Reference != "fake_1" || event.Amount != 500 {
+		t.Errorf("unexpected event %+v", event)
+	}
+
+	if _, err := f.VerifyWebhook(payload, "bad"); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("expected invalid signature but got %v", err)
+	}
+
+	other := NewFake([]byte("other"))
+	if _, err := f.VerifyWebhook(payload, other.SignWebhook(payload)); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("expected a signature from another secret to fail but got %v", err)
+	}
+
+	unset := NewFake(nil)
+	if _, err := unset.VerifyWebhook(payload, unset.SignWebhook(payload)); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("expected a webhook signed with no secret to fail but got %v", err)
+	}
+}
@@ -0,0 +1,69 @@
+package payments
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrDeclined is returned when the provider refuses to authorize a charge
+var ErrDeclined = errors.New("payment declined")
+
+// ErrInvalidAmount is returned for a non-positive amount, or more than can be captured or refunded
+var ErrInvalidAmount = errors.New("invalid payment amount")
+
+// ErrUnknownReference is returned for a reference the provider has no record of
+var ErrUnknownReference = errors.New("unknown payment reference")
+
+// ErrInvalidSignature is returned for a webhook that was not signed by the provider
+var ErrInvalidSignature = errors.New("invalid webhook signature")
+
+// Webhook event types
+const (
+	EventCaptured = "payment.captured"
+	EventRefunded = "payment.refunded"
+	EventFailed   = "payment.failed"
+)
+
+// Charge is a request to authorize Amount, in cents, against the card the guest's Token stands for
+type Charge struct {
+	Amount      int
+	Token       string
+	Email       string
+	Description string
+}
+
+// Result is the provider's answer to a call. Reference identifies the authorization, and is what
+// later captures and refunds are made against
+type Result struct {
+	Reference string
+	Amount    int
+}
+
+// Event is a notification the provider sends about a payment after the fact
+type Event struct {
+	ID        string `json:"id"`
+	Type      string `json:"type"`
+	Reference string `json:"reference"`
+	Amount    int    `json:"amount"`
+}
+
+// Provider takes payments. An authorization holds funds on the guest's card; capturing takes them.
+// Refunding an authorization that hasn't been captured releases it instead
+type Provider interface {
+	Name() string
+	Authorize(ctx context.Context, charge Charge) (Result, error)
+	Capture(ctx context.Context, reference string, amount int) (Result, error)
+	Refund(ctx context.Context, reference string, amount int) (Result, error)
+	VerifyWebhook(payload []byte, signature string) (Event, error)
+}
+
+// Deposit returns percent of total, in cents, rounded up so a deposit is never less than asked for
+func Deposit(total, percent int) int {
+	if percent <= 0 || total <= 0 {
+		return 0
+	}
+	if percent >= 100 {
+		return total
+	}
+	return (total*percent + 99) / 100
+}
@@ -0,0 +1,25 @@
+package payments
+
+import "testing"
+
+var depositTests = []struct {
+	name     string
+	total    int
+	percent  int
+	expected int
+}{
+	{"no-deposit", 30000, 0, 0},
+	{"twenty-percent", 30000, 20, 6000},
+	{"rounds-up", 999, 10, 100},
+	{"full-amount", 30000, 100, 30000},
+	{"over-full-amount", 30000, 150, 30000},
+	{"free-stay", 0, 20, 0},
+}
+
+func TestDeposit(t *testing.T) {
+	for _, e := range depositTests {
+		if got := Deposit(e.total, e.percent); got != e.expected {
+			t.Errorf("%s: expected %d but got %d", e.name, e.expected, got)
+		}
+	}
+}
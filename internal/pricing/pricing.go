@@ -0,0 +1,77 @@
+package pricing
+
+import (
+	"errors"
+	"time"
+
+	"github.com/msaufi2325/06_bookings/internal/models"
+)
+
+// ErrInvalidStay is returned when the departure date is not after the arrival date
+var ErrInvalidStay = errors.New("departure must be after arrival")
+
+// Calculate returns an itemized quote for staying from start until end under rules.
+// Each night starts at the room's nightly rate, or at the rate of the season covering
+// it (the season starting latest wins if several overlap), and then has the percentage
+// adjustment for its day of the week applied
+func Calculate(rules models.RateRules, start, end time.Time) (models.Quote, error) {
+	quote := models.Quote{
+		RoomID:    rules.RoomID,
+		StartDate: start,
+		EndDate:   end,
+	}
+
+	if !end.After(start) {
+		return quote, ErrInvalidStay
+	}
+
+	adjustments := make(map[time.Weekday]int)
+	for _, a := range rules.Adjustments {
+		adjustments[a.Weekday] = a.Percent
+	}
+
+	for d := start; d.Before(end); d = d.AddDate(0, 0, 1) {
+		night := models.QuoteNight{
+			Date:     d,
+			BaseRate: rules.NightlyRate,
+		}
+
+		if season, ok := seasonFor(rules.Seasons, d); ok {
+			night.BaseRate = season.NightlyRate
+			night.Season = season.Name
+		}
+
+		night.AdjustmentPercent = adjustments[d.Weekday()]
+		night.Rate = applyPercent(night.BaseRate, night.AdjustmentPercent)
+
+		quote.Nights = append(quote.Nights, night)
+		quote.Total += night.Rate
+	}
+
+	return quote, nil
+}
+
+// seasonFor returns the season covering the night of d, if any
+func seasonFor(seasons []models.RateSeason, d time.Time) (models.RateSeason, bool) {
+	var found models.RateSeason
+	ok := false
+	for _, s := range seasons {
+		if d.Before(s.StartDate) || !d.Before(s.EndDate) {
+			continue
+		}
+		if !ok || s.StartDate.After(found.StartDate) {
+			found = s
+			ok = true
+		}
+	}
+	return found, ok
+}
+
+// applyPercent adjusts amount by percent, rounding to the nearest cent
+func applyPercent(amount, percent int) int {
+	adjusted := amount * (100 + percent)
+	if adjusted < 0 {
+		return 0
+	}
+	return (adjusted + 50) / 100
+}
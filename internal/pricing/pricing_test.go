@@ -0,0 +1,119 @@
+package pricing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/msaufi2325/06_bookings/internal/models"
+)
+
+func date(s string) time.Time {
+	t, _ := time.Parse("2006-01-02", s)
+	return t
+}
+
+var calculateTests = []struct {
+	name          string
+	rules         models.RateRules
+	start         string
+	end           string
+	expectedTotal int
+	expectedRates []int
+}{
+	{
+		name:          "base-rate-only",
+		rules:         models.RateRules{NightlyRate: 10000},
+		start:         "2050-01-03",
+		end:           "2050-01-06",
+		expectedTotal: 30000,
+		expectedRates: []int{10000, 10000, 10000},
+	},
+	{
+		name: "weekend-adjustment",
+		rules: models.RateRules{
+			NightlyRate: 10000,
+			Adjustments: []models.RateAdjustment{
+				{Weekday: time.Friday, Percent: 20},
+				{Weekday: time.Saturday, Percent: 20},
+			},
+		},
+		// 2050-01-07 is a Friday
+		start:         "2050-01-06",
+		end:           "2050-01-09",
+		expectedTotal: 34000,
+		expectedRates: []int{10000, 12000, 12000},
+	},
+	{
+		name: "season-override",
+		rules: models.RateRules{
+			NightlyRate: 10000,
+			Seasons: []models.RateSeason{
+				{Name: "Summer", StartDate: date("2050-07-01"), EndDate: date("2050-09-01"), NightlyRate: 15000},
+			},
+		},
+		start:         "2050-06-30",
+		end:           "2050-07-02",
+		expectedTotal: 25000,
+		expectedRates: []int{10000, 15000},
+	},
+	{
+		name: "latest-season-wins",
+		rules: models.RateRules{
+			NightlyRate: 10000,
+			Seasons: []models.RateSeason{
+				{Name: "Winter", StartDate: date("2050-12-01"), EndDate: date("2051-03-01"), NightlyRate: 8000},
+				{Name: "Holidays", StartDate: date("2050-12-24"), EndDate: date("2051-01-02"), NightlyRate: 20000},
+			},
+		},
+		start:         "2050-12-23",
+		end:           "2050-12-25",
+		expectedTotal: 28000,
+		expectedRates: []int{8000, 20000},
+	},
+	{
+		name: "weekday-discount-rounds",
+		rules: models.RateRules{
+			NightlyRate: 9999,
+			Adjustments: []models.RateAdjustment{
+				{Weekday: time.Monday, Percent: -15},
+			},
+		},
+		// 2050-01-03 is a Monday
+		start:         "2050-01-03",
+		end:           "2050-01-04",
+		expectedTotal: 8499,
+		expectedRates: []int{8499},
+	},
+}
+
+func TestCalculate(t *testing.T) {
+	for _, e := range calculateTests {
+		quote, err := Calculate(e.rules, date(e.start), date(e.end))
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", e.name, err)
+			continue
+		}
+
+		if quote.Total != e.expectedTotal {
+			t.Errorf("%s: expected total %d but got %d", e.name, e.expectedTotal, quote.Total)
+		}
+
+		if len(quote.Nights) != len(e.expectedRates) {
+			t.Errorf("%s: expected %d nights but got %d", e.name, len(e.expectedRates), len(quote.Nights))
+			continue
+		}
+
+		for i, n := range quote.Nights {
+			if n.Rate != e.expectedRates[i] {
+				t.Errorf("%s: expected night %d to cost %d but got %d", e.name, i, e.expectedRates[i], n.Rate)
+			}
+		}
+	}
+}
+
+func TestCalculateInvalidStay(t *testing.T) {
+	_, err := Calculate(models.RateRules{NightlyRate: 10000}, date("2050-01-02"), date("2050-01-02"))
+	if err != ErrInvalidStay {
+		t.Errorf("expected ErrInvalidStay for a zero night stay, got %v", err)
+	}
+}
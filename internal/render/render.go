@@ -11,15 +11,20 @@ import (
 	"time"
 
 	"github.com/justinas/nosurf"
+	"github.com/msaufi2325/06_bookings/internal/cancellation"
 	"github.com/msaufi2325/06_bookings/internal/config"
 	"github.com/msaufi2325/06_bookings/internal/models"
+	"github.com/msaufi2325/06_bookings/internal/status"
 )
 
 var functions = template.FuncMap{
-	"humanDate":  HumanDate,
-	"formatDate": FormatDate,
-	"iterate":    Iterate,
-	"add":        Add,
+	"humanDate":      HumanDate,
+	"formatDate":     FormatDate,
+	"iterate":        Iterate,
+	"add":            Add,
+	"formatCurrency": FormatCurrency,
+	"statusLabel":    status.Label,
+	"policyTerms":    cancellation.Describe,
 }
 
 var app *config.AppConfig
@@ -54,6 +59,16 @@ func FormatDate(t time.Time, f string) string {
 	return t.Format(f)
 }
 
+// FormatCurrency returns an amount in cents as dollars, e.g. 12550 becomes $125.50
+func FormatCurrency(cents int) string {
+	sign := ""
+	if cents < 0 {
+		sign = "-"
+		cents = -cents
+	}
+	return fmt.Sprintf("%s$%d.%02d", sign, cents/100, cents%100)
+}
+
 // AddDefaultData adds data for all templates
 func AddDefaultData(td *models.TemplateData, r *http.Request) *models.TemplateData {
 	td.Flash = app.Session.PopString(r.Context(), "flash")
@@ -1,12 +1,17 @@
 package dbrepo
 
 import (
+	"context"
 	"database/sql"
+	"time"
 
 	"github.com/msaufi2325/06_bookings/internal/config"
 	"github.com/msaufi2325/06_bookings/internal/repository"
 )
 
+// defaultQueryTimeout is used when the app config does not set a query timeout
+const defaultQueryTimeout = 3 * time.Second
+
 type postgresDBRepo struct {
 	App *config.AppConfig
 	DB  *sql.DB
@@ -29,3 +34,12 @@ func NewTestingRepo(a *config.AppConfig) repository.DatabaseRepo {
 		App: a,
 	}
 }
+
+// withTimeout derives a context for a single query from ctx, bounded by the configured query timeout
+func (m *postgresDBRepo) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout := defaultQueryTimeout
+	if m.App != nil && m.App.DBQueryTimeout > 0 {
+		timeout = m.App.DBQueryTimeout
+	}
+	return context.WithTimeout(ctx, timeout)
+}
@@ -2,21 +2,35 @@ package dbrepo
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
+	"strings"
 	"time"
 
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/msaufi2325/06_bookings/internal/helpers"
 	"github.com/msaufi2325/06_bookings/internal/models"
+	"github.com/msaufi2325/06_bookings/internal/repository"
+	"github.com/msaufi2325/06_bookings/internal/status"
 	"golang.org/x/crypto/bcrypt"
 )
 
-func (m *postgresDBRepo) AllUsers() bool {
+// exclusionViolation is the postgres error code raised when an exclusion constraint fails
+const exclusionViolation = "23P01"
+
+// uniqueViolation is the postgres error code raised when a unique index fails
+const uniqueViolation = "23505"
+
+func (m *postgresDBRepo) AllUsers(ctx context.Context) bool {
 	return true
 }
 
 // InsertReservation inserts a reservation into the database
-func (m *postgresDBRepo) InsertReservation(res models.Reservation) (int, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m *postgresDBRepo) InsertReservation(ctx context.Context, res models.Reservation) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
 	defer cancel()
 
 	var newID int
@@ -45,8 +59,8 @@ func (m *postgresDBRepo) InsertReservation(res models.Reservation) (int, error)
 }
 
 // InsertRoomRestriction inserts a room restriction into the database
-func (m *postgresDBRepo) InsertRoomRestriction(r models.RoomRestriction) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m *postgresDBRepo) InsertRoomRestriction(ctx context.Context, r models.RoomRestriction) error {
+	ctx, cancel := m.withTimeout(ctx)
 	defer cancel()
 
 	stmt := `insert into room_restrictions (start_date, end_date, room_id, reservation_id,	
@@ -70,9 +84,127 @@ func (m *postgresDBRepo) InsertRoomRestriction(r models.RoomRestriction) error {
 	return nil
 }
 
+// InsertReservationWithRestriction inserts a reservation, its room restriction and the emails mail
+// builds, if it isn't nil, in a single transaction. If the dates overlap an existing restriction
+// for the room, it returns repository.ErrRoomUnavailable and nothing is written
+func (m *postgresDBRepo) InsertReservationWithRestriction(ctx context.Context, res models.Reservation, mail repository.MailFunc) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	newID, err := insertReservationWithRestriction(ctx, tx, res)
+	if err != nil {
+		return 0, err
+	}
+
+	if mail != nil {
+		if err = queueMail(ctx, tx, mail(newID)); err != nil {
+			return 0, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// insertReservationWithRestriction writes a pending reservation, its first status change and its
+// room restriction within tx, returning repository.ErrRoomUnavailable if the room is taken
+func insertReservationWithRestriction(ctx context.Context, tx *sql.Tx, res models.Reservation) (int, error) {
+	var newID int
+
+	breakdown, err := json.Marshal(res.Quote)
+	if err != nil {
+		return 0, err
+	}
+
+	policy, err := json.Marshal(res.CancellationPolicy)
+	if err != nil {
+		return 0, err
+	}
+
+	paymentStatus := res.PaymentStatus
+	if paymentStatus == "" {
+		paymentStatus = models.PaymentNone
+	}
+
+	stmt := `insert into reservations (first_name, last_name, email, phone, start_date,
+			end_date, room_id, total_price, price_breakdown, cancellation_policy, status,
+			payment_status, deposit_amount, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15) returning id`
+
+	err = tx.QueryRowContext(ctx, stmt,
+		res.FirstName,
+		res.LastName,
+		res.Email,
+		res.Phone,
+		res.StartDate,
+		res.EndDate,
+		res.RoomID,
+		res.TotalPrice,
+		string(breakdown),
+		string(policy),
+		models.StatusPending,
+		paymentStatus,
+		res.DepositAmount,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	err = insertStatusChange(ctx, tx, newID, "", models.StatusPending, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	stmt = `insert into room_restrictions (start_date, end_date, room_id, reservation_id,
+			created_at, updated_at, restriction_id)
+			values
+			($1, $2, $3, $4, $5, $6, $7)`
+
+	_, err = tx.ExecContext(ctx, stmt,
+		res.StartDate,
+		res.EndDate,
+		res.RoomID,
+		newID,
+		time.Now(),
+		time.Now(),
+		models.ReservationRestrictionID,
+	)
+	if err != nil {
+		if isExclusionViolation(err) {
+			return 0, repository.ErrRoomUnavailable
+		}
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// isExclusionViolation reports whether err was caused by the room_restrictions no-overlap constraint
+func isExclusionViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == exclusionViolation
+}
+
+// isUniqueViolation reports whether err was caused by a unique index
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == uniqueViolation
+}
+
 // SearchAvailabilityByDatesByRoomID returns true if availability exists for roomID, and false if no availability
-func (m *postgresDBRepo) SearchAvailabilityByDatesByRoomID(start, end time.Time, roomID int) (bool, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m *postgresDBRepo) SearchAvailabilityByDatesByRoomID(ctx context.Context, start, end time.Time, roomID int) (bool, error) {
+	ctx, cancel := m.withTimeout(ctx)
 	defer cancel()
 
 	var numRows int
@@ -99,32 +231,30 @@ func (m *postgresDBRepo) SearchAvailabilityByDatesByRoomID(start, end time.Time,
 }
 
 // SearchAvailabilityForAllRooms returns a slice of available rooms, if any, for given date range
-func (m *postgresDBRepo) SearchAvailabilityForAllRooms(start, end time.Time) ([]models.Room, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m *postgresDBRepo) SearchAvailabilityForAllRooms(ctx context.Context, start, end time.Time) ([]models.Room, error) {
+	ctx, cancel := m.withTimeout(ctx)
 	defer cancel()
 
 	var rooms []models.Room
 
 	query := `
 		select
-			r.id, r.room_name
+			` + roomColumns + `
 		from
 			rooms r
-		where r.id not in 
-		(select room_id from room_restrictions rr where $1 < rr.end_date and $2 > rr.start_date);
+		where r.archived = 0 and r.id not in
+		(select room_id from room_restrictions rr where $1 < rr.end_date and $2 > rr.start_date)
+		order by r.room_name;
 		`
 
 	rows, err := m.DB.QueryContext(ctx, query, start, end)
 	if err != nil {
 		return rooms, err
 	}
+	defer rows.Close()
 
 	for rows.Next() {
-		var room models.Room
-		err := rows.Scan(
-			&room.ID,
-			&room.RoomName,
-		)
+		room, err := scanRoom(rows)
 		if err != nil {
 			return rooms, err
 		}
@@ -135,38 +265,66 @@ func (m *postgresDBRepo) SearchAvailabilityForAllRooms(start, end time.Time) ([]
 		return rooms, err
 	}
 
-	return rooms, nil
+	return rooms, m.attachRoomPhotos(ctx, rooms)
 }
 
 // GetRoomByID gets a room by id
-func (m *postgresDBRepo) GetRoomByID(id int) (models.Room, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m *postgresDBRepo) GetRoomByID(ctx context.Context, id int) (models.Room, error) {
+	ctx, cancel := m.withTimeout(ctx)
 	defer cancel()
 
-	var room models.Room
+	query := `select ` + roomColumns + ` from rooms r where r.id = $1`
 
-	query := `
-		select id, room_name, created_at, updated_at from rooms where id = $1
-`
+	room, err := scanRoom(m.DB.QueryRowContext(ctx, query, id))
+	if err != nil {
+		return room, err
+	}
 
-	row := m.DB.QueryRowContext(ctx, query, id)
-	err := row.Scan(
-		&room.ID,
-		&room.RoomName,
-		&room.CreatedAt,
-		&room.UpdatedAt,
-	)
+	room.Photos, err = m.photosForRoom(ctx, room.ID)
+	if err != nil {
+		return room, err
+	}
+
+	if room.CancellationPolicyID > 0 {
+		room.CancellationPolicy, err = m.cancellationPolicy(ctx, room.CancellationPolicyID)
+		if err != nil {
+			return room, err
+		}
+	}
 
+	return room, nil
+}
+
+// GetRoomBySlug gets a room by its url slug
+func (m *postgresDBRepo) GetRoomBySlug(ctx context.Context, slug string) (models.Room, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `select ` + roomColumns + ` from rooms r where r.slug = $1`
+
+	room, err := scanRoom(m.DB.QueryRowContext(ctx, query, slug))
+	if err != nil {
+		return room, err
+	}
+
+	room.Photos, err = m.photosForRoom(ctx, room.ID)
 	if err != nil {
 		return room, err
 	}
 
+	if room.CancellationPolicyID > 0 {
+		room.CancellationPolicy, err = m.cancellationPolicy(ctx, room.CancellationPolicyID)
+		if err != nil {
+			return room, err
+		}
+	}
+
 	return room, nil
 }
 
 // GetUserByID gets a user by id
-func (m *postgresDBRepo) GetUserByID(id int) (models.User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m *postgresDBRepo) GetUserByID(ctx context.Context, id int) (models.User, error) {
+	ctx, cancel := m.withTimeout(ctx)
 	defer cancel()
 
 	query := `select id, first_name, last_name, email, password, access_level, created_at, updated_at from users where id = $1`
@@ -194,8 +352,8 @@ func (m *postgresDBRepo) GetUserByID(id int) (models.User, error) {
 }
 
 // UpdateUser updates a user in the database
-func (m *postgresDBRepo) UpdateUser(u models.User) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m *postgresDBRepo) UpdateUser(ctx context.Context, u models.User) error {
+	ctx, cancel := m.withTimeout(ctx)
 	defer cancel()
 
 	query := `update users set first_name = $1, last_name = $2, email = $3, access_level = $4, updated_at = $5 where id = $6`
@@ -210,8 +368,8 @@ func (m *postgresDBRepo) UpdateUser(u models.User) error {
 }
 
 // Authenticate authenticates a user
-func (m *postgresDBRepo) Authenticate(email, testPassword string) (int, string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m *postgresDBRepo) Authenticate(ctx context.Context, email, testPassword string) (int, string, error) {
+	ctx, cancel := m.withTimeout(ctx)
 	defer cancel()
 
 	var id int
@@ -233,19 +391,20 @@ func (m *postgresDBRepo) Authenticate(email, testPassword string) (int, string,
 	return id, hashedPassword, nil
 }
 
-// AllReservations returns a slice of all reservations
-func (m *postgresDBRepo) AllReservations() ([]models.Reservation, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// AllReservations returns a slice of all reservations that have not been deleted
+func (m *postgresDBRepo) AllReservations(ctx context.Context) ([]models.Reservation, error) {
+	ctx, cancel := m.withTimeout(ctx)
 	defer cancel()
 
 	var reservations []models.Reservation
 
 	query := `
 		select r.id, r.first_name, r.last_name, r.email, r.phone, r.start_date, 
-		r.end_date, r.room_id, r.created_at, r.updated_at,
+		r.end_date, r.room_id, r.created_at, r.updated_at, r.status,
 		rm.id, rm.room_name 
 		from reservations r
 		left join rooms rm on (r.room_id = rm.id)
+		where r.deleted_at is null
 		order by r.start_date asc
 	`
 
@@ -268,6 +427,7 @@ func (m *postgresDBRepo) AllReservations() ([]models.Reservation, error) {
 			&i.RoomID,
 			&i.CreatedAt,
 			&i.UpdatedAt,
+			&i.Status,
 			&i.Room.ID,
 			&i.Room.RoomName,
 		)
@@ -285,24 +445,79 @@ func (m *postgresDBRepo) AllReservations() ([]models.Reservation, error) {
 	return reservations, nil
 }
 
-// AllNewReservations returns a slice of all new reservations
-func (m *postgresDBRepo) AllNewReservations() ([]models.Reservation, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// ReservationsBetween returns the reservations, other than deleted or cancelled ones, that arrive or
+// depart from start up to end, in order of arrival
+func (m *postgresDBRepo) ReservationsBetween(ctx context.Context, start, end time.Time) ([]models.Reservation, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var reservations []models.Reservation
+
+	query := `
+		select r.id, r.first_name, r.last_name, r.email, r.phone, r.start_date,
+		r.end_date, r.room_id, r.created_at, r.updated_at, r.status,
+		rm.id, rm.room_name
+		from reservations r
+		left join rooms rm on (r.room_id = rm.id)
+		where r.deleted_at is null and r.status <> $1
+		and ((r.start_date >= $2 and r.start_date < $3) or (r.end_date >= $2 and r.end_date < $3))
+		order by r.start_date asc
+	`
+
+	rows, err := m.DB.QueryContext(ctx, query, models.StatusCancelled, start, end)
+	if err != nil {
+		return reservations, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var i models.Reservation
+		err := rows.Scan(
+			&i.ID,
+			&i.FirstName,
+			&i.LastName,
+			&i.Email,
+			&i.Phone,
+			&i.StartDate,
+			&i.EndDate,
+			&i.RoomID,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.Status,
+			&i.Room.ID,
+			&i.Room.RoomName,
+		)
+		if err != nil {
+			return reservations, err
+		}
+		reservations = append(reservations, i)
+	}
+
+	if err = rows.Err(); err != nil {
+		return reservations, err
+	}
+
+	return reservations, nil
+}
+
+// AllNewReservations returns a slice of all reservations still waiting to be confirmed
+func (m *postgresDBRepo) AllNewReservations(ctx context.Context) ([]models.Reservation, error) {
+	ctx, cancel := m.withTimeout(ctx)
 	defer cancel()
 
 	var reservations []models.Reservation
 
 	query := `
 		select r.id, r.first_name, r.last_name, r.email, r.phone, r.start_date, 
-		r.end_date, r.room_id, r.created_at, r.updated_at, r.processed,
+		r.end_date, r.room_id, r.created_at, r.updated_at, r.status,
 		rm.id, rm.room_name 
 		from reservations r
 		left join rooms rm on (r.room_id = rm.id)
-		where processed = 0
+		where r.status = $1 and r.deleted_at is null
 		order by r.start_date asc
 	`
 
-	rows, err := m.DB.QueryContext(ctx, query)
+	rows, err := m.DB.QueryContext(ctx, query, models.StatusPending)
 	if err != nil {
 		return reservations, err
 	}
@@ -321,7 +536,7 @@ func (m *postgresDBRepo) AllNewReservations() ([]models.Reservation, error) {
 			&i.RoomID,
 			&i.CreatedAt,
 			&i.UpdatedAt,
-			&i.Processed,
+			&i.Status,
 			&i.Room.ID,
 			&i.Room.RoomName,
 		)
@@ -340,15 +555,20 @@ func (m *postgresDBRepo) AllNewReservations() ([]models.Reservation, error) {
 }
 
 // GetReservationByID gets a reservation by id
-func (m *postgresDBRepo) GetReservationByID(id int) (models.Reservation, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m *postgresDBRepo) GetReservationByID(ctx context.Context, id int) (models.Reservation, error) {
+	ctx, cancel := m.withTimeout(ctx)
 	defer cancel()
 
 	var res models.Reservation
 
+	var breakdown, policy string
+	var cancelledAt, deletedAt sql.NullTime
+
 	query := `
 		select r.id, r.first_name, r.last_name, r.email, r.phone, r.start_date,
-		r.end_date, r.room_id, r.created_at, r.updated_at, r.processed,
+		r.end_date, r.room_id, r.created_at, r.updated_at, r.status,
+		r.total_price, r.price_breakdown, r.cancellation_policy, r.refund_amount, r.cancelled_at,
+		r.deleted_at, coalesce(r.deleted_by, 0), r.payment_status, r.deposit_amount,
 		rm.id, rm.room_name
 		from reservations r
 		left join rooms rm on (r.room_id = rm.id)
@@ -367,7 +587,16 @@ func (m *postgresDBRepo) GetReservationByID(id int) (models.Reservation, error)
 		&res.RoomID,
 		&res.CreatedAt,
 		&res.UpdatedAt,
-		&res.Processed,
+		&res.Status,
+		&res.TotalPrice,
+		&breakdown,
+		&policy,
+		&res.RefundAmount,
+		&cancelledAt,
+		&deletedAt,
+		&res.DeletedBy.ID,
+		&res.PaymentStatus,
+		&res.DepositAmount,
 		&res.Room.ID,
 		&res.Room.RoomName,
 	)
@@ -378,12 +607,31 @@ func (m *postgresDBRepo) GetReservationByID(id int) (models.Reservation, error)
 		return res, err
 	}
 
+	res.CancelledAt = cancelledAt.Time
+	res.DeletedAt = deletedAt.Time
+
+	// reservations made before pricing existed have no breakdown
+	if breakdown != "" {
+		err = json.Unmarshal([]byte(breakdown), &res.Quote)
+		if err != nil {
+			return res, err
+		}
+	}
+
+	// nor do reservations made before cancellation policies have a policy
+	if policy != "" {
+		err = json.Unmarshal([]byte(policy), &res.CancellationPolicy)
+		if err != nil {
+			return res, err
+		}
+	}
+
 	return res, nil
 }
 
 // UpdateReservation updates a reservation in the database
-func (m *postgresDBRepo) UpdateReservation(u models.Reservation) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (m *postgresDBRepo) UpdateReservation(ctx context.Context, u models.Reservation) error {
+	ctx, cancel := m.withTimeout(ctx)
 	defer cancel()
 
 	query := `update reservations set first_name = $1, last_name = $2, email = $3, phone = $4, updated_at = $5 where id = $6`
@@ -403,133 +651,2847 @@ func (m *postgresDBRepo) UpdateReservation(u models.Reservation) error {
 	return nil
 }
 
-// DeleteReservation deletes a reservation from the database
-func (m *postgresDBRepo) DeleteReservation(id int) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// ChangeReservationDates moves a reservation, and its room restriction, to res.StartDate and
+// res.EndDate, saving its new price and deposit. If the new dates overlap another restriction for
+// the room, repository.ErrRoomUnavailable is returned, and if the reservation has been cancelled or
+// trashed repository.ErrStatusChanged; either way nothing is changed
+func (m *postgresDBRepo) ChangeReservationDates(ctx context.Context, res models.Reservation) error {
+	ctx, cancel := m.withTimeout(ctx)
 	defer cancel()
 
-	query := "delete from reservations where id = $1"
-	_, err := m.DB.ExecContext(ctx, query, id)
+	tx, err := m.DB.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	return nil
-}
+	breakdown, err := json.Marshal(res.Quote)
+	if err != nil {
+		return err
+	}
 
-// UpdateProcessedForReservation updates processed for a reservation
-func (m *postgresDBRepo) UpdateProcessedForReservation(id, processed int) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+	query := `update reservations set start_date = $1, end_date = $2, total_price = $3, price_breakdown = $4,
+			deposit_amount = $5, updated_at = $6 where id = $7 and status <> $8 and deleted_at is null`
+
+	result, err := tx.ExecContext(ctx, query,
+		res.StartDate,
+		res.EndDate,
+		res.TotalPrice,
+		string(breakdown),
+		res.DepositAmount,
+		time.Now(),
+		res.ID,
+		models.StatusCancelled,
+	)
+	if err != nil {
+		return err
+	}
 
-	query := "update reservations set processed = $1 where id = $2"
-	_, err := m.DB.ExecContext(ctx, query, processed, id)
+	rows, err := result.RowsAffected()
 	if err != nil {
 		return err
 	}
+	if rows == 0 {
+		return repository.ErrStatusChanged
+	}
 
-	return nil
+	query = `update room_restrictions set start_date = $1, end_date = $2, updated_at = $3 where reservation_id = $4`
+
+	_, err = tx.ExecContext(ctx, query, res.StartDate, res.EndDate, time.Now(), res.ID)
+	if isExclusionViolation(err) {
+		return repository.ErrRoomUnavailable
+	}
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
-func (m *postgresDBRepo) AllRooms() ([]models.Room, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// DeleteReservation moves a reservation to the trash, recording who deleted it, and frees its
+// room restrictions. Trashed reservations can be restored until they are purged. It returns
+// sql.ErrNoRows if id doesn't exist or is already in the trash
+func (m *postgresDBRepo) DeleteReservation(ctx context.Context, id, userID int) error {
+	ctx, cancel := m.withTimeout(ctx)
 	defer cancel()
 
-	var rooms []models.Room
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-	query := `select id, room_name, created_at, updated_at from rooms order by room_name`
+	var user sql.NullInt64
+	if userID > 0 {
+		user = sql.NullInt64{Int64: int64(userID), Valid: true}
+	}
 
-	rows, err := m.DB.QueryContext(ctx, query)
+	query := `update reservations set deleted_at = $1, deleted_by = $2 where id = $3 and deleted_at is null`
+	result, err := tx.ExecContext(ctx, query, time.Now(), user, id)
 	if err != nil {
-		return rooms, err
+		return err
 	}
-	defer rows.Close()
 
-	for rows.Next() {
-		var room models.Room
-		err := rows.Scan(
-			&room.ID,
-			&room.RoomName,
-			&room.CreatedAt,
-			&room.UpdatedAt,
-		)
-		if err != nil {
-			return rooms, err
-		}
-		rooms = append(rooms, room)
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
 	}
 
-	if err = rows.Err(); err != nil {
-		return rooms, err
+	_, err = tx.ExecContext(ctx, `delete from room_restrictions where reservation_id = $1`, id)
+	if err != nil {
+		return err
 	}
 
-	return rooms, nil
+	return tx.Commit()
 }
 
-// GetRestrictionsForRoomByDate returns restrictions for a room by date range
-func (m *postgresDBRepo) GetRestrictionsForRoomByDate(roomID int, start, end time.Time) ([]models.RoomRestriction, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// AllDeletedReservations returns the reservations in the trash, most recently deleted first
+func (m *postgresDBRepo) AllDeletedReservations(ctx context.Context) ([]models.Reservation, error) {
+	ctx, cancel := m.withTimeout(ctx)
 	defer cancel()
 
-	var restrictions []models.RoomRestriction
+	var reservations []models.Reservation
 
-	query := `select id, coalesce(reservation_id, 0), restriction_id, room_id, start_date, end_date from room_restrictions where $1 < end_date and $2 >= start_date and room_id = $3`
+	query := `
+		select r.id, r.first_name, r.last_name, r.email, r.phone, r.start_date,
+		r.end_date, r.room_id, r.created_at, r.updated_at, r.status,
+		r.deleted_at, coalesce(r.deleted_by, 0), coalesce(u.first_name, ''), coalesce(u.last_name, ''),
+		rm.id, rm.room_name
+		from reservations r
+		left join rooms rm on (r.room_id = rm.id)
+		left join users u on (r.deleted_by = u.id)
+		where r.deleted_at is not null
+		order by r.deleted_at desc
+	`
 
-	rows, err := m.DB.QueryContext(ctx, query, start, end, roomID)
+	rows, err := m.DB.QueryContext(ctx, query)
 	if err != nil {
-		return nil, err
+		return reservations, err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		var restriction models.RoomRestriction
+		var i models.Reservation
 		err := rows.Scan(
-			&restriction.ID,
-			&restriction.ReservationID,
-			&restriction.RestrictionID,
-			&restriction.RoomID,
-			&restriction.StartDate,
-			&restriction.EndDate,
+			&i.ID,
+			&i.FirstName,
+			&i.LastName,
+			&i.Email,
+			&i.Phone,
+			&i.StartDate,
+			&i.EndDate,
+			&i.RoomID,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.Status,
+			&i.DeletedAt,
+			&i.DeletedBy.ID,
+			&i.DeletedBy.FirstName,
+			&i.DeletedBy.LastName,
+			&i.Room.ID,
+			&i.Room.RoomName,
 		)
 		if err != nil {
-			return restrictions, err
+			return reservations, err
 		}
-		restrictions = append(restrictions, restriction)
+		reservations = append(reservations, i)
 	}
 
 	if err = rows.Err(); err != nil {
-		return restrictions, err
+		return reservations, err
 	}
 
-	return restrictions, nil
+	return reservations, nil
 }
 
-// InsertBlockForRoom inserts a block for a room for a given date
-func (m *postgresDBRepo) InsertBlockForRoom(id int, startDate time.Time) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// RestoreReservation takes a reservation out of the trash. Unless it was cancelled, its room
+// restriction is put back; if the room has been booked or blocked for those dates in the
+// meantime, repository.ErrRoomUnavailable is returned and the reservation stays in the trash
+func (m *postgresDBRepo) RestoreReservation(ctx context.Context, id int) error {
+	ctx, cancel := m.withTimeout(ctx)
 	defer cancel()
 
-	query := `insert into room_restrictions (start_date, end_date, room_id, restriction_id, created_at, updated_at) values ($1, $2, $3, $4, $5, $6)`
-
-	_, err := m.DB.ExecContext(ctx, query, startDate, startDate.AddDate(0, 0, 1), id, 2, time.Now(), time.Now())
+	tx, err := m.DB.BeginTx(ctx, nil)
 	if err != nil {
-		log.Println(err)
 		return err
 	}
-	return nil
+	defer tx.Rollback()
+
+	var res models.Reservation
+
+	query := `update reservations set deleted_at = null, deleted_by = null, updated_at = $1
+			where id = $2 and deleted_at is not null
+			returning room_id, start_date, end_date, status`
+
+	err = tx.QueryRowContext(ctx, query, time.Now(), id).Scan(&res.RoomID, &res.StartDate, &res.EndDate, &res.Status)
+	if err != nil {
+		return err
+	}
+
+	if !status.FreesRoom(res.Status) {
+		stmt := `insert into room_restrictions (start_date, end_date, room_id, reservation_id,
+				created_at, updated_at, restriction_id)
+				values ($1, $2, $3, $4, $5, $6, $7)`
+
+		_, err = tx.ExecContext(ctx, stmt,
+			res.StartDate,
+			res.EndDate,
+			res.RoomID,
+			id,
+			time.Now(),
+			time.Now(),
+			models.ReservationRestrictionID,
+		)
+		if isExclusionViolation(err) {
+			return repository.ErrRoomUnavailable
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// PurgeDeletedReservations permanently deletes reservations that went into the trash before
+// deletedBefore, and returns how many were removed
+func (m *postgresDBRepo) PurgeDeletedReservations(ctx context.Context, deletedBefore time.Time) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `delete from reservations where deleted_at < $1`, deletedBefore)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(n), nil
+}
+
+// UpdateReservationStatus moves a reservation from one status to another and records who did it.
+// If the reservation is no longer in status from, nothing is written and repository.ErrStatusChanged
+// is returned. Cancelling a reservation deletes its room restrictions, so the room can be booked again
+func (m *postgresDBRepo) UpdateReservationStatus(ctx context.Context, id int, from, to string, userID int) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = changeStatus(ctx, tx, id, from, to, userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// CancelReservation cancels a reservation that is in status from, as UpdateReservationStatus does,
+// and records when it was cancelled and the refund, in cents, that is owed to the guest
+func (m *postgresDBRepo) CancelReservation(ctx context.Context, id int, from string, userID, refund int) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = changeStatus(ctx, tx, id, from, models.StatusCancelled, userID)
+	if err != nil {
+		return err
+	}
+
+	query := `update reservations set refund_amount = $1, cancelled_at = $2 where id = $3`
+	_, err = tx.ExecContext(ctx, query, refund, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// changeStatus moves a reservation from one status to another within tx, recording the change and
+// freeing the room if the new status calls for it
+func changeStatus(ctx context.Context, tx *sql.Tx, id int, from, to string, userID int) error {
+	query := `update reservations set status = $1, updated_at = $2 where id = $3 and status = $4 and deleted_at is null`
+	result, err := tx.ExecContext(ctx, query, to, time.Now(), id, from)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return repository.ErrStatusChanged
+	}
+
+	err = insertStatusChange(ctx, tx, id, from, to, userID)
+	if err != nil {
+		return err
+	}
+
+	if status.FreesRoom(to) {
+		_, err = tx.ExecContext(ctx, `delete from room_restrictions where reservation_id = $1`, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// insertStatusChange records a change of status for a reservation; a userID of 0 is stored as null
+func insertStatusChange(ctx context.Context, tx *sql.Tx, reservationID int, from, to string, userID int) error {
+	var user sql.NullInt64
+	if userID > 0 {
+		user = sql.NullInt64{Int64: int64(userID), Valid: true}
+	}
+
+	query := `insert into reservation_status_changes (reservation_id, from_status, to_status, user_id, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6)`
+
+	_, err := tx.ExecContext(ctx, query, reservationID, from, to, user, time.Now(), time.Now())
+	return err
+}
+
+// GetReservationStatusHistory returns the status changes for a reservation, oldest first
+func (m *postgresDBRepo) GetReservationStatusHistory(ctx context.Context, id int) ([]models.ReservationStatusChange, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var changes []models.ReservationStatusChange
+
+	query := `select c.id, c.reservation_id, c.from_status, c.to_status, coalesce(c.user_id, 0), c.created_at, c.updated_at,
+			coalesce(u.first_name, ''), coalesce(u.last_name, '')
+			from reservation_status_changes c
+			left join users u on (c.user_id = u.id)
+			where c.reservation_id = $1
+			order by c.created_at, c.id`
+
+	rows, err := m.DB.QueryContext(ctx, query, id)
+	if err != nil {
+		return changes, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c models.ReservationStatusChange
+		err := rows.Scan(
+			&c.ID,
+			&c.ReservationID,
+			&c.FromStatus,
+			&c.ToStatus,
+			&c.UserID,
+			&c.CreatedAt,
+			&c.UpdatedAt,
+			&c.User.FirstName,
+			&c.User.LastName,
+		)
+		if err != nil {
+			return changes, err
+		}
+		c.User.ID = c.UserID
+		changes = append(changes, c)
+	}
+
+	if err = rows.Err(); err != nil {
+		return changes, err
+	}
+
+	return changes, nil
+}
+
+// AllRooms returns all rooms that are in service
+func (m *postgresDBRepo) AllRooms(ctx context.Context) ([]models.Room, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var rooms []models.Room
+
+	query := `select ` + roomColumns + ` from rooms r where r.archived = 0 order by r.room_name`
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return rooms, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		room, err := scanRoom(rows)
+		if err != nil {
+			return rooms, err
+		}
+		rooms = append(rooms, room)
+	}
+
+	if err = rows.Err(); err != nil {
+		return rooms, err
+	}
+
+	return rooms, m.attachRoomPhotos(ctx, rooms)
+}
+
+// AllRoomsWithArchived returns all rooms, including those taken out of service
+func (m *postgresDBRepo) AllRoomsWithArchived(ctx context.Context) ([]models.Room, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var rooms []models.Room
+
+	query := `select ` + roomColumns + ` from rooms r order by r.archived, r.room_name`
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return rooms, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		room, err := scanRoom(rows)
+		if err != nil {
+			return rooms, err
+		}
+		rooms = append(rooms, room)
+	}
+
+	if err = rows.Err(); err != nil {
+		return rooms, err
+	}
+
+	return rooms, m.attachRoomPhotos(ctx, rooms)
+}
+
+// InsertRoom inserts a room and its photos into the database
+func (m *postgresDBRepo) InsertRoom(ctx context.Context, room models.Room) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var newID int
+
+	stmt := `insert into rooms (room_name, slug, description, max_occupancy, bed_configuration,
+			amenities, nightly_rate, cancellation_policy_id, archived, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7, $8, 0, $9, $10) returning id`
+
+	err = tx.QueryRowContext(ctx, stmt,
+		room.RoomName,
+		room.Slug,
+		room.Description,
+		room.MaxOccupancy,
+		room.BedConfiguration,
+		strings.Join(room.Amenities, "\n"),
+		room.NightlyRate,
+		nullableID(room.CancellationPolicyID),
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	err = replaceRoomPhotos(ctx, tx, newID, room.Photos)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// UpdateRoom updates a room and replaces its photos in the database
+func (m *postgresDBRepo) UpdateRoom(ctx context.Context, room models.Room) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `update rooms set room_name = $1, slug = $2, description = $3, max_occupancy = $4,
+			bed_configuration = $5, amenities = $6, nightly_rate = $7, cancellation_policy_id = $8,
+			updated_at = $9 where id = $10`
+
+	_, err = tx.ExecContext(ctx, query,
+		room.RoomName,
+		room.Slug,
+		room.Description,
+		room.MaxOccupancy,
+		room.BedConfiguration,
+		strings.Join(room.Amenities, "\n"),
+		room.NightlyRate,
+		nullableID(room.CancellationPolicyID),
+		time.Now(),
+		room.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	err = replaceRoomPhotos(ctx, tx, room.ID, room.Photos)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ArchiveRoom takes a room out of service, keeping its reservation history
+func (m *postgresDBRepo) ArchiveRoom(ctx context.Context, id int) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `update rooms set archived = 1, updated_at = $1 where id = $2`
+
+	_, err := m.DB.ExecContext(ctx, query, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RestoreRoom puts an archived room back into service
+func (m *postgresDBRepo) RestoreRoom(ctx context.Context, id int) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `update rooms set archived = 0, updated_at = $1 where id = $2`
+
+	_, err := m.DB.ExecContext(ctx, query, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetRateRulesForRoom returns the nightly rate, seasons and weekday adjustments for a room
+func (m *postgresDBRepo) GetRateRulesForRoom(ctx context.Context, roomID int) (models.RateRules, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	rules := models.RateRules{RoomID: roomID}
+
+	err := m.DB.QueryRowContext(ctx, `select nightly_rate from rooms where id = $1`, roomID).Scan(&rules.NightlyRate)
+	if err != nil {
+		return rules, err
+	}
+
+	query := `select id, room_id, name, start_date, end_date, nightly_rate, created_at, updated_at
+			from rate_seasons where room_id = $1 order by start_date`
+
+	rows, err := m.DB.QueryContext(ctx, query, roomID)
+	if err != nil {
+		return rules, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var s models.RateSeason
+		err := rows.Scan(&s.ID, &s.RoomID, &s.Name, &s.StartDate, &s.EndDate, &s.NightlyRate, &s.CreatedAt, &s.UpdatedAt)
+		if err != nil {
+			return rules, err
+		}
+		rules.Seasons = append(rules.Seasons, s)
+	}
+
+	if err = rows.Err(); err != nil {
+		return rules, err
+	}
+
+	query = `select id, room_id, weekday, percent, created_at, updated_at
+			from rate_adjustments where room_id = $1 order by weekday`
+
+	adjRows, err := m.DB.QueryContext(ctx, query, roomID)
+	if err != nil {
+		return rules, err
+	}
+	defer adjRows.Close()
+
+	for adjRows.Next() {
+		var a models.RateAdjustment
+		err := adjRows.Scan(&a.ID, &a.RoomID, &a.Weekday, &a.Percent, &a.CreatedAt, &a.UpdatedAt)
+		if err != nil {
+			return rules, err
+		}
+		rules.Adjustments = append(rules.Adjustments, a)
+	}
+
+	if err = adjRows.Err(); err != nil {
+		return rules, err
+	}
+
+	return rules, nil
+}
+
+// InsertRateSeason inserts a seasonal rate override for a room
+func (m *postgresDBRepo) InsertRateSeason(ctx context.Context, season models.RateSeason) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var newID int
+
+	stmt := `insert into rate_seasons (room_id, name, start_date, end_date, nightly_rate, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7) returning id`
+
+	err := m.DB.QueryRowContext(ctx, stmt,
+		season.RoomID,
+		season.Name,
+		season.StartDate,
+		season.EndDate,
+		season.NightlyRate,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// DeleteRateSeason deletes a seasonal rate override
+func (m *postgresDBRepo) DeleteRateSeason(ctx context.Context, id int) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `delete from rate_seasons where id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// UpdateRateAdjustments replaces the weekday adjustments for a room. Days with a zero percent are not stored
+func (m *postgresDBRepo) UpdateRateAdjustments(ctx context.Context, roomID int, adjustments []models.RateAdjustment) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `delete from rate_adjustments where room_id = $1`, roomID)
+	if err != nil {
+		return err
+	}
+
+	stmt := `insert into rate_adjustments (room_id, weekday, percent, created_at, updated_at)
+			values ($1, $2, $3, $4, $5)`
+
+	for _, a := range adjustments {
+		if a.Percent == 0 {
+			continue
+		}
+		_, err = tx.ExecContext(ctx, stmt, roomID, int(a.Weekday), a.Percent, time.Now(), time.Now())
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// roomColumns is the column list, aliased on r, that scanRoom expects
+const roomColumns = `r.id, r.room_name, r.slug, r.description, r.max_occupancy, r.bed_configuration,
+		r.amenities, r.nightly_rate, coalesce(r.cancellation_policy_id, 0), r.archived, r.created_at, r.updated_at`
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanRoom scans a row selected with roomColumns into a room
+func scanRoom(row rowScanner) (models.Room, error) {
+	var room models.Room
+	var amenities string
+
+	err := row.Scan(
+		&room.ID,
+		&room.RoomName,
+		&room.Slug,
+		&room.Description,
+		&room.MaxOccupancy,
+		&room.BedConfiguration,
+		&amenities,
+		&room.NightlyRate,
+		&room.CancellationPolicyID,
+		&room.Archived,
+		&room.CreatedAt,
+		&room.UpdatedAt,
+	)
+	if err != nil {
+		return room, err
+	}
+
+	room.Amenities = helpers.SplitLines(amenities)
+
+	return room, nil
+}
+
+// photosForRoom returns the photos for one room in display order
+func (m *postgresDBRepo) photosForRoom(ctx context.Context, roomID int) ([]models.RoomPhoto, error) {
+	var photos []models.RoomPhoto
+
+	query := `select id, room_id, path, caption, sort_order, created_at, updated_at
+			from room_photos where room_id = $1 order by sort_order, id`
+
+	rows, err := m.DB.QueryContext(ctx, query, roomID)
+	if err != nil {
+		return photos, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p models.RoomPhoto
+		err := rows.Scan(&p.ID, &p.RoomID, &p.Path, &p.Caption, &p.SortOrder, &p.CreatedAt, &p.UpdatedAt)
+		if err != nil {
+			return photos, err
+		}
+		photos = append(photos, p)
+	}
+
+	return photos, rows.Err()
+}
+
+// attachRoomPhotos loads the photos for every room in rooms in a single query
+func (m *postgresDBRepo) attachRoomPhotos(ctx context.Context, rooms []models.Room) error {
+	if len(rooms) == 0 {
+		return nil
+	}
+
+	query := `select id, room_id, path, caption, sort_order, created_at, updated_at
+			from room_photos order by room_id, sort_order, id`
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	photos := make(map[int][]models.RoomPhoto)
+	for rows.Next() {
+		var p models.RoomPhoto
+		err := rows.Scan(&p.ID, &p.RoomID, &p.Path, &p.Caption, &p.SortOrder, &p.CreatedAt, &p.UpdatedAt)
+		if err != nil {
+			return err
+		}
+		photos[p.RoomID] = append(photos[p.RoomID], p)
+	}
+
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for i := range rooms {
+		rooms[i].Photos = photos[rooms[i].ID]
+	}
+
+	return nil
+}
+
+// replaceRoomPhotos replaces all photos for a room, storing them in the order given
+func replaceRoomPhotos(ctx context.Context, tx *sql.Tx, roomID int, photos []models.RoomPhoto) error {
+	_, err := tx.ExecContext(ctx, `delete from room_photos where room_id = $1`, roomID)
+	if err != nil {
+		return err
+	}
+
+	stmt := `insert into room_photos (room_id, path, caption, sort_order, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6)`
+
+	for i, p := range photos {
+		_, err = tx.ExecContext(ctx, stmt, roomID, p.Path, p.Caption, i, time.Now(), time.Now())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetRestrictionsForRoomByDate returns restrictions for a room by date range
+func (m *postgresDBRepo) GetRestrictionsForRoomByDate(ctx context.Context, roomID int, start, end time.Time) ([]models.RoomRestriction, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var restrictions []models.RoomRestriction
+
+	query := `select rr.id, coalesce(rr.reservation_id, 0), coalesce(rr.waitlist_entry_id, 0), rr.restriction_id,
+			rr.room_id, rr.start_date, rr.end_date, rr.reason, r.id, r.restriction_name, r.colour, r.counts_toward_occupancy, coalesce(res.status, '')
+			from room_restrictions rr
+			left join restrictions r on (rr.restriction_id = r.id)
+			left join reservations res on (rr.reservation_id = res.id)
+			where $1 < rr.end_date and $2 >= rr.start_date and rr.room_id = $3
+			order by rr.start_date`
+
+	rows, err := m.DB.QueryContext(ctx, query, start, end, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var restriction models.RoomRestriction
+		err := rows.Scan(
+			&restriction.ID,
+			&restriction.ReservationID,
+			&restriction.WaitlistEntryID,
+			&restriction.RestrictionID,
+			&restriction.RoomID,
+			&restriction.StartDate,
+			&restriction.EndDate,
+			&restriction.Reason,
+			&restriction.Restriction.ID,
+			&restriction.Restriction.RestrictionName,
+			&restriction.Restriction.Colour,
+			&restriction.Restriction.CountsTowardOccupancy,
+			&restriction.Reservation.Status,
+		)
+		if err != nil {
+			return restrictions, err
+		}
+		restrictions = append(restrictions, restriction)
+	}
+
+	if err = rows.Err(); err != nil {
+		return restrictions, err
+	}
+
+	return restrictions, nil
+}
+
+// AllRestrictions returns all restriction types
+func (m *postgresDBRepo) AllRestrictions(ctx context.Context) ([]models.Restriction, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var restrictions []models.Restriction
+
+	query := `select id, restriction_name, colour, counts_toward_occupancy, created_at, updated_at
+			from restrictions order by id`
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return restrictions, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r models.Restriction
+		err := rows.Scan(&r.ID, &r.RestrictionName, &r.Colour, &r.CountsTowardOccupancy, &r.CreatedAt, &r.UpdatedAt)
+		if err != nil {
+			return restrictions, err
+		}
+		restrictions = append(restrictions, r)
+	}
+
+	if err = rows.Err(); err != nil {
+		return restrictions, err
+	}
+
+	return restrictions, nil
+}
+
+// GetRestrictionByID returns a restriction type by id
+func (m *postgresDBRepo) GetRestrictionByID(ctx context.Context, id int) (models.Restriction, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var r models.Restriction
+
+	query := `select id, restriction_name, colour, counts_toward_occupancy, created_at, updated_at
+			from restrictions where id = $1`
+
+	row := m.DB.QueryRowContext(ctx, query, id)
+	err := row.Scan(&r.ID, &r.RestrictionName, &r.Colour, &r.CountsTowardOccupancy, &r.CreatedAt, &r.UpdatedAt)
+	if err != nil {
+		return r, err
+	}
+
+	return r, nil
+}
+
+// InsertRestriction inserts a new restriction type
+func (m *postgresDBRepo) InsertRestriction(ctx context.Context, r models.Restriction) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var newID int
+
+	query := `insert into restrictions (restriction_name, colour, counts_toward_occupancy, created_at, updated_at)
+			values ($1, $2, $3, $4, $5) returning id`
+
+	err := m.DB.QueryRowContext(ctx, query,
+		r.RestrictionName,
+		r.Colour,
+		r.CountsTowardOccupancy,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// UpdateRestriction updates a restriction type
+func (m *postgresDBRepo) UpdateRestriction(ctx context.Context, r models.Restriction) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `update restrictions set restriction_name = $1, colour = $2, counts_toward_occupancy = $3, updated_at = $4
+			where id = $5`
+
+	_, err := m.DB.ExecContext(ctx, query,
+		r.RestrictionName,
+		r.Colour,
+		r.CountsTowardOccupancy,
+		time.Now(),
+		r.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeleteRestriction deletes a restriction type. The foreign key from room_restrictions cascades,
+// so a type that is still in use is refused with repository.ErrRestrictionInUse rather than
+// taking its reservations and blocks with it
+func (m *postgresDBRepo) DeleteRestriction(ctx context.Context, id int) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	if id == models.ReservationRestrictionID || id == models.ChannelRestrictionID {
+		return repository.ErrRestrictionInUse
+	}
+
+	query := `delete from restrictions
+			where id = $1 and not exists (select 1 from room_restrictions where restriction_id = $1)`
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return repository.ErrRestrictionInUse
+	}
+
+	return nil
+}
+
+// GetBlockByID returns a block (a room restriction with no reservation or waitlist hold) by id.
+// Blocks imported from other channels belong to the importer, so they aren't returned
+func (m *postgresDBRepo) GetBlockByID(ctx context.Context, id int) (models.RoomRestriction, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var block models.RoomRestriction
+
+	query := `select rr.id, rr.room_id, rr.restriction_id, rr.start_date, rr.end_date, rr.reason,
+			rr.created_at, rr.updated_at, rm.id, rm.room_name
+			from room_restrictions rr
+			left join rooms rm on (rr.room_id = rm.id)
+			where rr.id = $1 and rr.reservation_id is null and rr.waitlist_entry_id is null
+			and rr.restriction_id <> $2`
+
+	row := m.DB.QueryRowContext(ctx, query, id, models.ChannelRestrictionID)
+	err := row.Scan(
+		&block.ID,
+		&block.RoomID,
+		&block.RestrictionID,
+		&block.StartDate,
+		&block.EndDate,
+		&block.Reason,
+		&block.CreatedAt,
+		&block.UpdatedAt,
+		&block.Room.ID,
+		&block.Room.RoomName,
+	)
+	if err != nil {
+		return block, err
+	}
+
+	return block, nil
+}
+
+// InsertBlock closes a room from block.StartDate up to (but not including) block.EndDate. If the
+// range overlaps a reservation or another block, it returns repository.ErrRoomUnavailable
+func (m *postgresDBRepo) InsertBlock(ctx context.Context, block models.RoomRestriction) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var newID int
+
+	query := `insert into room_restrictions (start_date, end_date, room_id, restriction_id, reason, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7) returning id`
+
+	err := m.DB.QueryRowContext(ctx, query,
+		block.StartDate,
+		block.EndDate,
+		block.RoomID,
+		block.RestrictionID,
+		block.Reason,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if isExclusionViolation(err) {
+		return 0, repository.ErrRoomUnavailable
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// UpdateBlock changes the dates, type and reason of a block. It returns sql.ErrNoRows if id isn't a
+// block, or is one imported from another channel
+func (m *postgresDBRepo) UpdateBlock(ctx context.Context, block models.RoomRestriction) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `update room_restrictions set start_date = $1, end_date = $2, room_id = $3, restriction_id = $4,
+			reason = $5, updated_at = $6
+			where id = $7 and reservation_id is null and waitlist_entry_id is null and restriction_id <> $8`
+
+	result, err := m.DB.ExecContext(ctx, query,
+		block.StartDate,
+		block.EndDate,
+		block.RoomID,
+		block.RestrictionID,
+		block.Reason,
+		time.Now(),
+		block.ID,
+		models.ChannelRestrictionID,
+	)
+	if isExclusionViolation(err) {
+		return repository.ErrRoomUnavailable
+	}
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// DeleteBlockByID deletes a block by id. Reservations, waitlist holds and blocks imported from
+// other channels are left alone, and it returns sql.ErrNoRows if id isn't a block
+func (m *postgresDBRepo) DeleteBlockByID(ctx context.Context, id int) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `delete from room_restrictions
+			where id = $1 and reservation_id is null and waitlist_entry_id is null and restriction_id <> $2`
+
+	result, err := m.DB.ExecContext(ctx, query, id, models.ChannelRestrictionID)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// ListUsers returns all users, ordered by name
+func (m *postgresDBRepo) ListUsers(ctx context.Context) ([]models.User, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var users []models.User
+
+	query := `select id, first_name, last_name, email, access_level, created_at, updated_at
+			from users order by last_name, first_name`
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return users, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var u models.User
+		err := rows.Scan(&u.ID, &u.FirstName, &u.LastName, &u.Email, &u.AccessLevel, &u.CreatedAt, &u.UpdatedAt)
+		if err != nil {
+			return users, err
+		}
+		users = append(users, u)
+	}
+
+	if err = rows.Err(); err != nil {
+		return users, err
+	}
+
+	return users, nil
+}
+
+// InsertAuditEntry appends an entry to the audit log
+func (m *postgresDBRepo) InsertAuditEntry(ctx context.Context, e models.AuditEntry) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `insert into audit_log (user_id, action, entity_type, entity_id, before, after, ip, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+
+	_, err := m.DB.ExecContext(ctx, query,
+		e.UserID,
+		e.Action,
+		e.EntityType,
+		e.EntityID,
+		e.Before,
+		e.After,
+		e.IP,
+		time.Now(),
+		time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// auditEntriesLimit caps how many audit entries are shown at once
+const auditEntriesLimit = 500
+
+// AuditEntries returns the most recent audit entries matching filter, newest first
+func (m *postgresDBRepo) AuditEntries(ctx context.Context, filter models.AuditFilter) ([]models.AuditEntry, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var entries []models.AuditEntry
+
+	var where []string
+	var args []interface{}
+	addCondition := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(condition, len(args)))
+	}
+
+	if filter.UserID > 0 {
+		addCondition("a.user_id = $%d", filter.UserID)
+	}
+	if filter.EntityType != "" {
+		addCondition("a.entity_type = $%d", filter.EntityType)
+	}
+	if !filter.From.IsZero() {
+		addCondition("a.created_at >= $%d", filter.From)
+	}
+	if !filter.To.IsZero() {
+		addCondition("a.created_at < $%d", filter.To)
+	}
+
+	query := `select a.id, a.user_id, a.action, a.entity_type, a.entity_id, a.before, a.after, a.ip,
+			a.created_at, a.updated_at, coalesce(u.first_name, ''), coalesce(u.last_name, '')
+			from audit_log a
+			left join users u on (a.user_id = u.id)`
+	if len(where) > 0 {
+		query += " where " + strings.Join(where, " and ")
+	}
+	query += fmt.Sprintf(" order by a.created_at desc, a.id desc limit %d", auditEntriesLimit)
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return entries, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e models.AuditEntry
+		err := rows.Scan(
+			&e.ID,
+			&e.UserID,
+			&e.Action,
+			&e.EntityType,
+			&e.EntityID,
+			&e.Before,
+			&e.After,
+			&e.IP,
+			&e.CreatedAt,
+			&e.UpdatedAt,
+			&e.User.FirstName,
+			&e.User.LastName,
+		)
+		if err != nil {
+			return entries, err
+		}
+		e.User.ID = e.UserID
+		entries = append(entries, e)
+	}
+
+	if err = rows.Err(); err != nil {
+		return entries, err
+	}
+
+	return entries, nil
+}
+
+// nullableID stores an id of 0 as null, for optional foreign keys
+func nullableID(id int) sql.NullInt64 {
+	if id > 0 {
+		return sql.NullInt64{Int64: int64(id), Valid: true}
+	}
+	return sql.NullInt64{}
+}
+
+// AllCancellationPolicies returns all cancellation policies, ordered by name
+func (m *postgresDBRepo) AllCancellationPolicies(ctx context.Context) ([]models.CancellationPolicy, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var policies []models.CancellationPolicy
+
+	query := `select id, name, description, tiers, created_at, updated_at from cancellation_policies order by name`
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return policies, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		p, err := scanCancellationPolicy(rows)
+		if err != nil {
+			return policies, err
+		}
+		policies = append(policies, p)
+	}
+
+	if err = rows.Err(); err != nil {
+		return policies, err
+	}
+
+	return policies, nil
+}
+
+// GetCancellationPolicyByID returns one cancellation policy
+func (m *postgresDBRepo) GetCancellationPolicyByID(ctx context.Context, id int) (models.CancellationPolicy, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	return m.cancellationPolicy(ctx, id)
+}
+
+// cancellationPolicy loads one cancellation policy using a context that already has a timeout
+func (m *postgresDBRepo) cancellationPolicy(ctx context.Context, id int) (models.CancellationPolicy, error) {
+	query := `select id, name, description, tiers, created_at, updated_at from cancellation_policies where id = $1`
+	return scanCancellationPolicy(m.DB.QueryRowContext(ctx, query, id))
+}
+
+// scanCancellationPolicy scans a cancellation policy row, decoding its tiers
+func scanCancellationPolicy(row rowScanner) (models.CancellationPolicy, error) {
+	var p models.CancellationPolicy
+	var tiers string
+
+	err := row.Scan(&p.ID, &p.Name, &p.Description, &tiers, &p.CreatedAt, &p.UpdatedAt)
+	if err != nil {
+		return p, err
+	}
+
+	err = json.Unmarshal([]byte(tiers), &p.Tiers)
+	if err != nil {
+		return p, err
+	}
+
+	return p, nil
+}
+
+// InsertCancellationPolicy adds a cancellation policy and returns its id
+func (m *postgresDBRepo) InsertCancellationPolicy(ctx context.Context, p models.CancellationPolicy) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	tiers, err := json.Marshal(p.Tiers)
+	if err != nil {
+		return 0, err
+	}
+
+	var newID int
+
+	stmt := `insert into cancellation_policies (name, description, tiers, created_at, updated_at)
+			values ($1, $2, $3, $4, $5) returning id`
+
+	err = m.DB.QueryRowContext(ctx, stmt, p.Name, p.Description, string(tiers), time.Now(), time.Now()).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// UpdateCancellationPolicy changes a cancellation policy. Reservations keep the copy they were made with
+func (m *postgresDBRepo) UpdateCancellationPolicy(ctx context.Context, p models.CancellationPolicy) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	tiers, err := json.Marshal(p.Tiers)
+	if err != nil {
+		return err
+	}
+
+	query := `update cancellation_policies set name = $1, description = $2, tiers = $3, updated_at = $4 where id = $5`
+
+	_, err = m.DB.ExecContext(ctx, query, p.Name, p.Description, string(tiers), time.Now(), p.ID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeleteCancellationPolicy deletes a cancellation policy. Rooms that used it are left without one
+func (m *postgresDBRepo) DeleteCancellationPolicy(ctx context.Context, id int) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `delete from cancellation_policies where id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// waitlistColumns is the column list, aliased on w with rooms r and h, that scanWaitlistEntry expects
+const waitlistColumns = `w.id, w.first_name, w.last_name, w.email, w.phone, w.start_date, w.end_date,
+		coalesce(w.room_id, 0), coalesce(r.room_name, ''), w.status, coalesce(w.hold_room_id, 0),
+		coalesce(h.room_name, ''), w.hold_expires_at, w.created_at, w.updated_at`
+
+// waitlistJoins joins the rooms named in waitlistColumns
+const waitlistJoins = `left join rooms r on (w.room_id = r.id) left join rooms h on (w.hold_room_id = h.id)`
+
+// scanWaitlistEntry scans a row selected with waitlistColumns into a waitlist entry
+func scanWaitlistEntry(row rowScanner) (models.WaitlistEntry, error) {
+	var e models.WaitlistEntry
+	var holdExpiresAt sql.NullTime
+
+	err := row.Scan(
+		&e.ID,
+		&e.FirstName,
+		&e.LastName,
+		&e.Email,
+		&e.Phone,
+		&e.StartDate,
+		&e.EndDate,
+		&e.RoomID,
+		&e.Room.RoomName,
+		&e.Status,
+		&e.HoldRoomID,
+		&e.HoldRoom.RoomName,
+		&holdExpiresAt,
+		&e.CreatedAt,
+		&e.UpdatedAt,
+	)
+	if err != nil {
+		return e, err
+	}
+
+	e.Room.ID = e.RoomID
+	e.HoldRoom.ID = e.HoldRoomID
+	e.HoldExpiresAt = holdExpiresAt.Time
+
+	return e, nil
+}
+
+// queryWaitlistEntries returns the waitlist entries selected by query, which must select waitlistColumns
+func (m *postgresDBRepo) queryWaitlistEntries(ctx context.Context, query string, args ...interface{}) ([]models.WaitlistEntry, error) {
+	var entries []models.WaitlistEntry
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return entries, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		e, err := scanWaitlistEntry(rows)
+		if err != nil {
+			return entries, err
+		}
+		entries = append(entries, e)
+	}
+
+	if err = rows.Err(); err != nil {
+		return entries, err
+	}
+
+	return entries, nil
+}
+
+// InsertWaitlistEntry puts a guest on the waitlist and returns the new entry's id
+func (m *postgresDBRepo) InsertWaitlistEntry(ctx context.Context, e models.WaitlistEntry) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var newID int
+
+	stmt := `insert into waitlist_entries (first_name, last_name, email, phone, start_date, end_date,
+			room_id, status, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) returning id`
+
+	err := m.DB.QueryRowContext(ctx, stmt,
+		e.FirstName,
+		e.LastName,
+		e.Email,
+		e.Phone,
+		e.StartDate,
+		e.EndDate,
+		nullableID(e.RoomID),
+		models.WaitlistWaiting,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// GetWaitlistEntryByID returns one waitlist entry
+func (m *postgresDBRepo) GetWaitlistEntryByID(ctx context.Context, id int) (models.WaitlistEntry, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `select ` + waitlistColumns + ` from waitlist_entries w ` + waitlistJoins + ` where w.id = $1`
+
+	return scanWaitlistEntry(m.DB.QueryRowContext(ctx, query, id))
+}
+
+// AllWaitlistEntries returns every waitlist entry, oldest first
+func (m *postgresDBRepo) AllWaitlistEntries(ctx context.Context) ([]models.WaitlistEntry, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `select ` + waitlistColumns + ` from waitlist_entries w ` + waitlistJoins + `
+			order by w.created_at, w.id`
+
+	return m.queryWaitlistEntries(ctx, query)
+}
+
+// WaitingWaitlistEntries returns the entries still waiting for dates that haven't started, in the
+// order they joined the list
+func (m *postgresDBRepo) WaitingWaitlistEntries(ctx context.Context) ([]models.WaitlistEntry, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `select ` + waitlistColumns + ` from waitlist_entries w ` + waitlistJoins + `
+			where w.status = $1 and w.start_date > $2
+			order by w.created_at, w.id`
+
+	return m.queryWaitlistEntries(ctx, query, models.WaitlistWaiting, time.Now())
+}
+
+// HoldWaitlistEntry holds roomID for a waiting entry's dates until expires, by giving the room a
+// restriction that belongs to the entry, and queues the emails mail builds in the same transaction.
+// If the room has been taken in the meantime, repository.ErrRoomUnavailable is returned; if the
+// entry is no longer waiting, repository.ErrStatusChanged is. Either way nothing is written
+func (m *postgresDBRepo) HoldWaitlistEntry(ctx context.Context, id, roomID int, expires time.Time, mail repository.MailFunc) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var e models.WaitlistEntry
+
+	query := `update waitlist_entries set status = $1, hold_room_id = $2, hold_expires_at = $3, updated_at = $4
+			where id = $5 and status = $6
+			returning first_name, last_name, start_date, end_date`
+
+	err = tx.QueryRowContext(ctx, query, models.WaitlistOffered, roomID, expires, time.Now(), id, models.WaitlistWaiting).
+		Scan(&e.FirstName, &e.LastName, &e.StartDate, &e.EndDate)
+	if errors.Is(err, sql.ErrNoRows) {
+		return repository.ErrStatusChanged
+	}
+	if err != nil {
+		return err
+	}
+
+	stmt := `insert into room_restrictions (start_date, end_date, room_id, restriction_id, waitlist_entry_id,
+			reason, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7, $8)`
+
+	_, err = tx.ExecContext(ctx, stmt,
+		e.StartDate,
+		e.EndDate,
+		roomID,
+		models.ReservationRestrictionID,
+		id,
+		fmt.Sprintf("Waitlist hold for %s %s", e.FirstName, e.LastName),
+		time.Now(),
+		time.Now(),
+	)
+	if isExclusionViolation(err) {
+		return repository.ErrRoomUnavailable
+	}
+	if err != nil {
+		return err
+	}
+
+	if mail != nil {
+		if err = queueMail(ctx, tx, mail(id)); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// BookWaitlistHold turns an offered waitlist entry into a reservation. The entry's hold is released
+// and the reservation inserted in its place, with the emails mail builds, in one transaction, so
+// nobody else can take the room in between. It returns the new reservation's id, or
+// repository.ErrHoldLapsed if the hold has expired or is no longer offered
+func (m *postgresDBRepo) BookWaitlistHold(ctx context.Context, id int, res models.Reservation, mail repository.MailFunc) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	query := `update waitlist_entries set status = $1, updated_at = $2
+			where id = $3 and status = $4 and hold_expires_at > $2`
+	result, err := tx.ExecContext(ctx, query, models.WaitlistBooked, now, id, models.WaitlistOffered)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, repository.ErrHoldLapsed
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from room_restrictions where waitlist_entry_id = $1`, id)
+	if err != nil {
+		return 0, err
+	}
+
+	newID, err := insertReservationWithRestriction(ctx, tx, res)
+	if err != nil {
+		return 0, err
+	}
+
+	if mail != nil {
+		if err = queueMail(ctx, tx, mail(newID)); err != nil {
+			return 0, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// ExpireWaitlistHolds releases the holds that ran out before now, marking their entries expired,
+// and returns how many were released
+func (m *postgresDBRepo) ExpireWaitlistHolds(ctx context.Context, now time.Time) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	query := `update waitlist_entries set status = $1, updated_at = $2 where status = $3 and hold_expires_at < $4`
+	result, err := tx.ExecContext(ctx, query, models.WaitlistExpired, time.Now(), models.WaitlistOffered, now)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	query = `delete from room_restrictions where waitlist_entry_id in
+			(select id from waitlist_entries where status = $1)`
+	_, err = tx.ExecContext(ctx, query, models.WaitlistExpired)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return int(n), nil
+}
+
+// DeleteWaitlistEntry takes an entry off the waitlist, releasing any hold it has
+func (m *postgresDBRepo) DeleteWaitlistEntry(ctx context.Context, id int) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `delete from waitlist_entries where id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RecordPayment stores a payment transaction and moves its reservation to paymentStatus. A
+// transaction from a provider event (EventID set) is recorded once: an event already seen for the
+// same reference and kind is ignored, and one about a call we made ourselves is matched to the
+// transaction already recorded for that call
+func (m *postgresDBRepo) RecordPayment(ctx context.Context, t models.PaymentTransaction, paymentStatus string) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if t.EventID != "" {
+		var seen int
+		query := `select count(id) from payment_transactions where reference = $1 and kind = $2 and event_id = $3`
+		err = tx.QueryRowContext(ctx, query, t.Reference, t.Kind, t.EventID).Scan(&seen)
+		if err != nil {
+			return err
+		}
+		if seen > 0 {
+			return nil
+		}
+
+		// the provider also tells us about the calls we made ourselves, which are already recorded
+		stmt := `update payment_transactions set event_id = $1, updated_at = $2
+			where id = (select id from payment_transactions
+				where reference = $3 and kind = $4 and amount = $5 and status = $6 and event_id = ''
+				order by id limit 1 for update)`
+		result, err := tx.ExecContext(ctx, stmt, t.EventID, time.Now(), t.Reference, t.Kind, t.Amount, t.Status)
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			return tx.Commit()
+		}
+	}
+
+	stmt := `insert into payment_transactions (reservation_id, provider, kind, reference, amount, status,
+			event_id, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+
+	_, err = tx.ExecContext(ctx, stmt,
+		t.ReservationID,
+		t.Provider,
+		t.Kind,
+		t.Reference,
+		t.Amount,
+		t.Status,
+		t.EventID,
+		time.Now(),
+		time.Now(),
+	)
+	// the same event arriving twice at once; the other delivery recorded it
+	if isUniqueViolation(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	query := `update reservations set payment_status = $1, updated_at = $2 where id = $3`
+	_, err = tx.ExecContext(ctx, query, paymentStatus, time.Now(), t.ReservationID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// paymentTransactionColumns is the column list scanPaymentTransaction expects
+const paymentTransactionColumns = `id, reservation_id, provider, kind, reference, amount, status, event_id,
+	created_at, updated_at`
+
+// scanPaymentTransaction scans a row selected with paymentTransactionColumns into a transaction
+func scanPaymentTransaction(row rowScanner) (models.PaymentTransaction, error) {
+	var t models.PaymentTransaction
+	err := row.Scan(
+		&t.ID,
+		&t.ReservationID,
+		&t.Provider,
+		&t.Kind,
+		&t.Reference,
+		&t.Amount,
+		&t.Status,
+		&t.EventID,
+		&t.CreatedAt,
+		&t.UpdatedAt,
+	)
+	return t, err
+}
+
+// PaymentTransactions returns a reservation's payment transactions, oldest first
+func (m *postgresDBRepo) PaymentTransactions(ctx context.Context, reservationID int) ([]models.PaymentTransaction, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var transactions []models.PaymentTransaction
+
+	query := `select ` + paymentTransactionColumns + ` from payment_transactions
+			where reservation_id = $1 order by created_at, id`
+
+	rows, err := m.DB.QueryContext(ctx, query, reservationID)
+	if err != nil {
+		return transactions, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		t, err := scanPaymentTransaction(rows)
+		if err != nil {
+			return transactions, err
+		}
+		transactions = append(transactions, t)
+	}
+
+	if err = rows.Err(); err != nil {
+		return transactions, err
+	}
+
+	return transactions, nil
+}
+
+// GetPaymentTransactionByReference returns the first transaction made against a provider reference,
+// which ties the provider's later webhooks back to a reservation
+func (m *postgresDBRepo) GetPaymentTransactionByReference(ctx context.Context, reference string) (models.PaymentTransaction, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `select ` + paymentTransactionColumns + ` from payment_transactions
+			where reference = $1 order by created_at, id limit 1`
+
+	return scanPaymentTransaction(m.DB.QueryRowContext(ctx, query, reference))
+}
+
+// IssueInvoice returns the invoice for a reservation, numbering a new one the first time it is asked for
+func (m *postgresDBRepo) IssueInvoice(ctx context.Context, reservationID int) (models.Invoice, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var inv models.Invoice
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return inv, err
+	}
+	defer tx.Rollback()
+
+	// the number comes from the row's own id, so it is set once the row exists
+	stmt := `insert into invoices (reservation_id, number, issued_at, created_at, updated_at)
+			values ($1, '', $2, $3, $4)
+			on conflict (reservation_id) do nothing`
+
+	_, err = tx.ExecContext(ctx, stmt, reservationID, time.Now(), time.Now(), time.Now())
+	if err != nil {
+		return inv, err
+	}
+
+	stmt = `update invoices set number = 'INV-' || lpad(id::text, 6, '0')
+			where reservation_id = $1 and number = ''`
+	_, err = tx.ExecContext(ctx, stmt, reservationID)
+	if err != nil {
+		return inv, err
+	}
+
+	query := `select id, reservation_id, number, issued_at, created_at, updated_at
+			from invoices where reservation_id = $1`
+
+	err = tx.QueryRowContext(ctx, query, reservationID).Scan(
+		&inv.ID,
+		&inv.ReservationID,
+		&inv.Number,
+		&inv.IssuedAt,
+		&inv.CreatedAt,
+		&inv.UpdatedAt,
+	)
+	if err != nil {
+		return inv, err
+	}
+
+	return inv, tx.Commit()
+}
+
+// calendarImportColumns are the columns scanCalendarImport reads, in order
+const calendarImportColumns = `ci.id, ci.room_id, ci.url, ci.last_synced_at, ci.last_status, ci.last_error,
+			ci.events_imported, ci.conflicts, ci.created_at, ci.updated_at, rm.id, rm.room_name`
+
+func scanCalendarImport(row rowScanner) (models.CalendarImport, error) {
+	var imp models.CalendarImport
+	var lastSyncedAt sql.NullTime
+
+	err := row.Scan(
+		&imp.ID,
+		&imp.RoomID,
+		&imp.URL,
+		&lastSyncedAt,
+		&imp.LastStatus,
+		&imp.LastError,
+		&imp.EventsImported,
+		&imp.Conflicts,
+		&imp.CreatedAt,
+		&imp.UpdatedAt,
+		&imp.Room.ID,
+		&imp.Room.RoomName,
+	)
+	imp.LastSyncedAt = lastSyncedAt.Time
+
+	return imp, err
+}
+
+// AllCalendarImports returns every room's calendar import, in room name order
+func (m *postgresDBRepo) AllCalendarImports(ctx context.Context) ([]models.CalendarImport, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var imports []models.CalendarImport
+
+	query := `select ` + calendarImportColumns + `
+			from calendar_imports ci
+			left join rooms rm on (ci.room_id = rm.id)
+			order by rm.room_name`
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return imports, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		imp, err := scanCalendarImport(rows)
+		if err != nil {
+			return imports, err
+		}
+		imports = append(imports, imp)
+	}
+
+	if err = rows.Err(); err != nil {
+		return imports, err
+	}
+
+	return imports, nil
+}
+
+// GetCalendarImportByRoomID returns a room's calendar import. A room that has never had one gets
+// an empty import for that room rather than an error
+func (m *postgresDBRepo) GetCalendarImportByRoomID(ctx context.Context, roomID int) (models.CalendarImport, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `select ` + calendarImportColumns + `
+			from calendar_imports ci
+			left join rooms rm on (ci.room_id = rm.id)
+			where ci.room_id = $1`
+
+	imp, err := scanCalendarImport(m.DB.QueryRowContext(ctx, query, roomID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.CalendarImport{RoomID: roomID}, nil
+	}
+
+	return imp, err
+}
+
+// UpdateCalendarImportURL sets the address a room's calendar is fetched from. An empty url stops
+// scheduled syncs, leaving the blocks already imported in place
+func (m *postgresDBRepo) UpdateCalendarImportURL(ctx context.Context, roomID int, url string) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `insert into calendar_imports (room_id, url, created_at, updated_at)
+			values ($1, $2, $3, $4)
+			on conflict (room_id) do update set url = excluded.url, updated_at = excluded.updated_at`
+
+	_, err := m.DB.ExecContext(ctx, stmt, roomID, url, time.Now(), time.Now())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RecordCalendarSync stores how a room's last calendar sync went
+func (m *postgresDBRepo) RecordCalendarSync(ctx context.Context, imp models.CalendarImport) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `insert into calendar_imports (room_id, last_synced_at, last_status, last_error, events_imported,
+			conflicts, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7, $8)
+			on conflict (room_id) do update set last_synced_at = excluded.last_synced_at,
+			last_status = excluded.last_status, last_error = excluded.last_error,
+			events_imported = excluded.events_imported, conflicts = excluded.conflicts,
+			updated_at = excluded.updated_at`
+
+	_, err := m.DB.ExecContext(ctx, stmt,
+		imp.RoomID,
+		imp.LastSyncedAt,
+		imp.LastStatus,
+		imp.LastError,
+		imp.EventsImported,
+		imp.Conflicts,
+		time.Now(),
+		time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// SyncChannelBlocks makes a room's channel blocks match blocks, matching them up by ExternalUID.
+// Blocks whose UID has gone from the feed are deleted, unless they ended before since, so past
+// stays that a channel has dropped from its feed are kept. A block that overlaps a reservation or
+// another block is skipped and counted as a conflict rather than failing the whole sync
+func (m *postgresDBRepo) SyncChannelBlocks(ctx context.Context, roomID int, since time.Time, blocks []models.RoomRestriction) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	conflicts := 0
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return conflicts, err
+	}
+	defer tx.Rollback()
+
+	uids := make([]string, 0, len(blocks))
+	for _, b := range blocks {
+		uids = append(uids, b.ExternalUID)
+	}
+
+	// retire first, so a stay that moved to dates another one just gave up doesn't conflict
+	stmt := `delete from room_restrictions
+			where room_id = $1 and restriction_id = $2 and external_uid is not null
+			and end_date > $3 and not (external_uid = any($4))`
+
+	_, err = tx.ExecContext(ctx, stmt, roomID, models.ChannelRestrictionID, since, uids)
+	if err != nil {
+		return conflicts, err
+	}
+
+	stmt = `insert into room_restrictions (start_date, end_date, room_id, restriction_id, reason, external_uid,
+			created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7, $8)
+			on conflict (room_id, external_uid) do update set start_date = excluded.start_date,
+			end_date = excluded.end_date, reason = excluded.reason, updated_at = excluded.updated_at`
+
+	for _, b := range blocks {
+		// a savepoint per block lets one conflict be rolled back without losing the rest
+		if _, err = tx.ExecContext(ctx, "savepoint channel_block"); err != nil {
+			return conflicts, err
+		}
+
+		_, err = tx.ExecContext(ctx, stmt,
+			b.StartDate,
+			b.EndDate,
+			roomID,
+			models.ChannelRestrictionID,
+			b.Reason,
+			b.ExternalUID,
+			time.Now(),
+			time.Now(),
+		)
+		if isExclusionViolation(err) {
+			conflicts++
+			if _, err = tx.ExecContext(ctx, "rollback to savepoint channel_block"); err != nil {
+				return conflicts, err
+			}
+			continue
+		}
+		if err != nil {
+			return conflicts, err
+		}
+	}
+
+	return conflicts, tx.Commit()
+}
+
+// apiKeyColumns are the columns scanAPIKey reads, in order
+const apiKeyColumns = `id, name, prefix, scopes, rate_limit, last_used_at, revoked_at, created_at, updated_at`
+
+func scanAPIKey(row rowScanner) (models.APIKey, error) {
+	var key models.APIKey
+	var scopes string
+	var lastUsedAt, revokedAt sql.NullTime
+
+	err := row.Scan(
+		&key.ID,
+		&key.Name,
+		&key.Prefix,
+		&scopes,
+		&key.RateLimit,
+		&lastUsedAt,
+		&revokedAt,
+		&key.CreatedAt,
+		&key.UpdatedAt,
+	)
+	key.Scopes = helpers.SplitLines(scopes)
+	key.LastUsedAt = lastUsedAt.Time
+	key.RevokedAt = revokedAt.Time
+
+	return key, err
+}
+
+// AllAPIKeys returns every API key, the ones still in use first
+func (m *postgresDBRepo) AllAPIKeys(ctx context.Context) ([]models.APIKey, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var keys []models.APIKey
+
+	query := `select ` + apiKeyColumns + ` from api_keys order by revoked_at nulls first, name`
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return keys, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return keys, err
+		}
+		keys = append(keys, key)
+	}
+
+	if err = rows.Err(); err != nil {
+		return keys, err
+	}
+
+	return keys, nil
+}
+
+// GetAPIKeyByID returns one API key, revoked or not
+func (m *postgresDBRepo) GetAPIKeyByID(ctx context.Context, id int) (models.APIKey, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `select ` + apiKeyColumns + ` from api_keys where id = $1`
+
+	return scanAPIKey(m.DB.QueryRowContext(ctx, query, id))
+}
+
+// GetAPIKeyByHash returns the key stored under hash. A revoked key is not found
+func (m *postgresDBRepo) GetAPIKeyByHash(ctx context.Context, hash string) (models.APIKey, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `select ` + apiKeyColumns + ` from api_keys where key_hash = $1 and revoked_at is null`
+
+	return scanAPIKey(m.DB.QueryRowContext(ctx, query, hash))
+}
+
+// InsertAPIKey stores a new key under hash, and returns its id
+func (m *postgresDBRepo) InsertAPIKey(ctx context.Context, key models.APIKey, hash string) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var newID int
+
+	stmt := `insert into api_keys (name, prefix, key_hash, scopes, rate_limit, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7) returning id`
+
+	err := m.DB.QueryRowContext(ctx, stmt,
+		key.Name,
+		key.Prefix,
+		hash,
+		strings.Join(key.Scopes, "\n"),
+		key.RateLimit,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// UpdateAPIKey changes a key's name, scopes and rate limit
+func (m *postgresDBRepo) UpdateAPIKey(ctx context.Context, key models.APIKey) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `update api_keys set name = $1, scopes = $2, rate_limit = $3, updated_at = $4 where id = $5`
+
+	_, err := m.DB.ExecContext(ctx, stmt,
+		key.Name,
+		strings.Join(key.Scopes, "\n"),
+		key.RateLimit,
+		time.Now(),
+		key.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RotateAPIKey replaces a key with a new one, stored under hash. The old key stops working at once.
+// A revoked key can't be rotated, and returns sql.ErrNoRows
+func (m *postgresDBRepo) RotateAPIKey(ctx context.Context, id int, prefix, hash string) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `update api_keys set prefix = $1, key_hash = $2, last_used_at = null, updated_at = $3
+			where id = $4 and revoked_at is null`
+
+	result, err := m.DB.ExecContext(ctx, stmt, prefix, hash, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// RevokeAPIKey stops a key working for good. The key is kept, so its history still makes sense
+func (m *postgresDBRepo) RevokeAPIKey(ctx context.Context, id int) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `update api_keys set revoked_at = $1, updated_at = $1 where id = $2 and revoked_at is null`
+
+	_, err := m.DB.ExecContext(ctx, stmt, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// TouchAPIKey records that a key was used at. To spare a write on every request, it is only
+// updated when the last recorded use is more than a minute old
+func (m *postgresDBRepo) TouchAPIKey(ctx context.Context, id int, at time.Time) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `update api_keys set last_used_at = $1
+			where id = $2 and (last_used_at is null or last_used_at < $3)`
+
+	_, err := m.DB.ExecContext(ctx, stmt, at, id, at.Add(-time.Minute))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// nullableTime stores a zero time as null, for timestamps that may not have happened yet
+func nullableTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+// webhookSubscriptionColumns are the columns scanWebhookSubscription reads, in order
+const webhookSubscriptionColumns = `id, url, secret, events, active, created_at, updated_at`
+
+func scanWebhookSubscription(row rowScanner) (models.WebhookSubscription, error) {
+	var sub models.WebhookSubscription
+	var events string
+
+	err := row.Scan(
+		&sub.ID,
+		&sub.URL,
+		&sub.Secret,
+		&events,
+		&sub.Active,
+		&sub.CreatedAt,
+		&sub.UpdatedAt,
+	)
+	sub.Events = helpers.SplitLines(events)
+
+	return sub, err
+}
+
+// AllWebhookSubscriptions returns every webhook subscription, ordered by url
+func (m *postgresDBRepo) AllWebhookSubscriptions(ctx context.Context) ([]models.WebhookSubscription, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var subs []models.WebhookSubscription
+
+	query := `select ` + webhookSubscriptionColumns + ` from webhook_subscriptions order by url, id`
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return subs, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		sub, err := scanWebhookSubscription(rows)
+		if err != nil {
+			return subs, err
+		}
+		subs = append(subs, sub)
+	}
+
+	if err = rows.Err(); err != nil {
+		return subs, err
+	}
+
+	return subs, nil
+}
+
+// GetWebhookSubscriptionByID returns one webhook subscription
+func (m *postgresDBRepo) GetWebhookSubscriptionByID(ctx context.Context, id int) (models.WebhookSubscription, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `select ` + webhookSubscriptionColumns + ` from webhook_subscriptions where id = $1`
+
+	return scanWebhookSubscription(m.DB.QueryRowContext(ctx, query, id))
 }
 
-// DeleteBlockByID deletes a room restriction by id
-func (m *postgresDBRepo) DeleteBlockByID(id int) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// InsertWebhookSubscription stores a new webhook subscription, and returns its id
+func (m *postgresDBRepo) InsertWebhookSubscription(ctx context.Context, sub models.WebhookSubscription) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
 	defer cancel()
 
-	query := `delete from room_restrictions where id = $1`
+	var newID int
+
+	stmt := `insert into webhook_subscriptions (url, secret, events, active, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6) returning id`
 
-	_, err := m.DB.ExecContext(ctx, query, id)
+	err := m.DB.QueryRowContext(ctx, stmt,
+		sub.URL,
+		sub.Secret,
+		strings.Join(sub.Events, "\n"),
+		sub.Active,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// UpdateWebhookSubscription changes a subscription's url, events and whether it is active. The
+// secret is never changed, so the subscriber doesn't have to be told again
+func (m *postgresDBRepo) UpdateWebhookSubscription(ctx context.Context, sub models.WebhookSubscription) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `update webhook_subscriptions set url = $1, events = $2, active = $3, updated_at = $4 where id = $5`
+
+	_, err := m.DB.ExecContext(ctx, stmt,
+		sub.URL,
+		strings.Join(sub.Events, "\n"),
+		sub.Active,
+		time.Now(),
+		sub.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeleteWebhookSubscription deletes a subscription, along with its delivery log
+func (m *postgresDBRepo) DeleteWebhookSubscription(ctx context.Context, id int) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `delete from webhook_subscriptions where id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// QueueWebhookDeliveries queues payload for every active subscription that wants event, due at
+// once, and returns how many deliveries were queued
+func (m *postgresDBRepo) QueueWebhookDeliveries(ctx context.Context, event, payload string) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `insert into webhook_deliveries
+			(subscription_id, event, payload, status, next_attempt_at, created_at, updated_at)
+		select id, $1, $2, $3, $4, $4, $4
+		from webhook_subscriptions
+		where active and $1 = any(string_to_array(events, E'\n'))`
+
+	result, err := m.DB.ExecContext(ctx, stmt, event, payload, models.DeliveryPending, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	queued, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(queued), nil
+}
+
+// webhookDeliveryColumns is the column list, aliased on d with webhook_subscriptions s, that
+// scanWebhookDelivery expects
+const webhookDeliveryColumns = `d.id, d.subscription_id, d.event, d.payload, d.status, d.attempts,
+		d.next_attempt_at, d.last_attempt_at, d.response_status, d.last_error, d.delivered_at,
+		d.created_at, d.updated_at, s.url, s.secret, s.active`
+
+func scanWebhookDelivery(row rowScanner) (models.WebhookDelivery, error) {
+	var d models.WebhookDelivery
+	var nextAttemptAt, lastAttemptAt, deliveredAt sql.NullTime
+
+	err := row.Scan(
+		&d.ID,
+		&d.SubscriptionID,
+		&d.Event,
+		&d.Payload,
+		&d.Status,
+		&d.Attempts,
+		&nextAttemptAt,
+		&lastAttemptAt,
+		&d.ResponseStatus,
+		&d.LastError,
+		&deliveredAt,
+		&d.CreatedAt,
+		&d.UpdatedAt,
+		&d.Subscription.URL,
+		&d.Subscription.Secret,
+		&d.Subscription.Active,
+	)
+	d.NextAttemptAt = nextAttemptAt.Time
+	d.LastAttemptAt = lastAttemptAt.Time
+	d.DeliveredAt = deliveredAt.Time
+	d.Subscription.ID = d.SubscriptionID
+
+	return d, err
+}
+
+func (m *postgresDBRepo) queryWebhookDeliveries(ctx context.Context, query string, args ...interface{}) ([]models.WebhookDelivery, error) {
+	var deliveries []models.WebhookDelivery
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return deliveries, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		d, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return deliveries, err
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	if err = rows.Err(); err != nil {
+		return deliveries, err
+	}
+
+	return deliveries, nil
+}
+
+// ClaimDueWebhookDeliveries returns up to limit pending deliveries due by now, to active
+// subscriptions, the longest waiting first, and puts them off until leaseUntil so no other worker
+// takes them meanwhile. A delivery whose worker dies before recording the attempt is picked up
+// again once the lease runs out
+func (m *postgresDBRepo) ClaimDueWebhookDeliveries(ctx context.Context, now, leaseUntil time.Time, limit int) ([]models.WebhookDelivery, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `update webhook_deliveries d set next_attempt_at = $1, updated_at = $2
+		from webhook_subscriptions s
+		where s.id = d.subscription_id and d.id in (
+			select due.id from webhook_deliveries due
+			join webhook_subscriptions sub on (sub.id = due.subscription_id)
+			where due.status = $3 and due.next_attempt_at <= $4 and sub.active
+			order by due.next_attempt_at, due.id
+			limit $5
+			for update of due skip locked
+		)
+		returning ` + webhookDeliveryColumns
+
+	return m.queryWebhookDeliveries(ctx, query, leaseUntil, time.Now(), models.DeliveryPending, now, limit)
+}
+
+// RecordWebhookAttempt saves how the latest attempt at a delivery went
+func (m *postgresDBRepo) RecordWebhookAttempt(ctx context.Context, d models.WebhookDelivery) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `update webhook_deliveries set status = $1, attempts = $2, next_attempt_at = $3,
+			last_attempt_at = $4, response_status = $5, last_error = $6, delivered_at = $7, updated_at = $8
+		where id = $9`
+
+	_, err := m.DB.ExecContext(ctx, stmt,
+		d.Status,
+		d.Attempts,
+		nullableTime(d.NextAttemptAt),
+		nullableTime(d.LastAttemptAt),
+		d.ResponseStatus,
+		d.LastError,
+		nullableTime(d.DeliveredAt),
+		time.Now(),
+		d.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// WebhookDeliveries returns the latest limit deliveries to a subscription, newest first
+func (m *postgresDBRepo) WebhookDeliveries(ctx context.Context, subscriptionID, limit int) ([]models.WebhookDelivery, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `select ` + webhookDeliveryColumns + `
+		from webhook_deliveries d
+		join webhook_subscriptions s on (s.id = d.subscription_id)
+		where d.subscription_id = $1
+		order by d.created_at desc, d.id desc
+		limit $2`
+
+	return m.queryWebhookDeliveries(ctx, query, subscriptionID, limit)
+}
+
+// GetWebhookDeliveryByID returns one delivery, with the subscription it is for
+func (m *postgresDBRepo) GetWebhookDeliveryByID(ctx context.Context, id int) (models.WebhookDelivery, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `select ` + webhookDeliveryColumns + `
+		from webhook_deliveries d
+		join webhook_subscriptions s on (s.id = d.subscription_id)
+		where d.id = $1`
+
+	return scanWebhookDelivery(m.DB.QueryRowContext(ctx, query, id))
+}
+
+// queueMail adds msgs to the outbox within tx, due to be sent at once
+func queueMail(ctx context.Context, tx *sql.Tx, msgs []models.MailData) error {
+	stmt := `insert into mail_outbox (mail_to, mail_from, subject, content, text, template, attachments,
+			status, next_attempt_at, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $9, $9)`
+
+	for _, msg := range msgs {
+		attachments, err := json.Marshal(msg.Attachments)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, stmt,
+			msg.To,
+			msg.From,
+			msg.Subject,
+			msg.Content,
+			msg.Text,
+			msg.Template,
+			string(attachments),
+			models.MailPending,
+			time.Now(),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// QueueMail adds msgs to the outbox, all or none of them, to be sent by the mail workers
+func (m *postgresDBRepo) QueueMail(ctx context.Context, msgs ...models.MailData) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = queueMail(ctx, tx, msgs); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// outboxColumns are the columns scanOutboxMessage reads, in order
+const outboxColumns = `id, mail_to, mail_from, subject, content, text, template, attachments, status, attempts,
+		next_attempt_at, last_attempt_at, last_error, sent_at, created_at, updated_at`
+
+func scanOutboxMessage(row rowScanner) (models.OutboxMessage, error) {
+	var msg models.OutboxMessage
+	var attachments string
+	var nextAttemptAt, lastAttemptAt, sentAt sql.NullTime
+
+	err := row.Scan(
+		&msg.ID,
+		&msg.Mail.To,
+		&msg.Mail.From,
+		&msg.Mail.Subject,
+		&msg.Mail.Content,
+		&msg.Mail.Text,
+		&msg.Mail.Template,
+		&attachments,
+		&msg.Status,
+		&msg.Attempts,
+		&nextAttemptAt,
+		&lastAttemptAt,
+		&msg.LastError,
+		&sentAt,
+		&msg.CreatedAt,
+		&msg.UpdatedAt,
+	)
+	if err != nil {
+		return msg, err
+	}
+
+	msg.NextAttemptAt = nextAttemptAt.Time
+	msg.LastAttemptAt = lastAttemptAt.Time
+	msg.SentAt = sentAt.Time
+
+	if attachments != "" {
+		err = json.Unmarshal([]byte(attachments), &msg.Mail.Attachments)
+	}
+
+	return msg, err
+}
+
+func (m *postgresDBRepo) queryOutboxMessages(ctx context.Context, query string, args ...interface{}) ([]models.OutboxMessage, error) {
+	var msgs []models.OutboxMessage
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return msgs, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		msg, err := scanOutboxMessage(rows)
+		if err != nil {
+			return msgs, err
+		}
+		msgs = append(msgs, msg)
+	}
+
+	if err = rows.Err(); err != nil {
+		return msgs, err
+	}
+
+	return msgs, nil
+}
+
+// ClaimDueMail returns up to limit pending messages due by now, the longest waiting first, and puts
+// them off until leaseUntil so no other worker takes them meanwhile. A message whose worker dies
+// before recording the attempt is picked up again once the lease runs out
+func (m *postgresDBRepo) ClaimDueMail(ctx context.Context, now, leaseUntil time.Time, limit int) ([]models.OutboxMessage, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `update mail_outbox set next_attempt_at = $1, updated_at = $2
+		where id in (
+			select id from mail_outbox
+			where status = $3 and next_attempt_at <= $4
+			order by next_attempt_at, id
+			limit $5
+			for update skip locked
+		)
+		returning ` + outboxColumns
+
+	return m.queryOutboxMessages(ctx, query, leaseUntil, time.Now(), models.MailPending, now, limit)
+}
+
+// RecordMailAttempt saves how the latest attempt to send a message went
+func (m *postgresDBRepo) RecordMailAttempt(ctx context.Context, msg models.OutboxMessage) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `update mail_outbox set status = $1, attempts = $2, next_attempt_at = $3, last_attempt_at = $4,
+			last_error = $5, sent_at = $6, updated_at = $7
+		where id = $8`
+
+	_, err := m.DB.ExecContext(ctx, stmt,
+		msg.Status,
+		msg.Attempts,
+		nullableTime(msg.NextAttemptAt),
+		nullableTime(msg.LastAttemptAt),
+		msg.LastError,
+		nullableTime(msg.SentAt),
+		time.Now(),
+		msg.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// OutboxMessages returns the latest limit messages, newest first, in status, or in any status if
+// it is empty
+func (m *postgresDBRepo) OutboxMessages(ctx context.Context, status string, limit int) ([]models.OutboxMessage, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `select ` + outboxColumns + ` from mail_outbox
+		where ($1 = '' or status = $1)
+		order by created_at desc, id desc
+		limit $2`
+
+	return m.queryOutboxMessages(ctx, query, status, limit)
+}
+
+// GetOutboxMessageByID returns one outbox message
+func (m *postgresDBRepo) GetOutboxMessageByID(ctx context.Context, id int) (models.OutboxMessage, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `select ` + outboxColumns + ` from mail_outbox where id = $1`
+
+	return scanOutboxMessage(m.DB.QueryRowContext(ctx, query, id))
+}
+
+// ResendOutboxMessage puts a dead message back in the outbox, due at once and with its attempts
+// starting over. It returns repository.ErrStatusChanged if the message isn't dead
+func (m *postgresDBRepo) ResendOutboxMessage(ctx context.Context, id int) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `update mail_outbox set status = $1, attempts = 0, next_attempt_at = $2, updated_at = $2
+		where id = $3 and status = $4`
+
+	result, err := m.DB.ExecContext(ctx, stmt, models.MailPending, time.Now(), id, models.MailDead)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
 	if err != nil {
-		log.Println(err)
 		return err
 	}
+	if n == 0 {
+		return repository.ErrStatusChanged
+	}
+
 	return nil
 }
+
+// emailTemplateColumns are the columns scanEmailTemplate reads, in order, from email_templates t
+// joined to users u
+const emailTemplateColumns = `t.id, t.event, t.version, t.source, t.note, t.user_id, t.created_at, t.updated_at,
+	coalesce(u.first_name, ''), coalesce(u.last_name, '')`
+
+func scanEmailTemplate(row rowScanner) (models.EmailTemplate, error) {
+	var t models.EmailTemplate
+
+	err := row.Scan(
+		&t.ID,
+		&t.Event,
+		&t.Version,
+		&t.Source,
+		&t.Note,
+		&t.UserID,
+		&t.CreatedAt,
+		&t.UpdatedAt,
+		&t.User.FirstName,
+		&t.User.LastName,
+	)
+	t.User.ID = t.UserID
+
+	return t, err
+}
+
+// queryEmailTemplates runs query, which selects emailTemplateColumns, and scans every row
+func (m *postgresDBRepo) queryEmailTemplates(ctx context.Context, query string, args ...interface{}) ([]models.EmailTemplate, error) {
+	var templates []models.EmailTemplate
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return templates, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		t, err := scanEmailTemplate(rows)
+		if err != nil {
+			return templates, err
+		}
+		templates = append(templates, t)
+	}
+
+	if err = rows.Err(); err != nil {
+		return templates, err
+	}
+
+	return templates, nil
+}
+
+// CurrentEmailTemplates returns the newest version of every event's email template, ordered by event
+func (m *postgresDBRepo) CurrentEmailTemplates(ctx context.Context) ([]models.EmailTemplate, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `select distinct on (t.event) ` + emailTemplateColumns + `
+		from email_templates t
+		left join users u on (t.user_id = u.id)
+		order by t.event, t.version desc`
+
+	return m.queryEmailTemplates(ctx, query)
+}
+
+// CurrentEmailTemplate returns the newest version of event's email template, or sql.ErrNoRows if
+// none has been saved
+func (m *postgresDBRepo) CurrentEmailTemplate(ctx context.Context, event string) (models.EmailTemplate, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `select ` + emailTemplateColumns + `
+		from email_templates t
+		left join users u on (t.user_id = u.id)
+		where t.event = $1
+		order by t.version desc
+		limit 1`
+
+	return scanEmailTemplate(m.DB.QueryRowContext(ctx, query, event))
+}
+
+// EmailTemplateVersions returns every saved version of event's email template, newest first
+func (m *postgresDBRepo) EmailTemplateVersions(ctx context.Context, event string) ([]models.EmailTemplate, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `select ` + emailTemplateColumns + `
+		from email_templates t
+		left join users u on (t.user_id = u.id)
+		where t.event = $1
+		order by t.version desc`
+
+	return m.queryEmailTemplates(ctx, query, event)
+}
+
+// GetEmailTemplateByID returns one version of an email template
+func (m *postgresDBRepo) GetEmailTemplateByID(ctx context.Context, id int) (models.EmailTemplate, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `select ` + emailTemplateColumns + `
+		from email_templates t
+		left join users u on (t.user_id = u.id)
+		where t.id = $1`
+
+	return scanEmailTemplate(m.DB.QueryRowContext(ctx, query, id))
+}
+
+// InsertEmailTemplate saves t's source as the version after t.Version, the one it was edited from
+// (0 for the template as shipped), and returns its id. If that version has already been saved, by
+// another save racing this one or since t was loaded, the unique index refuses it and
+// repository.ErrTemplateChanged is returned rather than one quietly replacing the other
+func (m *postgresDBRepo) InsertEmailTemplate(ctx context.Context, t models.EmailTemplate) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var newID int
+
+	stmt := `insert into email_templates (event, version, source, note, user_id, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7)
+		returning id`
+
+	err := m.DB.QueryRowContext(ctx, stmt,
+		t.Event,
+		t.Version+1,
+		t.Source,
+		t.Note,
+		t.UserID,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if isUniqueViolation(err) {
+		return 0, repository.ErrTemplateChanged
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
@@ -0,0 +1,87 @@
+package dbrepo
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/msaufi2325/06_bookings/internal/config"
+	"github.com/msaufi2325/06_bookings/internal/models"
+	"github.com/msaufi2325/06_bookings/internal/repository"
+)
+
+// RecordingRepo is the testing repo for the background jobs. It serves the due mail, due webhook
+// deliveries and calendar imports it is given, and keeps what the jobs write back, so their tests
+// can check it. It is safe for concurrent use by a pool of workers
+type RecordingRepo struct {
+	repository.DatabaseRepo
+
+	DueMail       []models.OutboxMessage
+	DueDeliveries []models.WebhookDelivery
+	Imports       []models.CalendarImport
+
+	mu              sync.Mutex
+	Lease           time.Duration
+	MailAttempts    []models.OutboxMessage
+	QueuedWebhooks  []string
+	WebhookAttempts []models.WebhookDelivery
+	CalendarSyncs   []models.CalendarImport
+}
+
+// NewRecordingRepo returns a RecordingRepo over the testing repo, with nothing due and nothing kept
+func NewRecordingRepo(a *config.AppConfig) *RecordingRepo {
+	return &RecordingRepo{DatabaseRepo: NewTestingRepo(a)}
+}
+
+// ClaimDueMail returns DueMail, keeping the lease it was claimed for
+func (m *RecordingRepo) ClaimDueMail(ctx context.Context, now, leaseUntil time.Time, limit int) ([]models.OutboxMessage, error) {
+	m.mu.Lock()
+	m.Lease = leaseUntil.Sub(now)
+	m.mu.Unlock()
+	return m.DueMail, nil
+}
+
+// RecordMailAttempt keeps msg; recording message 100 fails
+func (m *RecordingRepo) RecordMailAttempt(ctx context.Context, msg models.OutboxMessage) error {
+	m.mu.Lock()
+	m.MailAttempts = append(m.MailAttempts, msg)
+	m.mu.Unlock()
+	return m.DatabaseRepo.RecordMailAttempt(ctx, msg)
+}
+
+// QueueWebhookDeliveries keeps payload
+func (m *RecordingRepo) QueueWebhookDeliveries(ctx context.Context, event, payload string) (int, error) {
+	m.mu.Lock()
+	m.QueuedWebhooks = append(m.QueuedWebhooks, payload)
+	m.mu.Unlock()
+	return m.DatabaseRepo.QueueWebhookDeliveries(ctx, event, payload)
+}
+
+// ClaimDueWebhookDeliveries returns DueDeliveries, keeping the lease they were claimed for
+func (m *RecordingRepo) ClaimDueWebhookDeliveries(ctx context.Context, now, leaseUntil time.Time, limit int) ([]models.WebhookDelivery, error) {
+	m.mu.Lock()
+	m.Lease = leaseUntil.Sub(now)
+	m.mu.Unlock()
+	return m.DueDeliveries, nil
+}
+
+// RecordWebhookAttempt keeps d; recording delivery 100 fails
+func (m *RecordingRepo) RecordWebhookAttempt(ctx context.Context, d models.WebhookDelivery) error {
+	m.mu.Lock()
+	m.WebhookAttempts = append(m.WebhookAttempts, d)
+	m.mu.Unlock()
+	return m.DatabaseRepo.RecordWebhookAttempt(ctx, d)
+}
+
+// AllCalendarImports returns Imports
+func (m *RecordingRepo) AllCalendarImports(ctx context.Context) ([]models.CalendarImport, error) {
+	return m.Imports, nil
+}
+
+// RecordCalendarSync keeps imp
+func (m *RecordingRepo) RecordCalendarSync(ctx context.Context, imp models.CalendarImport) error {
+	m.mu.Lock()
+	m.CalendarSyncs = append(m.CalendarSyncs, imp)
+	m.mu.Unlock()
+	return m.DatabaseRepo.RecordCalendarSync(ctx, imp)
+}
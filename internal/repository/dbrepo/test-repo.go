@@ -1,19 +1,25 @@
 package dbrepo
 
 import (
+	"context"
+	"database/sql"
 	"errors"
+	"fmt"
 	"log"
+	"strings"
 	"time"
 
+	"github.com/msaufi2325/06_bookings/internal/apikeys"
 	"github.com/msaufi2325/06_bookings/internal/models"
+	"github.com/msaufi2325/06_bookings/internal/repository"
 )
 
-func (m *testDBRepo) AllUsers() bool {
+func (m *testDBRepo) AllUsers(ctx context.Context) bool {
 	return true
 }
 
 // InsertReservation inserts a reservation into the database
-func (m *testDBRepo) InsertReservation(res models.Reservation) (int, error) {
+func (m *testDBRepo) InsertReservation(ctx context.Context, res models.Reservation) (int, error) {
 	// if the room id is 2, then fail; otherwise, pass
 	if res.RoomID == 2 {
 		return 0, errors.New("some error)")
@@ -22,15 +28,38 @@ func (m *testDBRepo) InsertReservation(res models.Reservation) (int, error) {
 }
 
 // InsertRoomRestriction inserts a room restriction into the database
-func (m *testDBRepo) InsertRoomRestriction(r models.RoomRestriction) error {
+func (m *testDBRepo) InsertRoomRestriction(ctx context.Context, r models.RoomRestriction) error {
 	if r.RoomID == 1000 {
 		return errors.New("some error")
 	}
 	return nil
 }
 
+// InsertReservationWithRestriction inserts a reservation and its room restriction
+func (m *testDBRepo) InsertReservationWithRestriction(ctx context.Context, res models.Reservation, mail repository.MailFunc) (int, error) {
+	// if the room id is 2, then fail; otherwise, pass
+	if res.RoomID == 2 {
+		return 0, errors.New("some error")
+	}
+
+	// this is our test for a room that was booked by someone else -- specify 2070-01-01 as start
+	testDateTaken, err := time.Parse("2006-01-02", "2070-01-01")
+	if err != nil {
+		log.Println(err)
+	}
+
+	if res.StartDate == testDateTaken {
+		return 0, repository.ErrRoomUnavailable
+	}
+
+	if mail != nil {
+		m.QueueMail(ctx, mail(1)...)
+	}
+	return 1, nil
+}
+
 // SearchAvailabilityByDatesByRoomID returns true if availability exists for roomID, and false if no availability
-func (m *testDBRepo) SearchAvailabilityByDatesByRoomID(start, end time.Time, roomID int) (bool, error) {
+func (m *testDBRepo) SearchAvailabilityByDatesByRoomID(ctx context.Context, start, end time.Time, roomID int) (bool, error) {
 	// set up a test time
 	layout := "2006-01-02"
 	str := "2049-12-31"
@@ -60,9 +89,14 @@ func (m *testDBRepo) SearchAvailabilityByDatesByRoomID(start, end time.Time, roo
 }
 
 // SearchAvailabilityForAllRooms returns a slice of available rooms, if any, for given date range
-func (m *testDBRepo) SearchAvailabilityForAllRooms(start, end time.Time) ([]models.Room, error) {
+func (m *testDBRepo) SearchAvailabilityForAllRooms(ctx context.Context, start, end time.Time) ([]models.Room, error) {
 	var rooms []models.Room
 
+	// a canceled request context fails the query, as it would against postgres
+	if err := ctx.Err(); err != nil {
+		return rooms, err
+	}
+
 	// if the start date is after 2049-12-31, then return empty slice,
 	// indicating no rooms are available;
 	layout := "2006-01-02"
@@ -88,7 +122,13 @@ func (m *testDBRepo) SearchAvailabilityForAllRooms(start, end time.Time) ([]mode
 	// otherwise, put an entry into the slice, indicating that some room is
 	// available for search dates
 	room := models.Room{
-		ID: 1,
+		ID:               1,
+		RoomName:         "General's Quarters",
+		Slug:             "generals-quarters",
+		MaxOccupancy:     2,
+		BedConfiguration: "1 King",
+		Amenities:        []string{"Ocean view", "Free Wi-Fi"},
+		Photos:           []models.RoomPhoto{{Path: "/static/images/generals-quarters.png", Caption: "Bedroom"}},
 	}
 	rooms = append(rooms, room)
 
@@ -96,25 +136,72 @@ func (m *testDBRepo) SearchAvailabilityForAllRooms(start, end time.Time) ([]mode
 }
 
 // GetRoomByID gets a room by id
-func (m *testDBRepo) GetRoomByID(id int) (models.Room, error) {
+func (m *testDBRepo) GetRoomByID(ctx context.Context, id int) (models.Room, error) {
 	var room models.Room
+	// room 4 doesn't exist
+	if id == 4 {
+		return room, sql.ErrNoRows
+	}
+	// room 3 has been taken out of service
+	if id == 3 {
+		return models.Room{ID: 3, RoomName: "Old Barn", Slug: "old-barn", Archived: 1}, nil
+	}
 	if id > 2 {
 		return room, errors.New("some error")
 	}
 	return room, nil
 }
 
-func (m *testDBRepo) GetUserByID(id int) (models.User, error) {
-	var u models.User
+// GetRoomBySlug gets a room by its url slug; the slug "error" fails
+func (m *testDBRepo) GetRoomBySlug(ctx context.Context, slug string) (models.Room, error) {
+	var room models.Room
+	switch slug {
+	case "error":
+		return room, errors.New("some error")
+	case "generals-quarters":
+		room = models.Room{
+			ID:           1,
+			RoomName:     "General's Quarters",
+			Slug:         slug,
+			MaxOccupancy: 2,
+			Amenities:    []string{"Ocean view", "Free Wi-Fi"},
+			Photos: []models.RoomPhoto{
+				{Path: "/static/images/generals-quarters.png", Caption: "Bedroom"},
+				{Path: "/static/images/outside.png", Caption: "Outside"},
+			},
+		}
+	case "majors-suite":
+		room = models.Room{ID: 2, RoomName: "Major's Suite", Slug: slug}
+	case "old-barn":
+		room = models.Room{ID: 3, RoomName: "Old Barn", Slug: slug, Archived: 1}
+	default:
+		return room, sql.ErrNoRows
+	}
+	return room, nil
+}
+
+// GetUserByID returns the admin user for any id but 0, which no one has
+func (m *testDBRepo) GetUserByID(ctx context.Context, id int) (models.User, error) {
+	if id == 0 {
+		return models.User{}, sql.ErrNoRows
+	}
+
+	u := models.User{
+		ID:          id,
+		FirstName:   "Admin",
+		LastName:    "User",
+		Email:       "me@here.ca",
+		AccessLevel: 3,
+	}
 
 	return u, nil
 }
 
-func (m *testDBRepo) UpdateUser(u models.User) error {
+func (m *testDBRepo) UpdateUser(ctx context.Context, u models.User) error {
 	return nil
 }
 
-func (m *testDBRepo) Authenticate(email, testPassword string) (int, string, error) {
+func (m *testDBRepo) Authenticate(ctx context.Context, email, testPassword string) (int, string, error) {
 	if email == "me@here.ca" {
 		return 1, "", nil
 	}
@@ -122,56 +209,958 @@ func (m *testDBRepo) Authenticate(email, testPassword string) (int, string, erro
 }
 
 // All Reservations returns a slice of all reservations
-func (m *testDBRepo) AllReservations() ([]models.Reservation, error) {
+func (m *testDBRepo) AllReservations(ctx context.Context) ([]models.Reservation, error) {
 	var reservations []models.Reservation
 	return reservations, nil
 }
 
+// ReservationsBetween returns the reservations arriving or departing between start and end
+func (m *testDBRepo) ReservationsBetween(ctx context.Context, start, end time.Time) ([]models.Reservation, error) {
+	res, _ := m.GetReservationByID(ctx, 1)
+	res.Room = models.Room{ID: 1, RoomName: "General's Quarters"}
+	return []models.Reservation{res}, nil
+}
+
 // AllNewReservations returns a slice of all reservations
-func (m *testDBRepo) AllNewReservations() ([]models.Reservation, error) {
+func (m *testDBRepo) AllNewReservations(ctx context.Context) ([]models.Reservation, error) {
 	var reservations []models.Reservation
 	return reservations, nil
 }
 
 // GetReservationByID returns one reservation by id
-func (m *testDBRepo) GetReservationByID(id int) (models.Reservation, error) {
-	var res models.Reservation
+func (m *testDBRepo) GetReservationByID(ctx context.Context, id int) (models.Reservation, error) {
+	res := models.Reservation{
+		ID:                 id,
+		FirstName:          "John",
+		LastName:           "Smith",
+		Email:              "john@smith.com",
+		StartDate:          time.Date(2050, 1, 10, 0, 0, 0, 0, time.UTC),
+		EndDate:            time.Date(2050, 1, 12, 0, 0, 0, 0, time.UTC),
+		RoomID:             1,
+		Status:             models.StatusPending,
+		TotalPrice:         30000,
+		CancellationPolicy: testFlexiblePolicy,
+	}
+	switch id {
+	case 3:
+		// reservation 3 has already checked out
+		res.Status = models.StatusCheckedOut
+	case 4:
+		// reservation 4 is in the trash
+		res.DeletedAt = time.Now()
+	case 5:
+		// reservation 5 has paid a deposit
+		res.PaymentStatus = models.PaymentCaptured
+		res.DepositAmount = 6000
+	case 100:
+		return res, errors.New("some error")
+	}
 	return res, nil
 }
 
 // UpdateReservation updates a reservation in the database
-func (m *testDBRepo) UpdateReservation(u models.Reservation) error {
+func (m *testDBRepo) UpdateReservation(ctx context.Context, u models.Reservation) error {
 	return nil
 }
 
-// DeleteReservation deletes one reservation by id
-func (m *testDBRepo) DeleteReservation(id int) error {
+// ChangeReservationDates moves a reservation to new dates
+func (m *testDBRepo) ChangeReservationDates(ctx context.Context, res models.Reservation) error {
+	// reservation 2 clashes with a booking made in the meantime
+	if res.ID == 2 {
+		return repository.ErrRoomUnavailable
+	}
+	// reservation 6 was cancelled in the meantime
+	if res.ID == 6 {
+		return repository.ErrStatusChanged
+	}
+	return nil
+}
+
+// DeleteReservation moves one reservation to the trash
+func (m *testDBRepo) DeleteReservation(ctx context.Context, id, userID int) error {
+	if id == 2 {
+		return errors.New("some error")
+	}
+	// reservation 4 is already in the trash
+	if id == 4 {
+		return sql.ErrNoRows
+	}
 	return nil
 }
 
-// UpdateProcessedForReservation updates processed for a reservation
-func (m *testDBRepo) UpdateProcessedForReservation(id, processed int) error {
+// AllDeletedReservations returns the reservations in the trash
+func (m *testDBRepo) AllDeletedReservations(ctx context.Context) ([]models.Reservation, error) {
+	return []models.Reservation{
+		{
+			ID:        1,
+			FirstName: "John",
+			LastName:  "Smith",
+			Status:    models.StatusConfirmed,
+			DeletedAt: time.Now(),
+			DeletedBy: models.User{ID: 1, FirstName: "Admin", LastName: "User"},
+		},
+	}, nil
+}
+
+// RestoreReservation takes a reservation out of the trash
+func (m *testDBRepo) RestoreReservation(ctx context.Context, id int) error {
+	// reservation 2's room was booked by someone else while it was in the trash
+	if id == 2 {
+		return repository.ErrRoomUnavailable
+	}
 	return nil
 }
 
+// PurgeDeletedReservations permanently deletes reservations deleted before deletedBefore
+func (m *testDBRepo) PurgeDeletedReservations(ctx context.Context, deletedBefore time.Time) (int, error) {
+	if deletedBefore.After(time.Now()) {
+		return 0, errors.New("deletedBefore is in the future")
+	}
+	return 1, nil
+}
+
+// UpdateReservationStatus moves a reservation from one status to another
+func (m *testDBRepo) UpdateReservationStatus(ctx context.Context, id int, from, to string, userID int) error {
+	// reservation 2 was changed by someone else in the meantime
+	if id == 2 {
+		return repository.ErrStatusChanged
+	}
+	return nil
+}
+
+// CancelReservation cancels a reservation and records the refund
+func (m *testDBRepo) CancelReservation(ctx context.Context, id int, from string, userID, refund int) error {
+	// reservation 2 was changed by someone else in the meantime
+	if id == 2 {
+		return repository.ErrStatusChanged
+	}
+	return nil
+}
+
+// GetReservationStatusHistory returns the status changes for a reservation
+func (m *testDBRepo) GetReservationStatusHistory(ctx context.Context, id int) ([]models.ReservationStatusChange, error) {
+	return []models.ReservationStatusChange{
+		{ID: 1, ReservationID: id, ToStatus: models.StatusPending},
+	}, nil
+}
+
 // AllRooms returns all rooms
-func (m *testDBRepo) AllRooms() ([]models.Room, error) {
+func (m *testDBRepo) AllRooms(ctx context.Context) ([]models.Room, error) {
+	var rooms []models.Room
+	return rooms, nil
+}
+
+// AllRoomsWithArchived returns all rooms, including those taken out of service
+func (m *testDBRepo) AllRoomsWithArchived(ctx context.Context) ([]models.Room, error) {
 	var rooms []models.Room
 	return rooms, nil
 }
 
+// InsertRoom inserts a room
+func (m *testDBRepo) InsertRoom(ctx context.Context, room models.Room) (int, error) {
+	// if the room name is "fail", then fail; otherwise, pass
+	if room.RoomName == "fail" {
+		return 0, errors.New("some error")
+	}
+	return 1, nil
+}
+
+// UpdateRoom updates a room
+func (m *testDBRepo) UpdateRoom(ctx context.Context, room models.Room) error {
+	return nil
+}
+
+// ArchiveRoom takes a room out of service
+func (m *testDBRepo) ArchiveRoom(ctx context.Context, id int) error {
+	return nil
+}
+
+// RestoreRoom puts an archived room back into service
+func (m *testDBRepo) RestoreRoom(ctx context.Context, id int) error {
+	return nil
+}
+
+// GetRateRulesForRoom returns the rate rules for a room
+func (m *testDBRepo) GetRateRulesForRoom(ctx context.Context, roomID int) (models.RateRules, error) {
+	rules := models.RateRules{
+		RoomID:      roomID,
+		NightlyRate: 10000,
+		Adjustments: []models.RateAdjustment{
+			{RoomID: roomID, Weekday: time.Saturday, Percent: 20},
+		},
+	}
+	if roomID > 2 {
+		return rules, errors.New("some error")
+	}
+	return rules, nil
+}
+
+// InsertRateSeason inserts a seasonal rate override
+func (m *testDBRepo) InsertRateSeason(ctx context.Context, season models.RateSeason) (int, error) {
+	return 1, nil
+}
+
+// DeleteRateSeason deletes a seasonal rate override
+func (m *testDBRepo) DeleteRateSeason(ctx context.Context, id int) error {
+	return nil
+}
+
+// UpdateRateAdjustments replaces the weekday adjustments for a room
+func (m *testDBRepo) UpdateRateAdjustments(ctx context.Context, roomID int, adjustments []models.RateAdjustment) error {
+	return nil
+}
+
+// testFlexiblePolicy refunds everything up to a week before arrival and half up to two days before
+var testFlexiblePolicy = models.CancellationPolicy{
+	ID:   1,
+	Name: "Flexible",
+	Tiers: []models.CancellationTier{
+		{HoursBefore: 168, RefundPercent: 100},
+		{HoursBefore: 48, RefundPercent: 50},
+	},
+}
+
+// AllCancellationPolicies returns all cancellation policies
+func (m *testDBRepo) AllCancellationPolicies(ctx context.Context) ([]models.CancellationPolicy, error) {
+	return []models.CancellationPolicy{
+		testFlexiblePolicy,
+		{ID: 2, Name: "Non-refundable"},
+	}, nil
+}
+
+// GetCancellationPolicyByID returns one cancellation policy
+func (m *testDBRepo) GetCancellationPolicyByID(ctx context.Context, id int) (models.CancellationPolicy, error) {
+	switch id {
+	case 1:
+		return testFlexiblePolicy, nil
+	case 2:
+		return models.CancellationPolicy{ID: 2, Name: "Non-refundable"}, nil
+	}
+	return models.CancellationPolicy{}, sql.ErrNoRows
+}
+
+// InsertCancellationPolicy adds a cancellation policy
+func (m *testDBRepo) InsertCancellationPolicy(ctx context.Context, policy models.CancellationPolicy) (int, error) {
+	return 3, nil
+}
+
+// UpdateCancellationPolicy changes a cancellation policy
+func (m *testDBRepo) UpdateCancellationPolicy(ctx context.Context, policy models.CancellationPolicy) error {
+	return nil
+}
+
+// DeleteCancellationPolicy deletes a cancellation policy
+func (m *testDBRepo) DeleteCancellationPolicy(ctx context.Context, id int) error {
+	if id == 2 {
+		return errors.New("some error")
+	}
+	return nil
+}
+
 // GetRestrictionsForRoomByDate returns restrictions for a room by date range
-func (m *testDBRepo) GetRestrictionsForRoomByDate(roomID int, start, end time.Time) ([]models.RoomRestriction, error) {
+func (m *testDBRepo) GetRestrictionsForRoomByDate(ctx context.Context, roomID int, start, end time.Time) ([]models.RoomRestriction, error) {
 	var restrictions []models.RoomRestriction
+	if roomID != 1 {
+		return restrictions, nil
+	}
+
+	restrictions = append(restrictions, models.RoomRestriction{
+		ID:            1,
+		RoomID:        1,
+		RestrictionID: 2,
+		StartDate:     start.AddDate(0, 0, 2),
+		EndDate:       start.AddDate(0, 0, 6),
+		Reason:        "Painting",
+		Restriction:   models.Restriction{ID: 2, RestrictionName: "Owner Block", Colour: "#ffc107"},
+	}, models.RoomRestriction{
+		ID:            2,
+		RoomID:        1,
+		ReservationID: 1,
+		RestrictionID: 1,
+		Reservation:   models.Reservation{ID: 1, Status: models.StatusConfirmed},
+		StartDate:     start.AddDate(0, 0, 10),
+		EndDate:       start.AddDate(0, 0, 12),
+		Restriction:   models.Restriction{ID: 1, RestrictionName: "Reservation", Colour: "#dc3545", CountsTowardOccupancy: true},
+	}, models.RoomRestriction{
+		ID:            3,
+		RoomID:        1,
+		RestrictionID: models.ChannelRestrictionID,
+		StartDate:     start.AddDate(0, 0, 20),
+		EndDate:       start.AddDate(0, 0, 22),
+		Reason:        "Booked on another site",
+		Restriction:   models.Restriction{ID: models.ChannelRestrictionID, RestrictionName: "Channel Booking", Colour: "#6c757d"},
+	})
 	return restrictions, nil
 }
 
-// InsertBlockForRoom inserts a room restriction
-func (m *testDBRepo) InsertBlockForRoom(id int, startDate time.Time) error {
+// AllRestrictions returns all restriction types
+func (m *testDBRepo) AllRestrictions(ctx context.Context) ([]models.Restriction, error) {
+	return []models.Restriction{
+		{ID: 1, RestrictionName: "Reservation", Colour: "#dc3545", CountsTowardOccupancy: true},
+		{ID: 2, RestrictionName: "Owner Block", Colour: "#ffc107"},
+		{ID: 3, RestrictionName: "Staff Use", Colour: "#6f42c1", CountsTowardOccupancy: true},
+	}, nil
+}
+
+// GetRestrictionByID returns a restriction type by id
+func (m *testDBRepo) GetRestrictionByID(ctx context.Context, id int) (models.Restriction, error) {
+	if id > 3 {
+		return models.Restriction{}, sql.ErrNoRows
+	}
+	return models.Restriction{ID: id, RestrictionName: "Owner Block", Colour: "#ffc107"}, nil
+}
+
+// InsertRestriction inserts a new restriction type
+func (m *testDBRepo) InsertRestriction(ctx context.Context, restriction models.Restriction) (int, error) {
+	if restriction.RestrictionName == "fail" {
+		return 0, errors.New("some error")
+	}
+	return 4, nil
+}
+
+// UpdateRestriction updates a restriction type
+func (m *testDBRepo) UpdateRestriction(ctx context.Context, restriction models.Restriction) error {
+	return nil
+}
+
+// DeleteRestriction deletes a restriction type; types 1 and 2 are in use
+func (m *testDBRepo) DeleteRestriction(ctx context.Context, id int) error {
+	if id <= 2 || id == models.ChannelRestrictionID {
+		return repository.ErrRestrictionInUse
+	}
+	return nil
+}
+
+// GetBlockByID returns a block by id
+func (m *testDBRepo) GetBlockByID(ctx context.Context, id int) (models.RoomRestriction, error) {
+	if id > 1 {
+		return models.RoomRestriction{}, sql.ErrNoRows
+	}
+
+	startDate := time.Date(2050, 1, 10, 0, 0, 0, 0, time.UTC)
+	return models.RoomRestriction{
+		ID:            id,
+		RoomID:        1,
+		RestrictionID: 2,
+		StartDate:     startDate,
+		EndDate:       startDate.AddDate(0, 0, 14),
+		Reason:        "Painting",
+	}, nil
+}
+
+// InsertBlock inserts a block for a range of dates
+func (m *testDBRepo) InsertBlock(ctx context.Context, block models.RoomRestriction) (int, error) {
+	if block.StartDate.Equal(time.Date(2070, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		return 0, repository.ErrRoomUnavailable
+	}
+	return 1, nil
+}
+
+// UpdateBlock updates a block; only block 1 exists
+func (m *testDBRepo) UpdateBlock(ctx context.Context, block models.RoomRestriction) error {
+	if block.StartDate.Equal(time.Date(2070, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		return repository.ErrRoomUnavailable
+	}
+	if block.ID > 1 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteBlockByID deletes a block; only block 1 exists
+func (m *testDBRepo) DeleteBlockByID(ctx context.Context, id int) error {
+	if id > 1 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ListUsers returns all users
+func (m *testDBRepo) ListUsers(ctx context.Context) ([]models.User, error) {
+	return []models.User{
+		{ID: 1, FirstName: "Admin", LastName: "User", Email: "admin@here.com"},
+	}, nil
+}
+
+// InsertAuditEntry appends an entry to the audit log
+func (m *testDBRepo) InsertAuditEntry(ctx context.Context, entry models.AuditEntry) error {
+	return nil
+}
+
+// AuditEntries returns audit entries matching filter
+func (m *testDBRepo) AuditEntries(ctx context.Context, filter models.AuditFilter) ([]models.AuditEntry, error) {
+	entries := []models.AuditEntry{
+		{
+			ID:         1,
+			UserID:     1,
+			User:       models.User{ID: 1, FirstName: "Admin", LastName: "User"},
+			Action:     "update",
+			EntityType: "reservation",
+			EntityID:   1,
+			Before:     `{"FirstName":"Jon"}`,
+			After:      `{"FirstName":"John"}`,
+			IP:         "127.0.0.1",
+			CreatedAt:  time.Now(),
+		},
+	}
+	if filter.EntityType != "" && filter.EntityType != "reservation" {
+		return nil, nil
+	}
+	return entries, nil
+}
+
+// InsertWaitlistEntry puts a guest on the waitlist
+func (m *testDBRepo) InsertWaitlistEntry(ctx context.Context, entry models.WaitlistEntry) (int, error) {
+	// if the room id is 2, then fail; otherwise, pass
+	if entry.RoomID == 2 {
+		return 0, errors.New("some error")
+	}
+	return 1, nil
+}
+
+// GetWaitlistEntryByID returns one waitlist entry. Entry 1 holds room 1, entry 2's hold has
+// run out, entry 3 is still waiting and entry 100 doesn't exist
+func (m *testDBRepo) GetWaitlistEntryByID(ctx context.Context, id int) (models.WaitlistEntry, error) {
+	if id == 100 {
+		return models.WaitlistEntry{}, errors.New("some error")
+	}
+
+	entry := models.WaitlistEntry{
+		ID:            id,
+		FirstName:     "Jane",
+		LastName:      "Doe",
+		Email:         "jane@doe.com",
+		StartDate:     time.Date(2050, 1, 10, 0, 0, 0, 0, time.UTC),
+		EndDate:       time.Date(2050, 1, 12, 0, 0, 0, 0, time.UTC),
+		Status:        models.WaitlistOffered,
+		HoldRoomID:    1,
+		HoldRoom:      models.Room{ID: 1, RoomName: "General's Quarters"},
+		HoldExpiresAt: time.Now().Add(time.Hour),
+	}
+
+	switch id {
+	case 2:
+		entry.HoldExpiresAt = time.Now().Add(-time.Hour)
+	case 3:
+		entry.Status = models.WaitlistWaiting
+		entry.HoldRoomID = 0
+		entry.HoldRoom = models.Room{}
+		entry.HoldExpiresAt = time.Time{}
+	}
+
+	return entry, nil
+}
+
+// AllWaitlistEntries returns every waitlist entry
+func (m *testDBRepo) AllWaitlistEntries(ctx context.Context) ([]models.WaitlistEntry, error) {
+	entry, _ := m.GetWaitlistEntryByID(ctx, 1)
+	return []models.WaitlistEntry{entry}, nil
+}
+
+// WaitingWaitlistEntries returns the entries still waiting for a room
+func (m *testDBRepo) WaitingWaitlistEntries(ctx context.Context) ([]models.WaitlistEntry, error) {
+	entry, _ := m.GetWaitlistEntryByID(ctx, 3)
+	return []models.WaitlistEntry{entry}, nil
+}
+
+// HoldWaitlistEntry holds a room for a waitlist entry
+func (m *testDBRepo) HoldWaitlistEntry(ctx context.Context, id, roomID int, expires time.Time, mail repository.MailFunc) error {
+	if roomID == 2 {
+		return repository.ErrRoomUnavailable
+	}
+
+	if mail != nil {
+		return m.QueueMail(ctx, mail(id)...)
+	}
+	return nil
+}
+
+// BookWaitlistHold turns a waitlist hold into a reservation
+func (m *testDBRepo) BookWaitlistHold(ctx context.Context, id int, res models.Reservation, mail repository.MailFunc) (int, error) {
+	// if the room id is 2, then fail; otherwise, pass
+	if res.RoomID == 2 {
+		return 0, errors.New("some error")
+	}
+
+	// entry 2's hold has expired
+	if id == 2 {
+		return 0, repository.ErrHoldLapsed
+	}
+
+	if mail != nil {
+		m.QueueMail(ctx, mail(1)...)
+	}
+	return 1, nil
+}
+
+// ExpireWaitlistHolds releases the holds that have run out
+func (m *testDBRepo) ExpireWaitlistHolds(ctx context.Context, now time.Time) (int, error) {
+	return 0, nil
+}
+
+// DeleteWaitlistEntry takes an entry off the waitlist
+func (m *testDBRepo) DeleteWaitlistEntry(ctx context.Context, id int) error {
+	if id == 100 {
+		return errors.New("some error")
+	}
+	return nil
+}
+
+// RecordPayment stores a payment transaction
+func (m *testDBRepo) RecordPayment(ctx context.Context, t models.PaymentTransaction, paymentStatus string) error {
+	return nil
+}
+
+// PaymentTransactions returns a reservation's payment transactions. Reservation 5 paid its deposit
+// under the reference "fake_test"
+func (m *testDBRepo) PaymentTransactions(ctx context.Context, reservationID int) ([]models.PaymentTransaction, error) {
+	if reservationID != 5 {
+		return nil, nil
+	}
+	return []models.PaymentTransaction{
+		{ID: 1, ReservationID: 5, Provider: "fake", Kind: models.TransactionAuthorize, Reference: "fake_test", Amount: 6000, Status: models.TransactionSucceeded},
+		{ID: 2, ReservationID: 5, Provider: "fake", Kind: models.TransactionCapture, Reference: "fake_test", Amount: 6000, Status: models.TransactionSucceeded},
+	}, nil
+}
+
+// GetPaymentTransactionByReference returns the first transaction made against a provider reference
+func (m *testDBRepo) GetPaymentTransactionByReference(ctx context.Context, reference string) (models.PaymentTransaction, error) {
+	transactions, _ := m.PaymentTransactions(ctx, 5)
+	if reference != "fake_test" {
+		return models.PaymentTransaction{}, sql.ErrNoRows
+	}
+	return transactions[0], nil
+}
+
+// IssueInvoice returns the invoice for a reservation
+func (m *testDBRepo) IssueInvoice(ctx context.Context, reservationID int) (models.Invoice, error) {
+	if reservationID == 100 {
+		return models.Invoice{}, errors.New("some error")
+	}
+	return models.Invoice{
+		ID:            reservationID,
+		ReservationID: reservationID,
+		Number:        fmt.Sprintf("INV-%06d", reservationID),
+		IssuedAt:      time.Date(2049, 12, 1, 0, 0, 0, 0, time.UTC),
+	}, nil
+}
+
+// AllCalendarImports returns every room's calendar import
+func (m *testDBRepo) AllCalendarImports(ctx context.Context) ([]models.CalendarImport, error) {
+	imp, _ := m.GetCalendarImportByRoomID(ctx, 1)
+	return []models.CalendarImport{imp}, nil
+}
+
+// GetCalendarImportByRoomID returns a room's calendar import. Room 1's feed last synced with one
+// conflict; room 2 has never been synced; room 100 fails
+func (m *testDBRepo) GetCalendarImportByRoomID(ctx context.Context, roomID int) (models.CalendarImport, error) {
+	switch roomID {
+	case 1:
+		return models.CalendarImport{
+			ID:             1,
+			RoomID:         1,
+			URL:            "https://channel.example/rooms/1.ics",
+			LastSyncedAt:   time.Now().Add(-time.Hour),
+			LastStatus:     models.SyncSucceeded,
+			EventsImported: 3,
+			Conflicts:      1,
+			Room:           models.Room{ID: 1, RoomName: "General's Quarters"},
+		}, nil
+	case 100:
+		return models.CalendarImport{}, errors.New("some error")
+	}
+	return models.CalendarImport{RoomID: roomID}, nil
+}
+
+// UpdateCalendarImportURL sets where a room's calendar is fetched from
+func (m *testDBRepo) UpdateCalendarImportURL(ctx context.Context, roomID int, url string) error {
+	if roomID == 100 {
+		return errors.New("some error")
+	}
+	return nil
+}
+
+// RecordCalendarSync stores how a room's last calendar sync went
+func (m *testDBRepo) RecordCalendarSync(ctx context.Context, imp models.CalendarImport) error {
+	return nil
+}
+
+// SyncChannelBlocks replaces a room's channel blocks. Blocks starting on 2070-01-01 conflict
+func (m *testDBRepo) SyncChannelBlocks(ctx context.Context, roomID int, since time.Time, blocks []models.RoomRestriction) (int, error) {
+	if roomID == 100 {
+		return 0, errors.New("some error")
+	}
+	conflicts := 0
+	for _, b := range blocks {
+		if b.StartDate.Equal(time.Date(2070, 1, 1, 0, 0, 0, 0, time.UTC)) {
+			conflicts++
+		}
+	}
+	return conflicts, nil
+}
+
+// testAPIKeys are the keys the testing repo knows, by the key a client would send. Key 3 is allowed
+// one request a minute, and key 4 has been revoked
+var testAPIKeys = map[string]models.APIKey{
+	"bk_test_availability": {ID: 1, Name: "Availability partner", Prefix: "bk_test_ava", Scopes: []string{apikeys.ScopeAvailability}, RateLimit: 60},
+	"bk_test_booking":      {ID: 2, Name: "Booking partner", Prefix: "bk_test_boo", Scopes: []string{apikeys.ScopeBooking}, RateLimit: 60},
+	"bk_test_slow":         {ID: 3, Name: "Slow partner", Prefix: "bk_test_slo", Scopes: []string{apikeys.ScopeBooking}, RateLimit: 1},
+	"bk_test_revoked":      {ID: 4, Name: "Old partner", Prefix: "bk_test_rev", Scopes: []string{apikeys.ScopeBooking}, RateLimit: 60, RevokedAt: time.Date(2049, 1, 1, 0, 0, 0, 0, time.UTC)},
+}
+
+// AllAPIKeys returns every API key
+func (m *testDBRepo) AllAPIKeys(ctx context.Context) ([]models.APIKey, error) {
+	var keys []models.APIKey
+	for id := 1; id <= len(testAPIKeys); id++ {
+		key, _ := m.GetAPIKeyByID(ctx, id)
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// GetAPIKeyByID returns one API key; 100 fails
+func (m *testDBRepo) GetAPIKeyByID(ctx context.Context, id int) (models.APIKey, error) {
+	if id == 100 {
+		return models.APIKey{}, errors.New("some error")
+	}
+	for _, key := range testAPIKeys {
+		if key.ID == id {
+			return key, nil
+		}
+	}
+	return models.APIKey{}, sql.ErrNoRows
+}
+
+// GetAPIKeyByHash returns the key stored under hash, unless it has been revoked
+func (m *testDBRepo) GetAPIKeyByHash(ctx context.Context, hash string) (models.APIKey, error) {
+	for plain, key := range testAPIKeys {
+		if apikeys.Hash(plain) == hash && key.RevokedAt.IsZero() {
+			return key, nil
+		}
+	}
+	return models.APIKey{}, sql.ErrNoRows
+}
+
+// InsertAPIKey stores a new key
+func (m *testDBRepo) InsertAPIKey(ctx context.Context, key models.APIKey, hash string) (int, error) {
+	// if the name is "fail", then fail; otherwise, pass
+	if key.Name == "fail" {
+		return 0, errors.New("some error")
+	}
+	return len(testAPIKeys) + 1, nil
+}
+
+// UpdateAPIKey changes a key's name, scopes and rate limit
+func (m *testDBRepo) UpdateAPIKey(ctx context.Context, key models.APIKey) error {
+	if key.Name == "fail" {
+		return errors.New("some error")
+	}
+	return nil
+}
+
+// RotateAPIKey replaces a key; a revoked key can't be rotated
+func (m *testDBRepo) RotateAPIKey(ctx context.Context, id int, prefix, hash string) error {
+	key, err := m.GetAPIKeyByID(ctx, id)
+	if err != nil {
+		return err
+	}
+	if !key.RevokedAt.IsZero() {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// RevokeAPIKey stops a key working
+func (m *testDBRepo) RevokeAPIKey(ctx context.Context, id int) error {
+	if id == 100 {
+		return errors.New("some error")
+	}
+	return nil
+}
+
+// TouchAPIKey records that a key was used
+func (m *testDBRepo) TouchAPIKey(ctx context.Context, id int, at time.Time) error {
+	return nil
+}
+
+// testWebhookSubscriptions are the subscriptions the testing repo knows. Nothing listens at their
+// addresses, so deliveries to them fail straight away
+var testWebhookSubscriptions = []models.WebhookSubscription{
+	{ID: 1, URL: "http://127.0.0.1:1/housekeeping", Secret: "whsec_test", Active: true,
+		Events: []string{"reservation.created", "reservation.cancelled"}},
+	{ID: 2, URL: "http://127.0.0.1:1/accounting", Secret: "whsec_test", Active: false,
+		Events: []string{"reservation.created", "reservation.updated", "reservation.cancelled"}},
+}
+
+// AllWebhookSubscriptions returns every webhook subscription
+func (m *testDBRepo) AllWebhookSubscriptions(ctx context.Context) ([]models.WebhookSubscription, error) {
+	return testWebhookSubscriptions, nil
+}
+
+// GetWebhookSubscriptionByID returns one webhook subscription; 100 fails
+func (m *testDBRepo) GetWebhookSubscriptionByID(ctx context.Context, id int) (models.WebhookSubscription, error) {
+	if id == 100 {
+		return models.WebhookSubscription{}, errors.New("some error")
+	}
+	for _, sub := range testWebhookSubscriptions {
+		if sub.ID == id {
+			return sub, nil
+		}
+	}
+	return models.WebhookSubscription{}, sql.ErrNoRows
+}
+
+// InsertWebhookSubscription stores a new webhook subscription
+func (m *testDBRepo) InsertWebhookSubscription(ctx context.Context, sub models.WebhookSubscription) (int, error) {
+	// if the url mentions "fail", then fail; otherwise, pass
+	if strings.Contains(sub.URL, "fail") {
+		return 0, errors.New("some error")
+	}
+	return len(testWebhookSubscriptions) + 1, nil
+}
+
+// UpdateWebhookSubscription changes a webhook subscription
+func (m *testDBRepo) UpdateWebhookSubscription(ctx context.Context, sub models.WebhookSubscription) error {
+	if strings.Contains(sub.URL, "fail") {
+		return errors.New("some error")
+	}
+	return nil
+}
+
+// DeleteWebhookSubscription deletes a webhook subscription; 100 fails
+func (m *testDBRepo) DeleteWebhookSubscription(ctx context.Context, id int) error {
+	if id == 100 {
+		return errors.New("some error")
+	}
 	return nil
 }
 
-// DeleteBlockByID deletes a room restriction
-func (m *testDBRepo) DeleteBlockByID(id int) error {
+// QueueWebhookDeliveries counts the active subscriptions that want event
+func (m *testDBRepo) QueueWebhookDeliveries(ctx context.Context, event, payload string) (int, error) {
+	queued := 0
+	for _, sub := range testWebhookSubscriptions {
+		for _, e := range sub.Events {
+			if sub.Active && e == event {
+				queued++
+			}
+		}
+	}
+	return queued, nil
+}
+
+// ClaimDueWebhookDeliveries returns the deliveries that have fallen due; there never are any
+func (m *testDBRepo) ClaimDueWebhookDeliveries(ctx context.Context, now, leaseUntil time.Time, limit int) ([]models.WebhookDelivery, error) {
+	return nil, nil
+}
+
+// RecordWebhookAttempt saves how a delivery went; 100 fails
+func (m *testDBRepo) RecordWebhookAttempt(ctx context.Context, d models.WebhookDelivery) error {
+	if d.ID == 100 {
+		return errors.New("some error")
+	}
 	return nil
 }
+
+// WebhookDeliveries returns subscription 1's deliveries: one delivered, one given up on. 100 fails
+func (m *testDBRepo) WebhookDeliveries(ctx context.Context, subscriptionID, limit int) ([]models.WebhookDelivery, error) {
+	if subscriptionID == 100 {
+		return nil, errors.New("some error")
+	}
+	if subscriptionID != 1 {
+		return nil, nil
+	}
+
+	delivered, _ := m.GetWebhookDeliveryByID(ctx, 1)
+	failed, _ := m.GetWebhookDeliveryByID(ctx, 2)
+	return []models.WebhookDelivery{failed, delivered}, nil
+}
+
+// GetWebhookDeliveryByID returns one delivery to subscription 1; 100 fails
+func (m *testDBRepo) GetWebhookDeliveryByID(ctx context.Context, id int) (models.WebhookDelivery, error) {
+	d := models.WebhookDelivery{
+		ID:             id,
+		SubscriptionID: 1,
+		Event:          "reservation.created",
+		Payload:        `{"event":"reservation.created","created_at":"2050-01-01T00:00:00Z","data":{"id":1}}`,
+		Subscription:   testWebhookSubscriptions[0],
+		CreatedAt:      time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+
+	switch id {
+	case 1:
+		d.Status = models.DeliveryDelivered
+		d.Attempts = 1
+		d.ResponseStatus = 200
+		d.LastAttemptAt = d.CreatedAt
+		d.DeliveredAt = d.CreatedAt
+	case 2:
+		d.Status = models.DeliveryFailed
+		d.Attempts = 10
+		d.ResponseStatus = 500
+		d.LastError = "subscriber answered 500 Internal Server Error"
+		d.LastAttemptAt = d.CreatedAt.Add(6 * time.Hour)
+	case 100:
+		return models.WebhookDelivery{}, errors.New("some error")
+	default:
+		return models.WebhookDelivery{}, sql.ErrNoRows
+	}
+
+	return d, nil
+}
+
+// QueueMail sends messages straight away with the app's mailer, if it has one, so tests can see
+// them; one to fail@here.com fails, and none are sent
+func (m *testDBRepo) QueueMail(ctx context.Context, msgs ...models.MailData) error {
+	for _, msg := range msgs {
+		if msg.To == "fail@here.com" {
+			return errors.New("some error")
+		}
+	}
+
+	if m.App == nil || m.App.Mailer == nil {
+		return nil
+	}
+	for _, msg := range msgs {
+		if err := m.App.Mailer.Send(ctx, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ClaimDueMail returns the messages that have fallen due; there never are any
+func (m *testDBRepo) ClaimDueMail(ctx context.Context, now, leaseUntil time.Time, limit int) ([]models.OutboxMessage, error) {
+	return nil, nil
+}
+
+// RecordMailAttempt saves how sending a message went; 100 fails
+func (m *testDBRepo) RecordMailAttempt(ctx context.Context, msg models.OutboxMessage) error {
+	if msg.ID == 100 {
+		return errors.New("some error")
+	}
+	return nil
+}
+
+// OutboxMessages returns the outbox: one message sent and one dead, filtered by status
+func (m *testDBRepo) OutboxMessages(ctx context.Context, status string, limit int) ([]models.OutboxMessage, error) {
+	var msgs []models.OutboxMessage
+	for _, id := range []int{2, 1} {
+		msg, _ := m.GetOutboxMessageByID(ctx, id)
+		if status == "" || msg.Status == status {
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs, nil
+}
+
+// GetOutboxMessageByID returns one outbox message: 1 was sent and 2 is dead. 100 fails
+func (m *testDBRepo) GetOutboxMessageByID(ctx context.Context, id int) (models.OutboxMessage, error) {
+	msg := models.OutboxMessage{
+		ID: id,
+		Mail: models.MailData{
+			To:       "john@smith.com",
+			From:     "me@here.com",
+			Subject:  "Reservation Confirmation",
+			Content:  "<strong>Reservation Confirmation</strong>",
+			Text:     "Reservation Confirmation",
+			Template: "reservation-confirmation",
+		},
+		CreatedAt: time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+
+	switch id {
+	case 1:
+		msg.Status = models.MailSent
+		msg.Attempts = 1
+		msg.LastAttemptAt = msg.CreatedAt
+		msg.SentAt = msg.CreatedAt
+	case 2:
+		msg.Status = models.MailDead
+		msg.Attempts = 8
+		msg.LastAttemptAt = msg.CreatedAt.Add(6 * time.Hour)
+		msg.LastError = "dial tcp 127.0.0.1:1025: connect: connection refused"
+	case 100:
+		return models.OutboxMessage{}, errors.New("some error")
+	default:
+		return models.OutboxMessage{}, sql.ErrNoRows
+	}
+
+	return msg, nil
+}
+
+// ResendOutboxMessage puts a dead message back in the outbox; only message 2 is dead
+func (m *testDBRepo) ResendOutboxMessage(ctx context.Context, id int) error {
+	if id != 2 {
+		return repository.ErrStatusChanged
+	}
+	return nil
+}
+
+// testEmailTemplateSource is the source of the saved email template versions
+const testEmailTemplateSource = `{{template "basic" .}}
+{{define "subject"}}Your booking{{end}}
+{{define "body"}}Hello {{.Reservation.FirstName}}{{end}}`
+
+// CurrentEmailTemplates returns no templates, as none have been saved
+func (m *testDBRepo) CurrentEmailTemplates(ctx context.Context) ([]models.EmailTemplate, error) {
+	var templates []models.EmailTemplate
+	return templates, nil
+}
+
+// CurrentEmailTemplate returns sql.ErrNoRows, as no template has been saved, so the ones in the
+// email-templates directory are used
+func (m *testDBRepo) CurrentEmailTemplate(ctx context.Context, event string) (models.EmailTemplate, error) {
+	return models.EmailTemplate{}, sql.ErrNoRows
+}
+
+// EmailTemplateVersions returns versions 1 and 2 of the reservation confirmation
+func (m *testDBRepo) EmailTemplateVersions(ctx context.Context, event string) ([]models.EmailTemplate, error) {
+	var templates []models.EmailTemplate
+	if event != "reservation-confirmation" {
+		return templates, nil
+	}
+
+	for _, id := range []int{2, 1} {
+		t, _ := m.GetEmailTemplateByID(ctx, id)
+		templates = append(templates, t)
+	}
+	return templates, nil
+}
+
+// GetEmailTemplateByID returns a version of the reservation confirmation: 1 renders and 2 uses a
+// field reservations don't have. 100 fails
+func (m *testDBRepo) GetEmailTemplateByID(ctx context.Context, id int) (models.EmailTemplate, error) {
+	t := models.EmailTemplate{
+		ID:        id,
+		Event:     "reservation-confirmation",
+		Version:   id,
+		Source:    testEmailTemplateSource,
+		UserID:    1,
+		User:      models.User{ID: 1, FirstName: "Admin", LastName: "User"},
+		CreatedAt: time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+
+	switch id {
+	case 1:
+	case 2:
+		t.Source = strings.Replace(t.Source, ".Reservation.FirstName", ".Reservation.Nickname", 1)
+	case 100:
+		return models.EmailTemplate{}, errors.New("some error")
+	default:
+		return models.EmailTemplate{}, sql.ErrNoRows
+	}
+
+	return t, nil
+}
+
+// InsertEmailTemplate saves a new version as id 3. It fails for the note "fail", and finds a newer
+// version already saved for the note "race"
+func (m *testDBRepo) InsertEmailTemplate(ctx context.Context, t models.EmailTemplate) (int, error) {
+	if t.Note == "fail" {
+		return 0, errors.New("some error")
+	}
+	if t.Note == "race" {
+		return 0, repository.ErrTemplateChanged
+	}
+	return 3, nil
+}
@@ -1,32 +1,145 @@
 package repository
 
 import (
+	"context"
+	"errors"
 	"time"
 
 	"github.com/msaufi2325/06_bookings/internal/models"
 )
 
+// ErrRoomUnavailable is returned when a room restriction would overlap an existing one
+var ErrRoomUnavailable = errors.New("room is not available for the requested dates")
+
+// ErrStatusChanged is returned when a reservation is no longer in the status a change was made from
+var ErrStatusChanged = errors.New("reservation status has changed")
+
+// ErrHoldLapsed is returned when booking a waitlist hold that has expired or is no longer offered
+var ErrHoldLapsed = errors.New("waitlist hold is no longer offered")
+
+// ErrRestrictionInUse is returned when deleting a restriction type that reservations or blocks still use
+var ErrRestrictionInUse = errors.New("restriction type is in use")
+
+// ErrTemplateChanged is returned when saving an email template edited from a version that is no
+// longer the newest
+var ErrTemplateChanged = errors.New("email template has a newer version")
+
+// MailFunc builds the emails a booking sends, once the new reservation's id is known. They are
+// queued in the outbox within the booking's transaction, so they go if and only if it is kept
+type MailFunc func(id int) []models.MailData
+
 type DatabaseRepo interface {
-	AllUsers() bool
-
-	InsertReservation(res models.Reservation) (int, error)
-	InsertRoomRestriction(r models.RoomRestriction) error
-	SearchAvailabilityByDatesByRoomID(start, end time.Time, roomID int) (bool, error)
-	SearchAvailabilityForAllRooms(start, end time.Time) ([]models.Room, error)
-	GetRoomByID(id int) (models.Room, error)
-
-	GetUserByID(id int) (models.User, error)
-	UpdateUser(u models.User) error
-	Authenticate(email, testPassword string) (int, string, error)
-
-	AllReservations() ([]models.Reservation, error)
-	AllNewReservations() ([]models.Reservation, error)
-	GetReservationByID(id int) (models.Reservation, error)
-	UpdateReservation(u models.Reservation) error
-	DeleteReservation(id int) error
-	UpdateProcessedForReservation(id, processed int) error
-	AllRooms() ([]models.Room, error)
-	GetRestrictionsForRoomByDate(roomID int, start, end time.Time) ([]models.RoomRestriction, error)
-	InsertBlockForRoom(id int, startDate time.Time) error
-	DeleteBlockByID(id int) error
+	AllUsers(ctx context.Context) bool
+
+	InsertReservation(ctx context.Context, res models.Reservation) (int, error)
+	InsertRoomRestriction(ctx context.Context, r models.RoomRestriction) error
+	InsertReservationWithRestriction(ctx context.Context, res models.Reservation, mail MailFunc) (int, error)
+	SearchAvailabilityByDatesByRoomID(ctx context.Context, start, end time.Time, roomID int) (bool, error)
+	SearchAvailabilityForAllRooms(ctx context.Context, start, end time.Time) ([]models.Room, error)
+	GetRoomByID(ctx context.Context, id int) (models.Room, error)
+	GetRoomBySlug(ctx context.Context, slug string) (models.Room, error)
+
+	GetUserByID(ctx context.Context, id int) (models.User, error)
+	ListUsers(ctx context.Context) ([]models.User, error)
+	UpdateUser(ctx context.Context, u models.User) error
+	Authenticate(ctx context.Context, email, testPassword string) (int, string, error)
+
+	AllReservations(ctx context.Context) ([]models.Reservation, error)
+	AllNewReservations(ctx context.Context) ([]models.Reservation, error)
+	ReservationsBetween(ctx context.Context, start, end time.Time) ([]models.Reservation, error)
+	GetReservationByID(ctx context.Context, id int) (models.Reservation, error)
+	UpdateReservation(ctx context.Context, u models.Reservation) error
+	ChangeReservationDates(ctx context.Context, res models.Reservation) error
+	DeleteReservation(ctx context.Context, id, userID int) error
+	AllDeletedReservations(ctx context.Context) ([]models.Reservation, error)
+	RestoreReservation(ctx context.Context, id int) error
+	PurgeDeletedReservations(ctx context.Context, deletedBefore time.Time) (int, error)
+	UpdateReservationStatus(ctx context.Context, id int, from, to string, userID int) error
+	CancelReservation(ctx context.Context, id int, from string, userID, refund int) error
+	GetReservationStatusHistory(ctx context.Context, id int) ([]models.ReservationStatusChange, error)
+	AllRooms(ctx context.Context) ([]models.Room, error)
+	AllRoomsWithArchived(ctx context.Context) ([]models.Room, error)
+	InsertRoom(ctx context.Context, room models.Room) (int, error)
+	UpdateRoom(ctx context.Context, room models.Room) error
+	ArchiveRoom(ctx context.Context, id int) error
+	RestoreRoom(ctx context.Context, id int) error
+
+	GetRateRulesForRoom(ctx context.Context, roomID int) (models.RateRules, error)
+	InsertRateSeason(ctx context.Context, season models.RateSeason) (int, error)
+	DeleteRateSeason(ctx context.Context, id int) error
+	UpdateRateAdjustments(ctx context.Context, roomID int, adjustments []models.RateAdjustment) error
+
+	AllCancellationPolicies(ctx context.Context) ([]models.CancellationPolicy, error)
+	GetCancellationPolicyByID(ctx context.Context, id int) (models.CancellationPolicy, error)
+	InsertCancellationPolicy(ctx context.Context, policy models.CancellationPolicy) (int, error)
+	UpdateCancellationPolicy(ctx context.Context, policy models.CancellationPolicy) error
+	DeleteCancellationPolicy(ctx context.Context, id int) error
+
+	GetRestrictionsForRoomByDate(ctx context.Context, roomID int, start, end time.Time) ([]models.RoomRestriction, error)
+	AllRestrictions(ctx context.Context) ([]models.Restriction, error)
+	GetRestrictionByID(ctx context.Context, id int) (models.Restriction, error)
+	InsertRestriction(ctx context.Context, restriction models.Restriction) (int, error)
+	UpdateRestriction(ctx context.Context, restriction models.Restriction) error
+	DeleteRestriction(ctx context.Context, id int) error
+	GetBlockByID(ctx context.Context, id int) (models.RoomRestriction, error)
+	InsertBlock(ctx context.Context, block models.RoomRestriction) (int, error)
+	UpdateBlock(ctx context.Context, block models.RoomRestriction) error
+	DeleteBlockByID(ctx context.Context, id int) error
+
+	InsertWaitlistEntry(ctx context.Context, entry models.WaitlistEntry) (int, error)
+	GetWaitlistEntryByID(ctx context.Context, id int) (models.WaitlistEntry, error)
+	AllWaitlistEntries(ctx context.Context) ([]models.WaitlistEntry, error)
+	WaitingWaitlistEntries(ctx context.Context) ([]models.WaitlistEntry, error)
+	HoldWaitlistEntry(ctx context.Context, id, roomID int, expires time.Time, mail MailFunc) error
+	BookWaitlistHold(ctx context.Context, id int, res models.Reservation, mail MailFunc) (int, error)
+	ExpireWaitlistHolds(ctx context.Context, now time.Time) (int, error)
+	DeleteWaitlistEntry(ctx context.Context, id int) error
+
+	RecordPayment(ctx context.Context, t models.PaymentTransaction, paymentStatus string) error
+	PaymentTransactions(ctx context.Context, reservationID int) ([]models.PaymentTransaction, error)
+	GetPaymentTransactionByReference(ctx context.Context, reference string) (models.PaymentTransaction, error)
+
+	IssueInvoice(ctx context.Context, reservationID int) (models.Invoice, error)
+
+	AllCalendarImports(ctx context.Context) ([]models.CalendarImport, error)
+	GetCalendarImportByRoomID(ctx context.Context, roomID int) (models.CalendarImport, error)
+	UpdateCalendarImportURL(ctx context.Context, roomID int, url string) error
+	RecordCalendarSync(ctx context.Context, imp models.CalendarImport) error
+	SyncChannelBlocks(ctx context.Context, roomID int, since time.Time, blocks []models.RoomRestriction) (int, error)
+
+	AllAPIKeys(ctx context.Context) ([]models.APIKey, error)
+	GetAPIKeyByID(ctx context.Context, id int) (models.APIKey, error)
+	GetAPIKeyByHash(ctx context.Context, hash string) (models.APIKey, error)
+	InsertAPIKey(ctx context.Context, key models.APIKey, hash string) (int, error)
+	UpdateAPIKey(ctx context.Context, key models.APIKey) error
+	RotateAPIKey(ctx context.Context, id int, prefix, hash string) error
+	RevokeAPIKey(ctx context.Context, id int) error
+	TouchAPIKey(ctx context.Context, id int, at time.Time) error
+
+	AllWebhookSubscriptions(ctx context.Context) ([]models.WebhookSubscription, error)
+	GetWebhookSubscriptionByID(ctx context.Context, id int) (models.WebhookSubscription, error)
+	InsertWebhookSubscription(ctx context.Context, sub models.WebhookSubscription) (int, error)
+	UpdateWebhookSubscription(ctx context.Context, sub models.WebhookSubscription) error
+	DeleteWebhookSubscription(ctx context.Context, id int) error
+	QueueWebhookDeliveries(ctx context.Context, event, payload string) (int, error)
+	ClaimDueWebhookDeliveries(ctx context.Context, now, leaseUntil time.Time, limit int) ([]models.WebhookDelivery, error)
+	RecordWebhookAttempt(ctx context.Context, d models.WebhookDelivery) error
+	WebhookDeliveries(ctx context.Context, subscriptionID, limit int) ([]models.WebhookDelivery, error)
+	GetWebhookDeliveryByID(ctx context.Context, id int) (models.WebhookDelivery, error)
+
+	QueueMail(ctx context.Context, msgs ...models.MailData) error
+	ClaimDueMail(ctx context.Context, now, leaseUntil time.Time, limit int) ([]models.OutboxMessage, error)
+	RecordMailAttempt(ctx context.Context, msg models.OutboxMessage) error
+	OutboxMessages(ctx context.Context, status string, limit int) ([]models.OutboxMessage, error)
+	GetOutboxMessageByID(ctx context.Context, id int) (models.OutboxMessage, error)
+	ResendOutboxMessage(ctx context.Context, id int) error
+
+	CurrentEmailTemplates(ctx context.Context) ([]models.EmailTemplate, error)
+	CurrentEmailTemplate(ctx context.Context, event string) (models.EmailTemplate, error)
+	EmailTemplateVersions(ctx context.Context, event string) ([]models.EmailTemplate, error)
+	GetEmailTemplateByID(ctx context.Context, id int) (models.EmailTemplate, error)
+	InsertEmailTemplate(ctx context.Context, t models.EmailTemplate) (int, error)
+
+	InsertAuditEntry(ctx context.Context, entry models.AuditEntry) error
+	AuditEntries(ctx context.Context, filter models.AuditFilter) ([]models.AuditEntry, error)
 }
@@ -0,0 +1,19 @@
+package retry
+
+import "time"
+
+// MaxWait is the longest Backoff waits between attempts
+const MaxWait = 6 * time.Hour
+
+// Backoff is how long to wait before trying something again after attempt failed: a minute after
+// the first, doubling each time, up to MaxWait
+func Backoff(attempt int) time.Duration {
+	wait := time.Minute
+	for i := 1; i < attempt && wait < MaxWait; i++ {
+		wait *= 2
+	}
+	if wait > MaxWait {
+		wait = MaxWait
+	}
+	return wait
+}
@@ -0,0 +1,27 @@
+package retry
+
+import (
+	"testing"
+	"time"
+)
+
+var backoffTests = []struct {
+	attempt  int
+	expected time.Duration
+}{
+	{1, time.Minute},
+	{2, 2 * time.Minute},
+	{3, 4 * time.Minute},
+	{7, 64 * time.Minute},
+	{9, 256 * time.Minute},
+	{10, 6 * time.Hour},
+	{50, 6 * time.Hour},
+}
+
+func TestBackoff(t *testing.T) {
+	for _, e := range backoffTests {
+		if got := Backoff(e.attempt); got != e.expected {
+			t.Errorf("attempt %d: expected %s, got %s", e.attempt, e.expected, got)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package signedlink
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalid is returned for a token that is malformed or was not signed with the secret
+var ErrInvalid = errors.New("invalid link")
+
+// ErrExpired is returned for a correctly signed token whose expiry has passed
+var ErrExpired = errors.New("link has expired")
+
+// Sign returns a url safe token for id that is valid until expires. The token is "id.expiry.signature",
+// where the signature is an HMAC-SHA256 of purpose, id and expiry. Purpose names what the id refers
+// to, e.g. "reservation", so a token made for one kind of record can't be used for another
+func Sign(secret []byte, purpose string, id int, expires time.Time) string {
+	token := fmt.Sprintf("%d.%d", id, expires.Unix())
+	return token + "." + signature(secret, purpose+"."+token)
+}
+
+// Verify checks that token was made by Sign with secret and purpose and has not expired at now, and
+// returns the id it was made for
+func Verify(secret []byte, purpose, token string, now time.Time) (int, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return 0, ErrInvalid
+	}
+
+	payload := purpose + "." + parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(parts[2]), []byte(signature(secret, payload))) {
+		return 0, ErrInvalid
+	}
+
+	id, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, ErrInvalid
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, ErrInvalid
+	}
+
+	if now.Unix() > expires {
+		return 0, ErrExpired
+	}
+
+	return id, nil
+}
+
+// Token returns a url safe token for id that never expires, for links that are handed out once and
+// used for a long time, such as calendar feeds. Changing the secret revokes every token
+func Token(secret []byte, purpose string, id int) string {
+	return signature(secret, fmt.Sprintf("token.%s.%d", purpose, id))
+}
+
+// CheckToken reports whether token was made by Token with secret for purpose and id
+func CheckToken(secret []byte, purpose string, id int, token string) bool {
+	return hmac.Equal([]byte(token), []byte(Token(secret, purpose, id)))
+}
+
+// signature returns the url safe HMAC of payload under secret
+func signature(secret []byte, payload string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,70 @@
+package signedlink
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+var secret = []byte("test-secret")
+
+func TestSignAndVerify(t *testing.T) {
+	now := time.Date(2050, 1, 1, 12, 0, 0, 0, time.UTC)
+	token := Sign(secret, "reservation", 42, now.Add(time.Hour))
+
+	id, err := Verify(secret, "reservation", token, now)
+	if err != nil {
+		t.Fatalf("expected a valid token, but got %s", err)
+	}
+	if id != 42 {
+		t.Errorf("expected reservation 42, but got %d", id)
+	}
+}
+
+var verifyTests = []struct {
+	name  string
+	token func() string
+	err   error
+}{
+	{"expired", func() string { return Sign(secret, "reservation", 42, time.Date(2050, 1, 1, 11, 0, 0, 0, time.UTC)) }, ErrExpired},
+	{"other-secret", func() string {
+		return Sign([]byte("other"), "reservation", 42, time.Date(2050, 1, 2, 0, 0, 0, 0, time.UTC))
+	}, ErrInvalid},
+	{"changed-id", func() string {
+		token := Sign(secret, "reservation", 42, time.Date(2050, 1, 2, 0, 0, 0, 0, time.UTC))
+		return "43" + token[2:]
+	}, ErrInvalid},
+	{"other-purpose", func() string { return Sign(secret, "waitlist", 42, time.Date(2050, 1, 2, 0, 0, 0, 0, time.UTC)) }, ErrInvalid},
+	{"malformed", func() string { return "not-a-token" }, ErrInvalid},
+	{"empty", func() string { return "" }, ErrInvalid},
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Date(2050, 1, 1, 12, 0, 0, 0, time.UTC)
+	for _, e := range verifyTests {
+		_, err := Verify(secret, "reservation", e.token(), now)
+		if !errors.Is(err, e.err) {
+			t.Errorf("%s: expected %v, but got %v", e.name, e.err, err)
+		}
+	}
+}
+
+var checkTokenTests = []struct {
+	name     string
+	token    string
+	expected bool
+}{
+	{"valid", Token(secret, "ical-room", 1), true},
+	{"other-id", Token(secret, "ical-room", 2), false},
+	{"other-purpose", Token(secret, "ical-staff", 1), false},
+	{"other-secret", Token([]byte("other"), "ical-room", 1), false},
+	{"empty", "", false},
+}
+
+func TestCheckToken(t *testing.T) {
+	for _, e := range checkTokenTests {
+		if got := CheckToken(secret, "ical-room", 1, e.token); got != e.expected {
+			t.Errorf("%s: expected %t, but got %t", e.name, e.expected, got)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package status
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/msaufi2325/06_bookings/internal/models"
+)
+
+// ErrInvalidTransition is returned when a reservation can't move from its current status to the one asked for
+var ErrInvalidTransition = errors.New("invalid status change")
+
+// transitions lists, for each status, the statuses a reservation may move to next. Checked-out,
+// cancelled and no-show are final
+var transitions = map[string][]string{
+	models.StatusPending:   {models.StatusConfirmed, models.StatusCancelled},
+	models.StatusConfirmed: {models.StatusCheckedIn, models.StatusCancelled, models.StatusNoShow},
+	models.StatusCheckedIn: {models.StatusCheckedOut},
+}
+
+// labels are the names shown to staff for each status
+var labels = map[string]string{
+	models.StatusPending:    "Pending",
+	models.StatusConfirmed:  "Confirmed",
+	models.StatusCheckedIn:  "Checked in",
+	models.StatusCheckedOut: "Checked out",
+	models.StatusCancelled:  "Cancelled",
+	models.StatusNoShow:     "No-show",
+}
+
+// Next returns the statuses a reservation in status from may move to
+func Next(from string) []string {
+	return transitions[from]
+}
+
+// Validate returns ErrInvalidTransition unless a reservation may move from one status to the other
+func Validate(from, to string) error {
+	for _, s := range transitions[from] {
+		if s == to {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w from %q to %q", ErrInvalidTransition, from, to)
+}
+
+// FreesRoom reports whether moving into status gives the room back for the reservation's dates
+func FreesRoom(status string) bool {
+	return status == models.StatusCancelled
+}
+
+// Label returns the name shown to staff for a status
+func Label(status string) string {
+	if l, ok := labels[status]; ok {
+		return l
+	}
+	return status
+}
@@ -0,0 +1,60 @@
+package status
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/msaufi2325/06_bookings/internal/models"
+)
+
+var validateTests = []struct {
+	name  string
+	from  string
+	to    string
+	valid bool
+}{
+	{"confirm", models.StatusPending, models.StatusConfirmed, true},
+	{"cancel-pending", models.StatusPending, models.StatusCancelled, true},
+	{"check-in-pending", models.StatusPending, models.StatusCheckedIn, false},
+	{"check-in", models.StatusConfirmed, models.StatusCheckedIn, true},
+	{"no-show", models.StatusConfirmed, models.StatusNoShow, true},
+	{"check-out", models.StatusCheckedIn, models.StatusCheckedOut, true},
+	{"cancel-checked-in", models.StatusCheckedIn, models.StatusCancelled, false},
+	{"reopen-cancelled", models.StatusCancelled, models.StatusPending, false},
+	{"same-status", models.StatusConfirmed, models.StatusConfirmed, false},
+	{"unknown-status", "lost", models.StatusConfirmed, false},
+}
+
+func TestValidate(t *testing.T) {
+	for _, e := range validateTests {
+		err := Validate(e.from, e.to)
+		if e.valid && err != nil {
+			t.Errorf("%s: expected no error, but got %s", e.name, err)
+		}
+		if !e.valid && !errors.Is(err, ErrInvalidTransition) {
+			t.Errorf("%s: expected ErrInvalidTransition, but got %v", e.name, err)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	for _, s := range []string{models.StatusCheckedOut, models.StatusCancelled, models.StatusNoShow} {
+		if len(Next(s)) != 0 {
+			t.Errorf("expected %s to be final, but got %v", s, Next(s))
+		}
+	}
+
+	if len(Next(models.StatusConfirmed)) != 3 {
+		t.Errorf("expected 3 statuses after confirmed, but got %v", Next(models.StatusConfirmed))
+	}
+}
+
+func TestLabel(t *testing.T) {
+	if Label(models.StatusCheckedIn) != "Checked in" {
+		t.Errorf("expected Checked in, but got %s", Label(models.StatusCheckedIn))
+	}
+
+	if Label("lost") != "lost" {
+		t.Errorf("expected an unknown status to be shown as is, but got %s", Label("lost"))
+	}
+}
@@ -0,0 +1,109 @@
+package waitlist
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/msaufi2325/06_bookings/internal/config"
+	"github.com/msaufi2325/06_bookings/internal/emails"
+	"github.com/msaufi2325/06_bookings/internal/models"
+	"github.com/msaufi2325/06_bookings/internal/repository"
+	"github.com/msaufi2325/06_bookings/internal/signedlink"
+)
+
+// LinkPurpose is the signedlink purpose of the links that let a guest book their held room
+const LinkPurpose = "waitlist"
+
+// HoldLink returns the signed link that lets the guest on entry book the room held for them. It
+// stops working when the hold expires
+func HoldLink(app *config.AppConfig, entry models.WaitlistEntry) string {
+	token := signedlink.Sign(app.LinkSecret, LinkPurpose, entry.ID, entry.HoldExpiresAt)
+	return fmt.Sprintf("%s/waitlist/hold?t=%s", app.BaseURL, token)
+}
+
+// OfferFreedRooms goes through the waiting entries, first come first served, and holds a room for
+// each one whose dates have become available, emailing the guest a link to book it. The email is
+// queued with the hold, so a guest is never held a room they weren't told about. It returns how
+// many holds were placed
+func OfferFreedRooms(ctx context.Context, db repository.DatabaseRepo, app *config.AppConfig) (int, error) {
+	entries, err := db.WaitingWaitlistEntries(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	t, err := emails.Load(ctx, db, app.EmailTemplateDir, emails.WaitlistOffer)
+	if err != nil {
+		return 0, err
+	}
+
+	offered := 0
+	for _, entry := range entries {
+		roomID, err := freeRoom(ctx, db, entry)
+		if err != nil {
+			return offered, err
+		}
+		if roomID == 0 {
+			continue
+		}
+
+		entry.HoldRoomID = roomID
+		entry.HoldExpiresAt = time.Now().Add(app.WaitlistHold)
+
+		msg, err := emails.Render(t, emails.WaitlistOfferData{
+			Entry: entry,
+			Link:  HoldLink(app, entry),
+		})
+		if err != nil {
+			return offered, err
+		}
+		msg.To = entry.Email
+		msg.From = "me@here.com"
+
+		err = db.HoldWaitlistEntry(ctx, entry.ID, roomID, entry.HoldExpiresAt, func(id int) []models.MailData {
+			return []models.MailData{msg}
+		})
+		// someone else got there first, either to the room or to the entry
+		if errors.Is(err, repository.ErrRoomUnavailable) || errors.Is(err, repository.ErrStatusChanged) {
+			continue
+		}
+		if err != nil {
+			return offered, err
+		}
+
+		offered++
+	}
+
+	return offered, nil
+}
+
+// ExpireHolds releases the holds that have run out and offers the rooms they free to the next
+// guests in line
+func ExpireHolds(ctx context.Context, db repository.DatabaseRepo, app *config.AppConfig) error {
+	if _, err := db.ExpireWaitlistHolds(ctx, time.Now()); err != nil {
+		return err
+	}
+
+	_, err := OfferFreedRooms(ctx, db, app)
+	return err
+}
+
+// freeRoom returns the id of a room that is free for the entry's dates, or 0 if there is none. An
+// entry with a room only takes that room; otherwise the first free room is used
+func freeRoom(ctx context.Context, db repository.DatabaseRepo, entry models.WaitlistEntry) (int, error) {
+	if entry.RoomID > 0 {
+		available, err := db.SearchAvailabilityByDatesByRoomID(ctx, entry.StartDate, entry.EndDate, entry.RoomID)
+		if err != nil || !available {
+			return 0, err
+		}
+		return entry.RoomID, nil
+	}
+
+	rooms, err := db.SearchAvailabilityForAllRooms(ctx, entry.StartDate, entry.EndDate)
+	if err != nil || len(rooms) == 0 {
+		return 0, err
+	}
+
+	return rooms[0].ID, nil
+}
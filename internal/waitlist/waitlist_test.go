@@ -0,0 +1,143 @@
+package waitlist
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/msaufi2325/06_bookings/internal/config"
+	"github.com/msaufi2325/06_bookings/internal/emails"
+	"github.com/msaufi2325/06_bookings/internal/models"
+	"github.com/msaufi2325/06_bookings/internal/repository"
+	"github.com/msaufi2325/06_bookings/internal/repository/dbrepo"
+	"github.com/msaufi2325/06_bookings/internal/signedlink"
+)
+
+// waitingRepo is the testing repo with its waiting entries replaced, keeping the mail it is given
+type waitingRepo struct {
+	repository.DatabaseRepo
+	entries []models.WaitlistEntry
+	mail    []models.MailData
+}
+
+func (m *waitingRepo) WaitingWaitlistEntries(ctx context.Context) ([]models.WaitlistEntry, error) {
+	return m.entries, nil
+}
+
+func (m *waitingRepo) HoldWaitlistEntry(ctx context.Context, id, roomID int, expires time.Time, mail repository.MailFunc) error {
+	var msgs []models.MailData
+	err := m.DatabaseRepo.HoldWaitlistEntry(ctx, id, roomID, expires, func(id int) []models.MailData {
+		msgs = mail(id)
+		return msgs
+	})
+	if err == nil {
+		m.mail = append(m.mail, msgs...)
+	}
+	return err
+}
+
+func testApp() *config.AppConfig {
+	return &config.AppConfig{
+		BaseURL:          "http://localhost:8080",
+		LinkSecret:       []byte("test-secret"),
+		WaitlistHold:     time.Hour,
+		EmailTemplateDir: "./../../email-templates",
+	}
+}
+
+func entry(id, roomID int, start string) models.WaitlistEntry {
+	s, _ := time.Parse("2006-01-02", start)
+	return models.WaitlistEntry{
+		ID:        id,
+		FirstName: "Jane",
+		Email:     "jane@doe.com",
+		StartDate: s,
+		EndDate:   s.AddDate(0, 0, 2),
+		RoomID:    roomID,
+		Status:    models.WaitlistWaiting,
+	}
+}
+
+// unreachable is entry with an address the outbox refuses
+func unreachable(e models.WaitlistEntry) models.WaitlistEntry {
+	e.Email = "fail@here.com"
+	return e
+}
+
+var offerTests = []struct {
+	name     string
+	entries  []models.WaitlistEntry
+	expected int
+	wantErr  bool
+}{
+	{"any-room-free", []models.WaitlistEntry{entry(1, 0, "2040-01-01")}, 1, false},
+	{"room-free", []models.WaitlistEntry{entry(1, 1, "2040-01-01")}, 1, false},
+	{"nothing-free", []models.WaitlistEntry{entry(1, 0, "2050-01-01")}, 0, false},
+	{"room-taken-meanwhile", []models.WaitlistEntry{entry(1, 2, "2040-01-01")}, 0, false},
+	{"skips-to-next", []models.WaitlistEntry{entry(1, 0, "2050-01-01"), entry(2, 0, "2040-01-01")}, 1, false},
+	{"search-fails", []models.WaitlistEntry{entry(1, 0, "2060-01-01")}, 0, true},
+	{"mail-fails", []models.WaitlistEntry{unreachable(entry(1, 0, "2040-01-01"))}, 0, true},
+}
+
+func TestOfferFreedRooms(t *testing.T) {
+	for _, e := range offerTests {
+		app := testApp()
+		db := &waitingRepo{DatabaseRepo: dbrepo.NewTestingRepo(app), entries: e.entries}
+
+		n, err := OfferFreedRooms(context.Background(), db, app)
+		if e.wantErr != (err != nil) {
+			t.Errorf("%s: expected error %v but got %v", e.name, e.wantErr, err)
+		}
+		if n != e.expected {
+			t.Errorf("%s: expected %d offers but got %d", e.name, e.expected, n)
+		}
+		if len(db.mail) != n {
+			t.Errorf("%s: expected %d emails but got %d", e.name, n, len(db.mail))
+		}
+		for _, msg := range db.mail {
+			if msg.To != "jane@doe.com" || msg.Template != emails.WaitlistOffer || !strings.Contains(msg.Text, "/waitlist/hold?t=") {
+				t.Errorf("%s: unexpected email %+v", e.name, msg)
+			}
+		}
+	}
+}
+
+func TestHoldLink(t *testing.T) {
+	app := testApp()
+	e := entry(7, 0, "2040-01-01")
+	e.HoldExpiresAt = time.Now().Add(time.Hour)
+
+	link := HoldLink(app, e)
+
+	prefix := "http://localhost:8080/waitlist/hold?t="
+	if !strings.HasPrefix(link, prefix) {
+		t.Fatalf("unexpected link %s", link)
+	}
+
+	token := strings.TrimPrefix(link, prefix)
+	id, err := signedlink.Verify(app.LinkSecret, LinkPurpose, token, time.Now())
+	if err != nil || id != 7 {
+		t.Errorf("expected id 7 but got %d, %v", id, err)
+	}
+
+	// the link stops working when the hold does
+	_, err = signedlink.Verify(app.LinkSecret, LinkPurpose, token, e.HoldExpiresAt.Add(time.Second))
+	if err != signedlink.ErrExpired {
+		t.Errorf("expected expired link but got %v", err)
+	}
+
+	// and can't be used to manage a reservation
+	_, err = signedlink.Verify(app.LinkSecret, "reservation", token, time.Now())
+	if err != signedlink.ErrInvalid {
+		t.Errorf("expected invalid link but got %v", err)
+	}
+}
+
+func TestExpireHolds(t *testing.T) {
+	app := testApp()
+
+	if err := ExpireHolds(context.Background(), dbrepo.NewTestingRepo(app), app); err != nil {
+		t.Error(err)
+	}
+}
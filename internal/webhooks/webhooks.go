@@ -0,0 +1,235 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/msaufi2325/06_bookings/internal/models"
+	"github.com/msaufi2325/06_bookings/internal/repository"
+	"github.com/msaufi2325/06_bookings/internal/retry"
+)
+
+// The events a subscription can ask for
+const (
+	EventReservationCreated   = "reservation.created"
+	EventReservationUpdated   = "reservation.updated"
+	EventReservationCancelled = "reservation.cancelled"
+	EventBlockCreated         = "block.created"
+	EventBlockUpdated         = "block.updated"
+	EventBlockDeleted         = "block.deleted"
+)
+
+// Events lists every event, in the order they are offered to admins
+var Events = []string{
+	EventReservationCreated,
+	EventReservationUpdated,
+	EventReservationCancelled,
+	EventBlockCreated,
+	EventBlockUpdated,
+	EventBlockDeleted,
+}
+
+// Request headers sent with every delivery
+const (
+	SignatureHeader = "X-Webhook-Signature"
+	EventHeader     = "X-Webhook-Event"
+	DeliveryHeader  = "X-Webhook-Delivery"
+)
+
+// Timeout is how long a subscriber has to answer one delivery
+const Timeout = 10 * time.Second
+
+// MaxAttempts is how many times a delivery is tried before it is given up on
+const MaxAttempts = 10
+
+// BatchSize is the most deliveries DeliverDue sends in one go
+const BatchSize = 100
+
+// Lease is how long claimed deliveries are kept from other workers while they are being sent. It
+// is long enough for every delivery in a batch to time out
+const Lease = 2 * BatchSize * Timeout
+
+// SignatureTolerance is how old a signed timestamp Verify accepts, to stop old deliveries being
+// replayed
+const SignatureTolerance = 5 * time.Minute
+
+// ErrInvalidSignature is returned by Verify for a delivery that wasn't signed with the secret
+var ErrInvalidSignature = errors.New("invalid webhook signature")
+
+// Envelope is the JSON body of every delivery. Data is the reservation or block the event is about
+type Envelope struct {
+	Event     string          `json:"event"`
+	CreatedAt time.Time       `json:"created_at"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// ValidEvent reports whether event is one subscriptions can ask for
+func ValidEvent(event string) bool {
+	for _, e := range Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// NewSecret returns a random secret to sign a subscription's deliveries with
+func NewSecret() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
+
+// Sign returns the signature header for body sent at timestamp: the timestamp, and an HMAC-SHA256
+// of the timestamp and body together, so neither can be changed without the secret
+func Sign(secret string, timestamp time.Time, body []byte) string {
+	t := strconv.FormatInt(timestamp.Unix(), 10)
+	return "t=" + t + ",v1=" + signature(secret, t, body)
+}
+
+func signature(secret, t string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(t))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks a signature header made by Sign, as a subscriber would. A timestamp more than
+// SignatureTolerance away from now is refused
+func Verify(secret string, body []byte, header string, now time.Time) error {
+	var t, v1 string
+	for _, part := range strings.Split(header, ",") {
+		k, v, _ := strings.Cut(part, "=")
+		switch k {
+		case "t":
+			t = v
+		case "v1":
+			v1 = v
+		}
+	}
+
+	unix, err := strconv.ParseInt(t, 10, 64)
+	if err != nil || v1 == "" {
+		return ErrInvalidSignature
+	}
+	if age := now.Sub(time.Unix(unix, 0)); age > SignatureTolerance || age < -SignatureTolerance {
+		return ErrInvalidSignature
+	}
+	if !hmac.Equal([]byte(v1), []byte(signature(secret, t, body))) {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+// Queue wraps data in an Envelope for event and queues a delivery of it to every active
+// subscription that wants event. Nothing is sent until the deliveries fall due
+func Queue(ctx context.Context, db repository.DatabaseRepo, event string, data interface{}) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(Envelope{
+		Event:     event,
+		CreatedAt: time.Now().UTC(),
+		Data:      raw,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = db.QueueWebhookDeliveries(ctx, event, string(payload))
+	return err
+}
+
+// Deliver sends d to its subscription and records how it went. A 2xx answer marks it delivered;
+// anything else is tried again after retry.Backoff, until MaxAttempts have failed. The error is only
+// for failing to record the attempt; a failed delivery shows in the returned delivery's LastError
+func Deliver(ctx context.Context, db repository.DatabaseRepo, client *http.Client, d models.WebhookDelivery, now time.Time) (models.WebhookDelivery, error) {
+	d.Attempts++
+	d.LastAttemptAt = now
+
+	d.ResponseStatus, d.LastError = send(ctx, client, d, now)
+	switch {
+	case d.LastError == "":
+		d.Status = models.DeliveryDelivered
+		d.DeliveredAt = now
+		d.NextAttemptAt = time.Time{}
+	case d.Attempts >= MaxAttempts:
+		d.Status = models.DeliveryFailed
+		d.NextAttemptAt = time.Time{}
+	default:
+		d.Status = models.DeliveryPending
+		d.NextAttemptAt = now.Add(retry.Backoff(d.Attempts))
+	}
+
+	return d, db.RecordWebhookAttempt(ctx, d)
+}
+
+// send posts d, returning the subscriber's status code, if it answered, and what went wrong, if
+// anything
+func send(ctx context.Context, client *http.Client, d models.WebhookDelivery, now time.Time) (int, string) {
+	body := []byte(d.Payload)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.Subscription.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err.Error()
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, d.Event)
+	req.Header.Set(DeliveryHeader, strconv.Itoa(d.ID))
+	req.Header.Set(SignatureHeader, Sign(d.Subscription.Secret, now, body))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err.Error()
+	}
+	defer resp.Body.Close()
+
+	// drain a little of the body so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Sprintf("subscriber answered %s", resp.Status)
+	}
+
+	return resp.StatusCode, ""
+}
+
+// DeliverDue sends the deliveries that have fallen due. Each is signed when it is sent, not when
+// the batch was claimed, so the last of a slow batch is still fresh enough to verify. One subscriber
+// failing doesn't stop the others; errors recording attempts are returned together once every
+// delivery has been tried
+func DeliverDue(ctx context.Context, db repository.DatabaseRepo, client *http.Client) error {
+	now := time.Now()
+
+	due, err := db.ClaimDueWebhookDeliveries(ctx, now, now.Add(Lease), BatchSize)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, d := range due {
+		if _, err := Deliver(ctx, db, client, d, time.Now()); err != nil {
+			errs = append(errs, fmt.Errorf("delivery %d: %w", d.ID, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,193 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/msaufi2325/06_bookings/internal/config"
+	"github.com/msaufi2325/06_bookings/internal/models"
+	"github.com/msaufi2325/06_bookings/internal/repository/dbrepo"
+)
+
+func TestSignAndVerify(t *testing.T) {
+	now := time.Date(2050, 1, 1, 12, 0, 0, 0, time.UTC)
+	body := []byte(`{"event":"reservation.created"}`)
+	header := Sign("whsec_test", now, body)
+
+	if err := Verify("whsec_test", body, header, now.Add(time.Minute)); err != nil {
+		t.Errorf("expected signature to verify, got %v", err)
+	}
+	if err := Verify("whsec_other", body, header, now); err != ErrInvalidSignature {
+		t.Error("a different secret should not verify")
+	}
+	if err := Verify("whsec_test", []byte(`{"event":"reservation.cancelled"}`), header, now); err != ErrInvalidSignature {
+		t.Error("a changed body should not verify")
+	}
+	if err := Verify("whsec_test", body, header, now.Add(SignatureTolerance+time.Second)); err != ErrInvalidSignature {
+		t.Error("an old signature should not verify")
+	}
+	if err := Verify("whsec_test", body, "v1=abc", now); err != ErrInvalidSignature {
+		t.Error("a signature without a timestamp should not verify")
+	}
+}
+
+func TestQueue(t *testing.T) {
+	db := dbrepo.NewRecordingRepo(&config.AppConfig{})
+
+	err := Queue(context.Background(), db, EventReservationCreated, map[string]int{"id": 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(db.QueuedWebhooks) != 1 {
+		t.Fatalf("expected one payload queued, got %d", len(db.QueuedWebhooks))
+	}
+
+	var env Envelope
+	if err := json.Unmarshal([]byte(db.QueuedWebhooks[0]), &env); err != nil {
+		t.Fatal(err)
+	}
+	if env.Event != EventReservationCreated || string(env.Data) != `{"id":7}` || env.CreatedAt.IsZero() {
+		t.Errorf("unexpected envelope %+v", env)
+	}
+}
+
+func TestDeliver(t *testing.T) {
+	var got *http.Request
+	var gotBody []byte
+	answer := http.StatusOK
+
+	// a local receiver standing in for a subscriber
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		gotBody, _ = io.ReadAll(r.Body)
+		w.WriteHeader(answer)
+	}))
+	defer receiver.Close()
+
+	db := dbrepo.NewRecordingRepo(&config.AppConfig{})
+	now := time.Now()
+	d := models.WebhookDelivery{
+		ID:           3,
+		Event:        EventBlockCreated,
+		Payload:      `{"event":"block.created","data":{"id":1}}`,
+		Status:       models.DeliveryPending,
+		Subscription: models.WebhookSubscription{URL: receiver.URL, Secret: "whsec_test"},
+	}
+
+	delivered, err := Deliver(context.Background(), db, receiver.Client(), d, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delivered.Status != models.DeliveryDelivered || delivered.Attempts != 1 || delivered.ResponseStatus != http.StatusOK {
+		t.Errorf("expected a delivered first attempt, got %+v", delivered)
+	}
+	if got.Header.Get(EventHeader) != EventBlockCreated || got.Header.Get(DeliveryHeader) != "3" {
+		t.Errorf("unexpected headers %v", got.Header)
+	}
+	if err := Verify("whsec_test", gotBody, got.Header.Get(SignatureHeader), now); err != nil {
+		t.Errorf("receiver couldn't verify the delivery: %v", err)
+	}
+	if len(db.WebhookAttempts) != 1 {
+		t.Errorf("expected the attempt to be recorded")
+	}
+
+	answer = http.StatusInternalServerError
+	retried, err := Deliver(context.Background(), db, receiver.Client(), d, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retried.Status != models.DeliveryPending || !retried.NextAttemptAt.Equal(now.Add(time.Minute)) || retried.LastError == "" {
+		t.Errorf("expected a retry in a minute, got %+v", retried)
+	}
+
+	d.Attempts = MaxAttempts - 1
+	failed, err := Deliver(context.Background(), db, receiver.Client(), d, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failed.Status != models.DeliveryFailed || !failed.NextAttemptAt.IsZero() {
+		t.Errorf("expected the delivery to be given up on, got %+v", failed)
+	}
+}
+
+func TestDeliverUnreachable(t *testing.T) {
+	db := dbrepo.NewRecordingRepo(&config.AppConfig{})
+	d, _ := db.GetWebhookDeliveryByID(context.Background(), 1)
+	d.Status = models.DeliveryPending
+	d.Attempts = 0
+
+	client := &http.Client{Timeout: time.Second}
+	got, err := Deliver(context.Background(), db, client, d, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != models.DeliveryPending || got.ResponseStatus != 0 || got.LastError == "" {
+		t.Errorf("expected an unreachable subscriber to be tried again, got %+v", got)
+	}
+}
+
+func TestDeliverDue(t *testing.T) {
+	var hits int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+	}))
+	defer srv.Close()
+
+	db := dbrepo.NewRecordingRepo(&config.AppConfig{})
+	db.DueDeliveries = []models.WebhookDelivery{
+		{ID: 1, Event: EventBlockCreated, Payload: "{}", Status: models.DeliveryPending, Subscription: models.WebhookSubscription{URL: srv.URL}},
+		{ID: 2, Event: EventBlockDeleted, Payload: "{}", Status: models.DeliveryPending, Subscription: models.WebhookSubscription{URL: srv.URL}},
+	}
+
+	if err := DeliverDue(context.Background(), db, srv.Client()); err != nil {
+		t.Fatal(err)
+	}
+	if db.Lease != Lease {
+		t.Errorf("expected the deliveries to be claimed for %s, got %s", Lease, db.Lease)
+	}
+	if hits != 2 || len(db.WebhookAttempts) != 2 {
+		t.Errorf("expected both deliveries sent and recorded, got %d sent and %d recorded", hits, len(db.WebhookAttempts))
+	}
+}
+
+// TestDeliverDueSlowBatch tests that each delivery in a batch is signed as it is sent, so one
+// queued behind slow subscribers isn't signed with a time long past
+func TestDeliverDueSlowBatch(t *testing.T) {
+	const slow = 1500 * time.Millisecond
+
+	var lags []time.Duration
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var signed int64
+		fmt.Sscanf(r.Header.Get(SignatureHeader), "t=%d,", &signed)
+		lags = append(lags, time.Since(time.Unix(signed, 0)))
+		time.Sleep(slow)
+	}))
+	defer srv.Close()
+
+	db := dbrepo.NewRecordingRepo(&config.AppConfig{})
+	for id := 1; id <= 3; id++ {
+		db.DueDeliveries = append(db.DueDeliveries, models.WebhookDelivery{
+			ID: id, Event: EventBlockCreated, Payload: "{}", Status: models.DeliveryPending,
+			Subscription: models.WebhookSubscription{URL: srv.URL, Secret: "whsec_test"},
+		})
+	}
+
+	if err := DeliverDue(context.Background(), db, srv.Client()); err != nil {
+		t.Fatal(err)
+	}
+	if len(lags) != 3 {
+		t.Fatalf("expected 3 deliveries, got %d", len(lags))
+	}
+	for i, lag := range lags {
+		// signatures carry whole seconds, so a fresh one can be up to a second behind
+		if lag >= slow {
+			t.Errorf("delivery %d was signed %s before it was sent", i+1, lag)
+		}
+	}
+}
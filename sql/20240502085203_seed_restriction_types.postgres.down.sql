@@ -0,0 +1 @@
+delete from "public"."restrictions" where "restriction_name" in ('Maintenance', 'Deep Clean', 'Staff Use')
@@ -0,0 +1,4 @@
+update "public"."restrictions" set "colour" = '#dc3545', "counts_toward_occupancy" = true where "id" = 1;
+update "public"."restrictions" set "colour" = '#ffc107' where "id" = 2;
+select setval(pg_get_serial_sequence('public.restrictions', 'id'), (select max("id") from "public"."restrictions"));
+insert into "public"."restrictions" ("created_at", "restriction_name", "colour", "counts_toward_occupancy", "updated_at") values ('2024-05-02 00:00:00', 'Maintenance', '#6c757d', false, '2024-05-02 00:00:00'), ('2024-05-02 00:00:00', 'Deep Clean', '#17a2b8', false, '2024-05-02 00:00:00'), ('2024-05-02 00:00:00', 'Staff Use', '#6f42c1', true, '2024-05-02 00:00:00')
@@ -0,0 +1,2 @@
+update "public"."rooms" set "cancellation_policy_id" = null where "cancellation_policy_id" in (1, 2);
+delete from "public"."cancellation_policies" where "id" in (1, 2)
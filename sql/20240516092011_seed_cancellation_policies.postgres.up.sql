@@ -0,0 +1,3 @@
+insert into "public"."cancellation_policies" ("id", "name", "description", "tiers", "created_at", "updated_at") values (1, 'Flexible', 'Cancel for free up to a week before arrival.', '[{"HoursBefore":168,"RefundPercent":100},{"HoursBefore":48,"RefundPercent":50}]', '2024-05-16 00:00:00', '2024-05-16 00:00:00'), (2, 'Non-refundable', 'The lowest price, but nothing is refunded if you cancel.', '[]', '2024-05-16 00:00:00', '2024-05-16 00:00:00');
+select setval(pg_get_serial_sequence('public.cancellation_policies', 'id'), (select max("id") from "public"."cancellation_policies"));
+update "public"."rooms" set "cancellation_policy_id" = 1 where "cancellation_policy_id" is null
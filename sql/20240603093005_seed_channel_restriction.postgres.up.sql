@@ -0,0 +1,2 @@
+insert into "public"."restrictions" ("id", "created_at", "restriction_name", "colour", "counts_toward_occupancy", "updated_at") values (100, '2024-06-03 00:00:00', 'Channel Booking', '#fd7e14', true, '2024-06-03 00:00:00');
+select setval(pg_get_serial_sequence('public.restrictions', 'id'), (select max("id") from "public"."restrictions"));